@@ -0,0 +1,39 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jaredwarren/plexupdate/app"
+)
+
+// Controller serves the api endpoints that don't belong to a feature package.
+type Controller struct {
+	mux *mux.Router
+}
+
+// Register ...
+func Register(service *app.Service) {
+	c := &Controller{
+		mux: service.API,
+	}
+	c.MountController()
+}
+
+// MountController ...
+func (c *Controller) MountController() {
+	c.mux.HandleFunc("/openapi.json", c.OpenAPI).Methods("GET")
+	c.mux.NotFoundHandler = http.HandlerFunc(c.NotFound)
+}
+
+// OpenAPI serves the api description
+func (c *Controller) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	http.ServeFile(w, r, "./static/openapi.json")
+}
+
+// NotFound ...
+func (c *Controller) NotFound(w http.ResponseWriter, r *http.Request) {
+	WriteError(w, r, http.StatusNotFound, fmt.Errorf("no route for %s %s", r.Method, r.URL.Path))
+}
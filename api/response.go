@@ -0,0 +1,58 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// WantsJSON true if client asked for json, either by path or Accept header
+func WantsJSON(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, Prefix+"/") {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// WriteJSON writes v as json with status code
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Println("  WriteJSON:", err)
+	}
+}
+
+// WriteError writes an Error object for json clients, or the old " [E]:" text for everyone else.
+func WriteError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	fmt.Println("  [E]:", status, err)
+	if WantsJSON(r) {
+		WriteJSON(w, status, &ErrorResponse{
+			Error: Error{
+				Code:    status,
+				Status:  http.StatusText(status),
+				Message: err.Error(),
+			},
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(" [E]:" + err.Error()))
+}
+
+// IsJSON true if the request body is json
+func IsJSON(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+}
+
+// ReadJSON decodes the request body into v
+func ReadJSON(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
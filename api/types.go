@@ -0,0 +1,573 @@
+package api
+
+import (
+	"time"
+
+	"github.com/jaredwarren/plexupdate/duplicates"
+	"github.com/jaredwarren/plexupdate/jobs"
+)
+
+// Prefix all api routes are mounted under
+const Prefix = "/api/v1"
+
+// Headers used by resumable uploads, PUT /uploads/{location}/{path}
+const (
+	UploadOffsetHeader = "Upload-Offset"
+	UploadLengthHeader = "Upload-Length"
+)
+
+// ErrorResponse every error returned by the api
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+// Error ...
+type Error struct {
+	Code    int    `json:"code"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// Location is a configured plex library folder
+type Location struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// Entry is a file or folder inside a location
+type Entry struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Dir      bool      `json:"dir"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	// Duration of audio and video in seconds, needs ffprobe
+	Duration float64 `json:"duration,omitempty"`
+	// Media what ffprobe found, only for audio and video files
+	Media *MediaProbe `json:"media,omitempty"`
+}
+
+// Media types a location can take
+const (
+	MediaVideo    = "video"
+	MediaAudio    = "audio"
+	MediaSubtitle = "subtitle"
+	MediaImage    = "image"
+)
+
+// MediaStream a video, audio or subtitle track
+type MediaStream struct {
+	Index    int    `json:"index"`
+	Codec    string `json:"codec"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	Channels int    `json:"channels,omitempty"`
+	Language string `json:"language,omitempty"`
+	Title    string `json:"title,omitempty"`
+}
+
+// MediaProbe what ffprobe found in a file
+type MediaProbe struct {
+	// Type video, audio, subtitle or image
+	Type      string         `json:"type"`
+	Container string         `json:"container"`
+	Duration  float64        `json:"duration,omitempty"`
+	Video     []MediaStream  `json:"video,omitempty"`
+	Audio     []MediaStream  `json:"audio,omitempty"`
+	Subtitles []MediaStream  `json:"subtitles,omitempty"`
+	Chapters  []MediaChapter `json:"chapters,omitempty"`
+}
+
+// MediaChapter a chapter marker, times in seconds. End is 0 if it runs to
+// the end of the file.
+type MediaChapter struct {
+	Title string  `json:"title"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end,omitempty"`
+}
+
+// Listing is the contents of a folder in a location
+type Listing struct {
+	Location string  `json:"location"`
+	Path     string  `json:"path"`
+	Entries  []Entry `json:"entries"`
+}
+
+// FolderRequest creates a folder, path is relative to the location root
+type FolderRequest struct {
+	Path string `json:"path"`
+}
+
+// MoveRequest renames or moves a file or folder, to another location if
+// ToLocation is set
+type MoveRequest struct {
+	Path       string `json:"path"`
+	ToLocation string `json:"toLocation,omitempty"`
+	ToPath     string `json:"toPath"`
+}
+
+// Space free space for a location
+type Space struct {
+	Location string `json:"location"`
+	// DiskFree and DiskTotal of the disk the location is on
+	DiskFree  int64 `json:"diskFree"`
+	DiskTotal int64 `json:"diskTotal"`
+	// Used bytes in the location and its Quota, only set when it has one
+	Used  int64 `json:"used,omitempty"`
+	Quota int64 `json:"quota,omitempty"`
+	// Available what an upload can use, with the margin and quota taken off
+	Available int64 `json:"available"`
+}
+
+// Upload result of a file upload
+type Upload struct {
+	Location string `json:"location"`
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	// ScanJob plex library scan started for the new file, empty if plex isn't configured
+	ScanJob string `json:"scanJob,omitempty"`
+	// Duplicates files already in the library with the same content
+	Duplicates []LibraryFile `json:"duplicates,omitempty"`
+	// Skipped the file was a duplicate and on_duplicate was skip, nothing was written
+	Skipped bool `json:"skipped,omitempty"`
+	// Media what ffprobe found, empty if it isn't installed
+	Media *MediaProbe `json:"media,omitempty"`
+	// TranscodeJob queued for the file, if it's being transcoded
+	TranscodeJob string `json:"transcodeJob,omitempty"`
+	// LoudnessJob queued for the file, if its location evens out loudness
+	LoudnessJob string `json:"loudnessJob,omitempty"`
+	// Extracted files from an archive, Path is the folder they're in
+	Extracted []string `json:"extracted,omitempty"`
+	// Ignored files in the archive that aren't media, or were refused
+	Ignored []string `json:"ignored,omitempty"`
+	// Error why the file wasn't uploaded, only set in a batch
+	Error string `json:"error,omitempty"`
+	// FetchJob job that fetched the file, when the server got it from a url
+	FetchJob string `json:"fetchJob,omitempty"`
+}
+
+// UploadBatch files sent together, each one's result in the order they came
+type UploadBatch struct {
+	Location string    `json:"location"`
+	Folder   string    `json:"folder"`
+	Files    []*Upload `json:"files"`
+	// Failed files, their Error says why
+	Failed int `json:"failed"`
+	// ScanJob plex library scan of the folder, empty if plex isn't configured
+	ScanJob string `json:"scanJob,omitempty"`
+}
+
+// What an upload does when the file is already in the library
+const (
+	DuplicateKeep    = "keep"
+	DuplicateSkip    = "skip"
+	DuplicateReplace = "replace"
+)
+
+// LibraryFile a file in one of the locations
+type LibraryFile struct {
+	Location string    `json:"location"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// DuplicateGroup files with the same content
+type DuplicateGroup struct {
+	Size  int64         `json:"size"`
+	Hash  string        `json:"hash"`
+	Files []LibraryFile `json:"files"`
+}
+
+// NewLibraryFiles converts index entries
+func NewLibraryFiles(entries []duplicates.Entry) []LibraryFile {
+	files := make([]LibraryFile, len(entries))
+	for i, e := range entries {
+		files[i] = LibraryFile{
+			Location: e.Location,
+			Path:     e.Path,
+			Size:     e.Size,
+			Modified: e.Modified,
+		}
+	}
+	return files
+}
+
+// NewDuplicateGroups converts index groups
+func NewDuplicateGroups(groups []duplicates.Group) []DuplicateGroup {
+	list := make([]DuplicateGroup, len(groups))
+	for i, g := range groups {
+		list[i] = DuplicateGroup{
+			Size:  g.Size,
+			Hash:  g.Hash,
+			Files: NewLibraryFiles(g.Entries),
+		}
+	}
+	return list
+}
+
+// UploadStatus how much of a resumable upload the server has
+type UploadStatus struct {
+	Location string `json:"location"`
+	Path     string `json:"path"`
+	Offset   int64  `json:"offset"`
+	Complete bool   `json:"complete"`
+}
+
+// Media types the naming helper knows
+const (
+	MediaMovie   = "movie"
+	MediaEpisode = "episode"
+	MediaMusic   = "music"
+)
+
+// MediaInfo what an upload is, used to build the path plex expects
+type MediaInfo struct {
+	// Type movie, episode or music
+	Type  string `json:"type"`
+	Title string `json:"title,omitempty"`
+	Year  int    `json:"year,omitempty"`
+	// Season and Episode for episodes, Title is the show
+	Season       int    `json:"season,omitempty"`
+	Episode      int    `json:"episode,omitempty"`
+	EpisodeTitle string `json:"episodeTitle,omitempty"`
+	// Date 2006-01-02 for episodes a show names by air date, not number
+	Date string `json:"date,omitempty"`
+	// Artist, Album and Track for music, Title is the track's title
+	Artist string `json:"artist,omitempty"`
+	Album  string `json:"album,omitempty"`
+	Track  int    `json:"track,omitempty"`
+}
+
+// NamingPreview where an upload would go
+type NamingPreview struct {
+	Info MediaInfo `json:"info"`
+	// Path inside the location, empty if Info isn't complete
+	Path  string `json:"path"`
+	Error string `json:"error,omitempty"`
+}
+
+// Reasons a file was moved to the trash
+const (
+	TrashDeleted     = "deleted"
+	TrashOverwritten = "overwritten"
+	// TrashQuarantined a new file that failed the media checks
+	TrashQuarantined = "quarantined"
+	// TrashSplit a download that was split into chapters
+	TrashSplit = "split"
+	// TrashExpired a subscription video past the subscription's keep rules
+	TrashExpired = "expired"
+	// TrashWatched a subscription video plex says was watched
+	TrashWatched = "watched"
+)
+
+// TrashItem a deleted or overwritten file or folder that can be restored
+type TrashItem struct {
+	ID       string `json:"id"`
+	Location string `json:"location"`
+	// Path where it was, restoring puts it back there
+	Path   string    `json:"path"`
+	Name   string    `json:"name"`
+	Dir    bool      `json:"dir"`
+	Size   int64     `json:"size"`
+	User   string    `json:"user,omitempty"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// YtdlRequest starts a youtube download
+type YtdlRequest struct {
+	ID       string `json:"id"`
+	Location string `json:"location"`
+	Audio    bool   `json:"audio"`
+	// Transcode profile the download is queued with, the location's
+	// transcode.auto profile if empty
+	Transcode string `json:"transcode,omitempty"`
+	// Split the download into a file per chapter, in an album folder for
+	// audio or a season folder for video
+	Split bool `json:"split,omitempty"`
+}
+
+// DownloadRequest fetches a url into a location
+type DownloadRequest struct {
+	URL      string `json:"url"`
+	Location string `json:"location"`
+	// Path of the folder in the location, the root if empty
+	Path string `json:"path,omitempty"`
+	// Name of the file, the one the server gives if empty
+	Name string `json:"name,omitempty"`
+	// Checksum the file must match, "sha256:<hex>", md5, sha1 and sha512
+	// work too
+	Checksum string `json:"checksum,omitempty"`
+	// RateLimit a second, e.g. 1MB. It can only be lower than
+	// download.ratelimit.
+	RateLimit string `json:"rateLimit,omitempty"`
+	// Transcode profile the download is queued with, the location's
+	// transcode.auto profile if empty
+	Transcode string `json:"transcode,omitempty"`
+	// Extract the media files if it's an archive, the archive is deleted
+	Extract bool `json:"extract,omitempty"`
+	// Flatten puts every extracted file right in Path, instead of keeping
+	// the archive's folders
+	Flatten bool `json:"flatten,omitempty"`
+}
+
+// Feed a podcast or video feed subscription
+type Feed struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	Title    string `json:"title,omitempty"`
+	Location string `json:"location"`
+	// Keep the newest episodes, 0 is feeds.keep
+	Keep    int        `json:"keep,omitempty"`
+	User    string     `json:"user"`
+	Added   time.Time  `json:"added"`
+	Checked *time.Time `json:"checked,omitempty"`
+	// Error from the last check
+	Error    string        `json:"error,omitempty"`
+	Episodes []FeedEpisode `json:"episodes"`
+}
+
+// FeedEpisode an episode that was downloaded
+type FeedEpisode struct {
+	GUID      string    `json:"guid"`
+	Title     string    `json:"title"`
+	Published time.Time `json:"published"`
+	// Path in the location, empty once it's been deleted to keep the
+	// newest
+	Path    string    `json:"path,omitempty"`
+	Fetched time.Time `json:"fetched"`
+}
+
+// FeedRequest subscribes to a feed
+type FeedRequest struct {
+	URL string `json:"url"`
+	// Location feeds.location if empty
+	Location string `json:"location,omitempty"`
+	Keep     int    `json:"keep,omitempty"`
+}
+
+// Subscription a youtube channel or playlist whose new videos are
+// downloaded
+type Subscription struct {
+	ID string `json:"id"`
+	// Feed youtube's feed of the channel or playlist
+	Feed     string `json:"feed"`
+	Title    string `json:"title,omitempty"`
+	Location string `json:"location"`
+	Audio    bool   `json:"audio"`
+	// Transcode profile new videos are queued with, the location's
+	// transcode.auto profile if empty
+	Transcode string `json:"transcode,omitempty"`
+	// Match a regexp the title must match
+	Match string `json:"match,omitempty"`
+	// MinDuration and MaxDuration e.g. 2m or 1h30m
+	MinDuration string `json:"minDuration,omitempty"`
+	MaxDuration string `json:"maxDuration,omitempty"`
+	NoShorts    bool   `json:"noShorts,omitempty"`
+	NoLive      bool   `json:"noLive,omitempty"`
+	// Keep the newest videos, 0 keeps them all
+	Keep int `json:"keep,omitempty"`
+	// KeepDays videos published longer ago are deleted, 0 keeps them all
+	KeepDays int `json:"keepDays,omitempty"`
+	// DeleteWatched deletes videos once plex says they've been watched
+	DeleteWatched bool       `json:"deleteWatched,omitempty"`
+	User          string     `json:"user"`
+	Added         time.Time  `json:"added"`
+	Checked       *time.Time `json:"checked,omitempty"`
+	// Error from the last check
+	Error  string              `json:"error,omitempty"`
+	Videos []SubscriptionVideo `json:"videos"`
+}
+
+// SubscriptionVideo a video from a subscription that was downloaded or
+// filtered out
+type SubscriptionVideo struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Published time.Time `json:"published"`
+	// Path in the location, empty if it was skipped or has been deleted
+	Path string `json:"path,omitempty"`
+	// Skipped why a filter left it out
+	Skipped string    `json:"skipped,omitempty"`
+	Fetched time.Time `json:"fetched"`
+}
+
+// SubscriptionRequest subscribes to a channel or playlist, URL is a channel
+// or playlist link or id, or its feed. The rest are as in Subscription.
+type SubscriptionRequest struct {
+	URL           string `json:"url"`
+	Location      string `json:"location"`
+	Audio         bool   `json:"audio,omitempty"`
+	Transcode     string `json:"transcode,omitempty"`
+	Match         string `json:"match,omitempty"`
+	MinDuration   string `json:"minDuration,omitempty"`
+	MaxDuration   string `json:"maxDuration,omitempty"`
+	NoShorts      bool   `json:"noShorts,omitempty"`
+	NoLive        bool   `json:"noLive,omitempty"`
+	Keep          int    `json:"keep,omitempty"`
+	KeepDays      int    `json:"keepDays,omitempty"`
+	DeleteWatched bool   `json:"deleteWatched,omitempty"`
+}
+
+// Remote a file server media can be imported from, without its login
+type Remote struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+// RemoteFile a file or folder on a remote server
+type RemoteFile struct {
+	Name string `json:"name"`
+	// Path from the server's folder, with a leading /
+	Path string `json:"path"`
+	Dir  bool   `json:"dir"`
+	// Size -1 if the server doesn't say
+	Size     int64      `json:"size"`
+	Modified *time.Time `json:"modified,omitempty"`
+}
+
+// ImportRequest copies a file or folder from a remote server into a
+// location
+type ImportRequest struct {
+	// Path on the server, a folder is imported with everything in it
+	Path     string `json:"path"`
+	Location string `json:"location"`
+	// Folder in the location, the root if empty
+	Folder string `json:"folder,omitempty"`
+	// Transcode profile the files are queued with, the location's
+	// transcode.auto profile if empty
+	Transcode string `json:"transcode,omitempty"`
+	// Extract the media files of archives, the archives are deleted
+	Extract bool `json:"extract,omitempty"`
+	// Flatten puts every extracted file right next to where its archive
+	// was, instead of keeping the archive's folders
+	Flatten bool `json:"flatten,omitempty"`
+}
+
+// TranscodeProfile how ffmpeg converts a file, from transcode.profiles
+type TranscodeProfile struct {
+	Name          string `json:"name"`
+	VideoCodec    string `json:"videoCodec,omitempty"`
+	VideoBitrate  string `json:"videoBitrate,omitempty"`
+	CRF           int    `json:"crf,omitempty"`
+	MaxHeight     int    `json:"maxHeight,omitempty"`
+	AudioCodec    string `json:"audioCodec,omitempty"`
+	AudioBitrate  string `json:"audioBitrate,omitempty"`
+	AudioChannels int    `json:"audioChannels,omitempty"`
+	Container     string `json:"container"`
+	// Replace the original, otherwise the new file goes next to it
+	Replace bool `json:"replace"`
+}
+
+// TranscodeRequest queues a library file, path is relative to the location
+type TranscodeRequest struct {
+	Location string `json:"location"`
+	Path     string `json:"path"`
+	Profile  string `json:"profile"`
+}
+
+// LoudnessRequest evens out the loudness of a file, or every audio file in a
+// folder. Mode is normalize or replaygain, the location's mode if empty.
+type LoudnessRequest struct {
+	Location string `json:"location"`
+	Path     string `json:"path"`
+	Mode     string `json:"mode,omitempty"`
+}
+
+// Job is a long running background task
+type Job struct {
+	ID       string      `json:"id"`
+	Type     string      `json:"type"`
+	User     string      `json:"user,omitempty"`
+	Location string      `json:"location,omitempty"`
+	Status   jobs.Status `json:"status"`
+	Progress float64     `json:"progress"`
+	Result   string      `json:"result,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Created  time.Time   `json:"created"`
+	Started  *time.Time  `json:"started,omitempty"`
+	Finished *time.Time  `json:"finished,omitempty"`
+}
+
+// NewJob converts a jobs.Job
+func NewJob(j *jobs.Job) *Job {
+	s := j.Snapshot()
+	return &Job{
+		ID:       s.ID,
+		Type:     s.Type,
+		User:     s.User,
+		Location: s.Location,
+		Status:   s.Status,
+		Progress: s.Progress,
+		Result:   s.Result,
+		Error:    s.Error,
+		Created:  s.Created,
+		Started:  timePtr(s.Started),
+		Finished: timePtr(s.Finished),
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// CommandRequest starts a command, either Cmd or a Preset name from config
+type CommandRequest struct {
+	Cmd    string `json:"cmd,omitempty"`
+	Preset string `json:"preset,omitempty"`
+	Dir    string `json:"dir,omitempty"`
+}
+
+// Command a running or finished command
+type Command struct {
+	ID        string    `json:"id"`
+	Cmd       string    `json:"cmd"`
+	Running   bool      `json:"running"`
+	StartTime time.Time `json:"start_time"`
+	Log       string    `json:"log,omitempty"`
+}
+
+// User the logged in user
+type User struct {
+	Username    string      `json:"username"`
+	Roles       []string    `json:"roles"`
+	Permissions []string    `json:"permissions"`
+	Tokens      []TokenInfo `json:"tokens"`
+}
+
+// TokenInfo describes an api token without the secret
+type TokenInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+// TokenRequest creates an api token
+type TokenRequest struct {
+	Name string `json:"name"`
+}
+
+// NewToken is only returned once, the server only keeps a hash
+type NewToken struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+}
+
+// WebhookEvent a webhook plex sent
+type WebhookEvent struct {
+	ID       int64     `json:"id"`
+	Event    string    `json:"event"`
+	Received time.Time `json:"received"`
+	Account  string    `json:"account,omitempty"`
+	Server   string    `json:"server,omitempty"`
+	Player   string    `json:"player,omitempty"`
+	Library  string    `json:"library,omitempty"`
+	Type     string    `json:"type,omitempty"`
+	Title    string    `json:"title,omitempty"`
+	// Summary one line for people, e.g. "bob played The Matrix on Living Room"
+	Summary string `json:"summary"`
+}
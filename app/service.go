@@ -7,28 +7,46 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/duplicates"
+	"github.com/jaredwarren/plexupdate/hub"
+	"github.com/jaredwarren/plexupdate/jobs"
+	"github.com/jaredwarren/plexupdate/plex"
 )
 
 // Service ...
 type Service struct {
 	Name   string
 	Mux    *mux.Router
-	Config config.Configuration
-	Exit   chan error
+	API    *mux.Router
+	Config *config.Current
+	Jobs   *jobs.Manager
+	Plex   *plex.Scanner
+	Hub    *hub.Hub
+	// Index of library files, for duplicate detection
+	Index *duplicates.Index
+	Exit  chan error
 }
 
 // New instantiates a service with the given name.
-func New(name string, conf config.Configuration) *Service {
+func New(name string, conf *config.Current) *Service {
 	mux := mux.NewRouter()
 
 	mux.HandleFunc("/static/{filename:[a-zA-Z0-9\\.\\-\\_\\/]*}", FileServer)
 
+	jobManager := jobs.NewManager()
+
 	var service = &Service{
 		Name:   name,
 		Mux:    mux,
+		API:    mux.PathPrefix("/api/v1").Subrouter(),
 		Config: conf,
+		Jobs:   jobManager,
+		Plex:   plex.NewScanner(conf, jobManager),
+		Hub:    hub.NewHub(),
+		Index:  duplicates.NewIndex(conf, jobManager),
 		Exit:   make(chan error),
 	}
+	go service.Hub.Run()
 
 	return service
 }
@@ -0,0 +1,501 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/jaredwarren/plexupdate/app"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/duplicates"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/jobs"
+	"github.com/jaredwarren/plexupdate/place"
+	"github.com/jaredwarren/plexupdate/probe"
+	"github.com/jaredwarren/plexupdate/space"
+	"github.com/jaredwarren/plexupdate/trash"
+)
+
+// partExt files are written to a hidden .part file until they're checked
+const partExt = ".part"
+
+var (
+	// ErrUnavailable the archive command isn't installed
+	ErrUnavailable = errors.New("archive command isn't installed")
+	// ErrBomb the archive unpacks to more than archive.maxsize,
+	// archive.maxratio or archive.maxfiles allow
+	ErrBomb = errors.New("archive unpacks to too much")
+	// ErrEmpty there's no media in the archive
+	ErrEmpty = errors.New("no media files in the archive")
+)
+
+// driveRe a windows drive at the start of an entry's name
+var driveRe = regexp.MustCompile(`^[A-Za-z]:`)
+
+// Archive kinds, by how they're read
+const (
+	kindZip = iota
+	kindTar
+	kindGzip
+	kindBzip2
+	// kindCommand read by archive.command
+	kindCommand
+)
+
+// suffixes of archive names, longest first so .tar.gz isn't taken for .gz
+var suffixes = []struct {
+	ext  string
+	kind int
+}{
+	{".tar.gz", kindGzip},
+	{".tar.bz2", kindBzip2},
+	{".tar.xz", kindCommand},
+	{".tar.zst", kindCommand},
+	{".tgz", kindGzip},
+	{".tbz2", kindBzip2},
+	{".tbz", kindBzip2},
+	{".txz", kindCommand},
+	{".tar", kindTar},
+	{".zip", kindZip},
+	{".rar", kindCommand},
+	{".7z", kindCommand},
+}
+
+// DefaultExtensions kept when archive.extensions isn't set
+var DefaultExtensions = []string{
+	".mkv", ".mp4", ".m4v", ".avi", ".mov", ".wmv", ".ts", ".webm", ".mpg", ".mpeg", ".flv",
+	".mp3", ".m4a", ".flac", ".ogg", ".opus", ".wav", ".aac",
+	".srt", ".ass", ".ssa", ".sub", ".idx", ".vtt",
+}
+
+// kind of archive name is, false if it isn't one
+func kind(name string) (int, bool) {
+	name = strings.ToLower(name)
+	for _, s := range suffixes {
+		if strings.HasSuffix(name, s.ext) {
+			return s.kind, true
+		}
+	}
+	return 0, false
+}
+
+// Is true if name looks like an archive that can be extracted
+func Is(name string) bool {
+	_, ok := kind(name)
+	return ok
+}
+
+// Refused true if the archive itself is the problem, it's broken, empty,
+// too big unpacked or has paths that climb out. A batch can go on with the
+// next file.
+func Refused(err error) bool {
+	return errors.Is(err, ErrBomb) || errors.Is(err, ErrEmpty) ||
+		errors.Is(err, filesystem.ErrEscape) || errors.Is(err, filesystem.ErrInvalid) ||
+		errors.Is(err, zip.ErrFormat) || errors.Is(err, tar.ErrHeader) || errors.Is(err, gzip.ErrHeader)
+}
+
+// Status 413 for ErrBomb, 422 for any other archive that's refused, 501
+// if the command isn't installed and 507 if there's no room
+func Status(err error) int {
+	switch {
+	case errors.Is(err, ErrBomb):
+		return http.StatusRequestEntityTooLarge
+	case Refused(err):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrUnavailable):
+		return http.StatusNotImplemented
+	}
+	return space.Status(err)
+}
+
+// extractor set up by Register, uploads and downloads use it with Extract
+var extractor *Extractor
+
+// Extractor unpacks archives into locations
+type Extractor struct {
+	conf  *config.Current
+	index *duplicates.Index
+}
+
+// Register sets up the extractor
+func Register(service *app.Service) {
+	extractor = &Extractor{
+		conf:  service.Config,
+		index: service.Index,
+	}
+}
+
+// Result what came out of an archive
+type Result struct {
+	// Files paths in the location
+	Files []string
+	// Ignored entries that aren't media, or were refused, with why
+	Ignored []string
+}
+
+// Extract unpacks the media files in file, an archive named name, into dir
+// of location. The archive's folders are kept unless flatten is set. The
+// archive is removed once it's unpacked or Refused, otherwise it's kept so
+// it can be tried again, e.g. after a cancel.
+func Extract(ctx context.Context, location, file, name, dir string, flatten bool, user string) (*Result, error) {
+	if extractor == nil {
+		return nil, errors.New("archives aren't set up")
+	}
+	res, err := extractor.Extract(ctx, location, file, name, dir, flatten, user)
+	if err == nil || Refused(err) {
+		os.Remove(file)
+	}
+	return res, err
+}
+
+// Extract ...
+func (e *Extractor) Extract(ctx context.Context, location, file, name, dir string, flatten bool, user string) (*Result, error) {
+	k, ok := kind(name)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't an archive", name)
+	}
+	sandbox, err := e.conf.Get().Plex.Sandbox(location)
+	if err != nil {
+		return nil, err
+	}
+	if dir, err = filesystem.Clean(dir); err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &unpack{
+		e:        e,
+		location: location,
+		sandbox:  sandbox,
+		dir:      dir,
+		flatten:  flatten,
+		user:     user,
+		exts:     map[string]bool{},
+		seen:     map[string]bool{},
+		res:      &Result{Files: []string{}, Ignored: []string{}},
+	}
+	if err := u.limits(fi.Size()); err != nil {
+		return nil, err
+	}
+
+	switch k {
+	case kindZip:
+		err = u.zip(ctx, file)
+	case kindCommand:
+		err = u.command(ctx, file)
+	default:
+		err = u.tar(ctx, file, k)
+	}
+	if err != nil {
+		if len(u.res.Files) > 0 {
+			err = fmt.Errorf("%w (%d files were extracted)", err, len(u.res.Files))
+		}
+		return u.res, err
+	}
+	if len(u.res.Files) == 0 {
+		return u.res, fmt.Errorf("%s: %w", name, ErrEmpty)
+	}
+	fmt.Println("  extracted", len(u.res.Files), "files from", name, "to", location, dir)
+	return u.res, nil
+}
+
+// unpack one archive
+type unpack struct {
+	e        *Extractor
+	location string
+	sandbox  *filesystem.Sandbox
+	dir      string
+	flatten  bool
+	user     string
+	exts     map[string]bool
+
+	// maxSize unpacked, maxFiles entries
+	maxSize  int64
+	maxFiles int
+	size     int64
+	files    int
+	seen     map[string]bool
+
+	res *Result
+}
+
+// limits from the config, for an archive of size bytes
+func (u *unpack) limits(size int64) error {
+	conf := u.e.conf.Get().Archive
+	exts := conf.Extensions
+	if len(exts) == 0 {
+		exts = DefaultExtensions
+	}
+	for _, ext := range exts {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		u.exts[ext] = true
+	}
+	ratio := conf.MaxRatio
+	if ratio <= 0 {
+		ratio = config.DefaultArchiveRatio
+	}
+	u.maxSize = size * int64(ratio)
+	if conf.MaxSize != "" {
+		max, err := config.ParseSize(conf.MaxSize)
+		if err != nil {
+			return fmt.Errorf("archive.maxsize: %w", err)
+		}
+		if max > 0 && max < u.maxSize {
+			u.maxSize = max
+		}
+	}
+	u.maxFiles = conf.MaxFiles
+	if u.maxFiles <= 0 {
+		u.maxFiles = config.DefaultArchiveMaxFiles
+	}
+	return nil
+}
+
+// zip reads every entry of a zip file
+func (u *unpack) zip(ctx context.Context, file string) error {
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if strings.HasSuffix(f.Name, "/") || f.Mode().IsDir() {
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			u.ignore(f.Name, "not a regular file")
+			continue
+		}
+		err := u.entry(ctx, f.Name, func() (io.ReadCloser, error) {
+			return f.Open()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tar reads every entry of a tar file, compressed with k
+func (u *unpack) tar(ctx context.Context, file string, k int) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	switch k {
+	case kindGzip:
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	case kindBzip2:
+		r = bzip2.NewReader(f)
+	}
+	return u.tarStream(ctx, tar.NewReader(r))
+}
+
+// command has archive.command turn file into a tar
+func (u *unpack) command(ctx context.Context, file string) error {
+	name := u.e.conf.Get().Archive.Command
+	if name == "" {
+		name = config.DefaultArchiveCommand
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, "-cf", "-", "--format", "pax", "@"+file)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return fmt.Errorf("%w: %s", ErrUnavailable, name)
+		}
+		return err
+	}
+	err = u.tarStream(ctx, tar.NewReader(out))
+	if err != nil {
+		// stop it, what it was writing isn't wanted
+		cancel()
+		io.Copy(ioutil.Discard, out)
+		cmd.Wait()
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %v %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// tarStream reads every entry of tr
+func (u *unpack) tarStream(ctx context.Context, tr *tar.Reader) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg:
+		default:
+			u.ignore(hdr.Name, "not a regular file")
+			continue
+		}
+		err = u.entry(ctx, hdr.Name, func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(tr), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ignore an entry, with why
+func (u *unpack) ignore(name, why string) {
+	u.res.Ignored = append(u.res.Ignored, name+": "+why)
+}
+
+// entry checks an archive entry and writes it into the location if it's
+// media
+func (u *unpack) entry(ctx context.Context, name string, open func() (io.ReadCloser, error)) error {
+	if u.files++; u.files > u.maxFiles {
+		return fmt.Errorf("%w: over %d files", ErrBomb, u.maxFiles)
+	}
+	// an entry that climbs out, "../x", "/etc/x" or "C:\x", means the whole
+	// archive can't be trusted, wherever it was made
+	p := strings.Replace(name, "\\", "/", -1)
+	if strings.HasPrefix(p, "/") || driveRe.MatchString(p) {
+		return fmt.Errorf("%q: %w", name, filesystem.ErrEscape)
+	}
+	p, err := filesystem.Clean(p)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for _, part := range parts {
+		// mac resource forks and hidden files
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return nil
+		}
+	}
+	if !u.exts[strings.ToLower(path.Ext(p))] {
+		u.ignore(name, "not media")
+		return nil
+	}
+	if u.flatten {
+		parts = parts[len(parts)-1:]
+	}
+	rel := []string{u.dir}
+	for _, part := range parts {
+		clean, err := filesystem.NormalizeFilename(part)
+		if err != nil {
+			return fmt.Errorf("%q: %w", name, err)
+		}
+		rel = append(rel, clean)
+	}
+	relPath := path.Join(rel...)
+	if trash.Contains(relPath) {
+		return fmt.Errorf("%s: %w", relPath, filesystem.ErrEscape)
+	}
+	if u.seen[relPath] {
+		u.ignore(name, "another file has the same name")
+		return nil
+	}
+	u.seen[relPath] = true
+
+	file, err := u.sandbox.Resolve(relPath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return err
+	}
+	part := filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+partExt)
+	if err := u.write(ctx, part, open); err != nil {
+		os.Remove(part)
+		return err
+	}
+
+	_, err = place.File(u.e.conf.Get(), u.e.index, place.Part{
+		Location: u.location,
+		Sandbox:  u.sandbox,
+		File:     part,
+		RelPath:  relPath,
+		User:     u.user,
+	})
+	if errors.Is(err, probe.ErrInvalid) || errors.Is(err, probe.ErrNotAllowed) {
+		u.ignore(name, err.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	u.res.Files = append(u.res.Files, relPath)
+	return nil
+}
+
+// write an entry to part, stopping at the size limit
+func (u *unpack) write(ctx context.Context, part string, open func() (io.ReadCloser, error)) error {
+	in, err := open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	f, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := space.Writer(u.e.conf.Get(), u.location, 0, f)
+	if err != nil {
+		return err
+	}
+	defer w.Release()
+	// one byte over the limit is enough to know
+	left := u.maxSize - u.size
+	n, err := io.Copy(jobs.NewWriter(ctx, w, nil, 0), io.LimitReader(in, left+1))
+	u.size += n
+	if err != nil {
+		return err
+	}
+	if n > left {
+		return fmt.Errorf("%w: over %d bytes", ErrBomb, u.maxSize)
+	}
+	return f.Close()
+}
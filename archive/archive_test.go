@@ -0,0 +1,396 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/duplicates"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/probe"
+)
+
+// entry a file in a test archive
+type entry struct {
+	name    string
+	content string
+	// link makes it a symlink to content
+	link bool
+}
+
+// media a file that passes as video by its name
+func media(name string) entry {
+	return entry{name: name, content: "video"}
+}
+
+// zipOf the entries zipped in memory, stored so the size is what it says
+func zipOf(t *testing.T, entries ...entry) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Store}
+		if e.link {
+			hdr.SetMode(os.ModeSymlink | 0777)
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// tarGzOf the entries as a .tar.gz in memory
+func tarGzOf(t *testing.T, entries ...entry) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.content))}
+		if e.link {
+			hdr = &tar.Header{Name: e.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: e.content}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if !e.link {
+			if _, err := tw.Write([]byte(e.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newExtractor for a location movies in a temp folder, with conf's limits.
+// ffprobe is left out, .mkv passes by its name.
+func newExtractor(t *testing.T, conf config.ArchiveConfiguration) (*Extractor, string) {
+	t.Helper()
+	old := probe.Run
+	probe.Run = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		return nil, exec.ErrNotFound
+	}
+	t.Cleanup(func() { probe.Run = old })
+
+	root := t.TempDir()
+	c := &config.Configuration{Archive: conf}
+	c.Plex.Locations = map[string]string{"movies": root}
+	c.Library.IndexFile = filepath.Join(t.TempDir(), "index.json")
+	cur := config.NewCurrent(c)
+	return &Extractor{conf: cur, index: duplicates.NewIndex(cur, nil)}, root
+}
+
+// extract writes b to a temp file called name and unpacks it into dir
+func extract(t *testing.T, e *Extractor, b []byte, name, dir string, flatten bool) (*Result, error) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return e.Extract(context.Background(), "movies", file, name, dir, flatten, "tester")
+}
+
+// files in root, hidden ones and the trash left out
+func files(t *testing.T, root string) []string {
+	t.Helper()
+	got := []string{}
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(fi.Name(), ".") {
+			if fi.IsDir() && p != root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.IsDir() {
+			rel, _ := filepath.Rel(root, p)
+			got = append(got, "/"+filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestEscape(t *testing.T) {
+	tests := []string{
+		"../evil.mkv",
+		"Show/../../evil.mkv",
+		"..\\evil.mkv",
+		"/etc/evil.mkv",
+		"\\evil.mkv",
+		"C:\\Windows\\evil.mkv",
+		"c:evil.mkv",
+		"\\\\server\\share\\evil.mkv",
+	}
+	for _, name := range tests {
+		t.Run(name, func(t *testing.T) {
+			for kind, b := range map[string][]byte{
+				"a.zip":    zipOf(t, media("first.mkv"), media(name)),
+				"a.tar.gz": tarGzOf(t, media("first.mkv"), media(name)),
+			} {
+				e, root := newExtractor(t, config.ArchiveConfiguration{})
+				_, err := extract(t, e, b, kind, "/", false)
+				if !errors.Is(err, filesystem.ErrEscape) || !Refused(err) {
+					t.Fatalf("%s: got %v, want %v", kind, err, filesystem.ErrEscape)
+				}
+				// nothing landed outside, what came before stays
+				if _, err := os.Stat(filepath.Join(filepath.Dir(root), "evil.mkv")); !os.IsNotExist(err) {
+					t.Fatalf("%s: evil.mkv was written: %v", kind, err)
+				}
+				if got, want := files(t, root), []string{"/first.mkv"}; !reflect.DeepEqual(got, want) {
+					t.Fatalf("%s: got %q, want %q", kind, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBomb(t *testing.T) {
+	big := entry{name: "big.mkv", content: strings.Repeat("0", 64<<10)}
+	half := func(name string) entry {
+		return entry{name: name, content: big.content[:30<<10]}
+	}
+	tests := []struct {
+		name    string
+		conf    config.ArchiveConfiguration
+		archive func(t *testing.T) ([]byte, string)
+		want    error
+	}{
+		{
+			// gzip squeezes the zeros to far less than a tenth
+			name:    "ratio",
+			archive: func(t *testing.T) ([]byte, string) { return tarGzOf(t, big), "a.tar.gz" },
+			want:    ErrBomb,
+		},
+		{
+			name:    "ratio allowed",
+			conf:    config.ArchiveConfiguration{MaxRatio: 10000},
+			archive: func(t *testing.T) ([]byte, string) { return tarGzOf(t, big), "a.tar.gz" },
+		},
+		{
+			name:    "maxsize",
+			conf:    config.ArchiveConfiguration{MaxSize: "32KB"},
+			archive: func(t *testing.T) ([]byte, string) { return zipOf(t, big), "a.zip" },
+			want:    ErrBomb,
+		},
+		{
+			name:    "maxsize across files",
+			conf:    config.ArchiveConfiguration{MaxSize: "40KB"},
+			archive: func(t *testing.T) ([]byte, string) { return zipOf(t, half("a.mkv"), half("b.mkv")), "a.zip" },
+			want:    ErrBomb,
+		},
+		{
+			name:    "under maxsize",
+			conf:    config.ArchiveConfiguration{MaxSize: "1MB"},
+			archive: func(t *testing.T) ([]byte, string) { return zipOf(t, big), "a.zip" },
+		},
+		{
+			name: "max files",
+			conf: config.ArchiveConfiguration{MaxFiles: 2},
+			archive: func(t *testing.T) ([]byte, string) {
+				return zipOf(t, media("a.mkv"), media("b.mkv"), media("c.mkv")), "a.zip"
+			},
+			want: ErrBomb,
+		},
+		{
+			name: "max files counts what isn't media",
+			conf: config.ArchiveConfiguration{MaxFiles: 2},
+			archive: func(t *testing.T) ([]byte, string) {
+				return zipOf(t, media("a.mkv"), entry{name: "a.txt", content: "x"}, entry{name: "b.txt", content: "x"}), "a.zip"
+			},
+			want: ErrBomb,
+		},
+		{
+			name: "at max files",
+			conf: config.ArchiveConfiguration{MaxFiles: 2},
+			archive: func(t *testing.T) ([]byte, string) {
+				return zipOf(t, media("a.mkv"), media("b.mkv")), "a.zip"
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, root := newExtractor(t, tt.conf)
+			b, name := tt.archive(t)
+			_, err := extract(t, e, b, name, "/", false)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) || !Refused(err) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if Status(err) != 413 {
+				t.Fatalf("status %d, want 413", Status(err))
+			}
+			// the file it stopped in is gone, part and all
+			for _, f := range files(t, root) {
+				if f == "/big.mkv" || f == "/c.mkv" {
+					t.Fatalf("%s was kept", f)
+				}
+			}
+			parts, _ := filepath.Glob(filepath.Join(root, "*"+partExt))
+			if len(parts) > 0 {
+				t.Fatalf("parts left: %q", parts)
+			}
+		})
+	}
+}
+
+func TestMediaOnly(t *testing.T) {
+	entries := []entry{
+		media("Movie/movie.mkv"),
+		{name: "Movie/movie.srt", content: "1"},
+		{name: "Movie/readme.txt", content: "x"},
+		{name: "Movie/sample.exe", content: "x"},
+		{name: "Movie/.hidden.mkv", content: "x"},
+		{name: "__MACOSX/Movie/._movie.mkv", content: "x"},
+		{name: "Movie/link.mkv", content: "movie.mkv", link: true},
+	}
+	for name, b := range map[string][]byte{
+		"a.zip":    zipOf(t, entries...),
+		"a.tar.gz": tarGzOf(t, entries...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			e, root := newExtractor(t, config.ArchiveConfiguration{})
+			res, err := extract(t, e, b, name, "/Downloads", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"/Downloads/Movie/movie.mkv", "/Downloads/Movie/movie.srt"}
+			if !reflect.DeepEqual(res.Files, want) {
+				t.Fatalf("got %q, want %q", res.Files, want)
+			}
+			if got := files(t, root); !reflect.DeepEqual(got, want) {
+				t.Fatalf("wrote %q, want %q", got, want)
+			}
+			// hidden files and resource forks aren't worth a mention
+			ignored := []string{
+				"Movie/readme.txt: not media",
+				"Movie/sample.exe: not media",
+				"Movie/link.mkv: not a regular file",
+			}
+			sort.Strings(ignored)
+			sort.Strings(res.Ignored)
+			if !reflect.DeepEqual(res.Ignored, ignored) {
+				t.Fatalf("ignored %q, want %q", res.Ignored, ignored)
+			}
+		})
+	}
+
+	t.Run("nothing", func(t *testing.T) {
+		e, _ := newExtractor(t, config.ArchiveConfiguration{})
+		_, err := extract(t, e, zipOf(t, entry{name: "readme.txt", content: "x"}), "a.zip", "/", false)
+		if !errors.Is(err, ErrEmpty) {
+			t.Fatalf("got %v, want %v", err, ErrEmpty)
+		}
+	})
+
+	t.Run("extensions", func(t *testing.T) {
+		e, _ := newExtractor(t, config.ArchiveConfiguration{Extensions: []string{"MKV"}})
+		res, err := extract(t, e, zipOf(t, entries...), "a.zip", "/", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"/Movie/movie.mkv"}; !reflect.DeepEqual(res.Files, want) {
+			t.Fatalf("got %q, want %q", res.Files, want)
+		}
+	})
+}
+
+func TestFlatten(t *testing.T) {
+	b := zipOf(t,
+		media("Show/Season 1/e1.mkv"),
+		media("Show/Season 2/e1.mkv"),
+		media("Show/Season 2/e2.mkv"),
+		media("Show/Extras/bad:name?.mkv"),
+	)
+	tests := []struct {
+		flatten bool
+		want    []string
+		ignored int
+	}{
+		{want: []string{"/TV/Show/Season 1/e1.mkv", "/TV/Show/Season 2/e1.mkv", "/TV/Show/Season 2/e2.mkv", "/TV/Show/Extras/bad -name_.mkv"}},
+		// the second e1.mkv would overwrite the first
+		{flatten: true, want: []string{"/TV/e1.mkv", "/TV/e2.mkv", "/TV/bad -name_.mkv"}, ignored: 1},
+	}
+	for _, tt := range tests {
+		e, root := newExtractor(t, config.ArchiveConfiguration{})
+		res, err := extract(t, e, b, "a.zip", "TV", tt.flatten)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res.Files, tt.want) {
+			t.Fatalf("flatten %v: got %q, want %q", tt.flatten, res.Files, tt.want)
+		}
+		if len(res.Ignored) != tt.ignored {
+			t.Fatalf("flatten %v: ignored %q", tt.flatten, res.Ignored)
+		}
+		want := append([]string{}, tt.want...)
+		sort.Strings(want)
+		if got := files(t, root); !reflect.DeepEqual(got, want) {
+			t.Fatalf("flatten %v: wrote %q, want %q", tt.flatten, got, want)
+		}
+	}
+}
+
+func TestExtractRemoves(t *testing.T) {
+	e, _ := newExtractor(t, config.ArchiveConfiguration{})
+	old := extractor
+	extractor = e
+	t.Cleanup(func() { extractor = old })
+
+	tests := []struct {
+		name string
+		b    []byte
+		kept bool
+	}{
+		{name: "done.zip", b: zipOf(t, media("a.mkv"))},
+		{name: "refused.zip", b: zipOf(t, media("../a.mkv"))},
+		{name: "broken.zip", b: []byte("not a zip")},
+	}
+	for _, tt := range tests {
+		file := filepath.Join(t.TempDir(), tt.name)
+		if err := ioutil.WriteFile(file, tt.b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		Extract(context.Background(), "movies", file, tt.name, "/", false, "tester")
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Fatalf("%s was kept: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/jobs"
+)
+
+// testConf an admin role, and one that uploads and manages movies
+func testConf() *config.Configuration {
+	c := &config.Configuration{}
+	c.Auth.Roles = map[string]config.RoleConfiguration{
+		"admin":  {Permissions: []string{All}, Locations: []string{All}},
+		"movies": {Permissions: []string{PermUpload, PermManage}, Locations: []string{"movies"}},
+	}
+	return c
+}
+
+// newController with the users admin and bob, bob has the movies role.
+// /can?perm=&location= answers 204 if the user can, 403 if not.
+func newController(t *testing.T) (*Controller, *mux.Router) {
+	t.Helper()
+	users, err := NewStore(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, role := range map[string]string{"admin": "admin", "bob": "movies"} {
+		if err := users.SetPassword(name, name+" password"); err != nil {
+			t.Fatal(err)
+		}
+		if err := users.SetRoles(name, []string{role}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := mux.NewRouter()
+	c := &Controller{
+		mux:      r,
+		api:      r.PathPrefix(api.Prefix).Subrouter(),
+		conf:     config.NewCurrent(testConf()),
+		users:    users,
+		sessions: NewSessions(time.Hour),
+		jobs:     jobs.NewManager(),
+	}
+	c.MountController()
+	r.HandleFunc("/can", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if Check(w, r, q.Get("perm"), q.Get("location")) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	return c, r
+}
+
+// serve req with the cookie, if there is one
+func serve(h http.Handler, req *http.Request, cookie *http.Cookie) *httptest.ResponseRecorder {
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// login posts the login form, from the repo's root so a failed login can
+// render the form
+func login(t *testing.T, h http.Handler, username, password, next string) *httptest.ResponseRecorder {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	form := url.Values{"username": {username}, "password": {password}, "next": {next}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return serve(h, req, nil)
+}
+
+// sessionCookie from a login response
+func sessionCookie(t *testing.T, w *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == CookieName && cookie.Value != "" {
+			return cookie
+		}
+	}
+	t.Fatalf("no session cookie, got %d", w.Code)
+	return nil
+}
+
+func TestLogin(t *testing.T) {
+	_, h := newController(t)
+
+	w := login(t, h, "bob", "wrong password", "/upload")
+	if w.Code != http.StatusUnauthorized || len(w.Result().Cookies()) != 0 {
+		t.Fatalf("wrong password: got %d, %v", w.Code, w.Result().Cookies())
+	}
+	if !strings.Contains(w.Body.String(), ErrInvalidLogin.Error()) {
+		t.Fatal("the form doesn't say why")
+	}
+	if w := login(t, h, "nobody", "bob password", "/"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unknown user: got %d", w.Code)
+	}
+
+	w = login(t, h, "bob", "bob password", "/upload?a=1")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/upload?a=1" {
+		t.Fatalf("got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	cookie := sessionCookie(t, w)
+	if !cookie.HttpOnly {
+		t.Fatal("the session cookie can be read by scripts")
+	}
+	if w := serve(h, httptest.NewRequest("GET", "/can?perm=upload", nil), cookie); w.Code != http.StatusNoContent {
+		t.Fatalf("logged in: got %d", w.Code)
+	}
+
+	// only back into the site
+	for _, next := range []string{"//evil.example", "/\\evil.example", "https://evil.example", ""} {
+		w := login(t, h, "bob", "bob password", next)
+		if got := w.Header().Get("Location"); got != "/" {
+			t.Errorf("next %q went to %q", next, got)
+		}
+	}
+
+	w = serve(h, httptest.NewRequest("POST", "/logout", nil), cookie)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+		t.Fatalf("logout: got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	w = serve(h, httptest.NewRequest("GET", "/can?perm=upload", nil), cookie)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login?next=%2Fcan%3Fperm%3Dupload" {
+		t.Fatalf("after logout: got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestLoginRequired(t *testing.T) {
+	_, h := newController(t)
+	tests := []struct {
+		name   string
+		path   string
+		header map[string]string
+		code   int
+	}{
+		{name: "page", path: "/can", code: http.StatusSeeOther},
+		{name: "api", path: api.Prefix + "/me", code: http.StatusUnauthorized},
+		{name: "json", path: "/can", header: map[string]string{"Accept": "application/json"}, code: http.StatusUnauthorized},
+		{name: "websocket", path: "/can", header: map[string]string{"Upgrade": "websocket"}, code: http.StatusUnauthorized},
+		{name: "bad token", path: "/can", header: map[string]string{"Authorization": "Bearer nope"}, code: http.StatusUnauthorized},
+		{name: "login form", path: "/login?next=/x", code: http.StatusOK},
+		{name: "openapi", path: api.Prefix + "/openapi.json", code: http.StatusNotFound},
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the login form is rendered from the repo's root
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			w := serve(h, req, nil)
+			if w.Code != tt.code {
+				t.Fatalf("got %d, want %d", w.Code, tt.code)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Fatal("no WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestToken(t *testing.T) {
+	c, h := newController(t)
+	token, err := c.users.NewToken("bob", "cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := sessionCookie(t, login(t, h, "admin", "admin password", "/"))
+
+	var byToken bool
+	var user string
+	c.mux.HandleFunc("/who", func(w http.ResponseWriter, r *http.Request) {
+		byToken, user = ByToken(r), Username(r)
+	})
+	tests := []struct {
+		name    string
+		auth    string
+		cookie  *http.Cookie
+		code    int
+		user    string
+		byToken bool
+	}{
+		{name: "token", auth: "Bearer " + token, code: http.StatusOK, user: "bob", byToken: true},
+		{name: "cookie", cookie: cookie, code: http.StatusOK, user: "admin"},
+		// a token that doesn't work doesn't fall back to the cookie
+		{name: "bad token and cookie", auth: "Bearer " + token + "x", cookie: cookie, code: http.StatusUnauthorized},
+		{name: "token wins over cookie", auth: "Bearer " + token, cookie: cookie, code: http.StatusOK, user: "bob", byToken: true},
+		{name: "not bearer", auth: "Basic " + token, cookie: cookie, code: http.StatusOK, user: "admin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			byToken, user = false, ""
+			req := httptest.NewRequest("GET", "/who", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			w := serve(h, req, tt.cookie)
+			if w.Code != tt.code || user != tt.user || byToken != tt.byToken {
+				t.Fatalf("got %d as %q, by token %v", w.Code, user, byToken)
+			}
+		})
+	}
+
+	// a revoked token stops working
+	if err := c.users.DeleteToken("bob", "cli"); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/who", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if w := serve(h, req, nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked token: got %d", w.Code)
+	}
+}
+
+func TestPublic(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/login", true},
+		{"/login/", false},
+		{"/loginx", false},
+		{"/static/app.js", true},
+		{"/static/css/base.css", true},
+		{"/static", false},
+		{"/staticx/app.js", false},
+		{api.Prefix + "/openapi.json", true},
+		{api.Prefix + "/openapi.json/x", false},
+		{api.Prefix + "/me", false},
+		{"/webhooks/plex", true},
+		{"/webhooks/plex/x", false},
+		{"/webhooks", false},
+		{"/", false},
+	}
+	for _, tt := range tests {
+		if got := public(tt.path); got != tt.want {
+			t.Errorf("%s: got %v", tt.path, got)
+		}
+	}
+}
+
+func TestCan(t *testing.T) {
+	conf := testConf()
+	conf.Auth.Roles["commands"] = config.RoleConfiguration{Permissions: []string{PermCommand}}
+	tests := []struct {
+		roles    []string
+		perm     string
+		location string
+		want     bool
+	}{
+		{roles: []string{"admin"}, perm: PermCommand, want: true},
+		{roles: []string{"admin"}, perm: PermManage, location: "tv", want: true},
+		{roles: []string{"movies"}, perm: PermUpload, location: "movies", want: true},
+		{roles: []string{"movies"}, perm: PermUpload, location: "tv"},
+		{roles: []string{"movies"}, perm: PermDownload, location: "movies"},
+		// "" is any location the permission is in
+		{roles: []string{"movies"}, perm: PermUpload, want: true},
+		{roles: []string{"movies"}, perm: PermCommand},
+		// a role without locations only counts for ""
+		{roles: []string{"commands"}, perm: PermCommand, want: true},
+		{roles: []string{"commands"}, perm: PermCommand, location: "movies"},
+		{roles: []string{"movies", "commands"}, perm: PermCommand, want: true},
+		{roles: []string{"gone"}, perm: PermUpload},
+		{perm: PermUpload},
+	}
+	for _, tt := range tests {
+		u := &User{Username: "u", Roles: tt.roles}
+		r := httptest.NewRequest("GET", "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), userKey, &identity{user: u, conf: conf}))
+		if got := Can(r, tt.perm, tt.location); got != tt.want {
+			t.Errorf("%v %s in %q: got %v", tt.roles, tt.perm, tt.location, got)
+		}
+		if got, want := Admin(r), len(tt.roles) == 1 && tt.roles[0] == "admin"; got != want {
+			t.Errorf("%v admin: got %v", tt.roles, got)
+		}
+	}
+	if Can(httptest.NewRequest("GET", "/", nil), PermUpload, "") {
+		t.Fatal("a request without a user can upload")
+	}
+}
+
+func TestForbiddenLocation(t *testing.T) {
+	_, h := newController(t)
+	cookie := sessionCookie(t, login(t, h, "bob", "bob password", "/"))
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{query: "perm=upload&location=movies", code: http.StatusNoContent},
+		{query: "perm=upload&location=tv", code: http.StatusForbidden},
+		{query: "perm=download&location=movies", code: http.StatusForbidden},
+		{query: "perm=manage", code: http.StatusNoContent},
+		{query: "perm=command", code: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/can?"+tt.query, nil)
+		req.Header.Set("Accept", "application/json")
+		w := serve(h, req, cookie)
+		if w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.query, w.Code, tt.code)
+		}
+		if w.Code == http.StatusForbidden && !strings.Contains(w.Body.String(), "permission denied") {
+			t.Errorf("%s: got %s", tt.query, w.Body.String())
+		}
+	}
+}
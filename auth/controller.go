@@ -0,0 +1,297 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/app"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/jobs"
+)
+
+// Defaults when not set in config
+const (
+	DefaultUsersFile  = "./users.json"
+	DefaultSessionTTL = 7 * 24 * time.Hour
+)
+
+// CookieName of the session cookie
+const CookieName = "plexupdate_session"
+
+type contextKey int
+
+const userKey contextKey = 0
+
+// publicPaths don't need a login, the ones ending in / are folders and cover
+// everything in them, the rest have to match exactly
+var publicPaths = []string{
+	"/login",
+	"/static/",
+	api.Prefix + "/openapi.json",
+	// plex can't log in, the webhook checks its own secret
+	"/webhooks/plex",
+}
+
+// Open loads the users file from config
+func Open(conf *config.Configuration) (*Store, error) {
+	path := conf.Auth.UsersFile
+	if path == "" {
+		path = DefaultUsersFile
+	}
+	return NewStore(path)
+}
+
+// CurrentUser returns the user of an authenticated request
+func CurrentUser(r *http.Request) *User {
+	if id := identityFor(r); id != nil {
+		return id.user
+	}
+	return nil
+}
+
+// Username of the request's user, empty if there isn't one
+func Username(r *http.Request) string {
+	if u := CurrentUser(r); u != nil {
+		return u.Username
+	}
+	return ""
+}
+
+// Controller handles login, logout, api tokens and who sees which jobs.
+type Controller struct {
+	mux      *mux.Router
+	api      *mux.Router
+	conf     *config.Current
+	users    *Store
+	sessions *Sessions
+	jobs     *jobs.Manager
+}
+
+// Register mounts login routes and requires a login on every other route.
+func Register(service *app.Service) error {
+	users, err := Open(service.Config.Get())
+	if err != nil {
+		return err
+	}
+	if users.Len() == 0 {
+		fmt.Println("WARNING: no users, nobody can log in. Add one with `plexupdate user add NAME`")
+	}
+
+	ttl := service.Config.Get().Auth.SessionTTL
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+
+	c := &Controller{
+		mux:      service.Mux,
+		api:      service.API,
+		conf:     service.Config,
+		users:    users,
+		sessions: NewSessions(ttl),
+		jobs:     service.Jobs,
+	}
+	c.MountController()
+	return nil
+}
+
+// MountController ...
+func (c *Controller) MountController() {
+	c.mux.Use(c.Middleware)
+
+	c.mux.HandleFunc("/login", c.Login).Methods("GET")
+	c.mux.HandleFunc("/login", c.LoginHandler).Methods("POST")
+	c.mux.HandleFunc("/logout", c.Logout).Methods("POST")
+
+	c.api.HandleFunc("/me", c.Me).Methods("GET")
+	c.api.HandleFunc("/tokens", c.TokenCreate).Methods("POST")
+	c.api.HandleFunc("/tokens/{name}", c.TokenDelete).Methods("DELETE")
+
+	c.api.HandleFunc("/jobs", c.JobList).Methods("GET")
+	c.api.HandleFunc("/jobs/{id}", c.Job).Methods("GET")
+	c.api.HandleFunc("/jobs/{id}", c.JobCancel).Methods("DELETE")
+}
+
+// public true if urlPath doesn't need a login
+func public(urlPath string) bool {
+	for _, p := range publicPaths {
+		if urlPath == p || strings.HasSuffix(p, "/") && strings.HasPrefix(urlPath, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware rejects requests without a valid session cookie or api token
+func (c *Controller) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if public(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		u, byToken := c.userFor(r)
+		if u == nil {
+			// api clients and websockets can't follow a redirect to a login form
+			if api.WantsJSON(r) || r.Header.Get("Upgrade") != "" || r.Header.Get("Authorization") != "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="plexupdate"`)
+				api.WriteError(w, r, http.StatusUnauthorized, errors.New("login required"))
+				return
+			}
+			http.Redirect(w, r, "/login?next="+template.URLQueryEscaper(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, &identity{
+			user:  u,
+			conf:  c.conf.Get(),
+			token: byToken,
+		})))
+	})
+}
+
+// userFor finds the user from an api token or session cookie, byToken is
+// true if it was the token
+func (c *Controller) userFor(r *http.Request) (u *User, byToken bool) {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		u, ok := c.users.UserForToken(strings.TrimPrefix(h, "Bearer "))
+		return u, ok
+	}
+
+	cookie, err := r.Cookie(CookieName)
+	if err != nil {
+		return nil, false
+	}
+	sess, ok := c.sessions.Get(cookie.Value)
+	if !ok {
+		return nil, false
+	}
+	// user could have been deleted since login
+	u, _ = c.users.Get(sess.Username)
+	return u, false
+}
+
+// Login shows the login form
+func (c *Controller) Login(w http.ResponseWriter, r *http.Request) {
+	c.renderLogin(w, r, "")
+}
+
+func (c *Controller) renderLogin(w http.ResponseWriter, r *http.Request, msg string) {
+	// parse every time to make updates easier, and save memory
+	tpl := template.Must(template.New("base").ParseFiles("templates/login.html", "templates/base.html"))
+	tpl.ExecuteTemplate(w, "base", &struct {
+		Title string
+		Error string
+		Next  string
+	}{
+		Title: "Login",
+		Error: msg,
+		Next:  safeNext(r.FormValue("next")),
+	})
+}
+
+// LoginHandler checks the password and starts a session
+func (c *Controller) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("LoginHandler", r.URL.String())
+
+	r.ParseForm()
+	username := r.PostForm.Get("username")
+	u, err := c.users.Authenticate(username, r.PostForm.Get("password"))
+	if err != nil {
+		fmt.Println("  [E]: login failed for", username)
+		w.WriteHeader(http.StatusUnauthorized)
+		c.renderLogin(w, r, err.Error())
+		return
+	}
+
+	sess, err := c.sessions.New(u.Username)
+	if err != nil {
+		api.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    sess.ID,
+		Path:     "/",
+		Expires:  sess.Expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, safeNext(r.PostForm.Get("next")), http.StatusSeeOther)
+}
+
+// Logout ends the session
+func (c *Controller) Logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(CookieName); err == nil {
+		c.sessions.Delete(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// safeNext only allows redirects back into this site
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// Me returns the current user
+func (c *Controller) Me(w http.ResponseWriter, r *http.Request) {
+	u := CurrentUser(r)
+	me := &api.User{
+		Username:    u.Username,
+		Roles:       u.Roles,
+		Permissions: []string{},
+		Tokens:      []api.TokenInfo{},
+	}
+	perms := Permissions(r)
+	for _, perm := range AllPermissions {
+		if perms[perm] {
+			me.Permissions = append(me.Permissions, perm)
+		}
+	}
+	for _, t := range u.Tokens {
+		me.Tokens = append(me.Tokens, api.TokenInfo{Name: t.Name, Created: t.Created})
+	}
+	api.WriteJSON(w, http.StatusOK, me)
+}
+
+// TokenCreate makes a new api token for the current user
+func (c *Controller) TokenCreate(w http.ResponseWriter, r *http.Request) {
+	req := &api.TokenRequest{}
+	if err := api.ReadJSON(r, req); err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	token, err := c.users.NewToken(CurrentUser(r).Username, req.Name)
+	if err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	api.WriteJSON(w, http.StatusCreated, &api.NewToken{Name: req.Name, Token: token})
+}
+
+// TokenDelete revokes one of the current user's tokens
+func (c *Controller) TokenDelete(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := c.users.DeleteToken(CurrentUser(r).Username, name); err != nil {
+		api.WriteError(w, r, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
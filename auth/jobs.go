@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/jobs"
+)
+
+// CanSeeJob true if the user started j, is an admin, or can manage the
+// location j works in
+func CanSeeJob(r *http.Request, j *jobs.Job) bool {
+	s := j.Snapshot()
+	if s.User != "" && s.User == Username(r) {
+		return true
+	}
+	return Admin(r) || Can(r, PermManage, s.Location)
+}
+
+// job the job with the id in the url, it writes a 404 and returns nil for
+// one the user can't see so ids can't be probed
+func (c *Controller) job(w http.ResponseWriter, r *http.Request) *jobs.Job {
+	id := mux.Vars(r)["id"]
+	j, ok := c.jobs.Get(id)
+	if !ok || !CanSeeJob(r, j) {
+		api.WriteError(w, r, http.StatusNotFound, fmt.Errorf("job not found: %s", id))
+		return nil
+	}
+	return j
+}
+
+// JobList the jobs the user can see
+func (c *Controller) JobList(w http.ResponseWriter, r *http.Request) {
+	list := []*api.Job{}
+	for _, j := range c.jobs.List() {
+		if CanSeeJob(r, j) {
+			list = append(list, api.NewJob(j))
+		}
+	}
+	api.WriteJSON(w, http.StatusOK, list)
+}
+
+// Job ...
+func (c *Controller) Job(w http.ResponseWriter, r *http.Request) {
+	if j := c.job(w, r); j != nil {
+		api.WriteJSON(w, http.StatusOK, api.NewJob(j))
+	}
+}
+
+// JobCancel ...
+func (c *Controller) JobCancel(w http.ResponseWriter, r *http.Request) {
+	j := c.job(w, r)
+	if j == nil {
+		return
+	}
+	if err := c.jobs.Cancel(j.ID); err != nil {
+		api.WriteError(w, r, http.StatusNotFound, err)
+		return
+	}
+	api.WriteJSON(w, http.StatusAccepted, api.NewJob(j))
+}
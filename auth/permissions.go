@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/config"
+)
+
+// Permissions a role can have
+const (
+	PermUpload   = "upload"
+	PermDownload = "download"
+	PermCommand  = "command"
+	PermLibrary  = "library"
+	PermManage   = "manage" // rename, move and delete in the library
+	// All every permission, or every location
+	All = "*"
+)
+
+// AllPermissions in the order they're shown
+var AllPermissions = []string{PermUpload, PermDownload, PermCommand, PermLibrary, PermManage}
+
+// identity is stored in the request context by the middleware
+type identity struct {
+	user *User
+	conf *config.Configuration
+	// token the request was authenticated with an api token, not the cookie
+	token bool
+}
+
+func identityFor(r *http.Request) *identity {
+	id, _ := r.Context().Value(userKey).(*identity)
+	return id
+}
+
+// ByToken true if an api token logged the request in, browsers never send
+// one on their own so it can't be a forged form
+func ByToken(r *http.Request) bool {
+	id := identityFor(r)
+	return id != nil && id.token
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s || v == All {
+			return true
+		}
+	}
+	return false
+}
+
+// Can the user do perm in location. Location "" is for things that aren't
+// tied to a location, e.g. commands, or the default ./uploads folder.
+func Can(r *http.Request, perm, location string) bool {
+	id := identityFor(r)
+	if id == nil || id.user == nil {
+		return false
+	}
+	for _, name := range id.user.Roles {
+		role, ok := id.conf.Auth.Roles[name]
+		if !ok || !contains(role.Permissions, perm) {
+			continue
+		}
+		if location == "" || contains(role.Locations, location) {
+			return true
+		}
+	}
+	return false
+}
+
+// Admin true if one of the user's roles can do everything everywhere
+func Admin(r *http.Request) bool {
+	id := identityFor(r)
+	if id == nil || id.user == nil {
+		return false
+	}
+	for _, name := range id.user.Roles {
+		role, ok := id.conf.Auth.Roles[name]
+		if ok && contains(role.Permissions, All) && contains(role.Locations, All) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check writes a 403 and returns false if the user can't do perm in location
+func Check(w http.ResponseWriter, r *http.Request, perm, location string) bool {
+	if Can(r, perm, location) {
+		return true
+	}
+	if location != "" {
+		api.WriteError(w, r, http.StatusForbidden, fmt.Errorf("permission denied: %s in %q", perm, location))
+	} else {
+		api.WriteError(w, r, http.StatusForbidden, fmt.Errorf("permission denied: %s", perm))
+	}
+	return false
+}
+
+// Permissions the user has anywhere, for hiding things in templates
+func Permissions(r *http.Request) map[string]bool {
+	perms := map[string]bool{}
+	id := identityFor(r)
+	if id == nil || id.user == nil {
+		return perms
+	}
+	for _, name := range id.user.Roles {
+		role := id.conf.Auth.Roles[name]
+		for _, perm := range AllPermissions {
+			if contains(role.Permissions, perm) {
+				perms[perm] = true
+			}
+		}
+	}
+	return perms
+}
+
+// Locations filters locations down to the ones the user can do perm in
+func Locations(r *http.Request, perm string, locations map[string]string) map[string]string {
+	allowed := map[string]string{}
+	for name, path := range locations {
+		if Can(r, perm, name) {
+			allowed[name] = path
+		}
+	}
+	return allowed
+}
+
+// Require wraps a handler that needs perm, for features that aren't tied to a location
+func Require(perm string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if Check(w, r, perm, "") {
+			h(w, r)
+		}
+	}
+}
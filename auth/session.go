@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// Session is a logged in browser
+type Session struct {
+	ID       string
+	Username string
+	Expires  time.Time
+}
+
+// Sessions kept in memory, a restart logs everyone out.
+type Sessions struct {
+	ttl      time.Duration
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewSessions ...
+func NewSessions(ttl time.Duration) *Sessions {
+	return &Sessions{
+		ttl:      ttl,
+		sessions: make(map[string]*Session),
+	}
+}
+
+// New starts a session for username
+func (s *Sessions) New(username string) (*Session, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	sess := &Session{
+		ID:       base64.RawURLEncoding.EncodeToString(b),
+		Username: username,
+		Expires:  time.Now().Add(s.ttl),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+	s.sessions[sess.ID] = sess
+	return sess, nil
+}
+
+// Get returns a session that hasn't expired
+func (s *Sessions) Get(id string) (*Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(sess.Expires) {
+		delete(s.sessions, id)
+		return nil, false
+	}
+	return sess, true
+}
+
+// Delete ...
+func (s *Sessions) Delete(id string) {
+	s.mu.Lock()
+	delete(s.sessions, id)
+	s.mu.Unlock()
+}
+
+// DeleteUser logs a user out everywhere, e.g. after a password change
+func (s *Sessions) DeleteUser(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.sessions {
+		if sess.Username == username {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// sweep drops expired sessions, caller must hold the lock
+func (s *Sessions) sweep() {
+	now := time.Now()
+	for id, sess := range s.sessions {
+		if now.After(sess.Expires) {
+			delete(s.sessions, id)
+		}
+	}
+}
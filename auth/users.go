@@ -0,0 +1,310 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidLogin same error for unknown user and wrong password
+var ErrInvalidLogin = errors.New("invalid username or password")
+
+// dummyHash is compared against for unknown users so response time doesn't give away valid usernames
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// User is a local account
+type User struct {
+	Username     string   `json:"username"`
+	PasswordHash string   `json:"password_hash"`
+	Roles        []string `json:"roles,omitempty"`
+	Tokens       []*Token `json:"tokens,omitempty"`
+}
+
+// clone so the user can be read after the store's lock is released, while
+// roles and tokens are being changed
+func (u *User) clone() *User {
+	c := *u
+	c.Roles = append([]string{}, u.Roles...)
+	c.Tokens = make([]*Token, len(u.Tokens))
+	for i, t := range u.Tokens {
+		tc := *t
+		c.Tokens[i] = &tc
+	}
+	return &c
+}
+
+// Token is an api token for the cli and scripts, only the hash is stored
+type Token struct {
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+// Store keeps users in a json file
+type Store struct {
+	path    string
+	mu      sync.RWMutex
+	users   map[string]*User
+	modTime time.Time
+}
+
+// NewStore loads users from path, a missing file is an empty store
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		path:  path,
+		users: make(map[string]*User),
+	}
+	return s, s.load()
+}
+
+// load reads the file, caller must hold the lock (or be NewStore)
+func (s *Store) load() error {
+	fi, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	users := []*User{}
+	if err := json.Unmarshal(data, &users); err != nil {
+		return fmt.Errorf("%s: %s", s.path, err)
+	}
+	s.users = make(map[string]*User)
+	for _, u := range users {
+		s.users[u.Username] = u
+	}
+	s.modTime = fi.ModTime()
+	return nil
+}
+
+// refresh reloads the file if it was changed by someone else, e.g. `plexupdate user add`
+func (s *Store) refresh() {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return
+	}
+	s.mu.RLock()
+	changed := !fi.ModTime().Equal(s.modTime)
+	s.mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		fmt.Println("  [E]: reload users:", err)
+	}
+}
+
+// save writes all users, caller must hold the lock
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	// write then rename so a crash doesn't leave half a file
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(s.path); err == nil {
+		s.modTime = fi.ModTime()
+	}
+	return nil
+}
+
+func (s *Store) list() []*User {
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(a, b int) bool {
+		return users[a].Username < users[b].Username
+	})
+	return users
+}
+
+// List copies of the users
+func (s *Store) List() []*User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := s.list()
+	for i, u := range users {
+		users[i] = u.clone()
+	}
+	return users
+}
+
+// Len number of users
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.users)
+}
+
+// Get a copy of the user
+func (s *Store) Get(username string) (*User, bool) {
+	s.refresh()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[username]
+	if !ok {
+		return nil, false
+	}
+	return u.clone(), true
+}
+
+// SetPassword creates the user if needed
+func (s *Store) SetPassword(username, password string) error {
+	if username == "" {
+		return errors.New("missing username")
+	}
+	if len(password) < 8 {
+		return errors.New("password must be at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		u = &User{Username: username}
+		s.users[username] = u
+	}
+	u.PasswordHash = string(hash)
+	return s.save()
+}
+
+// SetRoles replaces the user's roles
+func (s *Store) SetRoles(username string, roles []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return fmt.Errorf("unknown user: %q", username)
+	}
+	u.Roles = roles
+	return s.save()
+}
+
+// Delete ...
+func (s *Store) Delete(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[username]; !ok {
+		return fmt.Errorf("unknown user: %q", username)
+	}
+	delete(s.users, username)
+	return s.save()
+}
+
+// Authenticate checks username and password
+func (s *Store) Authenticate(username, password string) (*User, error) {
+	u, ok := s.Get(username)
+	if !ok {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidLogin
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)); err != nil {
+		return nil, ErrInvalidLogin
+	}
+	return u, nil
+}
+
+// NewToken returns a new api token for the user, it can't be looked up again
+func (s *Store) NewToken(username, name string) (string, error) {
+	if name == "" {
+		return "", errors.New("missing token name")
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return "", fmt.Errorf("unknown user: %q", username)
+	}
+	for _, t := range u.Tokens {
+		if t.Name == name {
+			return "", fmt.Errorf("token %q already exists", name)
+		}
+	}
+	u.Tokens = append(u.Tokens, &Token{
+		Name:    name,
+		Hash:    hashToken(token),
+		Created: time.Now(),
+	})
+	return token, s.save()
+}
+
+// DeleteToken ...
+func (s *Store) DeleteToken(username, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return fmt.Errorf("unknown user: %q", username)
+	}
+	for i, t := range u.Tokens {
+		if t.Name == name {
+			u.Tokens = append(u.Tokens[:i], u.Tokens[i+1:]...)
+			return s.save()
+		}
+	}
+	return fmt.Errorf("unknown token: %q", name)
+}
+
+// UserForToken finds the owner of an api token, a copy of them
+func (s *Store) UserForToken(token string) (*User, bool) {
+	hash := hashToken(token)
+	s.refresh()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.users {
+		for _, t := range u.Tokens {
+			if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+				return u.clone(), true
+			}
+		}
+	}
+	return nil, false
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
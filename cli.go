@@ -0,0 +1,294 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/client"
+	"github.com/jaredwarren/plexupdate/jobs"
+)
+
+// defaultServer can be overridden with $PLEXUPDATE_SERVER or --server
+const defaultServer = "http://localhost:8081"
+
+const cliUsage = `usage: plexupdate [command] [flags]
+
+Without a command the server is started.
+
+commands:
+  upload FILE [--location NAME] [--resume=true]
+  ytdl ID [--location NAME] [--audio] [--wait=true]
+  cmd presets
+  cmd run PRESET [--follow]
+  cmd follow ID
+  cmd kill ID
+  jobs list
+  jobs cancel ID
+  locations
+
+every command takes --server URL (default $PLEXUPDATE_SERVER or ` + defaultServer + `)
+and --token TOKEN (default $PLEXUPDATE_TOKEN)
+
+server admin, run next to the server's config file:
+  user list
+  user add NAME
+  user passwd NAME
+  user roles NAME [ROLE...]
+  user del NAME
+  user token NAME TOKEN_NAME
+  user revoke NAME TOKEN_NAME
+`
+
+// runCLI runs a client command against a running server, returns the exit code
+func runCLI(args []string) int {
+	var err error
+	switch args[0] {
+	case "upload":
+		err = cliUpload(args[1:])
+	case "ytdl":
+		err = cliYtdl(args[1:])
+	case "cmd":
+		err = cliCmd(args[1:])
+	case "jobs":
+		err = cliJobs(args[1:])
+	case "locations":
+		err = cliLocations(args[1:])
+	case "user":
+		loadConfig(nil)
+		err = cliUser(args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(cliUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], cliUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+// serverFlags every client command gets --server and --token
+type serverFlags struct {
+	server *string
+	token  *string
+}
+
+func (sf *serverFlags) client() *client.Client {
+	return client.New(*sf.server, *sf.token)
+}
+
+// newFlagSet ...
+func newFlagSet(name string) (*flag.FlagSet, *serverFlags) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	server := os.Getenv("PLEXUPDATE_SERVER")
+	if server == "" {
+		server = defaultServer
+	}
+	return fs, &serverFlags{
+		server: fs.String("server", server, "plexupdate server url"),
+		token:  fs.String("token", os.Getenv("PLEXUPDATE_TOKEN"), "api token, see `plexupdate user token`"),
+	}
+}
+
+// parseArgs lets flags come after positional args, e.g. `upload FILE --location movies`
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	positional := []string{}
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// need checks the number of positional args
+func need(fs *flag.FlagSet, args []string, n int, usage string) error {
+	if len(args) != n {
+		return fmt.Errorf("usage: plexupdate %s %s", fs.Name(), usage)
+	}
+	return nil
+}
+
+func cliUpload(args []string) error {
+	fs, server := newFlagSet("upload")
+	location := fs.String("location", "", "location name from the server config")
+	resume := fs.Bool("resume", true, "continue a previous upload of the same file")
+	args = parseArgs(fs, args)
+	if err := need(fs, args, 1, "FILE [--location NAME]"); err != nil {
+		return err
+	}
+	if *location == "" {
+		return fmt.Errorf("--location is required, see `plexupdate locations`")
+	}
+
+	c := server.client()
+	upload, err := c.Upload(args[0], *location, *resume, client.NewProgress(os.Stderr))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("uploaded %s to %s (%s)\n", upload.Path, upload.Location, api.FormatBytes(upload.Size))
+	if upload.ScanJob != "" {
+		fmt.Println("plex scan job", upload.ScanJob)
+	}
+	return nil
+}
+
+func cliYtdl(args []string) error {
+	fs, server := newFlagSet("ytdl")
+	location := fs.String("location", "", "location name from the server config")
+	audio := fs.Bool("audio", false, "audio only, converted to mp3")
+	wait := fs.Bool("wait", true, "wait for the download to finish")
+	args = parseArgs(fs, args)
+	if err := need(fs, args, 1, "ID [--location NAME] [--audio]"); err != nil {
+		return err
+	}
+
+	c := server.client()
+	job, err := c.Ytdl(&api.YtdlRequest{
+		ID:       args[0],
+		Location: *location,
+		Audio:    *audio,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("job", job.ID)
+	if !*wait {
+		return nil
+	}
+	return printJob(c.WaitJob(job.ID, client.NewProgress(os.Stderr)))
+}
+
+func printJob(job *api.Job, err error) error {
+	if err != nil {
+		return err
+	}
+	switch job.Status {
+	case jobs.Done:
+		fmt.Println(job.Result)
+	case jobs.Failed:
+		return fmt.Errorf("job %s failed: %s", job.ID, job.Error)
+	default:
+		fmt.Println("job", job.ID, job.Status)
+	}
+	return nil
+}
+
+func cliCmd(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: plexupdate cmd presets|run|follow|kill")
+	}
+	fs, server := newFlagSet("cmd " + args[0])
+	follow := fs.Bool("follow", false, "stream the log until the command finishes")
+	rest := parseArgs(fs, args[1:])
+	c := server.client()
+
+	switch args[0] {
+	case "presets":
+		presets, err := c.Presets()
+		if err != nil {
+			return err
+		}
+		names := []string{}
+		for name := range presets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, name := range names {
+			fmt.Fprintf(tw, "%s\t%s\n", name, presets[name])
+		}
+		return tw.Flush()
+	case "run":
+		if err := need(fs, rest, 1, "PRESET [--follow]"); err != nil {
+			return err
+		}
+		cmd, err := c.RunCommand(&api.CommandRequest{Preset: rest[0]})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "cmd", cmd.ID)
+		if !*follow {
+			return nil
+		}
+		_, err = c.FollowCommand(cmd.ID, os.Stdout)
+		return err
+	case "follow":
+		if err := need(fs, rest, 1, "ID"); err != nil {
+			return err
+		}
+		_, err := c.FollowCommand(rest[0], os.Stdout)
+		return err
+	case "kill":
+		if err := need(fs, rest, 1, "ID"); err != nil {
+			return err
+		}
+		_, err := c.KillCommand(rest[0])
+		return err
+	}
+	return fmt.Errorf("unknown cmd command %q", args[0])
+}
+
+func cliJobs(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: plexupdate jobs list|cancel")
+	}
+	fs, server := newFlagSet("jobs " + args[0])
+	rest := parseArgs(fs, args[1:])
+	c := server.client()
+
+	switch args[0] {
+	case "list":
+		list, err := c.Jobs()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tTYPE\tSTATUS\tPROGRESS\tRESULT")
+		for _, j := range list {
+			result := j.Result
+			if j.Error != "" {
+				result = j.Error
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%.0f%%\t%s\n", j.ID, j.Type, j.Status, j.Progress*100, result)
+		}
+		return tw.Flush()
+	case "cancel":
+		if err := need(fs, rest, 1, "ID"); err != nil {
+			return err
+		}
+		job, err := c.CancelJob(rest[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println("job", job.ID, "cancel requested")
+		return nil
+	}
+	return fmt.Errorf("unknown jobs command %q", args[0])
+}
+
+func cliLocations(args []string) error {
+	fs, server := newFlagSet("locations")
+	parseArgs(fs, args)
+
+	list, err := server.client().Locations()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, l := range list {
+		fmt.Fprintf(tw, "%s\t%s\n", l.Name, strings.TrimSpace(l.Path))
+	}
+	return tw.Flush()
+}
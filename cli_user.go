@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jaredwarren/plexupdate/auth"
+	"golang.org/x/term"
+)
+
+// cliUser manages the users file directly, it doesn't need a running server
+func cliUser(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: plexupdate user list|add|passwd|roles|del|token|revoke")
+	}
+	users, err := auth.Open(conf.Get())
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, u := range users.List() {
+			names := []string{}
+			for _, t := range u.Tokens {
+				names = append(names, t.Name)
+			}
+			fmt.Fprintf(tw, "%s\troles: %s\ttokens: %s\n", u.Username, strings.Join(u.Roles, ", "), strings.Join(names, ", "))
+		}
+		return tw.Flush()
+	case "add", "passwd":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: plexupdate user %s NAME", args[0])
+		}
+		_, exists := users.Get(args[1])
+		if args[0] == "add" && exists {
+			return fmt.Errorf("user %q already exists, use passwd", args[1])
+		}
+		if args[0] == "passwd" && !exists {
+			return fmt.Errorf("unknown user: %q", args[1])
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if err := users.SetPassword(args[1], password); err != nil {
+			return err
+		}
+		fmt.Println("saved", args[1])
+		if args[0] == "add" {
+			fmt.Printf("%s has no roles yet, see `plexupdate user roles %s ROLE...`\n", args[1], args[1])
+		}
+		return nil
+	case "roles":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: plexupdate user roles NAME [ROLE...]")
+		}
+		for _, role := range args[2:] {
+			if _, ok := conf.Get().Auth.Roles[role]; !ok {
+				return fmt.Errorf("unknown role %q, add it to auth.roles in the config", role)
+			}
+		}
+		return users.SetRoles(args[1], args[2:])
+	case "del":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: plexupdate user del NAME")
+		}
+		return users.Delete(args[1])
+	case "token":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: plexupdate user token NAME TOKEN_NAME")
+		}
+		token, err := users.NewToken(args[1], args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "save this token, it can't be shown again:")
+		fmt.Println(token)
+		return nil
+	case "revoke":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: plexupdate user revoke NAME TOKEN_NAME")
+		}
+		return users.DeleteToken(args[1], args[2])
+	}
+	return fmt.Errorf("unknown user command %q", args[0])
+}
+
+// readPassword asks twice on a terminal, or reads one line from a pipe
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "password: ")
+	p1, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "again: ")
+	p2, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(p1) != string(p2) {
+		return "", fmt.Errorf("passwords don't match")
+	}
+	return string(p1), nil
+}
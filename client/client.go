@@ -0,0 +1,176 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jaredwarren/plexupdate/api"
+)
+
+// Client talks to a running plexupdate server
+type Client struct {
+	Server string
+	// Token api token, see `plexupdate user token`
+	Token string
+	HTTP  *http.Client
+}
+
+// New server is the base url, e.g. http://localhost:8081
+func New(server, token string) *Client {
+	return &Client{
+		Server: strings.TrimSuffix(server, "/"),
+		Token:  token,
+		HTTP:   http.DefaultClient,
+	}
+}
+
+// header has the auth header for requests and websockets
+func (c *Client) header() http.Header {
+	h := http.Header{}
+	if c.Token != "" {
+		h.Set("Authorization", "Bearer "+c.Token)
+	}
+	return h
+}
+
+// APIError is returned when the server answers with an error object
+type APIError struct {
+	Code    int
+	Status  string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Code, e.Status, e.Message)
+}
+
+// request builds a request for an api path
+func (c *Client) request(method, apiPath string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.Server+api.Prefix+apiPath, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = c.header()
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+// send does req and decodes the json response into out
+func (c *Client) send(req *http.Request, out interface{}) error {
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		e := &api.ErrorResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(e); err != nil {
+			return fmt.Errorf("%s %s: %s", req.Method, req.URL, resp.Status)
+		}
+		return &APIError{
+			Code:    e.Error.Code,
+			Status:  e.Error.Status,
+			Message: e.Error.Message,
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// do sends v as json body, nil for no body
+func (c *Client) do(method, apiPath string, v, out interface{}) error {
+	var body io.Reader
+	if v != nil {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := c.request(method, apiPath, body)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(req, out)
+}
+
+// Locations ...
+func (c *Client) Locations() ([]api.Location, error) {
+	list := []api.Location{}
+	err := c.do("GET", "/locations", nil, &list)
+	return list, err
+}
+
+// Files lists a folder in a location
+func (c *Client) Files(location, dir string) (*api.Listing, error) {
+	listing := &api.Listing{}
+	err := c.do("GET", "/locations/"+url.PathEscape(location)+"/files?path="+url.QueryEscape(dir), nil, listing)
+	return listing, err
+}
+
+// Ytdl starts a youtube download job
+func (c *Client) Ytdl(req *api.YtdlRequest) (*api.Job, error) {
+	job := &api.Job{}
+	err := c.do("POST", "/ytdl", req, job)
+	return job, err
+}
+
+// Jobs ...
+func (c *Client) Jobs() ([]*api.Job, error) {
+	list := []*api.Job{}
+	err := c.do("GET", "/jobs", nil, &list)
+	return list, err
+}
+
+// Job ...
+func (c *Client) Job(id string) (*api.Job, error) {
+	job := &api.Job{}
+	err := c.do("GET", "/jobs/"+url.PathEscape(id), nil, job)
+	return job, err
+}
+
+// CancelJob ...
+func (c *Client) CancelJob(id string) (*api.Job, error) {
+	job := &api.Job{}
+	err := c.do("DELETE", "/jobs/"+url.PathEscape(id), nil, job)
+	return job, err
+}
+
+// Presets lists command presets
+func (c *Client) Presets() (map[string]string, error) {
+	presets := map[string]string{}
+	err := c.do("GET", "/commands/presets", nil, &presets)
+	return presets, err
+}
+
+// RunCommand ...
+func (c *Client) RunCommand(req *api.CommandRequest) (*api.Command, error) {
+	cmd := &api.Command{}
+	err := c.do("POST", "/commands", req, cmd)
+	return cmd, err
+}
+
+// Command returns command with its log
+func (c *Client) Command(id string) (*api.Command, error) {
+	cmd := &api.Command{}
+	err := c.do("GET", "/commands/"+url.PathEscape(id), nil, cmd)
+	return cmd, err
+}
+
+// KillCommand ...
+func (c *Client) KillCommand(id string) (*api.Command, error) {
+	cmd := &api.Command{}
+	err := c.do("DELETE", "/commands/"+url.PathEscape(id), nil, cmd)
+	return cmd, err
+}
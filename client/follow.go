@@ -0,0 +1,100 @@
+package client
+
+import (
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/jobs"
+)
+
+// pollInterval how often to check if a followed command or job finished
+const pollInterval = 2 * time.Second
+
+// FollowCommand writes the command log to out until the command finishes.
+// The websocket tells us when the log changed, the api gives us the new part.
+func (c *Client) FollowCommand(id string, out io.Writer) (*api.Command, error) {
+	printed := 0
+	flush := func() (*api.Command, error) {
+		cmd := &api.Command{}
+		err := c.do("GET", "/commands/"+url.PathEscape(id)+"?offset="+strconv.Itoa(printed), nil, cmd)
+		if err != nil {
+			return nil, err
+		}
+		io.WriteString(out, cmd.Log)
+		printed += len(cmd.Log)
+		return cmd, nil
+	}
+
+	cmd, err := flush()
+	if err != nil || !cmd.Running {
+		return cmd, err
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(c.Server, "http") + "/cmd/ws/" + url.PathEscape(id)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, c.header())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	changed := make(chan struct{}, 1)
+	go func() {
+		defer close(changed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case _, ok := <-changed:
+			if !ok {
+				// socket closed, print whatever is left
+				return flush()
+			}
+			if _, err := flush(); err != nil {
+				return nil, err
+			}
+		case <-ticker.C:
+			cmd, err := flush()
+			if err != nil || !cmd.Running {
+				return cmd, err
+			}
+		}
+	}
+}
+
+// WaitJob polls a job until it's finished, progress may be nil
+func (c *Client) WaitJob(id string, progress *Progress) (*api.Job, error) {
+	if progress != nil {
+		progress.StartPercent()
+		defer progress.Finish()
+	}
+	for {
+		job, err := c.Job(id)
+		if err != nil {
+			return nil, err
+		}
+		if progress != nil {
+			progress.Set(job.Progress)
+		}
+		switch job.Status {
+		case jobs.Done, jobs.Failed, jobs.Canceled:
+			return job, nil
+		}
+		time.Sleep(pollInterval / 2)
+	}
+}
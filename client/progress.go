@@ -0,0 +1,112 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+)
+
+const barWidth = 30
+
+// Progress draws a progress bar, it's an io.Writer so it can be used with io.TeeReader
+type Progress struct {
+	Out io.Writer
+
+	mu      sync.Mutex
+	start   time.Time
+	offset  int64
+	current int64
+	total   int64
+	percent bool
+	drawn   time.Time
+}
+
+// NewProgress ...
+func NewProgress(out io.Writer) *Progress {
+	return &Progress{Out: out}
+}
+
+// Start resets the bar, offset is what was already done before (resume)
+func (p *Progress) Start(offset, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.start = time.Now()
+	p.offset = offset
+	p.current = offset
+	p.total = total
+	p.percent = false
+	p.draw()
+}
+
+// StartPercent resets the bar for things that only report a fraction, e.g. jobs
+func (p *Progress) StartPercent() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.start = time.Now()
+	p.offset = 0
+	p.current = 0
+	p.total = 1000
+	p.percent = true
+	p.draw()
+}
+
+// Write counts bytes
+func (p *Progress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current += int64(len(b))
+	// don't redraw more than 10x a second
+	if time.Since(p.drawn) > 100*time.Millisecond {
+		p.draw()
+	}
+	return len(b), nil
+}
+
+// Set progress for things we don't stream ourselves, e.g. a job 0-1
+func (p *Progress) Set(fraction float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = int64(fraction * float64(p.total))
+	p.draw()
+}
+
+// Finish draws the final state and ends the line
+func (p *Progress) Finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.draw()
+	fmt.Fprintln(p.Out)
+}
+
+func (p *Progress) draw() {
+	p.drawn = time.Now()
+	if p.total <= 0 {
+		fmt.Fprintf(p.Out, "\r%s", api.FormatBytes(p.current))
+		return
+	}
+
+	fraction := float64(p.current) / float64(p.total)
+	if fraction > 1 {
+		fraction = 1
+	}
+	filled := int(fraction * barWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < barWidth {
+		bar += ">" + strings.Repeat(" ", barWidth-filled-1)
+	}
+
+	if p.percent {
+		fmt.Fprintf(p.Out, "\r[%s] %3.0f%%   ", bar, fraction*100)
+		return
+	}
+
+	rate := ""
+	if elapsed := time.Since(p.start).Seconds(); elapsed > 0 && p.current > p.offset {
+		rate = " " + api.FormatBytes(int64(float64(p.current-p.offset)/elapsed)) + "/s"
+	}
+	fmt.Fprintf(p.Out, "\r[%s] %3.0f%% %s/%s%s   ", bar, fraction*100, api.FormatBytes(p.current), api.FormatBytes(p.total), rate)
+}
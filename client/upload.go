@@ -0,0 +1,90 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/jaredwarren/plexupdate/api"
+)
+
+// uploadPath api path of a resumable upload
+func uploadPath(location, name string) string {
+	return "/uploads/" + url.PathEscape(location) + "/" + (&url.URL{Path: name}).EscapedPath()
+}
+
+// UploadStatus asks how much of a file the server already has
+func (c *Client) UploadStatus(location, name string) (*api.UploadStatus, error) {
+	status := &api.UploadStatus{}
+	err := c.do("GET", uploadPath(location, name), nil, status)
+	return status, err
+}
+
+// Upload sends filePath to location, continuing where a previous upload
+// stopped when resume is true. progress may be nil.
+func (c *Client) Upload(filePath, location string, resume bool, progress *Progress) (*api.Upload, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	length := fi.Size()
+	name := filepath.Base(filePath)
+
+	var offset int64
+	if resume {
+		status, err := c.UploadStatus(location, name)
+		if err != nil {
+			return nil, err
+		}
+		if status.Complete {
+			if status.Offset == length {
+				return &api.Upload{Location: location, Path: status.Path, Size: length}, nil
+			}
+			return nil, fmt.Errorf("%s already exists on server with a different size", status.Path)
+		}
+		offset = status.Offset
+		if offset > length {
+			return nil, fmt.Errorf("server has %d bytes, more than the local file", offset)
+		}
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var body io.Reader = f
+	if progress != nil {
+		progress.Start(offset, length)
+		body = io.TeeReader(f, progress)
+	}
+
+	req, err := c.request("PUT", uploadPath(location, name), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = length - offset
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(api.UploadOffsetHeader, strconv.FormatInt(offset, 10))
+	req.Header.Set(api.UploadLengthHeader, strconv.FormatInt(length, 10))
+
+	upload := &api.Upload{}
+	err = c.send(req, upload)
+	if progress != nil {
+		progress.Finish()
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict && !resume {
+		return nil, fmt.Errorf("%s, try again with --resume", err)
+	}
+	return upload, err
+}
@@ -0,0 +1,104 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jaredwarren/plexupdate/api"
+)
+
+// APICommandList ...
+func (c *Controller) APICommandList(w http.ResponseWriter, r *http.Request) {
+	c.CommandList(w, r)
+}
+
+// APIPresetList lists command presets from config
+func (c *Controller) APIPresetList(w http.ResponseWriter, r *http.Request) {
+	presets := c.Conf.Get().Commands
+	if presets == nil {
+		presets = map[string]string{}
+	}
+	api.WriteJSON(w, http.StatusOK, presets)
+}
+
+// APICommandCreate starts a new command
+func (c *Controller) APICommandCreate(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("APICommandCreate", r.URL.String())
+
+	req := &api.CommandRequest{}
+	if err := api.ReadJSON(r, req); err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if req.Preset != "" {
+		preset, ok := c.Conf.Get().Commands[req.Preset]
+		if !ok {
+			api.WriteError(w, r, http.StatusBadRequest, fmt.Errorf("unknown preset: %q", req.Preset))
+			return
+		}
+		req.Cmd = preset
+	}
+	if req.Cmd == "" {
+		api.WriteError(w, r, http.StatusBadRequest, errors.New("missing cmd"))
+		return
+	}
+
+	cmd := NewCommand(req.Cmd)
+	if req.Dir != "" {
+		cmd.Pwd = req.Dir
+	}
+	addCommand(cmd)
+	go c.run(cmd)
+
+	w.Header().Set("Location", api.Prefix+"/commands/"+cmd.ID)
+	api.WriteJSON(w, http.StatusCreated, cmd.API())
+}
+
+// APICommand returns command status and log
+func (c *Controller) APICommand(w http.ResponseWriter, r *http.Request) {
+	cmdID := mux.Vars(r)["id"]
+
+	cmd, ok := getCommand(cmdID)
+	if !ok {
+		filePath := fmt.Sprintf("./logs/%s.out", cmdID)
+		if _, err := os.Stat(filePath); err != nil {
+			api.WriteError(w, r, http.StatusNotFound, fmt.Errorf("cmd not found: %s", cmdID))
+			return
+		}
+		cmd = LoadFile(cmdID + ".out")
+	}
+
+	resp := cmd.API()
+	if cmd.LogFile != "" {
+		fileData, err := ioutil.ReadFile(cmd.LogFile)
+		if err != nil {
+			api.WriteError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		// ?offset= only returns what was written after offset
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		if offset > 0 && offset <= len(fileData) {
+			fileData = fileData[offset:]
+		}
+		resp.Log = string(fileData)
+	}
+	api.WriteJSON(w, http.StatusOK, resp)
+}
+
+// APICommandKill stops a running command
+func (c *Controller) APICommandKill(w http.ResponseWriter, r *http.Request) {
+	cmdID := mux.Vars(r)["id"]
+
+	cmd, ok := getCommand(cmdID)
+	if !ok {
+		api.WriteError(w, r, http.StatusNotFound, fmt.Errorf("cmd not running: %s", cmdID))
+		return
+	}
+	cmd.Close()
+	api.WriteJSON(w, http.StatusOK, cmd.API())
+}
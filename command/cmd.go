@@ -8,6 +8,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
 )
 
 // Command ...
@@ -31,7 +33,8 @@ func NewCommand(cmd string) *Command {
 	// Generate ID: timestamp, so if we runt the exact same command it doesn't conflict
 	now := time.Now()
 	timestamp := strconv.FormatInt(now.UTC().UnixNano(), 10)
-	bs := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s|%s", cmd, timestamp)))
+	// url encoding so the id is safe in paths and file names
+	bs := base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("%s|%s", cmd, timestamp)))
 	id := string(bs)
 
 	c := &Command{
@@ -51,7 +54,11 @@ func LoadFile(filePath string) (cmd *Command) {
 	parts := strings.Split(filePath, ".")
 	ID := parts[0]
 
-	dat, _ := base64.StdEncoding.DecodeString(ID)
+	dat, err := base64.URLEncoding.DecodeString(ID)
+	if err != nil {
+		// older logs used std encoding
+		dat, _ = base64.StdEncoding.DecodeString(ID)
+	}
 	cmdParts := strings.Split(string(dat), "|")
 
 	cmd = &Command{
@@ -67,8 +74,10 @@ func LoadFile(filePath string) (cmd *Command) {
 func (c *Command) Start() {
 	fmt.Println("  start cmd:", c.ID)
 	c.Cmd = exec.Command("bash", "-c", c.CmdString)
+	c.Cmd.Dir = c.Pwd
 
 	// setup file
+	os.MkdirAll("./logs", os.ModePerm)
 	c.LogFile = fmt.Sprintf("./logs/%s.out", c.ID)
 	logHandler, err := os.Create(c.LogFile)
 	c.logHandler = logHandler
@@ -94,6 +103,7 @@ func (c *Command) Start() {
 		panic(err)
 	}
 	c.Cmd.Wait()
+	c.Running = false
 }
 
 // Close ...
@@ -108,3 +118,13 @@ func (c *Command) Close() {
 		c.Cmd.Process.Kill()
 	}
 }
+
+// API returns the json representation, log is left empty
+func (c *Command) API() *api.Command {
+	return &api.Command{
+		ID:        c.ID,
+		Cmd:       c.CmdString,
+		Running:   c.Running,
+		StartTime: c.StartTime,
+	}
+}
@@ -7,13 +7,19 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/jaredwarren/plexupdate/api"
 	"github.com/jaredwarren/plexupdate/app"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/config"
 	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/form"
+	"github.com/jaredwarren/plexupdate/plex"
 )
 
 const (
@@ -40,6 +46,7 @@ var (
 
 // list if running commands
 var runningCommands map[string]*Command
+var runningMu sync.RWMutex
 
 func init() {
 	runningCommands = make(map[string]*Command)
@@ -47,46 +54,96 @@ func init() {
 
 // Controller implements the home resource.
 type Controller struct {
-	Mux *mux.Router
+	Mux  *mux.Router
+	API  *mux.Router
+	Conf *config.Current
+	Plex *plex.Scanner
 }
 
 // Register ...
 func Register(service *app.Service) {
 	uc := &Controller{
-		Mux: service.Mux,
+		Mux:  service.Mux,
+		API:  service.API,
+		Conf: service.Config,
+		Plex: service.Plex,
 	}
 	uc.MountController()
 }
 
 // MountController ...
 func (c *Controller) MountController() {
-	c.Mux.HandleFunc("/cmd", c.CommandList).Methods("GET")
-	c.Mux.HandleFunc("/cmd/{id}", c.Command).Methods("GET")
-	c.Mux.HandleFunc("/cmd/{id}", c.CommandHandler).Methods("POST")
-	c.Mux.HandleFunc("/cmd/ws/{id}", c.CmdWS).Methods("GET")
+	// everything here runs bash, so every route needs the command permission
+	c.Mux.HandleFunc("/cmd", auth.Require(auth.PermCommand, c.CommandList)).Methods("GET")
+	c.Mux.HandleFunc("/cmd/{id}", auth.Require(auth.PermCommand, c.Command)).Methods("GET")
+	c.Mux.HandleFunc("/cmd/{id}", auth.Require(auth.PermCommand, c.CommandHandler)).Methods("POST")
+	c.Mux.HandleFunc("/cmd/ws/{id}", auth.Require(auth.PermCommand, c.CmdWS)).Methods("GET")
+
+	c.API.HandleFunc("/commands", auth.Require(auth.PermCommand, c.APICommandList)).Methods("GET")
+	c.API.HandleFunc("/commands", auth.Require(auth.PermCommand, c.APICommandCreate)).Methods("POST")
+	c.API.HandleFunc("/commands/presets", auth.Require(auth.PermCommand, c.APIPresetList)).Methods("GET")
+	c.API.HandleFunc("/commands/{id}", auth.Require(auth.PermCommand, c.APICommand)).Methods("GET")
+	c.API.HandleFunc("/commands/{id}", auth.Require(auth.PermCommand, c.APICommandKill)).Methods("DELETE")
 }
 
-// CommandList ...
-func (c *Controller) CommandList(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("CommandList", r.URL.String())
+// getCommand returns a running command
+func getCommand(id string) (cmd *Command, ok bool) {
+	runningMu.RLock()
+	cmd, ok = runningCommands[id]
+	runningMu.RUnlock()
+	return
+}
 
-	// TODO: get previous and current commands...
+// addCommand stores a command so ws and api can find it
+func addCommand(cmd *Command) {
+	runningMu.Lock()
+	runningCommands[cmd.ID] = cmd
+	runningMu.Unlock()
+}
+
+// Run starts a command in the background, for other packages, e.g. webhook actions
+func Run(cmdString string) *Command {
+	cmd := NewCommand(cmdString)
+	addCommand(cmd)
+	go cmd.Start()
+	return cmd
+}
+
+// listCommands returns running and finished commands from ./logs
+func listCommands() ([]*Command, error) {
 	files, err := ioutil.ReadDir("./logs")
-	if err != nil {
-		log.Fatal(err)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
 	}
 
 	commands := []*Command{}
 	for _, f := range files {
 		fileName := f.Name()
-		var ok bool
-		cmd, ok := runningCommands[fileName]
+		cmd, ok := getCommand(fileName)
 		if !ok {
 			cmd = LoadFile(fileName)
 		}
-
 		commands = append(commands, cmd)
-		fmt.Println(f.Name())
+	}
+	return commands, nil
+}
+
+// CommandList ...
+func (c *Controller) CommandList(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("CommandList", r.URL.String())
+
+	commands, err := listCommands()
+	if err != nil {
+		api.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if api.WantsJSON(r) {
+		list := []*api.Command{}
+		for _, cmd := range commands {
+			list = append(list, cmd.API())
+		}
+		api.WriteJSON(w, http.StatusOK, list)
+		return
 	}
 
 	// parse every time to make updates easier, and save memory
@@ -114,7 +171,7 @@ func (c *Controller) Command(w http.ResponseWriter, r *http.Request) {
 
 	if cmdID == "new" {
 		// parse every time to make updates easier, and save memory
-		tpl := template.Must(template.New("base").ParseFiles("templates/cmd/command.html", "templates/base.html"))
+		tpl := template.Must(template.New("base").Funcs(template.FuncMap{"CsrfToken": form.TokenFunc(r)}).ParseFiles("templates/cmd/command.html", "templates/base.html"))
 		tpl.ExecuteTemplate(w, "base", &struct {
 			Title string
 		}{
@@ -123,7 +180,7 @@ func (c *Controller) Command(w http.ResponseWriter, r *http.Request) {
 	} else {
 		var cmd *Command
 		var ok bool
-		cmd, ok = runningCommands[cmdID]
+		cmd, ok = getCommand(cmdID)
 		if !ok {
 			filePath := fmt.Sprintf("./logs/%s.out", cmdID)
 			if filesystem.Exists(filePath) {
@@ -185,14 +242,38 @@ func (c *Controller) CommandHandler(w http.ResponseWriter, r *http.Request) {
 
 	// store for later, so ws can find it
 	cmd := NewCommand("ping 192.168.0.111")
-	runningCommands[cmd.ID] = cmd
+	addCommand(cmd)
 
 	// start command now, so
-	go cmd.Start()
+	go c.run(cmd)
 
 	http.Redirect(w, r, "/cmd/"+cmd.ID, http.StatusSeeOther)
 }
 
+// run starts cmd and scans the plex library when a command run in a library
+// folder finishes, the result goes at the end of the log.
+func (c *Controller) run(cmd *Command) {
+	cmd.Start()
+	if cmd.Cmd == nil || cmd.Cmd.ProcessState == nil || !cmd.Cmd.ProcessState.Success() {
+		return
+	}
+	location, ok := c.Plex.Locate(cmd.Pwd)
+	if !ok {
+		return
+	}
+	msg := c.Plex.ScanAndWait(location, cmd.Pwd)
+	if msg == "" {
+		return
+	}
+	f, err := os.OpenFile(cmd.LogFile, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		fmt.Println("  [E]:", err)
+		return
+	}
+	defer f.Close()
+	f.WriteString(msg + "\n")
+}
+
 // TODO: make page to list commands, running and finished
 // TODO: make handler to show command output, running and finished, whthout running again...
 // TODO: fix ws to read the file
@@ -204,9 +285,10 @@ func (c *Controller) CmdWS(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	cmdID := vars["id"]
 
-	cmd, ok := runningCommands[cmdID]
+	cmd, ok := getCommand(cmdID)
 	if !ok {
-		w.Write([]byte("Cmd not found:" + cmdID))
+		api.WriteError(w, r, http.StatusNotFound, fmt.Errorf("cmd not found: %s", cmdID))
+		return
 	}
 
 	// Web socket
@@ -220,7 +302,11 @@ func (c *Controller) CmdWS(w http.ResponseWriter, r *http.Request) {
 
 	done := make(chan bool)
 	go ping(ws, done)
-	go pumpStdIn(ws, cmd)
+	go func() {
+		pumpStdIn(ws, cmd)
+		// client went away, stop watching the log
+		close(done)
+	}()
 
 	pumpStdOut(ws, cmd, done)
 }
@@ -330,6 +416,8 @@ func ping(ws *websocket.Conn, done chan bool) {
 
 // Cleanup kills all running commands
 func Cleanup() {
+	runningMu.RLock()
+	defer runningMu.RUnlock()
 	for _, cmd := range runningCommands {
 		cmd.Close()
 	}
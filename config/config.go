@@ -1,11 +1,652 @@
 package config
 
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/filesystem"
+)
+
+// DefaultRootDir used when no location is given
+const DefaultRootDir = "./uploads"
+
 // Configuration ...
 type Configuration struct {
 	Plex PlexConfiguration
+	// Commands presets, name: bash command
+	Commands  map[string]string
+	Auth      AuthConfiguration
+	Webhooks  WebhooksConfiguration
+	Trash     TrashConfiguration
+	Library   LibraryConfiguration
+	Upload    UploadConfiguration
+	Space     SpaceConfiguration
+	Probe     ProbeConfiguration
+	Transcode TranscodeConfiguration
+	Loudness  LoudnessConfiguration
+	Download  DownloadConfiguration
+	Feeds     FeedsConfiguration
+	Youtube   YoutubeConfiguration
+	Remote    RemoteConfiguration
+	Archive   ArchiveConfiguration
+}
+
+// Current holds the configuration in use. A reload builds a whole new
+// Configuration and swaps it in, so nobody sees one half written.
+type Current struct {
+	v atomic.Value
+}
+
+// NewCurrent starts out with conf
+func NewCurrent(conf *Configuration) *Current {
+	c := &Current{}
+	c.Set(conf)
+	return c
+}
+
+// Get the configuration in use, it's shared and must not be changed
+func (c *Current) Get() *Configuration {
+	return c.v.Load().(*Configuration)
+}
+
+// Set swaps in conf, it mustn't be changed after this
+func (c *Current) Set(conf *Configuration) {
+	c.v.Store(conf)
+}
+
+// Loudness modes
+const (
+	// LoudnessNormalize re-encodes audio to the target loudness, the
+	// original goes to the trash
+	LoudnessNormalize = "normalize"
+	// LoudnessReplayGain only writes ReplayGain tags, the audio isn't touched
+	LoudnessReplayGain = "replaygain"
+)
+
+// Loudness defaults, ReplayGain 2 reference level
+const (
+	DefaultLoudnessTarget   = -18
+	DefaultLoudnessTruePeak = -1
+)
+
+// LoudnessConfiguration evens out the volume of new audio files, measured
+// with ffmpeg's EBU R128 loudnorm filter
+type LoudnessConfiguration struct {
+	// Locations location name: normalize or replaygain
+	Locations map[string]string
+	// Target integrated loudness in LUFS, default -18
+	Target float64
+	// TruePeak ceiling in dBTP, default -1
+	TruePeak float64
+}
+
+// sameKey true if key, from a map in the config, is name. viper lower cases
+// map keys, so they're compared without case.
+func sameKey(key, name string) bool {
+	return strings.EqualFold(key, name)
+}
+
+// Mode for location, empty if its audio is left alone
+func (l LoudnessConfiguration) Mode(location string) string {
+	for name, mode := range l.Locations {
+		if sameKey(name, location) {
+			return strings.ToLower(mode)
+		}
+	}
+	return ""
+}
+
+// Levels the target loudness and true peak, with the defaults filled in
+func (l LoudnessConfiguration) Levels() (float64, float64) {
+	target, peak := l.Target, l.TruePeak
+	if target == 0 {
+		target = DefaultLoudnessTarget
+	}
+	if peak == 0 {
+		peak = DefaultLoudnessTruePeak
+	}
+	return target, peak
+}
+
+// TranscodeConfiguration ffmpeg profiles and the queue that runs them
+type TranscodeConfiguration struct {
+	// Command ffmpeg, or anything that takes the same arguments
+	Command string
+	// Workers how many transcodes run at once, default 1, read at startup
+	Workers int
+	// Profiles name: settings
+	Profiles map[string]TranscodeProfile
+	// Auto location name: profile every new upload and download is queued
+	// with
+	Auto map[string]string
+}
+
+// TranscodeProfile how ffmpeg converts a file
+type TranscodeProfile struct {
+	// VideoCodec e.g. libx264 (the default) or copy
+	VideoCodec string
+	// VideoBitrate e.g. 4M, or CRF for constant quality
+	VideoBitrate string
+	CRF          int
+	// Preset e.g. veryfast
+	Preset string
+	// MaxHeight scales anything taller down, e.g. 1080
+	MaxHeight int
+	// AudioCodec e.g. aac (the default) or copy
+	AudioCodec   string
+	AudioBitrate string
+	// AudioChannels downmixes, e.g. 2 for stereo
+	AudioChannels int
+	// Container mp4 (the default), mkv, m4v, mov or webm
+	Container string
+	// Replace the original, it goes to the trash. Otherwise the new file is
+	// put next to it as "name - Suffix.ext", plex shows it as another version.
+	Replace bool
+	// Suffix for side by side versions, default the profile name
+	Suffix string
+}
+
+// Auto profile name for new files in location, empty for none
+func (t TranscodeConfiguration) AutoProfile(location string) string {
+	for name, profile := range t.Auto {
+		if sameKey(name, location) {
+			return profile
+		}
+	}
+	return ""
+}
+
+// Names of the profiles, sorted
+func (t TranscodeConfiguration) Names() []string {
+	names := make([]string, 0, len(t.Profiles))
+	for name := range t.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Profile by name
+func (t TranscodeConfiguration) Profile(name string) (TranscodeProfile, bool) {
+	for n, p := range t.Profiles {
+		if sameKey(n, name) {
+			return p, true
+		}
+	}
+	return TranscodeProfile{}, false
+}
+
+// ProbeConfiguration uploaded and downloaded files are checked with ffprobe,
+// ones that aren't media, or not a type the location takes, are refused
+type ProbeConfiguration struct {
+	// Disabled lets anything in
+	Disabled bool
+	// Command ffprobe, or anything that prints the same json
+	Command string
+	// Quarantine moves refused files to the trash instead of deleting them
+	Quarantine bool
+	// Types location name: media types it takes, video, audio, subtitle or
+	// image. Locations that aren't listed take any media.
+	Types map[string][]string
+}
+
+// Allowed media types for location, nil for any
+func (p ProbeConfiguration) Allowed(location string) []string {
+	for name, types := range p.Types {
+		if sameKey(name, location) {
+			return types
+		}
+	}
+	return nil
+}
+
+// DefaultUploadBatchFiles most files in one batch upload when
+// upload.batchmaxfiles isn't set
+const DefaultUploadBatchFiles = 1000
+
+// UploadConfiguration limits on uploads
+type UploadConfiguration struct {
+	// BatchMaxSize all the files of one batch upload together, e.g. 20GB,
+	// empty is only limited by the disk
+	BatchMaxSize string
+	// BatchMaxFiles in one batch upload, default 1000
+	BatchMaxFiles int
+}
+
+// BatchLimits BatchMaxSize in bytes, 0 is no limit, and BatchMaxFiles with
+// its default
+func (u UploadConfiguration) BatchLimits() (int64, int, error) {
+	maxFiles := u.BatchMaxFiles
+	if maxFiles <= 0 {
+		maxFiles = DefaultUploadBatchFiles
+	}
+	if u.BatchMaxSize == "" {
+		return 0, maxFiles, nil
+	}
+	maxSize, err := ParseSize(u.BatchMaxSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("upload.batchmaxsize: %w", err)
+	}
+	return maxSize, maxFiles, nil
+}
+
+// SpaceConfiguration free space and quotas, uploads and downloads that won't
+// fit are refused
+type SpaceConfiguration struct {
+	// Margin always left free on every disk, e.g. 1GB (the default)
+	Margin string
+	// Quotas location name: the most it may hold, e.g. 500GB
+	Quotas map[string]string
+}
+
+// DefaultSpaceMargin left free on every disk when Margin isn't set
+const DefaultSpaceMargin = 1 << 30
+
+// Limits the margin and the location's quota in bytes, 0 is no quota
+func (s SpaceConfiguration) Limits(location string) (int64, int64, error) {
+	margin := int64(DefaultSpaceMargin)
+	if s.Margin != "" {
+		var err error
+		if margin, err = ParseSize(s.Margin); err != nil {
+			return 0, 0, fmt.Errorf("space.margin: %w", err)
+		}
+	}
+	for name, q := range s.Quotas {
+		if !sameKey(name, location) || q == "" {
+			continue
+		}
+		quota, err := ParseSize(q)
+		if err != nil {
+			return 0, 0, fmt.Errorf("space.quotas.%s: %w", name, err)
+		}
+		return margin, quota, nil
+	}
+	return margin, 0, nil
+}
+
+// Download defaults
+const (
+	DefaultDownloadWorkers    = 2
+	DefaultDownloadSegments   = 4
+	DefaultDownloadMinSegment = 8 << 20
+	DefaultDownloadRetries    = 5
+	DefaultDownloadRedirects  = 10
+)
+
+// DownloadConfiguration direct url downloads, big files are fetched in
+// segments with range requests
+type DownloadConfiguration struct {
+	// Workers downloads that run at once, default 2, the rest are queued
+	Workers int
+	// Segments parallel requests per download, default 4
+	Segments int
+	// MinSegment the smallest part worth its own request, default 8MB
+	MinSegment string
+	// RateLimit per download, e.g. 2MB is 2MB a second. Empty is no limit
+	RateLimit string
+	// Retries after a dropped connection, each picks up where it stopped,
+	// default 5
+	Retries int
+	// MaxRedirects default 10
+	MaxRedirects int
+	// UserAgent sent with every request
+	UserAgent string
+}
+
+// Limits MinSegment with its default, and RateLimit in bytes a second, 0 is
+// no limit
+func (d DownloadConfiguration) Limits() (int64, int64, error) {
+	minSegment := int64(DefaultDownloadMinSegment)
+	if d.MinSegment != "" {
+		var err error
+		if minSegment, err = ParseSize(d.MinSegment); err != nil {
+			return 0, 0, fmt.Errorf("download.minsegment: %w", err)
+		}
+	}
+	if d.RateLimit == "" {
+		return minSegment, 0, nil
+	}
+	rate, err := ParseSize(d.RateLimit)
+	if err != nil {
+		return 0, 0, fmt.Errorf("download.ratelimit: %w", err)
+	}
+	return minSegment, rate, nil
+}
+
+// Remote server types
+const (
+	RemoteSFTP   = "sftp"
+	RemoteWebDAV = "webdav"
+	// RemoteHTTP a web server's directory listing, e.g. nginx autoindex
+	RemoteHTTP = "http"
+)
+
+// Remote import defaults
+const (
+	DefaultRemoteWorkers = 2
+	DefaultRemoteRetries = 5
+)
+
+// RemoteConfiguration file servers media can be imported from
+type RemoteConfiguration struct {
+	// Workers imports that run at once, default 2, the rest are queued
+	Workers int
+	// Retries after a dropped connection, each picks up where it stopped,
+	// default 5
+	Retries int
+	// Servers name: server
+	Servers map[string]RemoteServer
+}
+
+// RemoteServer a file server, and how to log in to it
+type RemoteServer struct {
+	// Type sftp, webdav or http. Default from the url, sftp:// is sftp and
+	// http(s):// a directory listing
+	Type string
+	// URL of the folder that's shown, e.g. sftp://seedbox.example.com/home/me/done
+	URL      string
+	User     string
+	Password string
+	// KeyFile a private key for sftp, instead of or as well as the password
+	KeyFile string
+	// HostKey the sftp server's key fingerprint as ssh-keygen -l shows it,
+	// SHA256:...
+	HostKey string
+	// KnownHosts a known_hosts file the sftp server's key is checked
+	// against, if HostKey isn't set. One of them has to be.
+	KnownHosts string
+}
+
+// Server the remote server with name, with its type filled in
+func (r RemoteConfiguration) Server(name string) (RemoteServer, bool) {
+	for key, s := range r.Servers {
+		if sameKey(key, name) {
+			if s.Type == "" {
+				s.Type = RemoteHTTP
+				if strings.HasPrefix(strings.ToLower(s.URL), "sftp://") {
+					s.Type = RemoteSFTP
+				}
+			}
+			return s, true
+		}
+	}
+	return RemoteServer{}, false
+}
+
+// Names of the remote servers, sorted
+func (r RemoteConfiguration) Names() []string {
+	names := make([]string, 0, len(r.Servers))
+	for name := range r.Servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Archive defaults
+const (
+	DefaultArchiveCommand  = "bsdtar"
+	DefaultArchiveRatio    = 10
+	DefaultArchiveMaxFiles = 5000
+)
+
+// ArchiveConfiguration unpacking uploaded and downloaded archives
+type ArchiveConfiguration struct {
+	// Command that reads rar, 7z and xz archives, default bsdtar. It's run
+	// as command -cf - --format pax @archive to turn them into a tar.
+	Command string
+	// Extensions of the files kept, default video, audio and subtitles
+	Extensions []string
+	// MaxSize unpacked, e.g. 100GB, empty is only limited by the disk
+	MaxSize string
+	// MaxRatio unpacked size over the archive's size, default 10
+	MaxRatio int
+	// MaxFiles in one archive, default 5000
+	MaxFiles int
+}
+
+// Feed defaults
+const (
+	DefaultFeedsFile     = "./feeds.json"
+	DefaultFeedsInterval = time.Hour
+	DefaultFeedsKeep     = 10
+)
+
+// FeedsConfiguration podcast and video feed subscriptions, new episodes are
+// downloaded as they come out
+type FeedsConfiguration struct {
+	// File where subscriptions and the episodes fetched are kept, default
+	// ./feeds.json
+	File string
+	// Interval between checks of every feed, default 1h
+	Interval time.Duration
+	// Location episodes go to when a subscription doesn't say
+	Location string
+	// Keep the newest episodes of a feed, older ones go to the trash.
+	// Default 10, a subscription can change it.
+	Keep int
+}
+
+// Youtube subscription defaults
+const (
+	DefaultSubscriptionsFile = "./subscriptions.json"
+	DefaultYoutubeInterval   = time.Hour
+)
+
+// YoutubeConfiguration channel and playlist subscriptions, new videos are
+// downloaded as they come out
+type YoutubeConfiguration struct {
+	// SubscriptionsFile where subscriptions and the videos seen are kept,
+	// default ./subscriptions.json
+	SubscriptionsFile string
+	// Interval between checks of every subscription, default 1h
+	Interval time.Duration
+}
+
+// LibraryConfiguration ...
+type LibraryConfiguration struct {
+	// IndexFile where file hashes for duplicate detection are kept, default ./library_index.json
+	IndexFile string
+	// IndexInterval how often every location is re-indexed, default 6h
+	IndexInterval time.Duration
+}
+
+// DefaultTrashMaxAge how long deleted files are kept when MaxAge isn't set
+const DefaultTrashMaxAge = 30 * 24 * time.Hour
+
+// TrashConfiguration deleted and overwritten files are moved to .trash in
+// their location, and purged after a while
+type TrashConfiguration struct {
+	// Disabled deletes files right away
+	Disabled bool
+	// MaxAge how long files are kept, default 30 days
+	MaxAge time.Duration
+	// MaxSize per location, e.g. 50GB, the oldest files go first. Empty is no limit
+	MaxSize string
+}
+
+// Limits MaxAge with its default, and MaxSize in bytes, 0 is no limit
+func (t TrashConfiguration) Limits() (time.Duration, int64, error) {
+	maxAge := t.MaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultTrashMaxAge
+	}
+	if t.MaxSize == "" {
+		return maxAge, 0, nil
+	}
+	maxSize, err := ParseSize(t.MaxSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("trash.maxsize: %w", err)
+	}
+	return maxAge, maxSize, nil
+}
+
+// WebhooksConfiguration for plex webhooks, point plex at
+// http://this-server/webhooks/plex?secret=SECRET
+type WebhooksConfiguration struct {
+	// Secret required in the url, webhooks are off when empty
+	Secret string
+	// Actions run for matching events, in order
+	Actions []WebhookAction
+}
+
+// WebhookAction what to do when an event comes in
+type WebhookAction struct {
+	// Event e.g. library.new, media.* or * for all of them
+	Event string
+	// Broadcast shows the event in every open browser
+	Broadcast bool
+	// Command preset name to run
+	Command string
+	// Notify url the event is posted to as json
+	Notify string
+}
+
+// AuthConfiguration ...
+type AuthConfiguration struct {
+	// UsersFile json file with accounts and api token hashes, default ./users.json
+	UsersFile string
+	// SessionTTL how long a login lasts, default 7 days
+	SessionTTL time.Duration
+	// Roles name: what members can do, users get roles with `plexupdate user roles`
+	Roles map[string]RoleConfiguration
+}
+
+// RoleConfiguration ...
+type RoleConfiguration struct {
+	// Permissions upload, download, command, library, manage or * for everything
+	Permissions []string
+	// Locations names from plex.locations, or * for all of them
+	Locations []string
 }
 
 // PlexConfiguration ...
 type PlexConfiguration struct {
+	// URL of the plex server, e.g. http://localhost:32400, empty turns off library scans
+	URL string
+	// Token X-Plex-Token, see "Finding an authentication token" in the plex docs
+	Token string
+	// Sections location name: plex library section id, only needed when plex
+	// can't be matched by folder
+	Sections map[string]string
+	// Discover adds a location for every folder of every plex library,
+	// locations set here win
+	Discover bool
+	// Symlinks in locations: inside (default) follows links that stay in the
+	// location, deny rejects every link, follow follows them anywhere
+	Symlinks string
+	// PathMap when plex sees different paths than this server, e.g. plex runs in docker
+	PathMap []PathMapping
+	// Locations name: folder
 	Locations map[string]string
 }
+
+// PathMapping the same folder as plex and this server see it
+type PathMapping struct {
+	Plex  string
+	Local string
+}
+
+// RootDir returns the folder for a location name, empty name falls back to DefaultRootDir
+func (p PlexConfiguration) RootDir(location string) (string, error) {
+	if location == "" {
+		return DefaultRootDir, nil
+	}
+	rootDir, ok := p.Locations[location]
+	if !ok || rootDir == "" {
+		return "", fmt.Errorf("unknown location: %q", location)
+	}
+	return rootDir, nil
+}
+
+// AllLocations every location's folder by name, and "" for DefaultRootDir,
+// where uploads without a location go
+func (p PlexConfiguration) AllLocations() map[string]string {
+	all := map[string]string{"": DefaultRootDir}
+	for name, rootDir := range p.Locations {
+		if rootDir != "" {
+			all[name] = rootDir
+		}
+	}
+	return all
+}
+
+// Sandbox confines user paths to a location's folder
+func (p PlexConfiguration) Sandbox(location string) (*filesystem.Sandbox, error) {
+	rootDir, err := p.RootDir(location)
+	if err != nil {
+		return nil, err
+	}
+	return filesystem.NewSandbox(rootDir, filesystem.SymlinkPolicy(p.Symlinks))
+}
+
+// ToLocal turns a path from plex into one this server can open
+func (p PlexConfiguration) ToLocal(plexPath string) string {
+	for _, m := range p.PathMap {
+		if rest, ok := trimDir(plexPath, m.Plex); ok {
+			return joinDir(m.Local, rest)
+		}
+	}
+	return plexPath
+}
+
+// ToPlex turns a local path into the one plex sees
+func (p PlexConfiguration) ToPlex(localPath string) string {
+	for _, m := range p.PathMap {
+		if rest, ok := trimDir(localPath, m.Local); ok {
+			return joinDir(m.Plex, rest)
+		}
+	}
+	return localPath
+}
+
+// trimDir returns what's left of p after dir, with / separators. Either side
+// can use \ since plex and this server may not run on the same os.
+func trimDir(p, dir string) (string, bool) {
+	p = strings.Replace(p, "\\", "/", -1)
+	dir = strings.TrimRight(strings.Replace(dir, "\\", "/", -1), "/")
+	if dir == "" || (p != dir && !strings.HasPrefix(p, dir+"/")) {
+		return "", false
+	}
+	return strings.TrimPrefix(p, dir), true
+}
+
+// joinDir adds rest to dir using dir's separator
+func joinDir(dir, rest string) string {
+	dir = strings.TrimRight(dir, "/\\")
+	if strings.Contains(dir, "\\") {
+		rest = strings.Replace(rest, "/", "\\", -1)
+	}
+	return dir + rest
+}
+
+// sizeUnits powers of 1024, like api.FormatBytes
+var sizeUnits = map[string]int64{
+	"":   1,
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+// ParseSize reads sizes like 500MB, 1.5GB or 1024
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := sizeUnits[strings.TrimSpace(s[i:])]
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if !ok || err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return int64(n * float64(unit)), nil
+}
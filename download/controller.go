@@ -0,0 +1,162 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/app"
+	"github.com/jaredwarren/plexupdate/archive"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/form"
+	"github.com/jaredwarren/plexupdate/jobs"
+	"github.com/jaredwarren/plexupdate/probe"
+	"github.com/jaredwarren/plexupdate/transcode"
+)
+
+// Controller downloads files from direct links.
+type Controller struct {
+	mux  *mux.Router
+	api  *mux.Router
+	conf *config.Current
+}
+
+// Register sets up the downloader and the routes
+func Register(service *app.Service) {
+	workers := service.Config.Get().Download.Workers
+	if workers <= 0 {
+		workers = config.DefaultDownloadWorkers
+	}
+	downloader = &Downloader{
+		conf:  service.Config,
+		jobs:  service.Jobs.NewQueue(workers),
+		plex:  service.Plex,
+		index: service.Index,
+	}
+	c := &Controller{
+		mux:  service.Mux,
+		api:  service.API,
+		conf: service.Config,
+	}
+	c.MountController()
+}
+
+// MountController ...
+func (c *Controller) MountController() {
+	c.mux.HandleFunc("/download", c.Download).Methods("GET")
+	c.mux.HandleFunc("/download", c.DownloadHandler).Methods("POST")
+
+	c.api.HandleFunc("/download", c.DownloadHandler).Methods("POST")
+}
+
+// writeError picks the status from err
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	api.WriteError(w, r, Status(err), err)
+}
+
+// Status 400 for a bad request, 403 for a path outside the location, 502
+// when the server won't hand over the file, and what archive, probe and
+// space say about the rest
+func Status(err error) int {
+	var se *statusError
+	switch {
+	case errors.Is(err, ErrURL), errors.Is(err, ErrChecksum), errors.Is(err, ErrRateLimit),
+		errors.Is(err, transcode.ErrUnknownProfile), errors.Is(err, filesystem.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, filesystem.ErrEscape), errors.Is(err, filesystem.ErrSymlink):
+		return http.StatusForbidden
+	case errors.Is(err, ErrBusy):
+		return http.StatusConflict
+	case errors.Is(err, ErrMismatch), errors.Is(err, probe.ErrInvalid):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, probe.ErrNotAllowed):
+		return http.StatusUnsupportedMediaType
+	case errors.As(err, &se), errors.Is(err, ErrChanged), errors.Is(err, ErrRedirect):
+		return http.StatusBadGateway
+	case os.IsNotExist(err):
+		return http.StatusNotFound
+	}
+	return archive.Status(err)
+}
+
+// Download shows the form
+func (c *Controller) Download(w http.ResponseWriter, r *http.Request) {
+	if !auth.Permissions(r)[auth.PermDownload] {
+		auth.Check(w, r, auth.PermDownload, "")
+		return
+	}
+
+	// parse every time to make updates easier, and save memory
+	templates := template.Must(template.New("base").Funcs(template.FuncMap{"CsrfToken": form.TokenFunc(r)}).ParseFiles("templates/download.html", "templates/base.html"))
+	templates.ExecuteTemplate(w, "base", &struct {
+		Title     string
+		Locations map[string]string
+		Profiles  []string
+	}{
+		Title:     "Download",
+		Locations: auth.Locations(r, auth.PermDownload, c.conf.Get().Plex.Locations),
+		Profiles:  c.conf.Get().Transcode.Names(),
+	})
+}
+
+// DownloadHandler starts a download job. Json clients get the job back right
+// away, the html form waits for the download to finish.
+func (c *Controller) DownloadHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("DownloadHandler:", r.URL.String())
+
+	req := &api.DownloadRequest{}
+	if api.IsJSON(r) {
+		if err := api.ReadJSON(r, req); err != nil {
+			api.WriteError(w, r, http.StatusBadRequest, err)
+			return
+		}
+	} else {
+		r.ParseForm()
+		req.URL = r.PostForm.Get("url")
+		req.Location = r.PostForm.Get("location")
+		req.Path = r.PostForm.Get("path")
+		req.Name = r.PostForm.Get("name")
+		req.Checksum = r.PostForm.Get("checksum")
+		req.RateLimit = r.PostForm.Get("rate_limit")
+		req.Transcode = r.PostForm.Get("transcode")
+		req.Extract = r.PostForm.Get("extract") == "on"
+		req.Flatten = r.PostForm.Get("flatten") == "on"
+	}
+	if req.URL == "" {
+		api.WriteError(w, r, http.StatusBadRequest, errors.New("missing url"))
+		return
+	}
+	if _, ok := c.conf.Get().Plex.Locations[req.Location]; !ok {
+		api.WriteError(w, r, http.StatusBadRequest, fmt.Errorf("unknown location: %q", req.Location))
+		return
+	}
+	if !auth.Check(w, r, auth.PermDownload, req.Location) {
+		return
+	}
+
+	job, err := Start(req, auth.Username(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if api.WantsJSON(r) {
+		w.Header().Set("Location", api.Prefix+"/jobs/"+job.ID)
+		api.WriteJSON(w, http.StatusAccepted, api.NewJob(job))
+		return
+	}
+
+	job.Wait()
+	s := job.Snapshot()
+	if s.Status != jobs.Done {
+		api.WriteError(w, r, http.StatusInternalServerError, fmt.Errorf("%s %s", s.Status, s.Error))
+		return
+	}
+	w.Write([]byte("Success:" + s.Result))
+}
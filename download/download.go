@@ -0,0 +1,477 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/archive"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/duplicates"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/jobs"
+	"github.com/jaredwarren/plexupdate/place"
+	"github.com/jaredwarren/plexupdate/plex"
+	"github.com/jaredwarren/plexupdate/space"
+	"github.com/jaredwarren/plexupdate/transcode"
+	"github.com/jaredwarren/plexupdate/trash"
+)
+
+// JobType of direct url downloads
+const JobType = "download"
+
+// partExt the file is written to a hidden .part file until it's done, and
+// what's been fetched so far to .part.json
+const (
+	partExt  = ".part"
+	stateExt = ".json"
+)
+
+var (
+	// ErrURL only http and https urls can be downloaded
+	ErrURL = errors.New("not an http or https url")
+	// ErrChecksum the checksum isn't algorithm:hex, or is for an algorithm
+	// we don't have
+	ErrChecksum = errors.New("invalid checksum")
+	// ErrMismatch the downloaded file doesn't match its checksum
+	ErrMismatch = errors.New("checksum doesn't match")
+	// ErrRateLimit the rate limit isn't a size
+	ErrRateLimit = errors.New("invalid rate limit")
+	// ErrBusy another download is writing the same file
+	ErrBusy = errors.New("already downloading that file")
+)
+
+// hashes checksum algorithms by name
+var hashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// extensions for a file whose url doesn't have one, by content type
+var extensions = map[string]string{
+	"video/mp4":            ".mp4",
+	"video/x-matroska":     ".mkv",
+	"video/webm":           ".webm",
+	"video/quicktime":      ".mov",
+	"video/x-msvideo":      ".avi",
+	"audio/mpeg":           ".mp3",
+	"audio/mp4":            ".m4a",
+	"audio/x-m4a":          ".m4a",
+	"audio/aac":            ".aac",
+	"audio/flac":           ".flac",
+	"audio/ogg":            ".ogg",
+	"audio/opus":           ".opus",
+	"audio/wav":            ".wav",
+	"audio/x-wav":          ".wav",
+	"application/x-subrip": ".srt",
+}
+
+// downloader set up by Register
+var downloader *Downloader
+
+// Downloader fetches urls into locations, download.workers at once
+type Downloader struct {
+	conf  *config.Current
+	jobs  *jobs.Queue
+	plex  *plex.Scanner
+	index *duplicates.Index
+}
+
+// Start queues req for user
+func Start(req *api.DownloadRequest, user string) (*jobs.Job, error) {
+	if downloader == nil {
+		return nil, errors.New("downloads aren't set up")
+	}
+	return downloader.Start(req, user)
+}
+
+// Fetch downloads req right away in the caller's job, for feeds and
+// subscriptions that tag and scan the file themselves. It returns the
+// file's path in the location.
+func Fetch(ctx context.Context, req *api.DownloadRequest, user string) (string, error) {
+	relPath, _, err := FetchJob(ctx, nil, req, user, nil)
+	return relPath, err
+}
+
+// Check looks at a fetched file before it's put in place, e.g. for
+// duplicates. It may change where pt goes or set its Before, or return
+// false to drop the file.
+type Check func(pt *place.Part) (bool, error)
+
+// FetchJob is Fetch with progress reported to j, for uploads from a url.
+// It returns the file's path, "" if check dropped it, and what came out of
+// it if it was an archive that was unpacked. j and check may be nil.
+func FetchJob(ctx context.Context, j *jobs.Job, req *api.DownloadRequest, user string, check Check) (string, *archive.Result, error) {
+	if downloader == nil {
+		return "", nil, errors.New("downloads aren't set up")
+	}
+	p, err := downloader.prepare(req)
+	if err != nil {
+		return "", nil, err
+	}
+	p.check = check
+	files, _, err := downloader.fetch(ctx, j, p, user)
+	if err != nil {
+		return "", nil, err
+	}
+	if p.unpacked != nil {
+		return p.dir, p.unpacked, nil
+	}
+	if len(files) == 0 {
+		return "", nil, nil
+	}
+	return files[0], nil, nil
+}
+
+// plan a checked request
+type plan struct {
+	url      string
+	location string
+	sandbox  *filesystem.Sandbox
+	dir      string
+	name     string
+	rate     int64
+	newHash  func() hash.Hash
+	want     []byte
+	profile  string
+	extract  bool
+	flatten  bool
+	// unpacked what came out of the archive, once it's been extracted
+	unpacked *archive.Result
+	// check, if set, runs before the file is put in place
+	check Check
+}
+
+// prepare checks req
+func (d *Downloader) prepare(req *api.DownloadRequest) (*plan, error) {
+	u, err := url.Parse(strings.TrimSpace(req.URL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: %q", ErrURL, req.URL)
+	}
+	p := &plan{url: u.String(), location: req.Location, name: req.Name, extract: req.Extract, flatten: req.Flatten}
+	if p.newHash, p.want, err = parseChecksum(req.Checksum); err != nil {
+		return nil, err
+	}
+	if p.rate, err = d.rate(req.RateLimit); err != nil {
+		return nil, err
+	}
+	if p.sandbox, err = d.conf.Get().Plex.Sandbox(req.Location); err != nil {
+		return nil, err
+	}
+	if p.dir, err = filesystem.Clean(req.Path); err != nil {
+		return nil, err
+	}
+	if trash.Contains(p.dir) {
+		return nil, fmt.Errorf("%s: %w", p.dir, filesystem.ErrEscape)
+	}
+	if _, err := p.sandbox.Resolve(p.dir); err != nil {
+		return nil, err
+	}
+	p.profile = transcode.ProfileFor(d.conf.Get(), req.Location, req.Transcode)
+	if _, ok := d.conf.Get().Transcode.Profile(p.profile); p.profile != "" && !ok {
+		return nil, fmt.Errorf("%w: %q", transcode.ErrUnknownProfile, p.profile)
+	}
+	if err := space.Check(d.conf.Get(), req.Location, 0); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Start checks req and queues it
+func (d *Downloader) Start(req *api.DownloadRequest, user string) (*jobs.Job, error) {
+	p, err := d.prepare(req)
+	if err != nil {
+		return nil, err
+	}
+
+	j := d.jobs.Start(JobType, user, req.Location, func(ctx context.Context, j *jobs.Job) (string, error) {
+		files, note, err := d.fetch(ctx, j, p, user)
+		if err != nil {
+			return note, err
+		}
+		result := strings.Join(files, "\n") + note
+		for _, relPath := range files {
+			if _, _, notes := place.Jobs(p.location, relPath, p.profile, user); len(notes) > 0 {
+				result += "\n" + strings.Join(notes, "\n")
+			}
+		}
+		dir, _ := p.sandbox.Resolve(p.dir)
+		if msg := d.plex.ScanAndWait(p.location, dir); msg != "" {
+			result += "\n" + msg
+		}
+		return result, nil
+	})
+	fmt.Println("  download", redact(p.url), "to", p.location, p.dir, "job", j.ID)
+	return j, nil
+}
+
+// rate a download may use a second, the lower of download.ratelimit and
+// requested, 0 is no limit
+func (d *Downloader) rate(requested string) (int64, error) {
+	_, rate, err := d.conf.Get().Download.Limits()
+	if err != nil || requested == "" {
+		return rate, err
+	}
+	r, err := config.ParseSize(requested)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrRateLimit, requested)
+	}
+	if rate == 0 || (r > 0 && r < rate) {
+		rate = r
+	}
+	return rate, nil
+}
+
+// fetch downloads p and puts it in place. It returns the file's path in
+// the location, or the files extracted from it, and a note on how it went.
+// j is nil for Fetch.
+func (d *Downloader) fetch(ctx context.Context, j *jobs.Job, p *plan, user string) ([]string, string, error) {
+	rawURL, location, sandbox, dir, name := p.url, p.location, p.sandbox, p.dir, p.name
+	conf := d.conf.Get().Download
+	minSegment, _, err := conf.Limits()
+	if err != nil {
+		return nil, "", err
+	}
+	segments, retries, redirects := conf.Segments, conf.Retries, conf.MaxRedirects
+	if segments <= 0 {
+		segments = config.DefaultDownloadSegments
+	}
+	if retries <= 0 {
+		retries = config.DefaultDownloadRetries
+	}
+	if redirects <= 0 {
+		redirects = config.DefaultDownloadRedirects
+	}
+	t := &transfer{
+		client:    newClient(redirects),
+		userAgent: conf.UserAgent,
+		limiter:   &limiter{rate: p.rate},
+		retries:   retries,
+	}
+
+	r, err := t.head(ctx, rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if name == "" {
+		name = remoteName(r)
+	}
+	name, err = filesystem.NormalizeFilename(name)
+	if err != nil {
+		return nil, "", err
+	}
+	file, err := sandbox.Join(dir, name)
+	if err != nil {
+		return nil, "", err
+	}
+	relPath := path.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return nil, "", err
+	}
+	part := filepath.Join(filepath.Dir(file), "."+name+partExt)
+	stateFile := part + stateExt
+	if !place.Claim(part) {
+		return nil, "", fmt.Errorf("%s: %w", relPath, ErrBusy)
+	}
+	defer place.Release(part)
+
+	note := ""
+	if r.length > 0 && r.ranges {
+		st := loadState(stateFile)
+		if st == nil || !st.matches(rawURL, r) {
+			st = newState(rawURL, r, segments, minSegment)
+			os.Remove(part)
+		} else if done := st.written(); done > 0 {
+			note = fmt.Sprintf("\nresumed at %s of %s", api.FormatBytes(done), api.FormatBytes(st.Length))
+		}
+		// the segments write in place, what's left is set aside up front
+		held, err := space.Reserve(d.conf.Get(), location, st.Length-st.written())
+		if err != nil {
+			return nil, "", err
+		}
+		f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			held.Release()
+			return nil, "", err
+		}
+		if err = f.Truncate(st.Length); err == nil {
+			err = t.segments(ctx, j, r, st, f, stateFile)
+		}
+		f.Close()
+		held.Release()
+		space.Forget(location)
+		if err != nil {
+			// a dropped connection or a cancel can pick up where it stopped
+			if retryable(err) {
+				return nil, "the next download of this url picks up where it stopped", err
+			}
+			os.Remove(part)
+			os.Remove(stateFile)
+			return nil, "", err
+		}
+		// an archive that isn't unpacked yet is picked up from here
+		if !(p.extract && archive.Is(name)) {
+			os.Remove(stateFile)
+		}
+	} else {
+		f, err := os.Create(part)
+		if err != nil {
+			return nil, "", err
+		}
+		w, err := space.Writer(d.conf.Get(), location, r.length, f)
+		if err == nil {
+			err = t.stream(ctx, j, r, w, func() error {
+				if err := f.Truncate(0); err != nil {
+					return err
+				}
+				_, err := f.Seek(0, io.SeekStart)
+				return err
+			})
+			w.Release()
+		}
+		f.Close()
+		if err != nil {
+			os.Remove(part)
+			return nil, "", err
+		}
+	}
+
+	if p.newHash != nil {
+		if err := verify(part, p.newHash, p.want); err != nil {
+			os.Remove(part)
+			os.Remove(stateFile)
+			return nil, "", err
+		}
+		note += "\nchecksum ok"
+	}
+	if p.extract && archive.Is(name) {
+		// the archive is deleted once it's unpacked, kept if it can be
+		// tried again
+		res, err := archive.Extract(ctx, location, part, name, dir, p.flatten, user)
+		if err == nil || archive.Refused(err) {
+			os.Remove(stateFile)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if len(res.Ignored) > 0 {
+			note += "\nleft out of the archive:\n" + strings.Join(res.Ignored, "\n")
+		}
+		p.unpacked = res
+		return res.Files, note, nil
+	}
+	pt := place.Part{
+		Location: location,
+		Sandbox:  sandbox,
+		File:     part,
+		RelPath:  relPath,
+		User:     user,
+	}
+	if p.check != nil {
+		keep, err := p.check(&pt)
+		if err != nil || !keep {
+			os.Remove(part)
+			return nil, note, err
+		}
+	}
+	if _, err = place.File(d.conf.Get(), d.index, pt); err != nil {
+		return nil, "", err
+	}
+	return []string{pt.RelPath}, note, nil
+}
+
+// redact the password in a url for the log
+func redact(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+// remoteName the file name the server gives, from Content-Disposition or
+// the url, with an extension for its content type if it has none
+func remoteName(r *remote) string {
+	if _, params, err := mime.ParseMediaType(r.disposition); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	name := ""
+	if u, err := url.Parse(r.url); err == nil {
+		name = path.Base(u.Path)
+	}
+	if name == "" || name == "." || name == "/" {
+		name = "download"
+	}
+	if path.Ext(name) == "" {
+		ct, _, _ := mime.ParseMediaType(r.contentType)
+		if ext, ok := extensions[ct]; ok {
+			name += ext
+		} else if exts, _ := mime.ExtensionsByType(ct); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	return name
+}
+
+// parseChecksum "sha256:<hex>", a bare hex sum is picked by its length.
+// It returns nil if s is empty.
+func parseChecksum(s string) (func() hash.Hash, []byte, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil, nil
+	}
+	algo, sum := "", s
+	if i := strings.Index(s, ":"); i >= 0 {
+		algo, sum = strings.ToLower(strings.Replace(s[:i], "-", "", -1)), s[i+1:]
+	}
+	want, err := hex.DecodeString(strings.ToLower(sum))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %q", ErrChecksum, s)
+	}
+	if algo == "" {
+		for name, newHash := range hashes {
+			if newHash().Size() == len(want) {
+				algo = name
+			}
+		}
+	}
+	newHash, ok := hashes[algo]
+	if !ok || newHash().Size() != len(want) {
+		return nil, nil, fmt.Errorf("%w: %q", ErrChecksum, s)
+	}
+	return newHash, want, nil
+}
+
+// verify file's checksum
+func verify(file string, newHash func() hash.Hash, want []byte) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, want) {
+		return fmt.Errorf("%w: got %x", ErrMismatch, got)
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/duplicates"
+	"github.com/jaredwarren/plexupdate/probe"
+)
+
+// fileServer serves content with ranges and an etag, like most servers do
+type fileServer struct {
+	sync.Mutex
+	content []byte
+	etag    string
+	// noRanges answers every request with the whole file
+	noRanges bool
+	// ranges the Range header of every request, "" for none
+	ranges []string
+	// onRequest, if set, runs before the nth request is answered, e.g.
+	// to change the file
+	onRequest func(n int)
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	if s.onRequest != nil {
+		s.onRequest(len(s.ranges))
+	}
+	content, etag, noRanges := s.content, s.etag, s.noRanges
+	s.Unlock()
+	if noRanges {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+// fetched the ranges asked for after the first request, sorted since
+// segments run at once
+func (s *fileServer) fetched() []string {
+	s.Lock()
+	defer s.Unlock()
+	got := append([]string{}, s.ranges[1:]...)
+	sort.Strings(got)
+	return got
+}
+
+// testContent 64KB that's the same every run
+func testContent() []byte {
+	b := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}
+
+// newDownloader for a location movies in a temp folder, with segments of
+// at least 1KB. ffprobe is left out, .mkv passes by its name.
+func newDownloader(t *testing.T, segments int) (*Downloader, string) {
+	t.Helper()
+	old := probe.Run
+	probe.Run = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		return nil, exec.ErrNotFound
+	}
+	t.Cleanup(func() { probe.Run = old })
+
+	root := t.TempDir()
+	conf := &config.Configuration{}
+	conf.Plex.Locations = map[string]string{"movies": root}
+	conf.Library.IndexFile = filepath.Join(t.TempDir(), "index.json")
+	conf.Download.Segments = segments
+	conf.Download.MinSegment = "1KB"
+	cur := config.NewCurrent(conf)
+	return &Downloader{conf: cur, index: duplicates.NewIndex(cur, nil)}, root
+}
+
+// fetchURL downloads url to movie.mkv in the root
+func fetchURL(t *testing.T, d *Downloader, url, checksum string) ([]string, string, error) {
+	t.Helper()
+	p, err := d.prepare(&api.DownloadRequest{URL: url, Location: "movies", Name: "movie.mkv", Checksum: checksum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.fetch(context.Background(), nil, p, "tester")
+}
+
+// checkFile fails unless the download is in place with content, and
+// nothing is left of the part
+func checkFile(t *testing.T, root string, content []byte) {
+	t.Helper()
+	got, err := ioutil.ReadFile(filepath.Join(root, "movie.mkv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("got %d bytes, not the file", len(got))
+	}
+	checkGone(t, root)
+}
+
+// checkGone fails if the part or its state are left
+func checkGone(t *testing.T, root string) {
+	t.Helper()
+	for _, name := range []string{".movie.mkv" + partExt, ".movie.mkv" + partExt + stateExt} {
+		if _, err := os.Stat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s left: %v", name, err)
+		}
+	}
+}
+
+func TestFetchSegments(t *testing.T) {
+	content := testContent()
+	s := &fileServer{content: content, etag: `"v1"`}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	d, root := newDownloader(t, 4)
+
+	files, _, err := fetchURL(t, d, srv.URL+"/movie.mkv", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != "/movie.mkv" {
+		t.Fatalf("got %q", files)
+	}
+	checkFile(t, root, content)
+	want := []string{"bytes=0-16383", "bytes=16384-32767", "bytes=32768-49151", "bytes=49152-65535"}
+	if got := s.fetched(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("asked for %q, want %q", got, want)
+	}
+}
+
+// partial writes the part and state of a download of url that stopped
+// after done bytes of the first of two segments
+func partial(t *testing.T, root, url, etag string, content []byte, done int64) {
+	t.Helper()
+	part := filepath.Join(root, ".movie.mkv"+partExt)
+	half := int64(len(content) / 2)
+	st := &state{URL: url, ETag: etag, Length: int64(len(content)), Segments: []*segment{
+		{Start: 0, End: half - 1, Done: done},
+		{Start: half, End: int64(len(content)) - 1},
+	}}
+	if err := st.save(part + stateExt); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, len(content))
+	copy(b, content[:done])
+	if err := ioutil.WriteFile(part, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchResume(t *testing.T) {
+	content := testContent()
+	s := &fileServer{content: content, etag: `"v1"`}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	d, root := newDownloader(t, 4)
+	partial(t, root, srv.URL+"/movie.mkv", `"v1"`, content, 20000)
+
+	_, note, err := fetchURL(t, d, srv.URL+"/movie.mkv", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(note, "resumed at") {
+		t.Fatalf("note %q doesn't say it resumed", note)
+	}
+	checkFile(t, root, content)
+	// only what's missing, with the same segments
+	want := []string{"bytes=20000-32767", "bytes=32768-65535"}
+	if got := s.fetched(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("asked for %q, want %q", got, want)
+	}
+}
+
+func TestFetchChanged(t *testing.T) {
+	content := testContent()
+
+	t.Run("before", func(t *testing.T) {
+		// the part is of an older file, it starts over
+		s := &fileServer{content: content, etag: `"v2"`}
+		srv := httptest.NewServer(s)
+		defer srv.Close()
+		d, root := newDownloader(t, 1)
+		partial(t, root, srv.URL+"/movie.mkv", `"v1"`, bytes.Repeat([]byte{'x'}, len(content)), 20000)
+
+		_, note, err := fetchURL(t, d, srv.URL+"/movie.mkv", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(note, "resumed") {
+			t.Fatalf("note %q, it can't resume a different file", note)
+		}
+		checkFile(t, root, content)
+		if got, want := s.fetched(), []string{"bytes=0-65535"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("asked for %q, want %q", got, want)
+		}
+	})
+
+	t.Run("during", func(t *testing.T) {
+		// If-Range gets the whole new file instead of a range of it
+		s := &fileServer{content: content, etag: `"v1"`}
+		s.onRequest = func(n int) {
+			if n == 2 {
+				s.etag = `"v2"`
+			}
+		}
+		srv := httptest.NewServer(s)
+		defer srv.Close()
+		d, root := newDownloader(t, 1)
+
+		_, _, err := fetchURL(t, d, srv.URL+"/movie.mkv", "")
+		if !errors.Is(err, ErrChanged) {
+			t.Fatalf("got %v, want %v", err, ErrChanged)
+		}
+		if len(s.fetched()) != 1 {
+			t.Fatalf("asked for %q, a changed file isn't tried again", s.fetched())
+		}
+		// the next one starts over
+		checkGone(t, root)
+	})
+}
+
+func TestFetchChecksum(t *testing.T) {
+	content := testContent()
+	s := &fileServer{content: content, etag: `"v1"`}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	d, root := newDownloader(t, 4)
+	_, _, err := fetchURL(t, d, srv.URL+"/movie.mkv", "sha256:"+strings.Repeat("00", sha256.Size))
+	if !errors.Is(err, ErrMismatch) {
+		t.Fatalf("got %v, want %v", err, ErrMismatch)
+	}
+	checkGone(t, root)
+	if _, err := os.Stat(filepath.Join(root, "movie.mkv")); !os.IsNotExist(err) {
+		t.Fatalf("a file that doesn't match was kept: %v", err)
+	}
+
+	_, note, err := fetchURL(t, d, srv.URL+"/movie.mkv", fmt.Sprintf("sha256:%x", sha256.Sum256(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(note, "checksum ok") {
+		t.Fatalf("note %q", note)
+	}
+	checkFile(t, root, content)
+}
+
+func TestFetchNoRanges(t *testing.T) {
+	content := testContent()
+	s := &fileServer{content: content, noRanges: true}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	d, root := newDownloader(t, 4)
+
+	if _, _, err := fetchURL(t, d, srv.URL+"/movie.mkv", ""); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, root, content)
+	// one request for all of it, after the one that found out
+	if got, want := s.fetched(), []string{""}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("asked for %q, want %q", got, want)
+	}
+}
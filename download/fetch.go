@@ -0,0 +1,468 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/jobs"
+	"github.com/jaredwarren/plexupdate/space"
+)
+
+// stallTimeout a connection that sends nothing for this long is dropped
+// and retried
+const stallTimeout = time.Minute
+
+// bufSize read from the server at a time
+const bufSize = 32 << 10
+
+// ErrChanged the file on the server isn't the one that was partly
+// downloaded
+var ErrChanged = errors.New("the file changed on the server")
+
+// ErrRedirect too many redirects, or one to something other than http
+var ErrRedirect = errors.New("bad redirect")
+
+// statusError the server answered with something other than the file
+type statusError struct {
+	url    string
+	status string
+	code   int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.url, e.status)
+}
+
+// retryable errors are dropped connections and server trouble, not a 404,
+// a redirect loop or a file that changed
+func retryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusTooManyRequests || se.code == http.StatusRequestTimeout
+	}
+	return !errors.Is(err, ErrChanged) && !errors.Is(err, ErrRedirect) &&
+		!errors.Is(err, space.ErrNoSpace) && !errors.Is(err, space.ErrQuota)
+}
+
+// remote what the server says about a url
+type remote struct {
+	// url after redirects
+	url          string
+	length       int64
+	ranges       bool
+	etag         string
+	lastModified string
+	disposition  string
+	contentType  string
+}
+
+// state of a download, saved next to the .part file so a later request
+// for the same url picks up where it stopped. URL is the one asked for,
+// signed redirects are different every time.
+type state struct {
+	URL          string     `json:"url"`
+	ETag         string     `json:"etag,omitempty"`
+	LastModified string     `json:"lastModified,omitempty"`
+	Length       int64      `json:"length"`
+	Segments     []*segment `json:"segments"`
+}
+
+// segment bytes Start to End of the file, End included, Done of them are
+// written
+type segment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Done  int64 `json:"done"`
+}
+
+// done bytes written so far, safe while segments are being fetched
+func (s *segment) done() int64 {
+	return atomic.LoadInt64(&s.Done)
+}
+
+// newState splits r, fetched from url, into n segments no smaller than
+// minSize
+func newState(url string, r *remote, n int, minSize int64) *state {
+	st := &state{URL: url, ETag: r.etag, LastModified: r.lastModified, Length: r.length}
+	if r.length <= 0 {
+		return st
+	}
+	if !r.ranges || n < 1 {
+		n = 1
+	}
+	if most := r.length / minSize; int64(n) > most {
+		n = int(most)
+	}
+	if n < 1 {
+		n = 1
+	}
+	size := r.length / int64(n)
+	for i := 0; i < n; i++ {
+		s := &segment{Start: int64(i) * size, End: int64(i+1)*size - 1}
+		if i == n-1 {
+			s.End = r.length - 1
+		}
+		st.Segments = append(st.Segments, s)
+	}
+	return st
+}
+
+// loadState the saved state in file, nil if there isn't one
+func loadState(file string) *state {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	st := &state{}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil
+	}
+	return st
+}
+
+// matches true if st is a partial download of what url gets now
+func (st *state) matches(url string, r *remote) bool {
+	return st.URL == url && st.Length == r.length && r.length > 0 && r.ranges &&
+		st.ETag == r.etag && st.LastModified == r.lastModified && len(st.Segments) > 0
+}
+
+// written bytes in every segment
+func (st *state) written() int64 {
+	var total int64
+	for _, s := range st.Segments {
+		total += s.done()
+	}
+	return total
+}
+
+// save st to file
+func (st *state) save(file string) error {
+	c := *st
+	c.Segments = nil
+	for _, s := range st.Segments {
+		c.Segments = append(c.Segments, &segment{Start: s.Start, End: s.End, Done: s.done()})
+	}
+	b, err := json.Marshal(&c)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, b, 0644)
+}
+
+// limiter shares a rate between every segment of a download
+type limiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time
+}
+
+// wait until n more bytes fit in the rate
+func (l *limiter) wait(ctx context.Context, n int) error {
+	if l == nil || l.rate <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	l.mu.Unlock()
+
+	d := time.Until(at)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// transfer fetches one url
+type transfer struct {
+	client    *http.Client
+	userAgent string
+	limiter   *limiter
+	retries   int
+}
+
+// newClient follows at most maxRedirects, and only to http and https urls
+func newClient(maxRedirects int) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("%w: stopped after %d", ErrRedirect, maxRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("%w: to a %s url", ErrRedirect, req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// get url, with a Range header if rng isn't empty. ifRange makes the
+// server send the whole file if it changed.
+func (t *transfer) get(ctx context.Context, url, rng, ifRange string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if t.userAgent != "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	if rng != "" {
+		req.Header.Set("Range", rng)
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, &statusError{url: url, status: resp.Status, code: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+// head asks for the first byte to find out the size, the name and if the
+// server does ranges. Plenty of servers get HEAD wrong.
+func (t *transfer) head(ctx context.Context, url string) (*remote, error) {
+	var resp *http.Response
+	err := t.retry(ctx, func() error {
+		var err error
+		resp, err = t.get(ctx, url, "bytes=0-0", "")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	r := &remote{
+		url:          resp.Request.URL.String(),
+		length:       resp.ContentLength,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		disposition:  resp.Header.Get("Content-Disposition"),
+		contentType:  resp.Header.Get("Content-Type"),
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		// bytes 0-0/1234, the size can be * if the server doesn't know
+		r.length = -1
+		cr := resp.Header.Get("Content-Range")
+		if i := strings.LastIndex(cr, "/"); i >= 0 {
+			if n, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+				r.length = n
+				r.ranges = true
+			}
+		}
+	}
+	// a weak etag can't be used with If-Range
+	if strings.HasPrefix(r.etag, "W/") {
+		r.etag = ""
+	}
+	return r, nil
+}
+
+// ifRange the validator that makes sure a range is from the same file
+func (r *remote) ifRange() string {
+	if r.etag != "" {
+		return r.etag
+	}
+	return r.lastModified
+}
+
+// retry fn after errors that might go away, waiting longer each time
+func (t *transfer) retry(ctx context.Context, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || ctx.Err() != nil || !retryable(err) || attempt >= t.retries {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		wait := time.Duration(1<<uint(attempt)) * time.Second
+		if wait > 30*time.Second {
+			wait = 30 * time.Second
+		}
+		fmt.Println("  [W]: download:", err, "retrying in", wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// segments fetches what's left of every segment of st into f at once,
+// saving st to stateFile as it goes
+func (t *transfer) segments(ctx context.Context, j *jobs.Job, r *remote, st *state, f *os.File, stateFile string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// progress and state, every second
+	stop := make(chan struct{})
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if j != nil {
+					j.SetProgress(float64(st.written()) / float64(st.Length))
+				}
+				st.save(stateFile)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	errs := make(chan error, len(st.Segments))
+	for _, s := range st.Segments {
+		go func(s *segment) {
+			err := t.retry(ctx, func() error {
+				return t.segment(ctx, r, s, f)
+			})
+			if err != nil {
+				// the others can't finish the file without this one
+				cancel()
+			}
+			errs <- err
+		}(s)
+	}
+	var first error
+	for range st.Segments {
+		if err := <-errs; err != nil && (first == nil || errors.Is(first, context.Canceled)) {
+			first = err
+		}
+	}
+	close(stop)
+	st.save(stateFile)
+	return first
+}
+
+// segment fetches the rest of s into f
+func (t *transfer) segment(ctx context.Context, r *remote, s *segment, f *os.File) error {
+	from := s.Start + s.done()
+	if from > s.End {
+		return nil
+	}
+	// a connection that stops sending is dropped so it can be retried
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stalled := time.AfterFunc(stallTimeout, cancel)
+	defer stalled.Stop()
+
+	resp, err := t.get(ctx, r.url, fmt.Sprintf("bytes=%d-%d", from, s.End), r.ifRange())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return ErrChanged
+	}
+
+	buf := make([]byte, bufSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		stalled.Reset(stallTimeout)
+		if n > 0 {
+			if left := s.End + 1 - (s.Start + s.done()); int64(n) > left {
+				n = int(left)
+			}
+			if werr := t.limiter.wait(ctx, n); werr != nil {
+				return werr
+			}
+			if _, werr := f.WriteAt(buf[:n], s.Start+s.done()); werr != nil {
+				return werr
+			}
+			atomic.AddInt64(&s.Done, int64(n))
+		}
+		if s.Start+s.done() > s.End {
+			return nil
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// stream fetches the whole file in one go into w, for servers that don't
+// do ranges or don't say how big it is. A retry starts over, reset
+// empties the file first.
+func (t *transfer) stream(ctx context.Context, j *jobs.Job, r *remote, w io.Writer, reset func() error) error {
+	attempt := 0
+	return t.retry(ctx, func() error {
+		if attempt++; attempt > 1 {
+			if err := reset(); err != nil {
+				return err
+			}
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stalled := time.AfterFunc(stallTimeout, cancel)
+		defer stalled.Stop()
+
+		resp, err := t.get(ctx, r.url, "", "")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		total := r.length
+		if total < 0 {
+			total = 0
+		}
+		out := jobs.NewWriter(ctx, w, j, total)
+		buf := make([]byte, bufSize)
+		for {
+			n, err := resp.Body.Read(buf)
+			stalled.Reset(stallTimeout)
+			if n > 0 {
+				if werr := t.limiter.wait(ctx, n); werr != nil {
+					return werr
+				}
+				if _, werr := out.Write(buf[:n]); werr != nil {
+					return werr
+				}
+			}
+			if err == io.EOF {
+				if r.length > 0 && out.Written() != r.length {
+					return io.ErrUnexpectedEOF
+				}
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
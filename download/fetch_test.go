@@ -0,0 +1,125 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jaredwarren/plexupdate/space"
+)
+
+func TestNewState(t *testing.T) {
+	tests := []struct {
+		name    string
+		length  int64
+		ranges  bool
+		n       int
+		minSize int64
+		want    [][2]int64
+	}{
+		{name: "even", length: 100, ranges: true, n: 4, minSize: 10, want: [][2]int64{{0, 24}, {25, 49}, {50, 74}, {75, 99}}},
+		{name: "last takes the rest", length: 10, ranges: true, n: 3, minSize: 1, want: [][2]int64{{0, 2}, {3, 5}, {6, 9}}},
+		{name: "no smaller than min", length: 100, ranges: true, n: 4, minSize: 40, want: [][2]int64{{0, 49}, {50, 99}}},
+		{name: "smaller than min", length: 100, ranges: true, n: 4, minSize: 1000, want: [][2]int64{{0, 99}}},
+		{name: "no ranges", length: 100, n: 4, minSize: 10, want: [][2]int64{{0, 99}}},
+		{name: "no size", length: -1, ranges: true, n: 4, minSize: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := newState("http://example.com/a.mkv", &remote{length: tt.length, ranges: tt.ranges, etag: `"v1"`}, tt.n, tt.minSize)
+			var got [][2]int64
+			for _, s := range st.Segments {
+				got = append(got, [2]int64{s.Start, s.End})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: io.ErrUnexpectedEOF, want: true},
+		{err: &statusError{code: http.StatusServiceUnavailable}, want: true},
+		{err: &statusError{code: http.StatusTooManyRequests}, want: true},
+		{err: &statusError{code: http.StatusRequestTimeout}, want: true},
+		{err: &statusError{code: http.StatusNotFound}},
+		{err: &statusError{code: http.StatusForbidden}},
+		{err: ErrChanged},
+		{err: fmt.Errorf("get: %w", ErrRedirect)},
+		{err: space.ErrNoSpace},
+		{err: space.ErrQuota},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.err); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	var requests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/ftp", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Redirect(w, r, "ftp://example.com/a.mkv", http.StatusFound)
+	})
+	mux.HandleFunc("/twice", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Redirect(w, r, "/once", http.StatusFound)
+	})
+	mux.HandleFunc("/once", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Redirect(w, r, "/a.mkv", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/a.mkv", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("movie"))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		path     string
+		err      error
+		requests int32
+	}{
+		{path: "/twice", requests: 3},
+		{path: "/loop", err: ErrRedirect, requests: 3},
+		{path: "/ftp", err: ErrRedirect, requests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+			tr := &transfer{client: newClient(3), limiter: &limiter{}, retries: 2}
+			r, err := tr.head(context.Background(), srv.URL+tt.path)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got %v, want %v", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if r.url != srv.URL+"/a.mkv" || r.length != 5 || r.ranges {
+				t.Fatalf("got %+v", r)
+			}
+			// a bad redirect isn't tried again
+			if n := atomic.LoadInt32(&requests); n != tt.requests {
+				t.Fatalf("%d requests, want %d", n, tt.requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,544 @@
+package duplicates
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/jobs"
+)
+
+// JobType of index updates in the job list
+const JobType = "library-index"
+
+// Defaults when the library config doesn't set them
+const (
+	DefaultIndexFile     = "./library_index.json"
+	DefaultIndexInterval = 6 * time.Hour
+)
+
+// QuickSize bytes read from each end of a file for the quick hash
+const QuickSize = 1 << 20
+
+// walk a location's folder, tests swap it to hold an update part way
+var walk = filepath.Walk
+
+// Entry a file in the index. Files are only compared by the full hash when
+// size and quick hash match.
+type Entry struct {
+	Location string    `json:"location"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Quick    string    `json:"quick"`
+	Full     string    `json:"full,omitempty"`
+}
+
+// Group files with the same content
+type Group struct {
+	Size    int64
+	Hash    string
+	Entries []Entry
+}
+
+// key of an entry in the index
+func key(location, relPath string) string {
+	return location + ":" + relPath
+}
+
+// Index of every file in the library by size and hash
+type Index struct {
+	conf *config.Current
+	jobs *jobs.Manager
+
+	mu      sync.Mutex
+	entries map[string]*Entry
+	loaded  bool
+	running *jobs.Job
+	// changed files added, or removed (nil), while an update walks the
+	// locations, they go on top of what it found. nil when none is running.
+	changed map[string]*Entry
+}
+
+// NewIndex the file is read the first time the index is used
+func NewIndex(conf *config.Current, jobManager *jobs.Manager) *Index {
+	return &Index{
+		conf:    conf,
+		jobs:    jobManager,
+		entries: map[string]*Entry{},
+	}
+}
+
+// file the index is saved to
+func (ix *Index) file() string {
+	if ix.conf.Get().Library.IndexFile != "" {
+		return ix.conf.Get().Library.IndexFile
+	}
+	return DefaultIndexFile
+}
+
+// load reads the index file once, caller must hold the lock
+func (ix *Index) load() {
+	if ix.loaded {
+		return
+	}
+	ix.loaded = true
+	data, err := ioutil.ReadFile(ix.file())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("  [E]: library index:", err)
+		}
+		return
+	}
+	entries := []*Entry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		fmt.Println("  [E]: library index:", err)
+		return
+	}
+	for _, e := range entries {
+		ix.entries[key(e.Location, e.Path)] = e
+	}
+}
+
+// save writes the index, caller must hold the lock
+func (ix *Index) save() error {
+	entries := make([]*Entry, 0, len(ix.entries))
+	for _, e := range ix.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return key(entries[i].Location, entries[i].Path) < key(entries[j].Location, entries[j].Path)
+	})
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	// write then rename so a crash doesn't leave half a file
+	tmp := ix.file() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ix.file())
+}
+
+// path of an entry on disk, empty if its location is gone
+func (ix *Index) path(e *Entry) string {
+	sandbox, err := ix.conf.Get().Plex.Sandbox(e.Location)
+	if err != nil {
+		return ""
+	}
+	p, err := sandbox.Resolve(e.Path)
+	if err != nil {
+		return ""
+	}
+	return p
+}
+
+// current true if the entry's file is still there unchanged
+func (ix *Index) current(e *Entry) bool {
+	p := ix.path(e)
+	if p == "" {
+		return false
+	}
+	fi, err := os.Stat(p)
+	return err == nil && fi.Size() == e.Size && fi.ModTime().Equal(e.Modified)
+}
+
+// Add indexes a new file, e.g. after an upload
+func (ix *Index) Add(location, relPath string) error {
+	e := &Entry{Location: location, Path: relPath}
+	p := ix.path(e)
+	if p == "" {
+		return fmt.Errorf("unknown location: %q", location)
+	}
+	if err := hashEntry(e, p); err != nil {
+		return err
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.load()
+	ix.entries[key(location, relPath)] = e
+	if ix.changed != nil {
+		ix.changed[key(location, relPath)] = e
+	}
+	return ix.save()
+}
+
+// Remove drops a file from the index, e.g. after it was replaced
+func (ix *Index) Remove(location, relPath string) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.load()
+	k := key(location, relPath)
+	if ix.changed != nil {
+		ix.changed[k] = nil
+	}
+	if _, ok := ix.entries[k]; !ok {
+		return nil
+	}
+	delete(ix.entries, k)
+	return ix.save()
+}
+
+// candidates entries with the same size and quick hash, an empty quick
+// hash matches any
+func (ix *Index) candidates(size int64, quick string) []*Entry {
+	ix.mu.Lock()
+	ix.load()
+	list := []*Entry{}
+	for _, e := range ix.entries {
+		if e.Size == size && (quick == "" || e.Quick == quick) {
+			list = append(list, e)
+		}
+	}
+	ix.mu.Unlock()
+
+	// files that were changed or deleted since they were indexed don't count
+	found := list[:0]
+	for _, e := range list {
+		if ix.current(e) {
+			found = append(found, e)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return key(found[i].Location, found[i].Path) < key(found[j].Location, found[j].Path)
+	})
+	return found
+}
+
+// Check finds files that may be the same as a file of size with the quick
+// hash, quick can be empty when the client couldn't hash the file
+func (ix *Index) Check(size int64, quick string) []Entry {
+	entries := []Entry{}
+	if size <= 0 {
+		return entries
+	}
+	for _, e := range ix.candidates(size, quick) {
+		ix.mu.Lock()
+		entries = append(entries, *e)
+		ix.mu.Unlock()
+	}
+	return entries
+}
+
+// Match finds files with the same content as r
+func (ix *Index) Match(r io.ReaderAt, size int64) ([]Entry, error) {
+	entries := []Entry{}
+	if size <= 0 {
+		return entries, nil
+	}
+	quick, err := QuickHash(r, size)
+	if err != nil {
+		return nil, err
+	}
+	candidates := ix.candidates(size, quick)
+	if len(candidates) == 0 {
+		return entries, nil
+	}
+
+	full, err := FullHash(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range candidates {
+		if h, err := ix.fullHash(e); err == nil && h == full {
+			ix.mu.Lock()
+			entries = append(entries, *e)
+			ix.mu.Unlock()
+		}
+	}
+	return entries, nil
+}
+
+// fullHash returns e.Full, hashing the file if it's missing
+func (ix *Index) fullHash(e *Entry) (string, error) {
+	ix.mu.Lock()
+	full := e.Full
+	ix.mu.Unlock()
+	if full != "" {
+		return full, nil
+	}
+
+	f, err := os.Open(ix.path(e))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	full, err = FullHash(f)
+	if err != nil {
+		return "", err
+	}
+
+	ix.mu.Lock()
+	e.Full = full
+	ix.mu.Unlock()
+	return full, nil
+}
+
+// Groups files with the same content, biggest first. Only files whose
+// quick hashes collided have a full hash, files that changed since they
+// were indexed are left out.
+func (ix *Index) Groups() []Group {
+	ix.mu.Lock()
+	ix.load()
+	hashed := []Entry{}
+	for _, e := range ix.entries {
+		if e.Full != "" {
+			hashed = append(hashed, *e)
+		}
+	}
+	ix.mu.Unlock()
+
+	byHash := map[string]*Group{}
+	for i := range hashed {
+		e := &hashed[i]
+		if !ix.current(e) {
+			continue
+		}
+		g, ok := byHash[e.Full]
+		if !ok {
+			g = &Group{Size: e.Size, Hash: e.Full}
+			byHash[e.Full] = g
+		}
+		g.Entries = append(g.Entries, *e)
+	}
+
+	groups := []Group{}
+	for _, g := range byHash {
+		if len(g.Entries) < 2 {
+			continue
+		}
+		sort.Slice(g.Entries, func(i, j int) bool {
+			return key(g.Entries[i].Location, g.Entries[i].Path) < key(g.Entries[j].Location, g.Entries[j].Path)
+		})
+		groups = append(groups, *g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Size != groups[j].Size {
+			return groups[i].Size > groups[j].Size
+		}
+		return groups[i].Hash < groups[j].Hash
+	})
+	return groups
+}
+
+// Update starts a job that re-indexes every location, only new and changed
+// files are hashed. If an update is already running that job is returned.
+func (ix *Index) Update() *jobs.Job {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.running != nil {
+		select {
+		case <-ix.running.Done():
+		default:
+			return ix.running
+		}
+	}
+	ix.running = ix.jobs.Start(JobType, "", "", ix.update)
+	return ix.running
+}
+
+// Job the running or last update, nil before the first one
+func (ix *Index) Job() *jobs.Job {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return ix.running
+}
+
+// StartUpdater runs Update now and then every library.indexinterval until
+// stop is closed
+func (ix *Index) StartUpdater(stop <-chan struct{}) {
+	go func() {
+		for {
+			ix.Update().Wait()
+			interval := ix.conf.Get().Library.IndexInterval
+			if interval <= 0 {
+				interval = DefaultIndexInterval
+			}
+			select {
+			case <-time.After(interval):
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// update walks every location, it's the job started by Update
+func (ix *Index) update(ctx context.Context, j *jobs.Job) (string, error) {
+	ix.mu.Lock()
+	ix.load()
+	old := make(map[string]*Entry, len(ix.entries))
+	for k, e := range ix.entries {
+		old[k] = e
+	}
+	ix.changed = map[string]*Entry{}
+	ix.mu.Unlock()
+	defer func() {
+		ix.mu.Lock()
+		ix.changed = nil
+		ix.mu.Unlock()
+	}()
+
+	locations := make([]string, 0, len(ix.conf.Get().Plex.Locations))
+	for location := range ix.conf.Get().Plex.Locations {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+
+	entries := map[string]*Entry{}
+	// locations can overlap, a file is only indexed once
+	seen := map[string]bool{}
+	for i, location := range locations {
+		sandbox, err := ix.conf.Get().Plex.Sandbox(location)
+		if err != nil {
+			continue
+		}
+		err = walk(sandbox.Root, func(p string, fi os.FileInfo, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				// unreadable folder, skip it and go on
+				return nil
+			}
+			name := fi.Name()
+			if fi.IsDir() {
+				if p != sandbox.Root && strings.HasPrefix(name, ".") {
+					// .trash and other hidden folders
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !fi.Mode().IsRegular() || fi.Size() == 0 || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".part") {
+				return nil
+			}
+			if seen[p] {
+				return nil
+			}
+			seen[p] = true
+
+			relPath, err := sandbox.Rel(p)
+			if err != nil {
+				return nil
+			}
+			k := key(location, relPath)
+			if e, ok := old[k]; ok && e.Size == fi.Size() && e.Modified.Equal(fi.ModTime()) {
+				entries[k] = e
+				return nil
+			}
+			e := &Entry{Location: location, Path: relPath}
+			if err := hashEntry(e, p); err == nil {
+				entries[k] = e
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		j.SetProgress(float64(i+1) / float64(len(locations)+1))
+	}
+
+	// full hashes only where size and quick hash collide
+	bySum := map[string][]*Entry{}
+	for _, e := range entries {
+		k := fmt.Sprintf("%d:%s", e.Size, e.Quick)
+		bySum[k] = append(bySum[k], e)
+	}
+	groups := 0
+	for _, list := range bySum {
+		if len(list) < 2 {
+			continue
+		}
+		for _, e := range list {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			if _, err := ix.fullHash(e); err != nil {
+				fmt.Println("  [E]: library index:", err)
+			}
+		}
+		groups++
+	}
+
+	ix.mu.Lock()
+	// what was added or removed since the walk started is newer
+	for k, e := range ix.changed {
+		if e == nil {
+			delete(entries, k)
+		} else {
+			entries[k] = e
+		}
+	}
+	ix.changed = nil
+	ix.entries = entries
+	err := ix.save()
+	ix.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d files, %d possible duplicate groups", len(entries), groups), nil
+}
+
+// hashEntry fills in size, modified and the quick hash of e from the file p
+func hashEntry(e *Entry, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	quick, err := QuickHash(f, fi.Size())
+	if err != nil {
+		return err
+	}
+	e.Size = fi.Size()
+	e.Modified = fi.ModTime()
+	e.Quick = quick
+	e.Full = ""
+	return nil
+}
+
+// QuickHash sha256 of the first and last QuickSize bytes, or the whole file
+// when it's smaller than both. The upload page computes the same in the
+// browser.
+func QuickHash(r io.ReaderAt, size int64) (string, error) {
+	h := sha256.New()
+	if size <= 2*QuickSize {
+		if _, err := io.Copy(h, io.NewSectionReader(r, 0, size)); err != nil {
+			return "", err
+		}
+	} else {
+		if _, err := io.Copy(h, io.NewSectionReader(r, 0, QuickSize)); err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(h, io.NewSectionReader(r, size-QuickSize, QuickSize)); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// FullHash sha256 of everything in r
+func FullHash(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
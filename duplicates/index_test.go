@@ -0,0 +1,237 @@
+package duplicates
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/jobs"
+)
+
+// newIndex for a location movies in a temp folder, saved to another
+func newIndex(t *testing.T) (*Index, string) {
+	t.Helper()
+	root := t.TempDir()
+	c := &config.Configuration{}
+	c.Plex.Locations = map[string]string{"movies": root}
+	c.Library.IndexFile = filepath.Join(t.TempDir(), "index.json")
+	return NewIndex(config.NewCurrent(c), jobs.NewManager()), root
+}
+
+// write data to name in root
+func write(t *testing.T, root, name string, data []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(root, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// update runs an update and waits for it
+func update(t *testing.T, ix *Index) {
+	t.Helper()
+	j := ix.Update()
+	j.Wait()
+	if s := j.Snapshot(); s.Status != jobs.Done {
+		t.Fatalf("update %s: %s", s.Status, s.Error)
+	}
+}
+
+// paths in the index, sorted
+func paths(ix *Index) []string {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.load()
+	list := []string{}
+	for _, e := range ix.entries {
+		list = append(list, e.Path)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// big a file bigger than both ends the quick hash reads, middle is what's
+// between them
+func big(middle string) []byte {
+	b := bytes.Repeat([]byte("x"), 2*QuickSize)
+	return append(b[:QuickSize:QuickSize], append([]byte(middle), b[QuickSize:]...)...)
+}
+
+func TestUpdateWhileChanging(t *testing.T) {
+	ix, root := newIndex(t)
+	write(t, root, "a.mkv", []byte("same"))
+	write(t, root, "b.mkv", []byte("same"))
+	write(t, root, "c.mkv", []byte("other"))
+
+	// hold the update once it has walked the location
+	walked, resume := make(chan struct{}), make(chan struct{})
+	t.Cleanup(func() { walk = filepath.Walk })
+	walk = func(root string, fn filepath.WalkFunc) error {
+		err := filepath.Walk(root, fn)
+		walked <- struct{}{}
+		<-resume
+		return err
+	}
+	j := ix.Update()
+	<-walked
+	if ix.Update() != j {
+		t.Fatal("a second update started while one is running")
+	}
+
+	// a new file, one that's gone and one that was replaced
+	write(t, root, "new.mkv", []byte("new"))
+	if err := ix.Add("movies", "/new.mkv"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Remove("movies", "/c.mkv"); err != nil {
+		t.Fatal(err)
+	}
+	write(t, root, "b.mkv", []byte("changed"))
+	if err := ix.Add("movies", "/b.mkv"); err != nil {
+		t.Fatal(err)
+	}
+
+	close(resume)
+	j.Wait()
+	if s := j.Snapshot(); s.Status != jobs.Done {
+		t.Fatalf("update %s: %s", s.Status, s.Error)
+	}
+	if got, want := paths(ix), []string{"/a.mkv", "/b.mkv", "/new.mkv"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	// the walk hashed b before it was replaced, Add's hash wins
+	if got := ix.Check(int64(len("changed")), ""); len(got) != 1 || got[0].Path != "/b.mkv" {
+		t.Fatalf("got %+v", got)
+	}
+	if groups := ix.Groups(); len(groups) != 0 {
+		t.Fatalf("got %+v, b isn't a copy of a anymore", groups)
+	}
+	ix.mu.Lock()
+	tracked := ix.changed != nil
+	ix.mu.Unlock()
+	if tracked {
+		t.Fatal("changes are still tracked after the update")
+	}
+
+	// what was merged is what was saved
+	saved := NewIndex(ix.conf, nil)
+	if got, want := paths(saved), paths(ix); !reflect.DeepEqual(got, want) {
+		t.Fatalf("saved %v, want %v", got, want)
+	}
+}
+
+func TestRemoveWhileUpdating(t *testing.T) {
+	ix, root := newIndex(t)
+	write(t, root, "a.mkv", []byte("same"))
+	update(t, ix)
+
+	// removed and added again before the update is done, the last one wins
+	walked, resume := make(chan struct{}), make(chan struct{})
+	t.Cleanup(func() { walk = filepath.Walk })
+	walk = func(root string, fn filepath.WalkFunc) error {
+		err := filepath.Walk(root, fn)
+		walked <- struct{}{}
+		<-resume
+		return err
+	}
+	j := ix.Update()
+	<-walked
+	if err := ix.Remove("movies", "/a.mkv"); err != nil {
+		t.Fatal(err)
+	}
+	write(t, root, "b.mkv", []byte("b"))
+	if err := ix.Add("movies", "/b.mkv"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Remove("movies", "/b.mkv"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Add("movies", "/a.mkv"); err != nil {
+		t.Fatal(err)
+	}
+	close(resume)
+	j.Wait()
+
+	if got, want := paths(ix), []string{"/a.mkv"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	ix, root := newIndex(t)
+	write(t, root, "a.mkv", []byte("same"))
+	write(t, root, "b.mkv", []byte("same"))
+	write(t, root, "c.mkv", []byte("diff"))
+	// same size and quick hash, only the full hash tells them apart
+	write(t, root, "big1.mkv", big("one"))
+	write(t, root, "big2.mkv", big("two"))
+	write(t, root, "big3.mkv", big("one"))
+	write(t, root, ".hidden.mkv", []byte("same"))
+	write(t, root, "d.mkv.part", []byte("same"))
+	if err := os.Mkdir(filepath.Join(root, ".trash"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	write(t, root, ".trash/e.mkv", []byte("same"))
+	update(t, ix)
+
+	if got, want := paths(ix), []string{"/a.mkv", "/b.mkv", "/big1.mkv", "/big2.mkv", "/big3.mkv", "/c.mkv"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	// only where size and quick hash collide is the whole file hashed
+	ix.mu.Lock()
+	for _, e := range ix.entries {
+		if full := e.Full != ""; full != (e.Path != "/c.mkv") {
+			t.Errorf("%s full hash %q", e.Path, e.Full)
+		}
+	}
+	ix.mu.Unlock()
+
+	groups := ix.Groups()
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups, want 2", len(groups))
+	}
+	// biggest first
+	var got [][]string
+	for _, g := range groups {
+		var names []string
+		for _, e := range g.Entries {
+			names = append(names, e.Path)
+		}
+		got = append(got, names)
+	}
+	if want := [][]string{{"/big1.mkv", "/big3.mkv"}, {"/a.mkv", "/b.mkv"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// Check goes by the quick hash, Match by the full one
+	data := big("two")
+	quick, err := QuickHash(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ix.Check(int64(len(data)), quick); len(got) != 3 {
+		t.Fatalf("checked %d files, want the 3 big ones", len(got))
+	}
+	matches, err := ix.Match(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Path != "/big2.mkv" {
+		t.Fatalf("got %+v", matches)
+	}
+
+	// a copy that changed since it was indexed isn't one
+	write(t, root, "b.mkv", []byte("SAME"))
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(root, "b.mkv"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if groups := ix.Groups(); len(groups) != 1 || groups[0].Size != int64(len(data)) {
+		t.Fatalf("got %+v", groups)
+	}
+}
@@ -0,0 +1,272 @@
+package feeds
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/app"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/form"
+	"github.com/jaredwarren/plexupdate/jobs"
+)
+
+// poller shared by the controller and the schedule
+var poller *Poller
+
+// Controller subscribes to podcast and video feeds.
+type Controller struct {
+	mux  *mux.Router
+	api  *mux.Router
+	conf *config.Current
+}
+
+// Register sets up the poller and the routes, and starts checking feeds
+func Register(service *app.Service) {
+	poller = &Poller{
+		conf:    service.Config,
+		store:   NewStore(service.Config),
+		jobs:    service.Jobs.NewQueue(1),
+		plex:    service.Plex,
+		index:   service.Index,
+		client:  &http.Client{},
+		running: map[string]*jobs.Job{},
+	}
+	c := &Controller{
+		mux:  service.Mux,
+		api:  service.API,
+		conf: service.Config,
+	}
+	c.MountController()
+	poller.Start(nil)
+}
+
+// MountController ...
+func (c *Controller) MountController() {
+	c.mux.HandleFunc("/feeds", c.List).Methods("GET")
+	c.mux.HandleFunc("/feeds", c.SubscribeHandler).Methods("POST")
+	c.mux.HandleFunc("/feeds/{id}/refresh", c.RefreshHandler).Methods("POST")
+	c.mux.HandleFunc("/feeds/{id}/delete", c.UnsubscribeHandler).Methods("POST")
+
+	c.api.HandleFunc("/feeds", c.APIList).Methods("GET")
+	c.api.HandleFunc("/feeds", c.SubscribeHandler).Methods("POST")
+	c.api.HandleFunc("/feeds/{id}", c.APIGet).Methods("GET")
+	c.api.HandleFunc("/feeds/{id}", c.UnsubscribeHandler).Methods("DELETE")
+	c.api.HandleFunc("/feeds/{id}/refresh", c.RefreshHandler).Methods("POST")
+}
+
+// writeError picks the status from err
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, ErrExists):
+		code = http.StatusConflict
+	case errors.Is(err, ErrNotFeed):
+		code = http.StatusBadRequest
+	}
+	api.WriteError(w, r, code, err)
+}
+
+// feed returns the subscription with id and checks the user can download to
+// its location
+func (c *Controller) feed(w http.ResponseWriter, r *http.Request, id string) (api.Feed, bool) {
+	f, err := poller.store.Get(id)
+	if err != nil {
+		writeError(w, r, err)
+		return f, false
+	}
+	if !auth.Check(w, r, auth.PermDownload, f.Location) {
+		return f, false
+	}
+	return f, true
+}
+
+// feeds in every location the user can download to, by title
+func (c *Controller) feeds(r *http.Request) []api.Feed {
+	locations := auth.Locations(r, auth.PermDownload, c.conf.Get().Plex.Locations)
+	list := []api.Feed{}
+	for _, f := range poller.store.List() {
+		if _, ok := locations[f.Location]; ok {
+			list = append(list, f)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Title < list[j].Title
+	})
+	return list
+}
+
+// List shows the subscriptions and the subscribe form
+func (c *Controller) List(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("List", r.URL.String())
+
+	if !auth.Permissions(r)[auth.PermDownload] {
+		auth.Check(w, r, auth.PermDownload, "")
+		return
+	}
+	interval := c.conf.Get().Feeds.Interval
+	if interval <= 0 {
+		interval = config.DefaultFeedsInterval
+	}
+	keep := c.conf.Get().Feeds.Keep
+	if keep <= 0 {
+		keep = config.DefaultFeedsKeep
+	}
+
+	// parse every time to make updates easier, and save memory
+	tpl := template.Must(template.New("base").Funcs(template.FuncMap{"CsrfToken": form.TokenFunc(r)}).ParseFiles("templates/feeds.html", "templates/base.html"))
+	tpl.ExecuteTemplate(w, "base", &struct {
+		Title     string
+		Feeds     []api.Feed
+		Locations map[string]string
+		Location  string
+		Interval  time.Duration
+		Keep      int
+	}{
+		Title:     "Podcasts",
+		Feeds:     c.feeds(r),
+		Locations: auth.Locations(r, auth.PermDownload, c.conf.Get().Plex.Locations),
+		Location:  c.conf.Get().Feeds.Location,
+		Interval:  interval,
+		Keep:      keep,
+	})
+}
+
+// SubscribeHandler adds a feed, after checking it is one, and fetches its
+// newest episodes
+func (c *Controller) SubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("SubscribeHandler", r.URL.String())
+
+	req := &api.FeedRequest{}
+	if api.IsJSON(r) {
+		if err := api.ReadJSON(r, req); err != nil {
+			api.WriteError(w, r, http.StatusBadRequest, err)
+			return
+		}
+	} else {
+		r.ParseForm()
+		req.URL = r.PostForm.Get("url")
+		req.Location = r.PostForm.Get("location")
+		if keep := r.PostForm.Get("keep"); keep != "" {
+			n, err := strconv.Atoi(keep)
+			if err != nil {
+				api.WriteError(w, r, http.StatusBadRequest, fmt.Errorf("keep: %w", err))
+				return
+			}
+			req.Keep = n
+		}
+	}
+	if req.URL == "" {
+		api.WriteError(w, r, http.StatusBadRequest, errors.New("missing url"))
+		return
+	}
+	if req.Location == "" {
+		req.Location = c.conf.Get().Feeds.Location
+	}
+	if _, ok := c.conf.Get().Plex.Locations[req.Location]; !ok {
+		api.WriteError(w, r, http.StatusBadRequest, fmt.Errorf("unknown location: %q", req.Location))
+		return
+	}
+	if req.Keep < 0 {
+		api.WriteError(w, r, http.StatusBadRequest, errors.New("keep can't be negative"))
+		return
+	}
+	if !auth.Check(w, r, auth.PermDownload, req.Location) {
+		return
+	}
+
+	ch, err := poller.get(r.Context(), req.URL)
+	if err != nil {
+		if !errors.Is(err, ErrNotFeed) {
+			err = fmt.Errorf("%w: %v", ErrNotFeed, err)
+		}
+		writeError(w, r, err)
+		return
+	}
+	f, err := poller.store.Add(api.Feed{
+		URL:      req.URL,
+		Title:    ch.Title,
+		Location: req.Location,
+		Keep:     req.Keep,
+		User:     auth.Username(r),
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if _, err := poller.Refresh(f.ID); err != nil {
+		fmt.Println("  [E]: feeds:", err)
+	}
+
+	if api.WantsJSON(r) {
+		w.Header().Set("Location", api.Prefix+"/feeds/"+f.ID)
+		api.WriteJSON(w, http.StatusCreated, f)
+		return
+	}
+	http.Redirect(w, r, "/feeds", http.StatusSeeOther)
+}
+
+// RefreshHandler checks a feed for new episodes now
+func (c *Controller) RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("RefreshHandler", r.URL.String())
+
+	f, ok := c.feed(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	job, err := poller.Refresh(f.ID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if api.WantsJSON(r) {
+		w.Header().Set("Location", api.Prefix+"/jobs/"+job.ID)
+		api.WriteJSON(w, http.StatusAccepted, api.NewJob(job))
+		return
+	}
+	http.Redirect(w, r, "/feeds", http.StatusSeeOther)
+}
+
+// UnsubscribeHandler removes a feed, episodes already fetched are kept
+func (c *Controller) UnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("UnsubscribeHandler", r.URL.String())
+
+	f, ok := c.feed(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	if err := poller.store.Remove(f.ID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if api.WantsJSON(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, "/feeds", http.StatusSeeOther)
+}
+
+// APIList lists the subscriptions in every location the user can download to
+func (c *Controller) APIList(w http.ResponseWriter, r *http.Request) {
+	api.WriteJSON(w, http.StatusOK, c.feeds(r))
+}
+
+// APIGet a subscription and its episodes
+func (c *Controller) APIGet(w http.ResponseWriter, r *http.Request) {
+	f, ok := c.feed(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	api.WriteJSON(w, http.StatusOK, f)
+}
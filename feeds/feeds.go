@@ -0,0 +1,427 @@
+package feeds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/download"
+	"github.com/jaredwarren/plexupdate/duplicates"
+	"github.com/jaredwarren/plexupdate/jobs"
+	"github.com/jaredwarren/plexupdate/naming"
+	"github.com/jaredwarren/plexupdate/place"
+	"github.com/jaredwarren/plexupdate/plex"
+	"github.com/jaredwarren/plexupdate/transcode"
+	"github.com/jaredwarren/plexupdate/trash"
+)
+
+// JobType of feed checks
+const JobType = "feed"
+
+// maxFeedSize feeds bigger than this are refused, some keep every episode
+// since 2005
+const maxFeedSize = 20 << 20
+
+// partExt tags are written to a hidden .part copy
+const partExt = ".part"
+
+// formats ffmpeg muxer for each extension that can be tagged
+var formats = map[string]string{
+	".mp3":  "mp3",
+	".m4a":  "ipod",
+	".aac":  "adts",
+	".ogg":  "ogg",
+	".opus": "opus",
+	".flac": "flac",
+	".mp4":  "mp4",
+	".m4v":  "mp4",
+	".mov":  "mov",
+	".mkv":  "matroska",
+	".webm": "webm",
+}
+
+// audioExts enclosures that go in an album rather than a season
+var audioExts = map[string]bool{
+	".mp3": true, ".m4a": true, ".aac": true, ".ogg": true, ".opus": true, ".flac": true, ".wav": true,
+}
+
+// Poller checks subscriptions for new episodes, one feed at a time
+type Poller struct {
+	conf   *config.Current
+	store  *Store
+	jobs   *jobs.Queue
+	plex   *plex.Scanner
+	index  *duplicates.Index
+	client *http.Client
+
+	mu      sync.Mutex
+	running map[string]*jobs.Job
+}
+
+// keep how many episodes f keeps
+func (p *Poller) keep(f api.Feed) int {
+	switch {
+	case f.Keep > 0:
+		return f.Keep
+	case p.conf.Get().Feeds.Keep > 0:
+		return p.conf.Get().Feeds.Keep
+	}
+	return config.DefaultFeedsKeep
+}
+
+// Start checks every feed now and then every feeds.interval until stop is
+// closed
+func (p *Poller) Start(stop <-chan struct{}) {
+	go func() {
+		for {
+			p.RefreshAll()
+			interval := p.conf.Get().Feeds.Interval
+			if interval <= 0 {
+				interval = config.DefaultFeedsInterval
+			}
+			select {
+			case <-time.After(interval):
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// RefreshAll queues a check of every feed
+func (p *Poller) RefreshAll() {
+	for _, f := range p.store.List() {
+		if _, err := p.Refresh(f.ID); err != nil {
+			fmt.Println("  [E]: feeds:", err)
+		}
+	}
+}
+
+// Refresh queues a check of the feed with id, or returns the one that's
+// already queued
+func (p *Poller) Refresh(id string) (*jobs.Job, error) {
+	f, err := p.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if j, ok := p.running[id]; ok {
+		select {
+		case <-j.Done():
+		default:
+			return j, nil
+		}
+	}
+	j := p.jobs.Start(JobType, f.User, f.Location, func(ctx context.Context, j *jobs.Job) (string, error) {
+		return p.refresh(ctx, j, id)
+	})
+	p.running[id] = j
+	return j, nil
+}
+
+// get the feed at rawURL
+func (p *Poller) get(ctx context.Context, rawURL string) (*channel, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.conf.Get().Download.UserAgent != "" {
+		req.Header.Set("User-Agent", p.conf.Get().Download.UserAgent)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", rawURL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxFeedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxFeedSize {
+		return nil, fmt.Errorf("%s: feed is over %d MB", rawURL, maxFeedSize>>20)
+	}
+	return parse(data)
+}
+
+// refresh downloads a feed's new episodes and deletes the ones it doesn't
+// keep
+func (p *Poller) refresh(ctx context.Context, j *jobs.Job, id string) (string, error) {
+	f, err := p.store.Get(id)
+	if err != nil {
+		return "", err
+	}
+	c, err := p.get(ctx, f.URL)
+	if err != nil {
+		p.store.Update(id, func(f *api.Feed) {
+			now := time.Now()
+			f.Checked, f.Error = &now, err.Error()
+		})
+		return "", err
+	}
+
+	// the newest episodes, there's no point fetching what wouldn't be kept
+	keep := p.keep(f)
+	items := c.Items
+	sort.SliceStable(items, func(a, b int) bool {
+		return items[a].Published.After(items[b].Published)
+	})
+	if len(items) > keep {
+		items = items[:keep]
+	}
+	have := map[string]bool{}
+	for _, e := range f.Episodes {
+		have[e.GUID] = true
+	}
+	todo := []item{}
+	for i := len(items) - 1; i >= 0; i-- {
+		if !have[items[i].GUID] {
+			todo = append(todo, items[i])
+		}
+	}
+
+	fetched, failed := 0, 0
+	var lastErr error
+	dirs := map[string]bool{}
+	for i, it := range todo {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		relPath, err := p.episode(ctx, f, c, it)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			failed++
+			lastErr = fmt.Errorf("%s: %w", it.Title, err)
+			fmt.Println("  [E]: feeds:", f.URL, lastErr)
+			continue
+		}
+		fetched++
+		dirs[path.Dir(relPath)] = true
+		p.store.Update(id, func(f *api.Feed) {
+			f.Episodes = append(f.Episodes, api.FeedEpisode{
+				GUID:      it.GUID,
+				Title:     it.Title,
+				Published: it.Published,
+				Path:      relPath,
+				Fetched:   time.Now(),
+			})
+		})
+		place.Jobs(f.Location, relPath, "", f.User)
+		j.SetProgress(float64(i+1) / float64(len(todo)))
+	}
+
+	removed := 0
+	err = p.store.Update(id, func(f *api.Feed) {
+		now := time.Now()
+		f.Checked, f.Error = &now, ""
+		if lastErr != nil {
+			f.Error = lastErr.Error()
+		}
+		if c.Title != "" {
+			f.Title = c.Title
+		}
+		removed = p.retain(f, c, keep)
+	})
+	if err != nil {
+		return "", err
+	}
+	if sandbox, err := p.conf.Get().Plex.Sandbox(f.Location); err == nil {
+		for dir := range dirs {
+			if d, err := sandbox.Resolve(dir); err == nil {
+				p.plex.Scan(f.Location, d)
+			}
+		}
+	}
+
+	result := fmt.Sprintf("%s: %d new, %d failed, %d removed", c.Title, fetched, failed, removed)
+	if fetched == 0 && failed > 0 {
+		return result, lastErr
+	}
+	return result, nil
+}
+
+// retain deletes f's episodes that aren't among the newest keep, and
+// forgets the ones that are gone from c too. It returns how many it
+// deleted.
+func (p *Poller) retain(f *api.Feed, c *channel, keep int) int {
+	sort.SliceStable(f.Episodes, func(a, b int) bool {
+		return f.Episodes[a].Published.After(f.Episodes[b].Published)
+	})
+	sandbox, err := p.conf.Get().Plex.Sandbox(f.Location)
+	if err != nil {
+		return 0
+	}
+	inFeed := map[string]bool{}
+	for _, it := range c.Items {
+		inFeed[it.GUID] = true
+	}
+
+	removed := 0
+	episodes := f.Episodes[:0]
+	for i, e := range f.Episodes {
+		if i >= keep && e.Path != "" {
+			err := trash.Delete(p.conf.Get().Trash, sandbox, f.Location, e.Path, f.User)
+			if err != nil && !os.IsNotExist(err) {
+				fmt.Println("  [E]: feeds:", e.Path, err)
+				episodes = append(episodes, e)
+				continue
+			}
+			e.Path = ""
+			removed++
+		}
+		// it's remembered so it isn't fetched again, until the feed drops it
+		if e.Path == "" && !inFeed[e.GUID] {
+			continue
+		}
+		episodes = append(episodes, e)
+	}
+	f.Episodes = episodes
+	return removed
+}
+
+// episode downloads and tags one episode, and returns its path in the
+// location
+func (p *Poller) episode(ctx context.Context, f api.Feed, c *channel, it item) (string, error) {
+	ext := ""
+	if u, err := url.Parse(it.URL); err == nil {
+		ext = strings.ToLower(path.Ext(u.Path))
+	}
+	if ext == "" {
+		if exts, _ := mime.ExtensionsByType(it.Type); len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+	audio := audioExts[ext] || strings.HasPrefix(it.Type, "audio/")
+
+	show := c.Title
+	if show == "" {
+		show = f.Title
+	}
+	if show == "" {
+		show = "Podcast"
+	}
+	published := it.Published
+	if published.IsZero() {
+		published = time.Now()
+	}
+	date := published.Format("2006-01-02")
+
+	var relPath string
+	var tags []string
+	if audio {
+		// the podcast is an album, by its author
+		artist := c.Author
+		if artist == "" {
+			artist = show
+		}
+		var err error
+		relPath, err = naming.Path(api.MediaInfo{
+			Type:   api.MediaMusic,
+			Artist: artist,
+			Album:  show,
+			Title:  date + " - " + it.Title,
+			Track:  it.Episode,
+		}, ext)
+		if err != nil {
+			return "", err
+		}
+		tags = []string{"title=" + it.Title, "artist=" + artist, "album_artist=" + artist, "album=" + show,
+			"date=" + date, "genre=Podcast"}
+		if it.Episode > 0 {
+			tags = append(tags, "track="+strconv.Itoa(it.Episode))
+		}
+	} else {
+		var err error
+		if relPath, err = naming.Dated(show, published, it.Title, ext); err != nil {
+			return "", err
+		}
+		tags = []string{"title=" + it.Title, "show=" + show, "date=" + date}
+		if it.Episode > 0 {
+			tags = append(tags, "episode_sort="+strconv.Itoa(it.Episode))
+		}
+		if it.Season > 0 {
+			tags = append(tags, "season_number="+strconv.Itoa(it.Season))
+		}
+	}
+
+	relPath, err := download.Fetch(ctx, &api.DownloadRequest{
+		URL:      it.URL,
+		Location: f.Location,
+		Path:     path.Dir(relPath),
+		Name:     path.Base(relPath),
+	}, f.User)
+	if err != nil {
+		return "", err
+	}
+	sandbox, err := p.conf.Get().Plex.Sandbox(f.Location)
+	if err != nil {
+		return "", err
+	}
+	file, err := sandbox.Resolve(relPath)
+	if err != nil {
+		return "", err
+	}
+	if err := p.tag(ctx, file, tags); err != nil {
+		// it's still worth having without them
+		fmt.Println("  [W]: feeds: tags:", relPath, err)
+	}
+	if err := p.index.Add(f.Location, relPath); err != nil {
+		fmt.Println("  [E]: library index:", err)
+	}
+	return relPath, nil
+}
+
+// tag writes tags into file with ffmpeg, the streams are copied
+func (p *Poller) tag(ctx context.Context, file string, tags []string) error {
+	format, ok := formats[strings.ToLower(filepath.Ext(file))]
+	if !ok {
+		return nil
+	}
+	command := p.conf.Get().Transcode.Command
+	if command == "" {
+		command = transcode.DefaultCommand
+	}
+	part := filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+partExt)
+	args := []string{"-hide_banner", "-nostdin", "-nostats", "-y", "-i", file,
+		"-map", "0", "-c", "copy", "-map_metadata", "0"}
+	for _, t := range tags {
+		args = append(args, "-metadata", t)
+	}
+	// mp4 only keeps tags it knows about without this
+	if format == "ipod" || format == "mp4" {
+		args = append(args, "-movflags", "use_metadata_tags")
+	}
+	args = append(args, "-f", format, part)
+	out, err := exec.CommandContext(ctx, command, args...).CombinedOutput()
+	if err != nil {
+		os.Remove(part)
+		if lines := strings.Split(strings.TrimSpace(string(out)), "\n"); lines[len(lines)-1] != "" {
+			return errors.New(lines[len(lines)-1])
+		}
+		return err
+	}
+	return os.Rename(part, file)
+}
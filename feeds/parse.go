@@ -0,0 +1,177 @@
+package feeds
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// ErrNotFeed the url isn't an rss or atom feed
+var ErrNotFeed = errors.New("not an rss or atom feed")
+
+// channel what we use of a feed
+type channel struct {
+	Title  string
+	Author string
+	Items  []item
+}
+
+// item an episode with something to download
+type item struct {
+	GUID      string
+	Title     string
+	Published time.Time
+	URL       string
+	Type      string
+	Season    int
+	Episode   int
+}
+
+type rssFeed struct {
+	Channel struct {
+		Title  string `xml:"title"`
+		Author string `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd author"`
+		Items  []struct {
+			Title     string `xml:"title"`
+			GUID      string `xml:"guid"`
+			PubDate   string `xml:"pubDate"`
+			Enclosure struct {
+				URL  string `xml:"url,attr"`
+				Type string `xml:"type,attr"`
+			} `xml:"enclosure"`
+			Season  string `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd season"`
+			Episode string `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd episode"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+type atomFeed struct {
+	Title  string `xml:"title"`
+	Author struct {
+		Name string `xml:"name"`
+	} `xml:"author"`
+	Entries []struct {
+		Title     string `xml:"title"`
+		ID        string `xml:"id"`
+		Published string `xml:"published"`
+		Updated   string `xml:"updated"`
+		Links     []struct {
+			Rel  string `xml:"rel,attr"`
+			Href string `xml:"href,attr"`
+			Type string `xml:"type,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+// parse an rss 2.0 or atom feed. Items without an enclosure are left out.
+func parse(data []byte) (*channel, error) {
+	var root struct {
+		XMLName xml.Name
+	}
+	if err := decode(data, &root); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotFeed, err)
+	}
+
+	c := &channel{}
+	switch root.XMLName.Local {
+	case "rss":
+		f := &rssFeed{}
+		if err := decode(data, f); err != nil {
+			return nil, err
+		}
+		c.Title, c.Author = strings.TrimSpace(f.Channel.Title), strings.TrimSpace(f.Channel.Author)
+		for _, i := range f.Channel.Items {
+			if i.Enclosure.URL == "" {
+				continue
+			}
+			it := item{
+				GUID:      strings.TrimSpace(i.GUID),
+				Title:     strings.TrimSpace(i.Title),
+				Published: parseTime(i.PubDate),
+				URL:       strings.TrimSpace(i.Enclosure.URL),
+				Type:      i.Enclosure.Type,
+			}
+			it.Season, _ = strconv.Atoi(strings.TrimSpace(i.Season))
+			it.Episode, _ = strconv.Atoi(strings.TrimSpace(i.Episode))
+			c.Items = append(c.Items, it)
+		}
+	case "feed":
+		f := &atomFeed{}
+		if err := decode(data, f); err != nil {
+			return nil, err
+		}
+		c.Title, c.Author = strings.TrimSpace(f.Title), strings.TrimSpace(f.Author.Name)
+		for _, e := range f.Entries {
+			it := item{GUID: strings.TrimSpace(e.ID), Title: strings.TrimSpace(e.Title)}
+			if it.Published = parseTime(e.Published); it.Published.IsZero() {
+				it.Published = parseTime(e.Updated)
+			}
+			for _, l := range e.Links {
+				if l.Rel == "enclosure" {
+					it.URL, it.Type = strings.TrimSpace(l.Href), l.Type
+					break
+				}
+			}
+			if it.URL != "" {
+				c.Items = append(c.Items, it)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%w: <%s>", ErrNotFeed, root.XMLName.Local)
+	}
+
+	for i := range c.Items {
+		// the enclosure is the best id a feed without guids has
+		if c.Items[i].GUID == "" {
+			c.Items[i].GUID = c.Items[i].URL
+		}
+		if c.Items[i].Title == "" {
+			c.Items[i].Title = c.Items[i].Published.Format("2006-01-02")
+		}
+	}
+	return c, nil
+}
+
+// decode xml in any charset, feeds are still often latin-1
+func decode(data []byte, v interface{}) error {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.CharsetReader = func(label string, r io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(label)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(r), nil
+	}
+	d.Strict = false
+	return d.Decode(v)
+}
+
+// timeFormats rss dates are RFC 822 give or take, atom's RFC 3339
+var timeFormats = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"Mon, 02 Jan 2006 15:04 -0700",
+	time.RFC3339,
+	"2006-01-02",
+}
+
+// parseTime zero if it isn't any date we know
+func parseTime(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, f := range timeFormats {
+		if t, err := time.Parse(f, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
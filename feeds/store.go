@@ -0,0 +1,161 @@
+package feeds
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/config"
+)
+
+var (
+	// ErrNotFound no subscription with that id
+	ErrNotFound = errors.New("feed not found")
+	// ErrExists already subscribed to the url in that location
+	ErrExists = errors.New("already subscribed")
+)
+
+// Store subscriptions and the episodes fetched for each, saved in
+// feeds.file
+type Store struct {
+	conf *config.Current
+
+	mu     sync.Mutex
+	feeds  []*api.Feed
+	loaded bool
+}
+
+// NewStore the file is read the first time the store is used
+func NewStore(conf *config.Current) *Store {
+	return &Store{conf: conf}
+}
+
+// file the store is saved to
+func (s *Store) file() string {
+	if s.conf.Get().Feeds.File != "" {
+		return s.conf.Get().Feeds.File
+	}
+	return config.DefaultFeedsFile
+}
+
+// load reads the file once, caller must hold the lock
+func (s *Store) load() {
+	if s.loaded {
+		return
+	}
+	s.loaded = true
+	data, err := ioutil.ReadFile(s.file())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("  [E]: feeds:", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &s.feeds); err != nil {
+		fmt.Println("  [E]: feeds:", err)
+	}
+}
+
+// save writes the file, caller must hold the lock
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.feeds, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write then rename so a crash doesn't leave half a file
+	tmp := s.file() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file())
+}
+
+// find the feed with id, caller must hold the lock
+func (s *Store) find(id string) (*api.Feed, int) {
+	for i, f := range s.feeds {
+		if f.ID == id {
+			return f, i
+		}
+	}
+	return nil, -1
+}
+
+// clone f so it can be read without the lock
+func clone(f *api.Feed) api.Feed {
+	c := *f
+	c.Episodes = append([]api.FeedEpisode{}, f.Episodes...)
+	return c
+}
+
+// List every subscription
+func (s *Store) List() []api.Feed {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load()
+	list := make([]api.Feed, 0, len(s.feeds))
+	for _, f := range s.feeds {
+		list = append(list, clone(f))
+	}
+	return list
+}
+
+// Get the subscription with id
+func (s *Store) Get(id string) (api.Feed, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load()
+	f, _ := s.find(id)
+	if f == nil {
+		return api.Feed{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return clone(f), nil
+}
+
+// Add a subscription, it gets an id and the time it was added
+func (s *Store) Add(f api.Feed) (api.Feed, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load()
+	for _, other := range s.feeds {
+		if other.URL == f.URL && other.Location == f.Location {
+			return api.Feed{}, fmt.Errorf("%w: %s in %s", ErrExists, f.URL, f.Location)
+		}
+	}
+	f.ID = strconv.FormatInt(time.Now().UnixNano(), 36)
+	f.Added = time.Now()
+	f.Episodes = []api.FeedEpisode{}
+	s.feeds = append(s.feeds, &f)
+	return clone(&f), s.save()
+}
+
+// Remove the subscription with id, the episodes stay
+func (s *Store) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load()
+	_, i := s.find(id)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	s.feeds = append(s.feeds[:i], s.feeds[i+1:]...)
+	return s.save()
+}
+
+// Update the subscription with id with fn and save it
+func (s *Store) Update(id string, fn func(f *api.Feed)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load()
+	f, _ := s.find(id)
+	if f == nil {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	fn(f)
+	return s.save()
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package filesystem
+
+import (
+	"errors"
+	"syscall"
+)
+
+// DiskSpace free and total bytes of the disk dir is on, free is what a
+// normal user can use
+func DiskSpace(dir string) (free, total int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(existing(dir), &st); err != nil {
+		return 0, 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), int64(st.Blocks) * int64(st.Bsize), nil
+}
+
+// crossDevice true if a rename failed because from and to are on different
+// disks
+func crossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
@@ -0,0 +1,39 @@
+package filesystem
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+// errorNotSameDevice ERROR_NOT_SAME_DEVICE, what a rename to another drive
+// fails with
+const errorNotSameDevice syscall.Errno = 17
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// DiskSpace free and total bytes of the disk dir is on, free is what the
+// user running the server can use
+func DiskSpace(dir string) (free, total int64, err error) {
+	p, err := syscall.UTF16PtrFromString(existing(dir))
+	if err != nil {
+		return 0, 0, err
+	}
+	var available, size, all uint64
+	r, _, err := getDiskFreeSpaceEx.Call(
+		uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&available)),
+		uintptr(unsafe.Pointer(&size)),
+		uintptr(unsafe.Pointer(&all)),
+	)
+	if r == 0 {
+		return 0, 0, err
+	}
+	return int64(available), int64(size), nil
+}
+
+// crossDevice true if a rename failed because from and to are on different
+// drives
+func crossDevice(err error) bool {
+	return errors.Is(err, errorNotSameDevice) || errors.Is(err, syscall.EXDEV)
+}
@@ -3,61 +3,29 @@ package filesystem
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
-var badCharacters = []string{
-	"../",
-	"<!--",
-	"-->",
-	"<",
-	">",
-	"'",
-	"\"",
-	"&",
-	"$",
-	"#",
-	"{", "}", "[", "]", "=",
-	";", "?", "%20", "%22",
-	"%3c",   // <
-	"%253c", // <
-	"%3e",   // >
-	"",      // > -- fill in with % 0 e - without spaces in between
-	"%28",   // (
-	"%29",   // )
-	"%2528", // (
-	"%26",   // &
-	"%24",   // $
-	"%3f",   // ?
-	"%3b",   // ;
-	"%3d",   // =
-}
-
-// SanitizeFilename ...
+// SanitizeFilename cleans a name, or every part of a relative path.
+//
+// Deprecated: it used to strip a list of bad strings one after the other, so
+// "....//" became "../". Use NormalizeFilename for names and Sandbox for paths.
 func SanitizeFilename(name string, relativePath bool) string {
-	if name == "" {
-		return name
-	}
-
-	// if relativePath is TRUE, we preserve the path in the filename
-	// If FALSE and will cause upper path foldername to merge with filename
-	// USE WITH CARE!!!
-	badDictionary := badCharacters
 	if !relativePath {
-		// add additional bad characters
-		badDictionary = append(badCharacters, "./", "/")
+		clean, _ := NormalizeFilename(name)
+		return clean
 	}
-
-	// trim white space
-	trimmed := strings.TrimSpace(name)
-
-	// trim bad chars
-	temp := trimmed
-	for _, badChar := range badDictionary {
-		temp = strings.Replace(temp, badChar, "", -1)
+	parts := []string{}
+	for _, part := range strings.Split(strings.Replace(name, "\\", "/", -1), "/") {
+		if part == "." || part == ".." {
+			continue
+		}
+		if clean, err := NormalizeFilename(part); err == nil {
+			parts = append(parts, clean)
+		}
 	}
-	stripped := strings.Replace(temp, "\\", "", -1)
-	return stripped
+	return strings.Join(parts, "/")
 }
 
 // IsDirEmpty ...
@@ -88,3 +56,19 @@ func Exists(filename string) bool {
 	_, err := os.Stat(filename)
 	return err == nil || os.IsNotExist(err)
 }
+
+// existing dir, or the closest parent that exists, locations are created on
+// the first upload
+func existing(dir string) string {
+	dir = filepath.Clean(dir)
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
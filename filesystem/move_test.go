@@ -0,0 +1,62 @@
+package filesystem
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestMove(t *testing.T) {
+	dir := t.TempDir()
+	from := filepath.Join(dir, "a.mkv")
+	if err := ioutil.WriteFile(from, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	to := filepath.Join(dir, "Movies", "a.mkv")
+	if err := Move(from, to); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(to); err != nil || string(b) != "a" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+	if _, err := os.Stat(from); !os.IsNotExist(err) {
+		t.Fatalf("%s left: %v", from, err)
+	}
+
+	if err := ioutil.WriteFile(from, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Move(from, to); err != ErrExists {
+		t.Fatalf("got %v, want %v", err, ErrExists)
+	}
+
+	// only another disk is copied, anything else is the rename's error
+	err := Move(filepath.Join(dir, "gone.mkv"), filepath.Join(dir, "b.mkv"))
+	var le *os.LinkError
+	if !errors.As(err, &le) || !os.IsNotExist(err) {
+		t.Fatalf("got %v, want the rename's error", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.mkv")); !os.IsNotExist(err) {
+		t.Fatalf("b.mkv was made: %v", err)
+	}
+}
+
+func TestCrossDevice(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: &os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.EXDEV}, want: true},
+		{err: &os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.ENOENT}},
+		{err: &os.LinkError{Op: "rename", Old: "a", New: "b", Err: os.ErrPermission}},
+		{err: errors.New("rename failed")},
+	}
+	for _, tt := range tests {
+		if got := crossDevice(tt.err); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package filesystem
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MaxNameBytes most file systems stop at 255 bytes per name
+const MaxNameBytes = 255
+
+// ErrEmptyName nothing was left of a name after normalizing
+var ErrEmptyName = errors.New("empty file name")
+
+// nameSymbols punctuation that's allowed in a name, everything else that isn't
+// a letter, number or space becomes _
+const nameSymbols = "-_.,()[]{}'!&+~#@=%$;"
+
+// windowsReserved can't be used as a name on windows, with any extension
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// NormalizeFilename turns name into a single file name that's safe on every
+// os plex runs on. Unicode is normalized to NFC, only letters, numbers, marks,
+// spaces and a few symbols are kept, ":" becomes " -" so "Title: Part 2"
+// still reads well, reserved windows names get a _ prefix and the name is cut
+// to MaxNameBytes keeping the extension.
+func NormalizeFilename(name string) (string, error) {
+	name = norm.NFC.String(strings.ToValidUTF8(name, ""))
+	// only the last part of a path, browsers on windows used to send the full path
+	if i := strings.LastIndexAny(name, "/\\"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	var b strings.Builder
+	space := false
+	for _, r := range name {
+		switch {
+		case r == ':':
+			r = '-'
+			if !space {
+				b.WriteByte(' ')
+			}
+		case unicode.IsSpace(r):
+			r = ' '
+		case unicode.IsLetter(r), unicode.IsNumber(r), unicode.IsMark(r):
+		case strings.ContainsRune(nameSymbols, r):
+		default:
+			r = '_'
+		}
+		// collapse runs of spaces
+		if r == ' ' && space {
+			continue
+		}
+		space = r == ' '
+		b.WriteRune(r)
+	}
+
+	// no hidden files, and windows drops trailing dots and spaces
+	clean := strings.Trim(b.String(), " .")
+	if clean == "" {
+		return "", ErrEmptyName
+	}
+
+	ext := filepath.Ext(clean)
+	base := strings.TrimSuffix(clean, ext)
+	// windows goes by what's before the first dot, CON.tar.gz is reserved too
+	if stem := strings.SplitN(base, ".", 2)[0]; windowsReserved[strings.ToUpper(strings.TrimRight(stem, " "))] {
+		base = "_" + base
+	}
+	if len(ext) > MaxNameBytes/2 {
+		// not a real extension
+		base, ext = base+ext, ""
+	}
+	if len(base)+len(ext) > MaxNameBytes {
+		base = truncate(base, MaxNameBytes-len(ext))
+		base = strings.TrimRight(base, " .")
+	}
+	if base == "" {
+		return "", ErrEmptyName
+	}
+	return base + ext, nil
+}
+
+// truncate cuts s to at most n bytes without splitting a rune
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,100 @@
+package filesystem
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNormalizeFilename(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  error
+	}{
+		{in: "movie.mkv", want: "movie.mkv"},
+		{in: "Title: Part 2.mkv", want: "Title - Part 2.mkv"},
+		{in: "a  \tb.mkv", want: "a b.mkv"},
+		{in: "a\x00b.mkv", want: "a_b.mkv"},
+		{in: ".hidden.mkv", want: "hidden.mkv"},
+		{in: "name. . .", want: "name"},
+		// only the last part of a path
+		{in: "../../etc/passwd", want: "passwd"},
+		{in: "..\\..\\boot.ini", want: "boot.ini"},
+		{in: "C:\\fakepath\\movie.mkv", want: "movie.mkv"},
+		{in: "/abs/movie.mkv", want: "movie.mkv"},
+		{in: "....//", err: ErrEmptyName},
+		{in: "..\\", err: ErrEmptyName},
+		{in: "..", err: ErrEmptyName},
+		{in: "", err: ErrEmptyName},
+		// reserved on windows
+		{in: "CON", want: "_CON"},
+		{in: "NUL.txt", want: "_NUL.txt"},
+		{in: "nul.tar.gz", want: "_nul.tar.gz"},
+		{in: "Com1 .mkv", want: "_Com1 .mkv"},
+		{in: "CONSOLE.txt", want: "CONSOLE.txt"},
+		// cut to 255 bytes, the extension stays, runes aren't split
+		{in: strings.Repeat("a", 300) + ".mkv", want: strings.Repeat("a", 251) + ".mkv"},
+		{in: strings.Repeat("é", 200) + ".mkv", want: strings.Repeat("é", 125) + ".mkv"},
+		{in: strings.Repeat("a", 255), want: strings.Repeat("a", 255)},
+		{in: "a." + strings.Repeat("b", 200), want: "a." + strings.Repeat("b", 200)},
+	}
+	for _, tt := range tests {
+		name := tt.in
+		if len(name) > 40 {
+			name = name[:40]
+		}
+		t.Run(name, func(t *testing.T) {
+			got, err := NormalizeFilename(tt.in)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got %q, %v, want %v", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzNormalizeFilename(f *testing.F) {
+	for _, s := range []string{
+		"movie.mkv", "Title: Part 2.mkv", "....//", "..\\", "../../etc/passwd",
+		"C:\\fakepath\\a.mkv", "CON", "NUL.txt", "con.tar.gz", ".hidden",
+		" . ", "a\x00b", "\xff\xfe.mkv", strings.Repeat("é", 200) + ".mkv",
+	} {
+		f.Add(s)
+	}
+	root := filepath.Join(string(filepath.Separator), "library")
+	f.Fuzz(func(t *testing.T, in string) {
+		got, err := NormalizeFilename(in)
+		if err != nil {
+			return
+		}
+		if got == "" || len(got) > MaxNameBytes || !utf8.ValidString(got) || strings.ContainsAny(got, "/\\:\x00") {
+			t.Fatalf("%q: got %q", in, got)
+		}
+		if strings.HasPrefix(got, ".") || strings.HasSuffix(got, ".") || strings.HasSuffix(got, " ") {
+			t.Fatalf("%q: got %q", in, got)
+		}
+		stem := strings.TrimRight(strings.SplitN(got, ".", 2)[0], " ")
+		if windowsReserved[strings.ToUpper(stem)] {
+			t.Fatalf("%q: got %q, reserved on windows", in, got)
+		}
+		// it's one name in the root, whatever it was
+		rel, err := Clean(got)
+		if err != nil || rel != "/"+got {
+			t.Fatalf("%q: got %q, cleaned to %q, %v", in, got, rel, err)
+		}
+		if full := filepath.Join(root, got); !Within(root, full) || filepath.Dir(full) != root {
+			t.Fatalf("%q: %q leaves the root", in, full)
+		}
+		if again, err := NormalizeFilename(got); err != nil || again != got {
+			t.Fatalf("%q: got %q, then %q, %v", in, got, again, err)
+		}
+	})
+}
@@ -0,0 +1,169 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Errors returned by Clean and Sandbox.Resolve
+var (
+	ErrEscape  = errors.New("path escapes the location")
+	ErrSymlink = errors.New("path goes through a symlink")
+	ErrInvalid = errors.New("invalid path")
+)
+
+// SymlinkPolicy what Resolve does with symlinks inside the root
+type SymlinkPolicy string
+
+// Symlink policies
+const (
+	// SymlinksInside follows links that stay inside the root, the default
+	SymlinksInside SymlinkPolicy = "inside"
+	// SymlinksDeny rejects any path that goes through a link
+	SymlinksDeny SymlinkPolicy = "deny"
+	// SymlinksFollow follows every link, e.g. libraries spread over disks with links
+	SymlinksFollow SymlinkPolicy = "follow"
+)
+
+// Sandbox confines paths from users to a root folder
+type Sandbox struct {
+	Root     string
+	Symlinks SymlinkPolicy
+}
+
+// NewSandbox root is made absolute, an empty policy is SymlinksInside
+func NewSandbox(root string, symlinks SymlinkPolicy) (*Sandbox, error) {
+	if root == "" {
+		return nil, errors.New("empty sandbox root")
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	switch symlinks {
+	case "":
+		symlinks = SymlinksInside
+	case SymlinksInside, SymlinksDeny, SymlinksFollow:
+	default:
+		return nil, fmt.Errorf("unknown symlink policy: %q", symlinks)
+	}
+	return &Sandbox{
+		Root:     abs,
+		Symlinks: symlinks,
+	}, nil
+}
+
+// Clean turns a path from a user into a clean slash path starting with /.
+// Either separator works, a leading / is the root, and anything that climbs
+// above the root, has a volume name or a NUL is an error.
+func Clean(userPath string) (string, error) {
+	if strings.IndexByte(userPath, 0) >= 0 {
+		return "", fmt.Errorf("%q: %w", userPath, ErrInvalid)
+	}
+	p := strings.Replace(userPath, "\\", "/", -1)
+	p = path.Clean(strings.TrimLeft(p, "/"))
+	if p == "." {
+		return "/", nil
+	}
+	if p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("%q: %w", userPath, ErrEscape)
+	}
+	// c:foo, or file:stream on windows
+	if runtime.GOOS == "windows" && strings.Contains(p, ":") || filepath.VolumeName(filepath.FromSlash(p)) != "" {
+		return "", fmt.Errorf("%q: %w", userPath, ErrEscape)
+	}
+	return "/" + p, nil
+}
+
+// Resolve returns the file path for userPath inside the root. The file
+// doesn't have to exist, but every part of it that does is checked against
+// the symlink policy.
+func (s *Sandbox) Resolve(userPath string) (string, error) {
+	rel, err := Clean(userPath)
+	if err != nil {
+		return "", err
+	}
+	full := filepath.Join(s.Root, filepath.FromSlash(rel))
+	if !Within(s.Root, full) {
+		return "", fmt.Errorf("%q: %w", userPath, ErrEscape)
+	}
+	if s.Symlinks == SymlinksFollow {
+		return full, nil
+	}
+
+	// walk down from the root, stop at the first part that doesn't exist yet
+	realRoot, err := filepath.EvalSymlinks(s.Root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return full, nil
+		}
+		return "", err
+	}
+	p := s.Root
+	for _, name := range strings.Split(strings.Trim(rel, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		p = filepath.Join(p, name)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if s.Symlinks == SymlinksDeny {
+			return "", fmt.Errorf("%q: %w", userPath, ErrSymlink)
+		}
+		target, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// dangling, it can't be read through, but don't let it be written through either
+				return "", fmt.Errorf("%q: %w", userPath, ErrSymlink)
+			}
+			return "", err
+		}
+		if !Within(realRoot, target) {
+			return "", fmt.Errorf("%q: %w", userPath, ErrEscape)
+		}
+	}
+	return full, nil
+}
+
+// Join resolves name, a single file name, inside the folder userDir
+func (s *Sandbox) Join(userDir, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return "", fmt.Errorf("%q: %w", name, ErrInvalid)
+	}
+	return s.Resolve(path.Join(strings.Replace(userDir, "\\", "/", -1), name))
+}
+
+// Rel returns the slash path of file inside the root, the reverse of Resolve
+func (s *Sandbox) Rel(file string) (string, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	if !Within(s.Root, abs) {
+		return "", fmt.Errorf("%q: %w", file, ErrEscape)
+	}
+	rel, err := filepath.Rel(s.Root, abs)
+	if err != nil {
+		return "", err
+	}
+	return path.Clean("/" + filepath.ToSlash(rel)), nil
+}
+
+// Within true if p is dir or inside it, both should be absolute
+func Within(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
@@ -0,0 +1,185 @@
+package filesystem
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// cleanSeeds paths users have tried to climb out with
+var cleanSeeds = []string{
+	"", "/", ".", "..", "../", "..\\", "....//", "....//....//etc/passwd",
+	"a/../../b", "a/./b//c/", "/etc/passwd", "\\\\server\\share\\x",
+	"C:\\Windows\\win.ini", "c:foo", "file.mkv:stream", "a\x00b", "%2e%2e/x",
+	"inside/x", "outside/x", "dangling/x",
+}
+
+func TestClean(t *testing.T) {
+	// a volume name is only one on windows
+	volume, volumeErr := "/C:/Windows", error(nil)
+	if runtime.GOOS == "windows" {
+		volume, volumeErr = "", ErrEscape
+	}
+	tests := []struct {
+		in   string
+		want string
+		err  error
+	}{
+		{in: "", want: "/"},
+		{in: "/", want: "/"},
+		{in: "a/b/", want: "/a/b"},
+		{in: "a/../b", want: "/b"},
+		{in: "....//", want: "/...."},
+		{in: "....//....//etc", want: "/..../..../etc"},
+		{in: "..", err: ErrEscape},
+		{in: "../", err: ErrEscape},
+		{in: "..\\", err: ErrEscape},
+		{in: "..\\..\\etc", err: ErrEscape},
+		{in: "a/../../b", err: ErrEscape},
+		// absolute paths start at the root
+		{in: "/etc/passwd", want: "/etc/passwd"},
+		{in: "\\\\server\\share", want: "/server/share"},
+		{in: "C:\\Windows", want: volume, err: volumeErr},
+		{in: "a\x00b", err: ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := Clean(tt.in)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got %q, %v, want %v", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// newRoot makes a sandbox root with a folder real, a link inside to it, a
+// link outside to another folder and a dangling one. It's skipped where
+// links can't be made.
+func newRoot(t *testing.T) (root, outside string) {
+	t.Helper()
+	root, outside = t.TempDir(), t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "real"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"inside":   filepath.Join(root, "real"),
+		"outside":  outside,
+		"dangling": filepath.Join(root, "gone"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skip("can't make links:", err)
+		}
+	}
+	return root, outside
+}
+
+func TestResolve(t *testing.T) {
+	root, _ := newRoot(t)
+	tests := []struct {
+		in       string
+		symlinks SymlinkPolicy
+		want     string
+		err      error
+	}{
+		{in: "movie.mkv", want: "movie.mkv"},
+		{in: "/etc/passwd", want: "etc/passwd"},
+		{in: "....//x", want: "..../x"},
+		{in: "../x", err: ErrEscape},
+		{in: "..\\x", err: ErrEscape},
+		{in: "inside/x", want: "inside/x"},
+		{in: "inside/x", symlinks: SymlinksDeny, err: ErrSymlink},
+		{in: "outside/x", err: ErrEscape},
+		{in: "outside/x", symlinks: SymlinksFollow, want: "outside/x"},
+		{in: "dangling/x", err: ErrSymlink},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.symlinks)+tt.in, func(t *testing.T) {
+			s, err := NewSandbox(root, tt.symlinks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.Resolve(tt.in)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got %q, %v, want %v", got, err, tt.err)
+				}
+				return
+			}
+			if want := filepath.Join(s.Root, filepath.FromSlash(tt.want)); err != nil || got != want {
+				t.Fatalf("got %q, %v, want %q", got, err, want)
+			}
+		})
+	}
+}
+
+func FuzzClean(f *testing.F) {
+	for _, s := range cleanSeeds {
+		f.Add(s)
+	}
+	root := filepath.Join(string(filepath.Separator), "library")
+	f.Fuzz(func(t *testing.T, in string) {
+		got, err := Clean(in)
+		if err != nil {
+			return
+		}
+		if !strings.HasPrefix(got, "/") || path.Clean(got) != got || strings.IndexByte(got, 0) >= 0 {
+			t.Fatalf("%q: got %q", in, got)
+		}
+		for _, name := range strings.Split(got, "/") {
+			if name == ".." {
+				t.Fatalf("%q: got %q", in, got)
+			}
+		}
+		if full := filepath.Join(root, filepath.FromSlash(got)); !Within(root, full) {
+			t.Fatalf("%q: %q leaves the root", in, full)
+		}
+	})
+}
+
+func FuzzResolve(f *testing.F) {
+	for _, s := range cleanSeeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, in string) {
+		root, outside := newRoot(t)
+		s, err := NewSandbox(root, SymlinksInside)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.Resolve(in)
+		if err != nil {
+			return
+		}
+		if !Within(s.Root, got) {
+			t.Fatalf("%q: %q leaves the root", in, got)
+		}
+		// what's there of it, links and all, is inside too
+		p := got
+		for {
+			if _, err := os.Lstat(p); err == nil {
+				break
+			}
+			p = filepath.Dir(p)
+		}
+		target, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			t.Fatalf("%q: %v", in, err)
+		}
+		realRoot, _ := filepath.EvalSymlinks(root)
+		realOutside, _ := filepath.EvalSymlinks(outside)
+		if !Within(realRoot, target) || Within(realOutside, target) {
+			t.Fatalf("%q: %q is %q, outside the root", in, got, target)
+		}
+	})
+}
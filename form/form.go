@@ -1,73 +1,141 @@
 package form
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"crypto/subtle"
+	"math/big"
+	"sync"
 	"time"
 )
 
-var forms map[string]*Form
+// TTL form timout, 1 day max
+const TTL = 24 * time.Hour
+
+var (
+	mu    sync.Mutex
+	forms map[string]*Form
+	// bySession newest token for each session, so a session reuses one token
+	bySession map[string]string
+)
 
 func init() {
 	forms = make(map[string]*Form)
+	bySession = make(map[string]string)
 }
 
 // Form ...
 type Form struct {
-	Hash string
-	Date time.Time
+	Hash    string
+	Session string
+	Date    time.Time
+}
+
+func (f *Form) expired() bool {
+	return time.Since(f.Date) > TTL
 }
 
-// GetForm return stored form
+// GetForm return stored form and remove it, for one time tokens
 func GetForm(key string) (f *Form, ok bool) {
+	mu.Lock()
+	defer mu.Unlock()
 	f, ok = forms[key]
 	delete(forms, key)
-
-	// form timout, 1 day max
-	if f != nil {
-		max := time.Now().AddDate(0, 0, -1)
-		if max.Sub(f.Date).Seconds() > 0 {
-			return nil, false
-		}
+	if ok && bySession[f.Session] == key {
+		delete(bySession, f.Session)
 	}
 
+	if f != nil && f.expired() {
+		return nil, false
+	}
 	return
 }
 
-// Check return stored form
+// Check return stored form, if it hasn't expired
 func Check(key string) (f *Form, ok bool) {
+	mu.Lock()
+	defer mu.Unlock()
 	f, ok = forms[key]
+	if f != nil && f.expired() {
+		return nil, false
+	}
 	return
 }
 
-// New return new form
-func New() string {
+// Valid true if key is a live token issued to session
+func Valid(key, session string) bool {
+	if key == "" || session == "" {
+		return false
+	}
+	f, ok := Check(key)
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(f.Session), []byte(session)) == 1
+}
+
+// New return token for session, the same one until it's half way to expiring
+func New(session string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	if hash, ok := bySession[session]; ok {
+		if f, ok := forms[hash]; ok && time.Since(f.Date) < TTL/2 {
+			return hash
+		}
+	}
+
 	hash := GetHash(32)
 	forms[hash] = &Form{
-		Hash: hash,
-		Date: time.Now(),
+		Hash:    hash,
+		Session: session,
+		Date:    time.Now(),
 	}
+	bySession[session] = hash
 	return hash
 }
 
+// Sweep removes expired tokens
+func Sweep() {
+	mu.Lock()
+	defer mu.Unlock()
+	for hash, f := range forms {
+		if f.expired() {
+			delete(forms, hash)
+			if bySession[f.Session] == hash {
+				delete(bySession, f.Session)
+			}
+		}
+	}
+}
+
+// StartSweeper runs Sweep every interval until stop is closed
+func StartSweeper(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				Sweep()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
 const letterBytes = "1234567890abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-const (
-	letterIdxBits = 6
-	letterIdxMask = 1<<letterIdxBits - 1
-)
 
-// GetHash ...
+// GetHash random string from crypto/rand
 func GetHash(n int) string {
 	b := make([]byte, n)
-	for i := 0; i < n; {
-		if idx := int(rand.Int63() & letterIdxMask); idx < len(letterBytes) {
-			b[i] = letterBytes[idx]
-			i++
+	max := big.NewInt(int64(len(letterBytes)))
+	for i := range b {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			// no randomness means no safe tokens, don't limp along
+			panic(err)
 		}
+		b[i] = letterBytes[idx.Int64()]
 	}
 	return string(b)
 }
-
-// CsrfToken returns token
-func CsrfToken() string {
-	return New()
-}
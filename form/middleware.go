@@ -0,0 +1,100 @@
+package form
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/app"
+	"github.com/jaredwarren/plexupdate/auth"
+)
+
+// Where the token can be sent. Multipart forms have to use the query
+// string, the middleware won't parse a multi GB body just to find it. It's
+// taken out of the query once it's checked, so handlers don't log it.
+const (
+	FieldName  = "csrf_token"
+	HeaderName = "X-CSRF-Token"
+)
+
+// sweepInterval how often expired tokens are removed
+const sweepInterval = time.Hour
+
+// exemptPaths don't have a session yet
+var exemptPaths = []string{
+	"/login",
+}
+
+// Register checks the csrf token on every state changing request, must be
+// registered after auth so only logged in requests get here.
+func Register(service *app.Service) {
+	service.Mux.Use(Middleware)
+	StartSweeper(sweepInterval, nil)
+}
+
+// session id of the request, empty if there's no session cookie
+func session(r *http.Request) string {
+	cookie, err := r.Cookie(auth.CookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// CsrfToken returns token for the request's session
+func CsrfToken(r *http.Request) string {
+	return New(session(r))
+}
+
+// TokenFunc for template.FuncMap, {{CsrfToken}}
+func TokenFunc(r *http.Request) func() string {
+	return func() string {
+		return CsrfToken(r)
+	}
+}
+
+// Middleware rejects POST, PUT, PATCH and DELETE without a valid token
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, p := range exemptPaths {
+			if r.URL.Path == p {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		// browsers never add this header on their own, so api tokens can't be forged
+		if auth.ByToken(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sess := session(r)
+		if sess == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := r.Header.Get(HeaderName)
+		if q := r.URL.Query(); q.Get(FieldName) != "" {
+			if token == "" {
+				token = q.Get(FieldName)
+			}
+			q.Del(FieldName)
+			r.URL.RawQuery = q.Encode()
+		}
+		if token == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			token = r.PostFormValue(FieldName)
+		}
+		if !Valid(token, sess) {
+			api.WriteError(w, r, http.StatusForbidden, errors.New("invalid or expired csrf token, reload the page and try again"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,189 @@
+package form
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jaredwarren/plexupdate/app"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/config"
+)
+
+// newService with auth and the csrf check registered, bob can log in and
+// has an api token. POST /echo writes back its query.
+func newService(t *testing.T) (http.Handler, string) {
+	t.Helper()
+	c := &config.Configuration{}
+	c.Auth.UsersFile = filepath.Join(t.TempDir(), "users.json")
+	c.Auth.Roles = map[string]config.RoleConfiguration{
+		"admin": {Permissions: []string{auth.All}, Locations: []string{auth.All}},
+	}
+	users, err := auth.NewStore(c.Auth.UsersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.SetPassword("bob", "bob password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.SetRoles("bob", []string{"admin"}); err != nil {
+		t.Fatal(err)
+	}
+	token, err := users.NewToken("bob", "cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := app.New("test", config.NewCurrent(c))
+	if err := auth.Register(service); err != nil {
+		t.Fatal(err)
+	}
+	Register(service)
+	service.Mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RawQuery))
+	})
+	return service.Mux, token
+}
+
+// login bob and return the session cookie
+func login(t *testing.T, h http.Handler) *http.Cookie {
+	t.Helper()
+	form := url.Values{"username": {"bob"}, "password": {"bob password"}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == auth.CookieName {
+			return cookie
+		}
+	}
+	t.Fatalf("login: got %d", w.Code)
+	return nil
+}
+
+func TestMiddleware(t *testing.T) {
+	h, apiToken := newService(t)
+	cookie := login(t, h)
+	token := New(cookie.Value)
+	other := New("another session")
+
+	multipartBody := func(token string) (string, *bytes.Buffer) {
+		b := &bytes.Buffer{}
+		mw := multipart.NewWriter(b)
+		mw.WriteField(FieldName, token)
+		mw.Close()
+		return mw.FormDataContentType(), b
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		header map[string]string
+		form   url.Values
+		// multipart the token only in a multipart body
+		multipart bool
+		noCookie  bool
+		code      int
+		// seen the query the handler gets
+		seen string
+	}{
+		{name: "get", method: "GET", code: http.StatusOK},
+		{name: "missing", method: "POST", code: http.StatusForbidden},
+		{name: "invalid", method: "POST", header: map[string]string{HeaderName: "nope"}, code: http.StatusForbidden},
+		{name: "another session's", method: "DELETE", header: map[string]string{HeaderName: other}, code: http.StatusForbidden},
+		{name: "header", method: "PUT", header: map[string]string{HeaderName: token}, code: http.StatusOK},
+		{name: "form", method: "POST", form: url.Values{FieldName: {token}}, code: http.StatusOK},
+		{name: "invalid form", method: "POST", form: url.Values{FieldName: {other}}, code: http.StatusForbidden},
+		{name: "multipart body isn't read", method: "POST", multipart: true, code: http.StatusForbidden},
+		// it's checked, then taken out so handlers don't log it
+		{name: "query", method: "POST", query: "a=1&" + FieldName + "=" + token, code: http.StatusOK, seen: "a=1"},
+		{name: "invalid query", method: "POST", query: FieldName + "=nope", code: http.StatusForbidden},
+		{name: "header before query", method: "PATCH", query: FieldName + "=nope&a=1", header: map[string]string{HeaderName: token}, code: http.StatusOK, seen: "a=1"},
+		// api tokens can't be sent by a forged form, so they don't need one
+		{name: "bearer", method: "POST", header: map[string]string{"Authorization": "Bearer " + apiToken}, noCookie: true, code: http.StatusOK},
+		{name: "bearer and cookie", method: "POST", header: map[string]string{"Authorization": "Bearer " + apiToken}, code: http.StatusOK},
+		// a cookie with any other Authorization still needs one
+		{name: "bad bearer and cookie", method: "POST", header: map[string]string{"Authorization": "Bearer nope"}, code: http.StatusUnauthorized},
+		{name: "basic and cookie", method: "POST", header: map[string]string{"Authorization": "Basic Ym9iOmJvYg=="}, code: http.StatusForbidden},
+		{name: "bearer token as csrf", method: "POST", header: map[string]string{HeaderName: apiToken}, code: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/echo"
+			if tt.query != "" {
+				target += "?" + tt.query
+			}
+			var req *http.Request
+			switch {
+			case tt.form != nil:
+				req = httptest.NewRequest(tt.method, target, strings.NewReader(tt.form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			case tt.multipart:
+				contentType, body := multipartBody(token)
+				req = httptest.NewRequest(tt.method, target, body)
+				req.Header.Set("Content-Type", contentType)
+			default:
+				req = httptest.NewRequest(tt.method, target, nil)
+			}
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			if !tt.noCookie {
+				req.AddCookie(cookie)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tt.code {
+				t.Fatalf("got %d, want %d: %s", w.Code, tt.code, w.Body.String())
+			}
+			if w.Code == http.StatusOK && w.Body.String() != tt.seen {
+				t.Fatalf("handler got query %q, want %q", w.Body.String(), tt.seen)
+			}
+		})
+	}
+}
+
+func TestLoginExempt(t *testing.T) {
+	h, _ := newService(t)
+	// logging in again from a page that has a session, but not its token
+	cookie := login(t, h)
+	form := url.Values{"username": {"bob"}, "password": {"bob password"}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestValid(t *testing.T) {
+	token := New("session")
+	if New("session") != token {
+		t.Fatal("a session got a second token")
+	}
+	tests := []struct {
+		token   string
+		session string
+		want    bool
+	}{
+		{token, "session", true},
+		{token, "other", false},
+		{token, "", false},
+		{"", "session", false},
+		{"nope", "session", false},
+	}
+	for _, tt := range tests {
+		if got := Valid(tt.token, tt.session); got != tt.want {
+			t.Errorf("%q for %q: got %v", tt.token, tt.session, got)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Status of a job
+type Status string
+
+// Job states
+const (
+	Queued   Status = "queued"
+	Running  Status = "running"
+	Done     Status = "done"
+	Failed   Status = "failed"
+	Canceled Status = "canceled"
+)
+
+// Func does the work for a job, result is usually the file that was written.
+type Func func(ctx context.Context, j *Job) (result string, err error)
+
+// Job is a long running task, e.g. a youtube download.
+type Job struct {
+	ID   string
+	Type string
+	// User who started it, "" for the server's own jobs
+	User string
+	// Location it works in, "" if it isn't tied to one
+	Location string
+	Status   Status
+	Progress float64
+	Result   string
+	Error    string
+	Created  time.Time
+	Started  time.Time
+	Finished time.Time
+
+	mu     sync.RWMutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// SetProgress 0-1
+func (j *Job) SetProgress(p float64) {
+	j.mu.Lock()
+	j.Progress = p
+	j.mu.Unlock()
+}
+
+// Snapshot returns a copy that is safe to read
+func (j *Job) Snapshot() Job {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return Job{
+		ID:       j.ID,
+		Type:     j.Type,
+		User:     j.User,
+		Location: j.Location,
+		Status:   j.Status,
+		Progress: j.Progress,
+		Result:   j.Result,
+		Error:    j.Error,
+		Created:  j.Created,
+		Started:  j.Started,
+		Finished: j.Finished,
+	}
+}
+
+// Wait blocks until the job is finished
+func (j *Job) Wait() {
+	<-j.done
+}
+
+// Done is closed when the job is finished
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Manager keeps track of jobs
+type Manager struct {
+	mu   sync.RWMutex
+	jobs map[string]*Job
+	seq  int64
+}
+
+// NewManager ...
+func NewManager() *Manager {
+	return &Manager{
+		jobs: make(map[string]*Job),
+	}
+}
+
+// Start runs fn in the background for user in location
+func (m *Manager) Start(jobType, user, location string, fn Func) *Job {
+	return m.start(jobType, user, location, fn, nil)
+}
+
+// Queue runs a limited number of jobs at once, the rest wait their turn
+type Queue struct {
+	m     *Manager
+	slots chan struct{}
+}
+
+// NewQueue that runs at most n jobs at once
+func (m *Manager) NewQueue(n int) *Queue {
+	if n < 1 {
+		n = 1
+	}
+	return &Queue{
+		m:     m,
+		slots: make(chan struct{}, n),
+	}
+}
+
+// Start queues fn, it stays Queued until a slot is free
+func (q *Queue) Start(jobType, user, location string, fn Func) *Job {
+	return q.m.start(jobType, user, location, fn, q.slots)
+}
+
+// start runs fn once there's room in slots, nil slots runs it right away
+func (m *Manager) start(jobType, user, location string, fn Func, slots chan struct{}) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m.mu.Lock()
+	m.seq++
+	j := &Job{
+		ID:       strconv.FormatInt(time.Now().Unix(), 36) + "-" + strconv.FormatInt(m.seq, 10),
+		Type:     jobType,
+		User:     user,
+		Location: location,
+		Status:   Queued,
+		Created:  time.Now(),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	m.jobs[j.ID] = j
+	m.mu.Unlock()
+
+	go func() {
+		defer close(j.done)
+		defer cancel()
+
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				j.mu.Lock()
+				j.Status = Canceled
+				j.Finished = time.Now()
+				j.mu.Unlock()
+				return
+			}
+		}
+
+		j.mu.Lock()
+		j.Status = Running
+		j.Started = time.Now()
+		j.mu.Unlock()
+
+		result, err := fn(ctx, j)
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.Result = result
+		j.Finished = time.Now()
+		switch {
+		case ctx.Err() == context.Canceled:
+			j.Status = Canceled
+		case err != nil:
+			j.Status = Failed
+			j.Error = err.Error()
+		default:
+			j.Status = Done
+			j.Progress = 1
+		}
+	}()
+
+	return j
+}
+
+// Get ...
+func (m *Manager) Get(id string) (*Job, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	j, ok := m.jobs[id]
+	return j, ok
+}
+
+// List returns all jobs, newest first
+func (m *Manager) List() []*Job {
+	m.mu.RLock()
+	list := make([]*Job, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		list = append(list, j)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].Created.After(list[b].Created)
+	})
+	return list
+}
+
+// Cancel stops a running job
+func (m *Manager) Cancel(id string) error {
+	j, ok := m.Get(id)
+	if !ok {
+		return fmt.Errorf("job not found: %s", id)
+	}
+	j.cancel()
+	return nil
+}
+
+// Cleanup cancels all running jobs
+func (m *Manager) Cleanup() {
+	for _, j := range m.List() {
+		j.cancel()
+	}
+}
@@ -0,0 +1,44 @@
+package jobs
+
+import (
+	"context"
+	"io"
+)
+
+// Writer wraps w, updating job progress as bytes are written and stopping
+// as soon as the job is canceled.
+type Writer struct {
+	ctx     context.Context
+	w       io.Writer
+	job     *Job
+	total   int64
+	written int64
+}
+
+// NewWriter total can be 0 if unknown.
+func NewWriter(ctx context.Context, w io.Writer, j *Job, total int64) *Writer {
+	return &Writer{
+		ctx:   ctx,
+		w:     w,
+		job:   j,
+		total: total,
+	}
+}
+
+// Write ...
+func (pw *Writer) Write(p []byte) (int, error) {
+	if err := pw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := pw.w.Write(p)
+	pw.written += int64(n)
+	if pw.job != nil && pw.total > 0 {
+		pw.job.SetProgress(float64(pw.written) / float64(pw.total))
+	}
+	return n, err
+}
+
+// Written bytes so far
+func (pw *Writer) Written() int64 {
+	return pw.written
+}
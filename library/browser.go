@@ -0,0 +1,230 @@
+package library
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/form"
+)
+
+// crumb is one folder in the breadcrumb trail
+type crumb struct {
+	Name string
+	Path string
+}
+
+// crumbs for relPath, the first one is the location root
+func crumbs(location, relPath string) []crumb {
+	list := []crumb{{Name: location, Path: "/"}}
+	p := ""
+	for _, name := range strings.Split(strings.Trim(relPath, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		p += "/" + name
+		list = append(list, crumb{Name: name, Path: p})
+	}
+	return list
+}
+
+// folderURL link to a folder in the browser
+func folderURL(location, relPath string) string {
+	return "/library/" + url.PathEscape(location) + "?path=" + url.QueryEscape(relPath)
+}
+
+// Browse lists the locations, or a folder in one of them
+func (c *Controller) Browse(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Browse", r.URL.String())
+
+	if !auth.Permissions(r)[auth.PermLibrary] {
+		auth.Check(w, r, auth.PermLibrary, "")
+		return
+	}
+
+	data := &struct {
+		Title     string
+		Location  string
+		Locations map[string]string
+		Targets   map[string]string
+		Listing   *api.Listing
+		Crumbs    []crumb
+		Parent    string
+		Columns   []string
+		Sort      string
+		Desc      bool
+		CanManage bool
+		Profiles  []string
+		Loudness  string
+	}{
+		Title:     "Library",
+		Location:  mux.Vars(r)["location"],
+		Locations: auth.Locations(r, auth.PermLibrary, c.conf.Get().Plex.Locations),
+		Columns:   []string{"name", "size", "modified", "duration"},
+		Targets:   auth.Locations(r, auth.PermManage, c.conf.Get().Plex.Locations),
+		Sort:      r.URL.Query().Get("sort"),
+		Desc:      r.URL.Query().Get("order") == "desc",
+		Profiles:  c.conf.Get().Transcode.Names(),
+	}
+
+	if data.Location != "" {
+		sandbox, ok := c.root(w, r, data.Location, auth.PermLibrary)
+		if !ok {
+			return
+		}
+		listing, err := c.list(data.Location, sandbox, r.URL.Query().Get("path"), data.Sort, data.Desc)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		data.Title = "Library: " + data.Location
+		data.Listing = listing
+		data.Crumbs = crumbs(data.Location, listing.Path)
+		data.Parent = path.Dir(listing.Path)
+		data.CanManage = auth.Can(r, auth.PermManage, data.Location)
+		data.Loudness = c.conf.Get().Loudness.Mode(data.Location)
+	}
+
+	// parse every time to make updates easier, and save memory
+	tpl := template.Must(template.New("base").Funcs(template.FuncMap{
+		"CsrfToken": form.TokenFunc(r),
+		"Size":      api.FormatBytes,
+		"Duration":  formatDuration,
+		"Media":     formatMedia,
+		"FolderURL": folderURL,
+	}).ParseFiles("templates/library.html", "templates/base.html"))
+	tpl.ExecuteTemplate(w, "base", data)
+}
+
+// formName the name field, a single name not a path
+func formName(r *http.Request) (string, error) {
+	name := strings.TrimSpace(r.PostForm.Get("name"))
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return "", fmt.Errorf("invalid name: %q", name)
+	}
+	return name, nil
+}
+
+// back redirects to the folder the form was posted from
+func back(w http.ResponseWriter, r *http.Request, location, relPath string) {
+	http.Redirect(w, r, folderURL(location, relPath), http.StatusSeeOther)
+}
+
+// MkdirHandler creates a folder named name in path
+func (c *Controller) MkdirHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("MkdirHandler", r.URL.String())
+
+	location := mux.Vars(r)["location"]
+	sandbox, ok := c.root(w, r, location, auth.PermManage)
+	if !ok {
+		return
+	}
+	r.ParseForm()
+	dir, err := filesystem.Clean(r.PostForm.Get("path"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	name, err := formName(r)
+	if err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if _, err := c.mkdir(location, sandbox, path.Join(dir, name)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	back(w, r, location, dir)
+}
+
+// RenameHandler renames path to name, in the same folder
+func (c *Controller) RenameHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("RenameHandler", r.URL.String())
+
+	location := mux.Vars(r)["location"]
+	sandbox, ok := c.root(w, r, location, auth.PermManage)
+	if !ok {
+		return
+	}
+	r.ParseForm()
+	relPath, err := filesystem.Clean(r.PostForm.Get("path"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	name, err := formName(r)
+	if err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	dir := path.Dir(relPath)
+	if _, err := c.move(location, sandbox, relPath, location, sandbox, path.Join(dir, name)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	back(w, r, location, dir)
+}
+
+// MoveHandler moves path into the folder to_path of to_location
+func (c *Controller) MoveHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("MoveHandler", r.URL.String())
+
+	location := mux.Vars(r)["location"]
+	sandbox, ok := c.root(w, r, location, auth.PermManage)
+	if !ok {
+		return
+	}
+	r.ParseForm()
+	toLocation := r.PostForm.Get("to_location")
+	if toLocation == "" {
+		toLocation = location
+	}
+	toSandbox, ok := c.root(w, r, toLocation, auth.PermManage)
+	if !ok {
+		return
+	}
+	relPath, err := filesystem.Clean(r.PostForm.Get("path"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	toDir, err := filesystem.Clean(r.PostForm.Get("to_path"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if _, err := c.move(location, sandbox, relPath, toLocation, toSandbox, path.Join(toDir, path.Base(relPath))); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	back(w, r, toLocation, toDir)
+}
+
+// DeleteHandler deletes path
+func (c *Controller) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("DeleteHandler", r.URL.String())
+
+	location := mux.Vars(r)["location"]
+	sandbox, ok := c.root(w, r, location, auth.PermManage)
+	if !ok {
+		return
+	}
+	r.ParseForm()
+	relPath, err := filesystem.Clean(r.PostForm.Get("path"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := c.remove(location, sandbox, relPath, auth.Username(r)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	back(w, r, location, path.Dir(relPath))
+}
@@ -0,0 +1,453 @@
+package library
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/app"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/duplicates"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/plex"
+	"github.com/jaredwarren/plexupdate/probe"
+	"github.com/jaredwarren/plexupdate/space"
+	"github.com/jaredwarren/plexupdate/trash"
+)
+
+// Controller lists and manages files in the configured locations.
+type Controller struct {
+	mux   *mux.Router
+	api   *mux.Router
+	conf  *config.Current
+	plex  *plex.Scanner
+	index *duplicates.Index
+}
+
+// Register ...
+func Register(service *app.Service) {
+	c := &Controller{
+		mux:   service.Mux,
+		api:   service.API,
+		conf:  service.Config,
+		plex:  service.Plex,
+		index: service.Index,
+	}
+	c.MountController()
+	c.index.StartUpdater(nil)
+}
+
+// MountController ...
+func (c *Controller) MountController() {
+	c.mux.HandleFunc("/library", c.Browse).Methods("GET")
+	// before /library/{location}, so it wins over a location with that name
+	c.mux.HandleFunc("/library/duplicates", c.Duplicates).Methods("GET")
+	c.mux.HandleFunc("/library/duplicates/scan", c.DuplicatesScan).Methods("POST")
+	c.mux.HandleFunc("/library/{location}", c.Browse).Methods("GET")
+	c.mux.HandleFunc("/library/{location}/mkdir", c.MkdirHandler).Methods("POST")
+	c.mux.HandleFunc("/library/{location}/rename", c.RenameHandler).Methods("POST")
+	c.mux.HandleFunc("/library/{location}/move", c.MoveHandler).Methods("POST")
+	c.mux.HandleFunc("/library/{location}/delete", c.DeleteHandler).Methods("POST")
+
+	c.api.HandleFunc("/locations", c.APILocationList).Methods("GET")
+	c.api.HandleFunc("/locations/{location}/files", c.APIList).Methods("GET")
+	c.api.HandleFunc("/locations/{location}/files", c.APIDelete).Methods("DELETE")
+	c.api.HandleFunc("/locations/{location}/folders", c.APIMkdir).Methods("POST")
+	c.api.HandleFunc("/locations/{location}/move", c.APIMove).Methods("POST")
+	c.api.HandleFunc("/space", c.APISpace).Methods("GET")
+	c.api.HandleFunc("/duplicates", c.APIDuplicates).Methods("GET")
+	c.api.HandleFunc("/duplicates/check", c.APIDuplicateCheck).Methods("GET")
+	c.api.HandleFunc("/duplicates/scan", c.APIDuplicatesScan).Methods("POST")
+}
+
+// statusError an error with the status code to send
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+// writeError picks the status from the error
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusInternalServerError
+	var se *statusError
+	switch {
+	case errors.As(err, &se):
+		code = se.code
+	case errors.Is(err, filesystem.ErrExists):
+		code = http.StatusConflict
+	case errors.Is(err, filesystem.ErrEscape), errors.Is(err, filesystem.ErrSymlink):
+		code = http.StatusForbidden
+	case errors.Is(err, filesystem.ErrEmptyName), errors.Is(err, filesystem.ErrInvalid):
+		code = http.StatusBadRequest
+	case errors.Is(err, space.ErrNoSpace), errors.Is(err, space.ErrQuota):
+		code = space.Status(err)
+	case errors.Is(err, probe.ErrNotAllowed):
+		code = probe.Status(err)
+	case os.IsNotExist(err):
+		code = http.StatusNotFound
+	}
+	api.WriteError(w, r, code, err)
+}
+
+// root returns the sandbox for a location and checks the user can do perm in it
+func (c *Controller) root(w http.ResponseWriter, r *http.Request, location, perm string) (*filesystem.Sandbox, bool) {
+	if rootDir, ok := c.conf.Get().Plex.Locations[location]; !ok || rootDir == "" {
+		api.WriteError(w, r, http.StatusNotFound, fmt.Errorf("unknown location: %q", location))
+		return nil, false
+	}
+	if !auth.Check(w, r, perm, location) {
+		return nil, false
+	}
+	sandbox, err := c.conf.Get().Plex.Sandbox(location)
+	if err != nil {
+		api.WriteError(w, r, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return sandbox, true
+}
+
+// APILocationList lists the locations the user can do anything in
+func (c *Controller) APILocationList(w http.ResponseWriter, r *http.Request) {
+	locations := []api.Location{}
+	for name, path := range c.conf.Get().Plex.Locations {
+		for _, perm := range auth.AllPermissions {
+			if auth.Can(r, perm, name) {
+				locations = append(locations, api.Location{Name: name, Path: path})
+				break
+			}
+		}
+	}
+	sort.Slice(locations, func(a, b int) bool {
+		return locations[a].Name < locations[b].Name
+	})
+	api.WriteJSON(w, http.StatusOK, locations)
+}
+
+// APISpace reports free space and quota use for the locations the user can
+// do anything in
+func (c *Controller) APISpace(w http.ResponseWriter, r *http.Request) {
+	api.WriteJSON(w, http.StatusOK, space.ForUser(r, c.conf.Get()))
+}
+
+// resolve is Sandbox.Resolve, the trash is only reachable from its own page
+func resolve(sandbox *filesystem.Sandbox, relPath string) (string, error) {
+	if trash.Contains(relPath) {
+		return "", &statusError{http.StatusNotFound, fmt.Errorf("%s is in the trash", relPath)}
+	}
+	return sandbox.Resolve(relPath)
+}
+
+// list reads a folder, sorted by name, size, modified or duration
+func (c *Controller) list(location string, sandbox *filesystem.Sandbox, relPath, sortBy string, desc bool) (*api.Listing, error) {
+	relPath, err := filesystem.Clean(relPath)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := resolve(sandbox, relPath)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	listing := &api.Listing{
+		Location: location,
+		Path:     relPath,
+		Entries:  []api.Entry{},
+	}
+	for _, f := range files {
+		if relPath == "/" && f.Name() == trash.Dir {
+			continue
+		}
+		e := api.Entry{
+			Name:     f.Name(),
+			Path:     path.Join(relPath, f.Name()),
+			Dir:      f.IsDir(),
+			Size:     f.Size(),
+			Modified: f.ModTime(),
+		}
+		if !f.IsDir() {
+			if e.Media = probe.Cached(c.conf.Get().Probe, filepath.Join(dir, f.Name()), f); e.Media != nil {
+				e.Duration = e.Media.Duration
+			}
+		}
+		listing.Entries = append(listing.Entries, e)
+	}
+	sortEntries(listing.Entries, sortBy, desc)
+	return listing, nil
+}
+
+// APIList lists a folder, ?path= is relative to the location root,
+// ?sort=name|size|modified|duration and ?order=desc
+func (c *Controller) APIList(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("APIList", r.URL.String())
+
+	location := mux.Vars(r)["location"]
+	sandbox, ok := c.root(w, r, location, auth.PermLibrary)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	listing, err := c.list(location, sandbox, q.Get("path"), q.Get("sort"), q.Get("order") == "desc")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	api.WriteJSON(w, http.StatusOK, listing)
+}
+
+// target cleans a path that's about to be created, the last part is normalized
+func target(sandbox *filesystem.Sandbox, relPath string) (string, string, error) {
+	relPath, err := filesystem.Clean(relPath)
+	if err != nil {
+		return "", "", err
+	}
+	if relPath == "/" {
+		return "", "", &statusError{http.StatusBadRequest, errors.New("missing path")}
+	}
+	name, err := filesystem.NormalizeFilename(path.Base(relPath))
+	if err != nil {
+		return "", "", err
+	}
+	relPath = path.Join(path.Dir(relPath), name)
+	p, err := resolve(sandbox, relPath)
+	return relPath, p, err
+}
+
+// mkdir creates relPath and any missing parents
+func (c *Controller) mkdir(location string, sandbox *filesystem.Sandbox, relPath string) (*api.Entry, error) {
+	relPath, dir, err := target(sandbox, relPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Lstat(dir); err == nil {
+		return nil, fmt.Errorf("%s %w", relPath, filesystem.ErrExists)
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &api.Entry{
+		Name:     fi.Name(),
+		Path:     relPath,
+		Dir:      true,
+		Modified: fi.ModTime(),
+	}, nil
+}
+
+// move renames relPath to toRelPath, which can be in another location
+func (c *Controller) move(location string, sandbox *filesystem.Sandbox, relPath, toLocation string, toSandbox *filesystem.Sandbox, toRelPath string) (*api.Entry, error) {
+	relPath, err := filesystem.Clean(relPath)
+	if err != nil {
+		return nil, err
+	}
+	if relPath == "/" {
+		return nil, &statusError{http.StatusBadRequest, errors.New("can't move a location root")}
+	}
+	from, err := resolve(sandbox, relPath)
+	if err != nil {
+		return nil, err
+	}
+	toRelPath, to, err := target(toSandbox, toRelPath)
+	if err != nil {
+		return nil, err
+	}
+	if filesystem.Within(from, to) {
+		return nil, &statusError{http.StatusBadRequest, errors.New("can't move a folder into itself")}
+	}
+	if _, err := os.Lstat(from); err != nil {
+		return nil, err
+	}
+	files, size, err := tree(from)
+	if err != nil {
+		return nil, err
+	}
+	if toLocation != location {
+		// it's new to the other location, like an upload
+		conf := c.conf.Get()
+		if err := space.Check(conf, toLocation, size); err != nil {
+			return nil, err
+		}
+		for _, rel := range files {
+			if err := probe.Allowed(conf.Probe, toLocation, filepath.Join(from, filepath.FromSlash(rel))); err != nil {
+				return nil, fmt.Errorf("%s: %w", path.Join(relPath, rel), err)
+			}
+		}
+	}
+	if err := filesystem.Move(from, to); err != nil {
+		if errors.Is(err, filesystem.ErrExists) {
+			return nil, fmt.Errorf("%s %w", toRelPath, filesystem.ErrExists)
+		}
+		return nil, err
+	}
+
+	for _, rel := range files {
+		if err := c.index.Remove(location, path.Join(relPath, rel)); err != nil {
+			fmt.Println("  [E]: library index:", err)
+		}
+		if err := c.index.Add(toLocation, path.Join(toRelPath, rel)); err != nil {
+			fmt.Println("  [E]: library index:", err)
+		}
+	}
+	if toLocation != location {
+		space.Forget(location)
+		space.Forget(toLocation)
+	}
+
+	// let plex know about both sides
+	c.plex.Scan(location, filepath.Dir(from))
+	if toLocation != location || filepath.Dir(from) != filepath.Dir(to) {
+		c.plex.Scan(toLocation, filepath.Dir(to))
+	}
+
+	fi, err := os.Stat(to)
+	if err != nil {
+		return nil, err
+	}
+	return &api.Entry{
+		Name:     fi.Name(),
+		Path:     toRelPath,
+		Dir:      fi.IsDir(),
+		Size:     fi.Size(),
+		Modified: fi.ModTime(),
+	}, nil
+}
+
+// tree the files in p the library index keeps, relative to p with "" for
+// p itself, and the size of everything in it
+func tree(p string) ([]string, int64, error) {
+	var files []string
+	var size int64
+	err := filepath.Walk(p, func(f string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		size += fi.Size()
+		rel, err := filepath.Rel(p, f)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			rel = ""
+		}
+		// what's in hidden folders, e.g. .trash, isn't indexed
+		if fi.Size() == 0 || strings.HasPrefix(fi.Name(), ".") || strings.HasSuffix(fi.Name(), ".part") ||
+			strings.HasPrefix(rel, ".") || strings.Contains(rel, "/.") {
+			return nil
+		}
+		files = append(files, rel)
+		return nil
+	})
+	return files, size, err
+}
+
+// remove moves a file, or a folder and everything in it, to the trash
+func (c *Controller) remove(location string, sandbox *filesystem.Sandbox, relPath, user string) error {
+	relPath, err := filesystem.Clean(relPath)
+	if err != nil {
+		return err
+	}
+	if relPath == "/" {
+		return &statusError{http.StatusBadRequest, errors.New("can't delete a location root")}
+	}
+	p, err := resolve(sandbox, relPath)
+	if err != nil {
+		return err
+	}
+	if err := trash.Delete(c.conf.Get().Trash, sandbox, location, relPath, user); err != nil {
+		return err
+	}
+	c.plex.Scan(location, filepath.Dir(p))
+	return nil
+}
+
+// APIMkdir creates a folder
+func (c *Controller) APIMkdir(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("APIMkdir", r.URL.String())
+
+	location := mux.Vars(r)["location"]
+	sandbox, ok := c.root(w, r, location, auth.PermManage)
+	if !ok {
+		return
+	}
+	req := &api.FolderRequest{}
+	if err := api.ReadJSON(r, req); err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	entry, err := c.mkdir(location, sandbox, req.Path)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	api.WriteJSON(w, http.StatusCreated, entry)
+}
+
+// APIMove renames or moves a file or folder
+func (c *Controller) APIMove(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("APIMove", r.URL.String())
+
+	location := mux.Vars(r)["location"]
+	sandbox, ok := c.root(w, r, location, auth.PermManage)
+	if !ok {
+		return
+	}
+	req := &api.MoveRequest{}
+	if err := api.ReadJSON(r, req); err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if req.ToLocation == "" {
+		req.ToLocation = location
+	}
+	toSandbox, ok := c.root(w, r, req.ToLocation, auth.PermManage)
+	if !ok {
+		return
+	}
+	entry, err := c.move(location, sandbox, req.Path, req.ToLocation, toSandbox, req.ToPath)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	api.WriteJSON(w, http.StatusOK, entry)
+}
+
+// APIDelete deletes a file or folder, ?path= is relative to the location root
+func (c *Controller) APIDelete(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("APIDelete", r.URL.String())
+
+	location := mux.Vars(r)["location"]
+	sandbox, ok := c.root(w, r, location, auth.PermManage)
+	if !ok {
+		return
+	}
+	if err := c.remove(location, sandbox, r.URL.Query().Get("path"), auth.Username(r)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
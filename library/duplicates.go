@@ -0,0 +1,117 @@
+package library
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/form"
+)
+
+// visible only files in locations the user can see, and only groups that
+// still have more than one of them
+func visible(r *http.Request, groups []api.DuplicateGroup) []api.DuplicateGroup {
+	list := []api.DuplicateGroup{}
+	for _, g := range groups {
+		files := []api.LibraryFile{}
+		for _, f := range g.Files {
+			if auth.Can(r, auth.PermLibrary, f.Location) {
+				files = append(files, f)
+			}
+		}
+		if len(files) > 1 {
+			g.Files = files
+			list = append(list, g)
+		}
+	}
+	return list
+}
+
+// Duplicates shows files that are in the library more than once
+func (c *Controller) Duplicates(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Duplicates", r.URL.String())
+
+	if !auth.Permissions(r)[auth.PermLibrary] {
+		auth.Check(w, r, auth.PermLibrary, "")
+		return
+	}
+
+	data := &struct {
+		Title  string
+		Groups []api.DuplicateGroup
+		Wasted int64
+		Job    *api.Job
+	}{
+		Title:  "Duplicates",
+		Groups: visible(r, api.NewDuplicateGroups(c.index.Groups())),
+	}
+	for _, g := range data.Groups {
+		data.Wasted += g.Size * int64(len(g.Files)-1)
+	}
+	if j := c.index.Job(); j != nil {
+		data.Job = api.NewJob(j)
+	}
+
+	// parse every time to make updates easier, and save memory
+	tpl := template.Must(template.New("base").Funcs(template.FuncMap{
+		"CsrfToken": form.TokenFunc(r),
+		"Size":      api.FormatBytes,
+		"FolderURL": folderURL,
+		"Dir":       path.Dir,
+	}).ParseFiles("templates/duplicates.html", "templates/base.html"))
+	tpl.ExecuteTemplate(w, "base", data)
+}
+
+// DuplicatesScan starts an index update
+func (c *Controller) DuplicatesScan(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("DuplicatesScan", r.URL.String())
+
+	if !auth.Permissions(r)[auth.PermLibrary] {
+		auth.Check(w, r, auth.PermLibrary, "")
+		return
+	}
+	c.index.Update()
+	http.Redirect(w, r, "/library/duplicates", http.StatusSeeOther)
+}
+
+// APIDuplicates lists groups of files with the same content
+func (c *Controller) APIDuplicates(w http.ResponseWriter, r *http.Request) {
+	api.WriteJSON(w, http.StatusOK, visible(r, api.NewDuplicateGroups(c.index.Groups())))
+}
+
+// APIDuplicateCheck lists files that may be the same as one about to be
+// uploaded, ?size= and ?quick= the hash of its first and last MB
+func (c *Controller) APIDuplicateCheck(w http.ResponseWriter, r *http.Request) {
+	if !auth.Permissions(r)[auth.PermUpload] {
+		auth.Check(w, r, auth.PermUpload, "")
+		return
+	}
+	size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+	if err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, errors.New("invalid size"))
+		return
+	}
+	files := []api.LibraryFile{}
+	for _, f := range api.NewLibraryFiles(c.index.Check(size, r.URL.Query().Get("quick"))) {
+		if auth.Can(r, auth.PermLibrary, f.Location) || auth.Can(r, auth.PermUpload, f.Location) {
+			files = append(files, f)
+		}
+	}
+	api.WriteJSON(w, http.StatusOK, files)
+}
+
+// APIDuplicatesScan starts an index update, or returns the one running
+func (c *Controller) APIDuplicatesScan(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("APIDuplicatesScan", r.URL.String())
+
+	if !auth.Permissions(r)[auth.PermLibrary] {
+		auth.Check(w, r, auth.PermLibrary, "")
+		return
+	}
+	api.WriteJSON(w, http.StatusAccepted, api.NewJob(c.index.Update()))
+}
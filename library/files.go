@@ -0,0 +1,83 @@
+package library
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+)
+
+// sortEntries by name, size or modified. Folders always come first.
+func sortEntries(entries []api.Entry, by string, desc bool) {
+	less := func(a, b api.Entry) bool {
+		switch by {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "modified":
+			if !a.Modified.Equal(b.Modified) {
+				return a.Modified.Before(b.Modified)
+			}
+		case "duration":
+			if a.Duration != b.Duration {
+				return a.Duration < b.Duration
+			}
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Dir != b.Dir {
+			return a.Dir
+		}
+		if desc {
+			return less(b, a)
+		}
+		return less(a, b)
+	})
+}
+
+// formatDuration 1:02:03 or 4:05
+func formatDuration(seconds float64) string {
+	if seconds <= 0 {
+		return ""
+	}
+	d := time.Duration(seconds) * time.Second
+	h, m, s := int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
+
+// formatMedia h264 1920x1080, aac 2ch, 2 subtitles
+func formatMedia(m *api.MediaProbe) string {
+	if m == nil {
+		return ""
+	}
+	parts := []string{}
+	for _, v := range m.Video {
+		parts = append(parts, fmt.Sprintf("%s %dx%d", v.Codec, v.Width, v.Height))
+	}
+	for _, a := range m.Audio {
+		p := a.Codec
+		if a.Channels > 0 {
+			p += fmt.Sprintf(" %dch", a.Channels)
+		}
+		if a.Language != "" {
+			p += " " + a.Language
+		}
+		parts = append(parts, p)
+	}
+	switch n := len(m.Subtitles); n {
+	case 0:
+	case 1:
+		parts = append(parts, "1 subtitle")
+	default:
+		parts = append(parts, fmt.Sprintf("%d subtitles", n))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,112 @@
+package loudness
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/gorilla/mux"
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/app"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/filesystem"
+)
+
+// Controller starts loudness jobs for library files and folders.
+type Controller struct {
+	mux  *mux.Router
+	api  *mux.Router
+	conf *config.Current
+}
+
+// Register sets up the processor uploads and downloads use, and the routes
+func Register(service *app.Service) {
+	processor = &Processor{
+		conf:  service.Config,
+		jobs:  service.Jobs.NewQueue(1),
+		plex:  service.Plex,
+		index: service.Index,
+	}
+	c := &Controller{
+		mux:  service.Mux,
+		api:  service.API,
+		conf: service.Config,
+	}
+	c.MountController()
+}
+
+// MountController ...
+func (c *Controller) MountController() {
+	c.mux.HandleFunc("/library/{location}/loudness", c.LoudnessHandler).Methods("POST")
+
+	c.api.HandleFunc("/loudness", c.APILoudness).Methods("POST")
+}
+
+// writeError picks the status from err
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrMode), errors.Is(err, filesystem.ErrInvalid):
+		code = http.StatusBadRequest
+	case errors.Is(err, filesystem.ErrEscape), errors.Is(err, filesystem.ErrSymlink):
+		code = http.StatusForbidden
+	case os.IsNotExist(err):
+		code = http.StatusNotFound
+	}
+	api.WriteError(w, r, code, err)
+}
+
+// check the location exists and the user can manage it
+func (c *Controller) check(w http.ResponseWriter, r *http.Request, location string) bool {
+	if _, ok := c.conf.Get().Plex.Locations[location]; !ok {
+		api.WriteError(w, r, http.StatusNotFound, fmt.Errorf("unknown location: %q", location))
+		return false
+	}
+	return auth.Check(w, r, auth.PermManage, location)
+}
+
+// LoudnessHandler starts a job for a file or folder from the library browser
+func (c *Controller) LoudnessHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("LoudnessHandler", r.URL.String())
+
+	location := mux.Vars(r)["location"]
+	if !c.check(w, r, location) {
+		return
+	}
+	r.ParseForm()
+	relPath := r.PostForm.Get("path")
+	if _, err := processor.Start(location, relPath, r.PostForm.Get("mode"), auth.Username(r)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	back := r.PostForm.Get("back")
+	if back == "" {
+		back = path.Dir(relPath)
+	}
+	http.Redirect(w, r, "/library/"+url.PathEscape(location)+"?path="+url.QueryEscape(back), http.StatusSeeOther)
+}
+
+// APILoudness starts a job for a file or every audio file in a folder
+func (c *Controller) APILoudness(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("APILoudness", r.URL.String())
+
+	req := &api.LoudnessRequest{}
+	if err := api.ReadJSON(r, req); err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if !c.check(w, r, req.Location) {
+		return
+	}
+	j, err := processor.Start(req.Location, req.Path, req.Mode, auth.Username(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", api.Prefix+"/jobs/"+j.ID)
+	api.WriteJSON(w, http.StatusAccepted, api.NewJob(j))
+}
@@ -0,0 +1,163 @@
+package loudness
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultCommand used when transcode.command isn't set
+const DefaultCommand = "ffmpeg"
+
+// lra loudness range loudnorm aims for, it only matters when it has to
+// fall back to dynamic mode
+const lra = 11
+
+// ErrSilent the file has no audio loud enough to measure
+var ErrSilent = errors.New("too quiet to measure")
+
+// codec how each audio format is written back
+type codec struct {
+	format string
+	args   []string
+}
+
+// codecs by extension, files with others are left alone
+var codecs = map[string]codec{
+	".mp3":  {"mp3", []string{"-c:a", "libmp3lame", "-q:a", "2"}},
+	".m4a":  {"ipod", []string{"-c:a", "aac", "-b:a", "256k"}},
+	".aac":  {"adts", []string{"-c:a", "aac", "-b:a", "256k"}},
+	".flac": {"flac", []string{"-c:a", "flac"}},
+	".ogg":  {"ogg", []string{"-c:a", "libvorbis", "-q:a", "6"}},
+	".opus": {"opus", []string{"-c:a", "libopus", "-b:a", "160k"}},
+	".wav":  {"wav", []string{"-c:a", "pcm_s16le"}},
+}
+
+// IsAudio true for files loudness knows how to write back
+func IsAudio(file string) bool {
+	_, ok := codecs[strings.ToLower(filepath.Ext(file))]
+	return ok
+}
+
+// Measurement what loudnorm's first pass found
+type Measurement struct {
+	// Integrated loudness in LUFS
+	Integrated float64
+	// TruePeak in dBTP
+	TruePeak   float64
+	Range      float64
+	Threshold  float64
+	Offset     float64
+	SampleRate int
+}
+
+// Gain to reach target, for ReplayGain
+func (m *Measurement) Gain(target float64) float64 {
+	return target - m.Integrated
+}
+
+// Peak as a linear sample value, for ReplayGain
+func (m *Measurement) Peak() float64 {
+	return math.Pow(10, m.TruePeak/20)
+}
+
+var sampleRateRe = regexp.MustCompile(`Audio: .*?, (\d+) Hz`)
+
+// ffmpeg runs command and returns what it wrote to stderr
+func ffmpeg(ctx context.Context, command string, args ...string) (string, error) {
+	if command == "" {
+		command = DefaultCommand
+	}
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		return "", fmt.Errorf("ffmpeg: %s", lines[len(lines)-1])
+	}
+	return stderr.String(), nil
+}
+
+// loudnorm filter settings for target and peak
+func loudnorm(target, peak float64) string {
+	return fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%d", target, peak, lra)
+}
+
+// Measure runs loudnorm's first pass over file
+func Measure(ctx context.Context, command, file string, target, peak float64) (*Measurement, error) {
+	out, err := ffmpeg(ctx, command, "-hide_banner", "-nostdin", "-nostats", "-i", file,
+		"-map", "0:a:0", "-af", loudnorm(target, peak)+":print_format=json", "-f", "null", "-")
+	if err != nil {
+		return nil, err
+	}
+	// the json is the last thing printed
+	start, end := strings.LastIndex(out, "{"), strings.LastIndex(out, "}")
+	if start < 0 || end < start {
+		return nil, errors.New("loudnorm printed no measurements")
+	}
+	raw := map[string]string{}
+	if err := json.Unmarshal([]byte(out[start:end+1]), &raw); err != nil {
+		return nil, fmt.Errorf("loudnorm: %w", err)
+	}
+	m := &Measurement{}
+	for key, v := range map[string]*float64{
+		"input_i":       &m.Integrated,
+		"input_tp":      &m.TruePeak,
+		"input_lra":     &m.Range,
+		"input_thresh":  &m.Threshold,
+		"target_offset": &m.Offset,
+	} {
+		f, err := strconv.ParseFloat(raw[key], 64)
+		if err != nil || math.IsInf(f, 0) {
+			return nil, ErrSilent
+		}
+		*v = f
+	}
+	if match := sampleRateRe.FindStringSubmatch(out); match != nil {
+		m.SampleRate, _ = strconv.Atoi(match[1])
+	}
+	return m, nil
+}
+
+// normalizeArgs loudnorm's second pass, in linear mode with what the first
+// pass measured, written to out
+func normalizeArgs(m *Measurement, in, out string, target, peak float64) []string {
+	c := codecs[strings.ToLower(filepath.Ext(in))]
+	filter := fmt.Sprintf("%s:measured_I=%g:measured_TP=%g:measured_LRA=%g:measured_thresh=%g:offset=%g:linear=true",
+		loudnorm(target, peak), m.Integrated, m.TruePeak, m.Range, m.Threshold, m.Offset)
+	// loudnorm resamples to 192kHz, go back to what it was
+	rate := m.SampleRate
+	if rate == 0 {
+		rate = 44100
+	}
+	a := []string{"-hide_banner", "-nostdin", "-nostats", "-y", "-i", in,
+		"-map", "0:a:0", "-map", "0:v?", "-c:v", "copy", "-map_metadata", "0",
+		"-af", filter, "-ar", strconv.Itoa(rate)}
+	a = append(a, c.args...)
+	return append(a, "-f", c.format, out)
+}
+
+// replayGainArgs copies in to out with ReplayGain track tags
+func replayGainArgs(m *Measurement, in, out string, target float64) []string {
+	c := codecs[strings.ToLower(filepath.Ext(in))]
+	a := []string{"-hide_banner", "-nostdin", "-nostats", "-y", "-i", in,
+		"-map", "0", "-c", "copy", "-map_metadata", "0",
+		"-metadata", fmt.Sprintf("REPLAYGAIN_TRACK_GAIN=%.2f dB", m.Gain(target)),
+		"-metadata", fmt.Sprintf("REPLAYGAIN_TRACK_PEAK=%.6f", m.Peak())}
+	// mp4 only keeps tags it knows about without this
+	if c.format == "ipod" {
+		a = append(a, "-movflags", "use_metadata_tags")
+	}
+	return append(a, "-f", c.format, out)
+}
@@ -0,0 +1,195 @@
+package loudness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/duplicates"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/jobs"
+	"github.com/jaredwarren/plexupdate/plex"
+	"github.com/jaredwarren/plexupdate/trash"
+)
+
+// JobType of loudness jobs, for a file or a whole folder
+const JobType = "loudness"
+
+// partExt the new file is written to a hidden .part file until ffmpeg is done
+const partExt = ".part"
+
+// tolerance files this close to the target, in LU, aren't re-encoded
+const tolerance = 0.5
+
+// ErrMode the location doesn't have a loudness mode, and none was asked for
+var ErrMode = errors.New("loudness mode must be normalize or replaygain")
+
+// processor set up by Register, uploads and downloads add to it with Enqueue
+var processor *Processor
+
+// Processor measures and evens out loudness, one file at a time
+type Processor struct {
+	conf  *config.Current
+	jobs  *jobs.Queue
+	plex  *plex.Scanner
+	index *duplicates.Index
+}
+
+// Enqueue processes a new file if its location has a loudness mode. It
+// returns nil if it doesn't or the file isn't audio.
+func Enqueue(location, relPath, user string) (*jobs.Job, error) {
+	if processor == nil {
+		return nil, errors.New("loudness isn't set up")
+	}
+	if processor.conf.Get().Loudness.Mode(location) == "" || !IsAudio(relPath) {
+		return nil, nil
+	}
+	return processor.Start(location, relPath, "", user)
+}
+
+// Start processes relPath, a file or every audio file in a folder, with
+// mode or the location's mode
+func (p *Processor) Start(location, relPath, mode, user string) (*jobs.Job, error) {
+	if mode == "" {
+		mode = p.conf.Get().Loudness.Mode(location)
+	}
+	if mode != config.LoudnessNormalize && mode != config.LoudnessReplayGain {
+		return nil, fmt.Errorf("%w, not %q", ErrMode, mode)
+	}
+	sandbox, err := p.conf.Get().Plex.Sandbox(location)
+	if err != nil {
+		return nil, err
+	}
+	relPath, err = filesystem.Clean(relPath)
+	if err != nil {
+		return nil, err
+	}
+	if trash.Contains(relPath) {
+		return nil, fmt.Errorf("%s: %w", relPath, filesystem.ErrEscape)
+	}
+	root, err := sandbox.Resolve(relPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+
+	j := p.jobs.Start(JobType, user, location, func(ctx context.Context, j *jobs.Job) (string, error) {
+		return p.run(ctx, j, location, sandbox, root, mode, user)
+	})
+	fmt.Println("  loudness", mode, location, relPath, "job", j.ID)
+	return j, nil
+}
+
+// run processes every audio file under root
+func (p *Processor) run(ctx context.Context, j *jobs.Job, location string, sandbox *filesystem.Sandbox, root, mode, user string) (string, error) {
+	files := []string{}
+	err := filepath.Walk(root, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// hidden folders, the trash among them
+		if fi.IsDir() && file != root && strings.HasPrefix(fi.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if fi.Mode().IsRegular() && IsAudio(file) && !strings.HasPrefix(fi.Name(), ".") {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", errors.New("no audio files")
+	}
+
+	done, skipped, failed := 0, 0, 0
+	var lastErr error
+	dirs := map[string]bool{}
+	for i, file := range files {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		relPath, err := sandbox.Rel(file)
+		if err == nil {
+			var changed bool
+			changed, err = p.process(ctx, location, sandbox, file, relPath, mode, user)
+			if changed {
+				done++
+				dirs[filepath.Dir(file)] = true
+			} else if err == nil {
+				skipped++
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			failed++
+			lastErr = err
+			fmt.Println("  [E]: loudness:", file, err)
+		}
+		j.SetProgress(float64(i+1) / float64(len(files)))
+	}
+	for dir := range dirs {
+		p.plex.Scan(location, dir)
+	}
+
+	result := fmt.Sprintf("%s: %d done, %d already fine, %d failed", mode, done, skipped, failed)
+	if failed == len(files) {
+		return result, lastErr
+	}
+	return result, nil
+}
+
+// process one file, changed is false if it was left alone
+func (p *Processor) process(ctx context.Context, location string, sandbox *filesystem.Sandbox, file, relPath, mode, user string) (bool, error) {
+	target, peak := p.conf.Get().Loudness.Levels()
+	m, err := Measure(ctx, p.conf.Get().Transcode.Command, file, target, peak)
+	if err != nil {
+		return false, err
+	}
+
+	part := filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+partExt)
+	var args []string
+	switch mode {
+	case config.LoudnessNormalize:
+		if math.Abs(m.Integrated-target) < tolerance && m.TruePeak <= peak {
+			return false, nil
+		}
+		args = normalizeArgs(m, file, part, target, peak)
+	case config.LoudnessReplayGain:
+		if strings.EqualFold(path.Ext(relPath), ".wav") {
+			return false, errors.New("wav files can't have ReplayGain tags")
+		}
+		args = replayGainArgs(m, file, part, target)
+	}
+	if _, err := ffmpeg(ctx, p.conf.Get().Transcode.Command, args...); err != nil {
+		os.Remove(part)
+		return false, err
+	}
+
+	// re-encoding loses something, keep the original. Tags are lossless.
+	if mode == config.LoudnessNormalize {
+		if err := trash.Replace(p.conf.Get().Trash, sandbox, location, relPath, user); err != nil {
+			os.Remove(part)
+			return false, err
+		}
+	}
+	if err := os.Rename(part, file); err != nil {
+		os.Remove(part)
+		return false, err
+	}
+	if err := p.index.Add(location, relPath); err != nil {
+		fmt.Println("  [E]: library index:", err)
+	}
+	return true, nil
+}
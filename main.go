@@ -1,60 +1,75 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"runtime"
+	"strings"
 	"text/template"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/websocket"
+	"github.com/jaredwarren/plexupdate/api"
 	"github.com/jaredwarren/plexupdate/app"
+	"github.com/jaredwarren/plexupdate/archive"
+	"github.com/jaredwarren/plexupdate/auth"
 	"github.com/jaredwarren/plexupdate/command"
 	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/download"
+	"github.com/jaredwarren/plexupdate/feeds"
 	"github.com/jaredwarren/plexupdate/form"
+	"github.com/jaredwarren/plexupdate/library"
+	"github.com/jaredwarren/plexupdate/loudness"
+	"github.com/jaredwarren/plexupdate/plex"
+	"github.com/jaredwarren/plexupdate/remote"
+	"github.com/jaredwarren/plexupdate/space"
+	"github.com/jaredwarren/plexupdate/transcode"
+	"github.com/jaredwarren/plexupdate/trash"
+	"github.com/jaredwarren/plexupdate/upload"
+	"github.com/jaredwarren/plexupdate/webhook"
 	"github.com/jaredwarren/plexupdate/youtube"
 	"github.com/spf13/viper"
 )
 
-var conf config.Configuration
+// conf in use, swapped for a new one when the config file changes
+var conf = config.NewCurrent(&config.Configuration{})
 
 func main() {
-	// config
-	viper.SetConfigName("config_" + runtime.GOOS)
-	viper.AddConfigPath(".")
-	viper.WatchConfig()
-	if err := viper.ReadInConfig(); err != nil {
-		log.Fatalf("Error reading config file, %s", err)
-	}
-	err := viper.Unmarshal(&conf)
-	if err != nil {
-		log.Fatalf("unable to decode into struct, %v", err)
+	// anything after the binary name is a cli command for a running server
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:]))
 	}
 
-	// Reload config on change
-	viper.OnConfigChange(func(e fsnotify.Event) {
-		// reset config, so deleted values go away
-		conf = config.Configuration{}
-		// reload new config
-		err := viper.Unmarshal(&conf)
-		if err != nil {
-			log.Fatalf("unable to decode into struct, %v", err)
-		}
-	})
+	loadConfig(discoverLocations)
 
 	service := app.New("Plex", conf)
 
+	// auth, must be first so every other route requires a login
+	if err := auth.Register(service); err != nil {
+		log.Fatalf("unable to load users, %v", err)
+	}
+
+	// csrf tokens on every form post
+	form.Register(service)
+
 	// Static file handler
 	// service.Mux.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static/"))))
 
 	service.Mux.HandleFunc("/", Home).Methods("GET") // for now just go to update.
-	service.Mux.HandleFunc("/upload", Upload).Methods("GET")
-	service.Mux.HandleFunc("/upload", UploadHandler).Methods("POST")
+
+	// upload
+	upload.Register(service)
+
+	// json api, openapi.json
+	api.Register(service)
+
+	// library
+	library.Register(service)
 
 	// ytdl
 	youtube.Register(service)
@@ -62,6 +77,30 @@ func main() {
 	// command
 	command.Register(service)
 
+	// plex webhooks
+	webhook.Register(service)
+
+	// trash, restore and purge deleted files
+	trash.Register(service)
+
+	// transcode queue and profiles
+	transcode.Register(service)
+
+	// loudness normalization and replaygain
+	loudness.Register(service)
+
+	// unpacking uploaded and downloaded archives
+	archive.Register(service)
+
+	// direct url downloads
+	download.Register(service)
+
+	// podcast and video feed subscriptions
+	feeds.Register(service)
+
+	// imports from remote file servers
+	remote.Register(service)
+
 	exit := make(chan error)
 
 	// Interrupt handler (ctrl-c)
@@ -88,85 +127,76 @@ func main() {
 	fmt.Printf("\nexiting (%v)\n", <-exit)
 
 	command.Cleanup()
+	service.Jobs.Cleanup()
 
 	fmt.Println("Good Bye!")
 }
 
-// Home ...
-func Home(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Home", r.URL.String())
-
-	// parse every time to make updates easier, and save memory
-	tpl := template.Must(template.New("base").ParseFiles("templates/home.html", "templates/base.html"))
-	tpl.ExecuteTemplate(w, "base", &struct {
-		Title string
-	}{
-		Title: "Home",
-	})
-}
-
-// Upload ...
-func Upload(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Update", r.URL.String())
+// loadConfig reads config_{os}.yml into conf, and on change reads it into
+// a new Configuration that replaces it. prepare, if not nil, gets each one
+// before it's used.
+func loadConfig(prepare func(*config.Configuration)) {
+	viper.SetConfigName("config_" + runtime.GOOS)
+	viper.AddConfigPath(".")
+	viper.WatchConfig()
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatalf("Error reading config file, %s", err)
+	}
+	read := func() {
+		// a new one, so deleted values go away
+		next := &config.Configuration{}
+		if err := viper.Unmarshal(next); err != nil {
+			log.Fatalf("unable to decode into struct, %v", err)
+		}
+		if prepare != nil {
+			prepare(next)
+		}
+		conf.Set(next)
+	}
+	read()
 
-	// parse every time to make updates easier, and save memory
-	tpl := template.Must(template.New("base").Funcs(template.FuncMap{"CsrfToken": form.CsrfToken}).ParseFiles("templates/upload.html", "templates/base.html"))
-	tpl.ExecuteTemplate(w, "base", &struct {
-		Title     string
-		Locations map[string]string
-	}{
-		Title:     "User List",
-		Locations: conf.Plex.Locations,
+	// Reload config on change
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		read()
 	})
 }
 
-// UploadHandler ...
-func UploadHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
-	fmt.Println("UploadHandler", r.URL.String())
-
-	// 3200 MB files max.
-	r.Body = http.MaxBytesReader(w, r.Body, 3200<<20)
-	if err := r.ParseMultipartForm(3200 << 20); err != nil {
-		w.Write([]byte(" [E]:" + err.Error()))
-		return
-	}
-
-	// setup root dir
-	location := r.PostForm.Get("location")
-	rootDir := conf.Plex.Locations[location]
-	if rootDir == "" {
-		rootDir = "./uploads"
-	}
-	err = os.MkdirAll(rootDir, os.ModePerm)
-	if err != nil {
-		w.Write([]byte(" [E]:" + err.Error()))
+// discoverLocations adds plex's library folders to c, if plex.discover is
+// on. c isn't in use yet.
+func discoverLocations(c *config.Configuration) {
+	if !c.Plex.Discover || c.Plex.URL == "" {
 		return
 	}
-
-	// get form file
-	file, handler, err := r.FormFile("video_file")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	added, err := plex.Discover(ctx, c)
 	if err != nil {
-		w.Write([]byte(" [E]:" + err.Error()))
+		fmt.Println("  [E]: plex discover:", err)
 		return
 	}
-	defer file.Close()
+	fmt.Println("plex locations:", strings.Join(added, ", "))
+}
 
-	// TODO: get dir
-	f, err := os.OpenFile(filepath.Join(rootDir, handler.Filename), os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		w.Write([]byte(" [E]:" + err.Error()))
-		return
-	}
-	defer f.Close()
-	_, err = io.Copy(f, file)
-	if err != nil {
-		w.Write([]byte(" [E]:" + err.Error()))
-		return
-	}
+// Home ...
+func Home(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Home", r.URL.String())
 
-	fmt.Println("  DONE!")
-	w.Write([]byte("DONE"))
+	// parse every time to make updates easier, and save memory
+	tpl := template.Must(template.New("base").Funcs(template.FuncMap{
+		"CsrfToken": form.TokenFunc(r),
+		"Size":      api.FormatBytes,
+	}).ParseFiles("templates/home.html", "templates/base.html"))
+	tpl.ExecuteTemplate(w, "base", &struct {
+		Title string
+		User  *auth.User
+		Can   map[string]bool
+		Space []*api.Space
+	}{
+		Title: "Home",
+		User:  auth.CurrentUser(r),
+		Can:   auth.Permissions(r),
+		Space: space.ForUser(r, conf.Get()),
+	})
 }
 
 func internalError(ws *websocket.Conn, msg string, err error) {
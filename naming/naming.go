@@ -0,0 +1,111 @@
+package naming
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/filesystem"
+)
+
+// Path builds the folder and file name plex recommends for info, relative to
+// the library folder, e.g.
+//
+//	movie:   /Title (Year)/Title (Year).mkv
+//	episode: /Show (Year)/Season 01/Show (Year) - s01e02 - Episode Title.mkv
+//	dated:   /Show/Season 2024/Show - 2024-03-01 - Episode Title.mkv
+//	music:   /Artist/Album/01 - Title.mp3
+//
+// ext is the extension of the uploaded file, with the dot.
+func Path(info api.MediaInfo, ext string) (string, error) {
+	title := strings.TrimSpace(info.Title)
+	ext = strings.ToLower(ext)
+
+	var parts []string
+	switch info.Type {
+	case api.MediaMovie:
+		if title == "" {
+			return "", errors.New("missing title")
+		}
+		name := withYear(title, info.Year)
+		parts = []string{name, name + ext}
+	case api.MediaEpisode:
+		if title == "" {
+			return "", errors.New("missing show title")
+		}
+		if info.Episode <= 0 && info.Date != "" {
+			date, err := time.Parse("2006-01-02", info.Date)
+			if err != nil {
+				return "", fmt.Errorf("invalid date: %q", info.Date)
+			}
+			return Dated(withYear(title, info.Year), date, info.EpisodeTitle, ext)
+		}
+		if info.Episode <= 0 {
+			return "", errors.New("missing episode number")
+		}
+		if info.Season < 0 {
+			return "", errors.New("invalid season")
+		}
+		show := withYear(title, info.Year)
+		name := fmt.Sprintf("%s - s%02de%02d", show, info.Season, info.Episode)
+		if t := strings.TrimSpace(info.EpisodeTitle); t != "" {
+			name += " - " + t
+		}
+		parts = []string{show, fmt.Sprintf("Season %02d", info.Season), name + ext}
+	case api.MediaMusic:
+		artist, album := strings.TrimSpace(info.Artist), strings.TrimSpace(info.Album)
+		if artist == "" || album == "" {
+			return "", errors.New("missing artist or album")
+		}
+		if title == "" {
+			return "", errors.New("missing track title")
+		}
+		name := title
+		if info.Track > 0 {
+			name = fmt.Sprintf("%02d - %s", info.Track, title)
+		}
+		parts = []string{artist, album, name + ext}
+	default:
+		return "", fmt.Errorf("unknown media type: %q", info.Type)
+	}
+	return join(parts)
+}
+
+// Dated builds plex's date based episode path, for shows that don't number
+// their episodes, e.g. /Show/Season 2024/Show - 2024-03-01 - Title.mp4
+func Dated(show string, date time.Time, title, ext string) (string, error) {
+	show, title = strings.TrimSpace(show), strings.TrimSpace(title)
+	if show == "" {
+		return "", errors.New("missing show title")
+	}
+	name := show + " - " + date.Format("2006-01-02")
+	if title != "" {
+		name += " - " + title
+	}
+	return join([]string{show, "Season " + date.Format("2006"), name + strings.ToLower(ext)})
+}
+
+// join parts into a path relative to the library folder
+func join(parts []string) (string, error) {
+	// every part is a single name, a / in a title must not add a folder
+	for i, part := range parts {
+		part = strings.NewReplacer("/", "-", "\\", "-").Replace(part)
+		name, err := filesystem.NormalizeFilename(part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = name
+	}
+	return path.Join(append([]string{"/"}, parts...)...), nil
+}
+
+// withYear "Title (Year)", or just the title if the year isn't known
+func withYear(title string, year int) string {
+	if year <= 0 {
+		return title
+	}
+	return fmt.Sprintf("%s (%d)", title, year)
+}
@@ -0,0 +1,156 @@
+package naming
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		want api.MediaInfo
+	}{
+		// episodes
+		{
+			name: "Show.Name.S01E02.Pilot.720p.HDTV.x264-GROUP.mkv",
+			want: api.MediaInfo{Type: api.MediaEpisode, Title: "Show Name", Season: 1, Episode: 2, EpisodeTitle: "Pilot"},
+		},
+		{
+			name: "show_name_s1e2.mkv",
+			want: api.MediaInfo{Type: api.MediaEpisode, Title: "show name", Season: 1, Episode: 2},
+		},
+		{
+			name: "Show Name - 1x02 - Pilot.avi",
+			want: api.MediaInfo{Type: api.MediaEpisode, Title: "Show Name", Season: 1, Episode: 2, EpisodeTitle: "Pilot"},
+		},
+		{
+			name: "Show.Name.2010.S03E04.mkv",
+			want: api.MediaInfo{Type: api.MediaEpisode, Title: "Show Name", Year: 2010, Season: 3, Episode: 4},
+		},
+		{
+			name: "Show.Name.S01E02E03.Two.Parter.1080p.mkv",
+			want: api.MediaInfo{Type: api.MediaEpisode, Title: "Show Name", Season: 1, Episode: 2, EpisodeTitle: "Two Parter"},
+		},
+		{
+			name: "Show Name S01E02-E03.mkv",
+			want: api.MediaInfo{Type: api.MediaEpisode, Title: "Show Name", Season: 1, Episode: 2},
+		},
+		{
+			name: "Late.Show.2024.03.15.Guest.Name.720p.WEB.mkv",
+			want: api.MediaInfo{Type: api.MediaEpisode, Title: "Late Show", Date: "2024-03-15", EpisodeTitle: "Guest Name"},
+		},
+		{
+			name: "Late Show - 2024-03-15.mp4",
+			want: api.MediaInfo{Type: api.MediaEpisode, Title: "Late Show", Date: "2024-03-15"},
+		},
+		{
+			name: "/downloads/[GRP] Show.Name.S01E02.WEB-DL.mkv",
+			want: api.MediaInfo{Type: api.MediaEpisode, Title: "Show Name", Season: 1, Episode: 2},
+		},
+		// movies
+		{
+			name: "The.Matrix.1999.1080p.BluRay.x264-GROUP.mkv",
+			want: api.MediaInfo{Type: api.MediaMovie, Title: "The Matrix", Year: 1999},
+		},
+		{
+			name: "The Matrix (1999).mkv",
+			want: api.MediaInfo{Type: api.MediaMovie, Title: "The Matrix", Year: 1999},
+		},
+		{
+			name: "2001.A.Space.Odyssey.1968.mkv",
+			want: api.MediaInfo{Type: api.MediaMovie, Title: "2001 A Space Odyssey", Year: 1968},
+		},
+		{
+			name: "Movie.2010-GROUP.mkv",
+			want: api.MediaInfo{Type: api.MediaMovie, Title: "Movie", Year: 2010},
+		},
+		{
+			name: "[GRP] Movie.Name.2010.REPACK.720p.WEBRip.mkv",
+			want: api.MediaInfo{Type: api.MediaMovie, Title: "Movie Name", Year: 2010},
+		},
+		{
+			name: "Movie.2010.13.45.mkv",
+			want: api.MediaInfo{Type: api.MediaMovie, Title: "Movie", Year: 2010},
+		},
+		{
+			name: "home movie final v2 copy.mp4",
+			want: api.MediaInfo{Type: api.MediaMovie, Title: "home movie"},
+		},
+		// music
+		{
+			name: "Artist - Album - 01 - Title.mp3",
+			want: api.MediaInfo{Type: api.MediaMusic, Artist: "Artist", Album: "Album", Track: 1, Title: "Title"},
+		},
+		{
+			name: "Artist - 03 Title.flac",
+			want: api.MediaInfo{Type: api.MediaMusic, Artist: "Artist", Track: 3, Title: "Title"},
+		},
+		{
+			name: "Artist - Album - Title - Live.mp3",
+			want: api.MediaInfo{Type: api.MediaMusic, Artist: "Artist", Album: "Album", Title: "Title - Live"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Parse(tt.name); got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPath(t *testing.T) {
+	tests := []struct {
+		name string
+		info api.MediaInfo
+		want string
+		err  bool
+	}{
+		{
+			name: "movie",
+			info: api.MediaInfo{Type: api.MediaMovie, Title: "The Matrix", Year: 1999},
+			want: "/The Matrix (1999)/The Matrix (1999).mkv",
+		},
+		{
+			name: "episode",
+			info: api.MediaInfo{Type: api.MediaEpisode, Title: "Show", Season: 1, Episode: 2, EpisodeTitle: "Pilot"},
+			want: "/Show/Season 01/Show - s01e02 - Pilot.mkv",
+		},
+		{
+			name: "dated episode",
+			info: api.MediaInfo{Type: api.MediaEpisode, Title: "Show", Date: "2024-03-15", EpisodeTitle: "Guest"},
+			want: "/Show/Season 2024/Show - 2024-03-15 - Guest.mkv",
+		},
+		{
+			name: "music",
+			info: api.MediaInfo{Type: api.MediaMusic, Artist: "Artist", Album: "Album", Track: 1, Title: "A/B"},
+			want: "/Artist/Album/01 - A-B.mkv",
+		},
+		{name: "bad date", info: api.MediaInfo{Type: api.MediaEpisode, Title: "Show", Date: "2024-13-01"}, err: true},
+		{name: "no episode", info: api.MediaInfo{Type: api.MediaEpisode, Title: "Show", Season: 1}, err: true},
+		{name: "no title", info: api.MediaInfo{Type: api.MediaMovie, Year: 1999}, err: true},
+		{name: "no album", info: api.MediaInfo{Type: api.MediaMusic, Artist: "Artist", Title: "Title"}, err: true},
+		{name: "no type", info: api.MediaInfo{Title: "Title"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Path(tt.info, ".MKV")
+			if (err != nil) != tt.err || got != tt.want {
+				t.Fatalf("got %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestDated(t *testing.T) {
+	date := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	got, err := Dated(" Show ", date, "", ".mp4")
+	if err != nil || got != "/Show/Season 2024/Show - 2024-03-01.mp4" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if _, err := Dated("", date, "Title", ".mp4"); err == nil {
+		t.Fatal("a show without a title was named")
+	}
+}
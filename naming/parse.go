@@ -0,0 +1,161 @@
+package naming
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+)
+
+// audioExts files that are parsed as music
+var audioExts = map[string]bool{
+	".mp3": true, ".m4a": true, ".flac": true, ".ogg": true, ".opus": true,
+	".wav": true, ".aac": true, ".wma": true, ".alac": true,
+}
+
+var (
+	// S01E02, s1e2, S01E02E03
+	seasonEpisodeRe = regexp.MustCompile(`(?i)\bs(\d{1,2})\s*e(\d{1,3})(?:-?e\d{1,3})*\b`)
+	// 1x02
+	crossEpisodeRe = regexp.MustCompile(`(?i)\b(\d{1,2})x(\d{2,3})\b`)
+	// 2024.03.15 or 2024-03-15, dots are spaces by the time it's matched
+	dateRe = regexp.MustCompile(`\b((?:19|20)\d{2})[ -](\d{2})[ -](\d{2})\b`)
+	yearRe = regexp.MustCompile(`\(?\b((?:19|20)\d{2})\b\)?`)
+	// everything from the first of these on is release info, not title
+	tagRe = regexp.MustCompile(`(?i)\b(?:480p|576p|720p|1080p|2160p|4k|uhd|blu ?ray|brrip|bdrip|web[ -]?dl|webrip|hdtv|hdrip|dvdrip|dvdscr|x26[45]|h ?26[45]|hevc|xvid|divx|aac|ac3|dts|ddp?5 1|proper|repack|remux|hdr|10bit|extended|unrated|imax)\b`)
+	// what people add to a file name while they work on it
+	junkRe = regexp.MustCompile(`(?i)(?:[\s-]+(?:final|v\d+|copy|\(\d{1,2}\)|\[[^\]]*\]))+$`)
+	// [group] at the start
+	groupRe = regexp.MustCompile(`^\s*\[[^\]]*\]`)
+	trackRe = regexp.MustCompile(`^(\d{1,3})(?:\s*[.\-]\s*|\s+)(.+)$`)
+	spaceRe = regexp.MustCompile(`\s+`)
+)
+
+// Parse guesses what a file is from its name, e.g.
+// The.Matrix.1999.1080p.BluRay.x264-GROUP.mkv is the movie The Matrix (1999)
+// and Show.Name.S01E02.Pilot.720p.HDTV.mkv episode 2 of season 1, or
+// Show.Name.2024.03.15.Guest.mkv the episode that aired that day. Audio
+// files are music, "Artist - Album - 01 - Title.mp3". Anything it doesn't
+// recognize is a movie titled with the cleaned up name.
+func Parse(fileName string) api.MediaInfo {
+	if i := strings.LastIndexAny(fileName, "/\\"); i >= 0 {
+		fileName = fileName[i+1:]
+	}
+	ext := filepath.Ext(fileName)
+	base := strings.TrimSuffix(fileName, ext)
+	base = groupRe.ReplaceAllString(base, "")
+
+	if audioExts[strings.ToLower(ext)] {
+		return parseMusic(clean(strings.Replace(base, "_", " ", -1)))
+	}
+
+	s := clean(strings.NewReplacer(".", " ", "_", " ").Replace(base))
+	for _, re := range []*regexp.Regexp{seasonEpisodeRe, crossEpisodeRe} {
+		m := re.FindStringSubmatchIndex(s)
+		if m == nil || m[0] == 0 {
+			continue
+		}
+		info := api.MediaInfo{Type: api.MediaEpisode}
+		info.Title, info.Year = splitYear(s[:m[0]])
+		info.Season, _ = strconv.Atoi(s[m[2]:m[3]])
+		info.Episode, _ = strconv.Atoi(s[m[4]:m[5]])
+		info.EpisodeTitle = clean(cutTags(s[m[1]:]))
+		return info
+	}
+	if m := dateRe.FindStringSubmatchIndex(s); m != nil && m[0] > 0 {
+		date := s[m[2]:m[3]] + "-" + s[m[4]:m[5]] + "-" + s[m[6]:m[7]]
+		if _, err := time.Parse("2006-01-02", date); err == nil {
+			info := api.MediaInfo{Type: api.MediaEpisode, Date: date}
+			info.Title, info.Year = splitYear(s[:m[0]])
+			info.EpisodeTitle = clean(cutTags(s[m[1]:]))
+			return info
+		}
+	}
+
+	info := api.MediaInfo{Type: api.MediaMovie}
+	info.Title, info.Year = splitYear(cutTags(s))
+	return info
+}
+
+// parseMusic Artist - Album - 01 - Title, and the shorter versions of it
+func parseMusic(s string) api.MediaInfo {
+	info := api.MediaInfo{Type: api.MediaMusic}
+	var parts []string
+	for _, p := range strings.Split(s, " - ") {
+		if p = clean(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	track := func(p string) (int, bool) {
+		n, err := strconv.Atoi(p)
+		return n, err == nil
+	}
+
+	switch len(parts) {
+	case 0:
+		return info
+	case 1:
+	case 2:
+		if n, ok := track(parts[0]); ok {
+			info.Track = n
+		} else {
+			info.Artist = parts[0]
+		}
+	case 3:
+		if n, ok := track(parts[0]); ok {
+			info.Track, info.Artist = n, parts[1]
+		} else if n, ok := track(parts[1]); ok {
+			info.Artist, info.Track = parts[0], n
+		} else {
+			info.Artist, info.Album = parts[0], parts[1]
+		}
+	default:
+		info.Artist, info.Album = parts[0], parts[1]
+		if n, ok := track(parts[2]); ok {
+			info.Track = n
+			parts = append(parts[:2], parts[3:]...)
+		}
+		// the rest is the title, it may have had a " - " in it
+		info.Title = strings.Join(parts[2:], " - ")
+		return info
+	}
+
+	info.Title = parts[len(parts)-1]
+	if m := trackRe.FindStringSubmatch(info.Title); m != nil && info.Track == 0 {
+		info.Track, _ = strconv.Atoi(m[1])
+		info.Title = m[2]
+	}
+	return info
+}
+
+// splitYear "Title 1999" or "Title (1999)" into title and year. The last
+// year wins, so "2001 A Space Odyssey 1968" keeps its title.
+func splitYear(s string) (string, int) {
+	s = clean(s)
+	matches := yearRe.FindAllStringSubmatchIndex(s, -1)
+	for i := len(matches) - 1; i >= 0; i-- {
+		m := matches[i]
+		if m[0] == 0 {
+			continue
+		}
+		year, _ := strconv.Atoi(s[m[2]:m[3]])
+		return clean(s[:m[0]]), year
+	}
+	return s, 0
+}
+
+// cutTags drops release info and working copy suffixes
+func cutTags(s string) string {
+	if loc := tagRe.FindStringIndex(s); loc != nil {
+		s = s[:loc[0]]
+	}
+	return junkRe.ReplaceAllString(clean(s), "")
+}
+
+// clean collapses spaces and trims separators
+func clean(s string) string {
+	return strings.Trim(spaceRe.ReplaceAllString(s, " "), " -_.([")
+}
@@ -0,0 +1,116 @@
+package place
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/duplicates"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/loudness"
+	"github.com/jaredwarren/plexupdate/probe"
+	"github.com/jaredwarren/plexupdate/transcode"
+	"github.com/jaredwarren/plexupdate/trash"
+)
+
+// claimed part files being written, by any download or import
+var claimed = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: map[string]bool{}}
+
+// Claim part for one download or import at a time, false if another one is
+// writing it
+func Claim(part string) bool {
+	claimed.Lock()
+	defer claimed.Unlock()
+	if claimed.m[part] {
+		return false
+	}
+	claimed.m[part] = true
+	return true
+}
+
+// Release part for the next one
+func Release(part string) {
+	claimed.Lock()
+	delete(claimed.m, part)
+	claimed.Unlock()
+}
+
+// Part a finished upload, download or import, and where it goes
+type Part struct {
+	Location string
+	Sandbox  *filesystem.Sandbox
+	// File the part is written to, RelPath where it goes in the location
+	File    string
+	RelPath string
+	User    string
+	// Before, if set, runs once the part is admitted and before what's at
+	// RelPath goes to the trash, e.g. to replace duplicates. An error stops
+	// it there.
+	Before func() error
+}
+
+// File puts p in place. It has to get past probe.Admit, what's at RelPath
+// goes to the trash and the library index learns the new file. If it
+// doesn't make it the part is gone, or quarantined.
+func File(conf *config.Configuration, index *duplicates.Index, p Part) (*api.MediaProbe, error) {
+	media, err := probe.Admit(conf, p.Sandbox, p.Location, p.File, p.RelPath, p.User)
+	if err != nil {
+		// Admit only cleans up files it turned down
+		if !errors.Is(err, probe.ErrInvalid) && !errors.Is(err, probe.ErrNotAllowed) {
+			os.Remove(p.File)
+		}
+		return nil, err
+	}
+	if p.Before != nil {
+		if err := p.Before(); err != nil {
+			os.Remove(p.File)
+			return nil, err
+		}
+	}
+	file, err := p.Sandbox.Resolve(p.RelPath)
+	if err == nil {
+		err = trash.Replace(conf.Trash, p.Sandbox, p.Location, p.RelPath, p.User)
+	}
+	if err == nil {
+		err = os.Rename(p.File, file)
+	}
+	if err != nil {
+		os.Remove(p.File)
+		return nil, err
+	}
+	if err := index.Add(p.Location, p.RelPath); err != nil {
+		fmt.Println("  [E]: library index:", err)
+	}
+	return media, nil
+}
+
+// Jobs queues what a new file gets after it's in place: loudness if its
+// location evens it out, and a transcode if profile isn't empty. It returns
+// the ids of the jobs started, and a line for each job or why it couldn't
+// start. The file stays either way.
+func Jobs(location, relPath, profile, user string) (loudnessJob, transcodeJob string, notes []string) {
+	if j, err := loudness.Enqueue(location, relPath, user); err != nil {
+		fmt.Println("  [E]: loudness:", err)
+		notes = append(notes, "loudness: "+err.Error())
+	} else if j != nil {
+		loudnessJob = j.ID
+		notes = append(notes, "evening out loudness of "+relPath+", job "+j.ID)
+	}
+	if profile == "" {
+		return
+	}
+	if j, err := transcode.Enqueue(location, relPath, profile, user); err != nil {
+		fmt.Println("  [E]: transcode:", err)
+		notes = append(notes, "transcode: "+err.Error())
+	} else {
+		transcodeJob = j.ID
+		notes = append(notes, "transcoding "+relPath+", job "+j.ID)
+	}
+	return
+}
@@ -0,0 +1,160 @@
+package plex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TokenHeader plex api token
+const TokenHeader = "X-Plex-Token"
+
+// Client talks to the Plex Media Server http api
+type Client struct {
+	URL   string
+	Token string
+	HTTP  *http.Client
+}
+
+// NewClient url is the server, e.g. http://localhost:32400
+func NewClient(serverURL, token string) *Client {
+	return &Client{
+		URL:   strings.TrimRight(serverURL, "/"),
+		Token: token,
+		HTTP:  &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// Section is a plex library
+type Section struct {
+	Key       string     `json:"key"`
+	Title     string     `json:"title"`
+	Type      string     `json:"type"`
+	Locations []Location `json:"Location"`
+}
+
+// Location is a folder in a library section, as plex sees it
+type Location struct {
+	ID   int    `json:"id"`
+	Path string `json:"path"`
+}
+
+// StatusError plex answered, but not with 2xx
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("plex: %d %s", e.Code, http.StatusText(e.Code))
+	}
+	return fmt.Sprintf("plex: %d %s: %s", e.Code, http.StatusText(e.Code), e.Body)
+}
+
+// Temporary true if trying again might work
+func (e *StatusError) Temporary() bool {
+	return e.Code >= 500 || e.Code == http.StatusTooManyRequests
+}
+
+func (c *Client) get(ctx context.Context, p string, query url.Values, v interface{}) error {
+	u := c.URL + p
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(TokenHeader, c.Token)
+	// plex sends xml unless asked for json
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return &StatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Sections lists the library sections and their folders
+func (c *Client) Sections(ctx context.Context) ([]Section, error) {
+	res := &struct {
+		MediaContainer struct {
+			Directory []Section
+		}
+	}{}
+	if err := c.get(ctx, "/library/sections", nil, res); err != nil {
+		return nil, err
+	}
+	return res.MediaContainer.Directory, nil
+}
+
+// Refresh scans a section, dir limits the scan to one folder, empty scans everything
+func (c *Client) Refresh(ctx context.Context, key, dir string) error {
+	query := url.Values{}
+	if dir != "" {
+		query.Set("path", dir)
+	}
+	return c.get(ctx, "/library/sections/"+url.PathEscape(key)+"/refresh", query, nil)
+}
+
+// itemTypes the type of item that has files, for each type of section
+var itemTypes = map[string]string{
+	"movie":  "1",
+	"show":   "4",
+	"artist": "10",
+}
+
+// Watched lists the files of every item in a section that's been played to
+// the end at least once, as plex sees them
+func (c *Client) Watched(ctx context.Context, key, sectionType string) ([]string, error) {
+	itemType, ok := itemTypes[sectionType]
+	if !ok {
+		return nil, fmt.Errorf("plex: section %s has no files to watch (%s)", key, sectionType)
+	}
+	res := &struct {
+		MediaContainer struct {
+			Metadata []struct {
+				ViewCount int `json:"viewCount"`
+				Media     []struct {
+					Part []struct {
+						File string `json:"file"`
+					}
+				}
+			}
+		}
+	}{}
+	query := url.Values{"type": {itemType}}
+	if err := c.get(ctx, "/library/sections/"+url.PathEscape(key)+"/all", query, res); err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, m := range res.MediaContainer.Metadata {
+		if m.ViewCount == 0 {
+			continue
+		}
+		for _, media := range m.Media {
+			for _, part := range media.Part {
+				files = append(files, part.File)
+			}
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,173 @@
+package plex
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testToken = "secret"
+
+// fakePlex answers the few calls the client makes like a plex server does
+type fakePlex struct {
+	sync.Mutex
+	sections []Section
+	// items key: what /all lists for the section
+	items map[string][]item
+	// fail statuses answered in order, one a request, 0 answers normally
+	fail []int
+	// requests every path and query asked for
+	requests []string
+}
+
+// item a movie or episode, with the files it has
+type item struct {
+	ViewCount int
+	Files     []string
+}
+
+func (f *fakePlex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests = append(f.requests, r.URL.RequestURI())
+	if r.Header.Get(TokenHeader) != testToken || r.Header.Get("Accept") != "application/json" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if len(f.fail) > 0 {
+		code := f.fail[0]
+		f.fail = f.fail[1:]
+		if code != 0 {
+			http.Error(w, "busy", code)
+			return
+		}
+	}
+
+	container := map[string]interface{}{}
+	p := strings.TrimPrefix(r.URL.Path, "/library/sections")
+	switch {
+	case p == "":
+		container["Directory"] = f.sections
+	case strings.HasSuffix(p, "/refresh"):
+		w.WriteHeader(http.StatusOK)
+		return
+	case strings.HasSuffix(p, "/all"):
+		metadata := []interface{}{}
+		for _, it := range f.items[strings.Trim(strings.TrimSuffix(p, "/all"), "/")] {
+			parts := []interface{}{}
+			for _, file := range it.Files {
+				parts = append(parts, map[string]string{"file": file})
+			}
+			metadata = append(metadata, map[string]interface{}{
+				"viewCount": it.ViewCount,
+				"Media":     []interface{}{map[string]interface{}{"Part": parts}},
+			})
+		}
+		container["Metadata"] = metadata
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"MediaContainer": container})
+}
+
+// count requests for paths starting with prefix
+func (f *fakePlex) count(prefix string) int {
+	f.Lock()
+	defer f.Unlock()
+	n := 0
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// newFakePlex starts f, it's stopped when the test ends
+func newFakePlex(t *testing.T, f *fakePlex) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSections(t *testing.T) {
+	f := &fakePlex{sections: []Section{
+		{Key: "1", Title: "Movies", Type: "movie", Locations: []Location{{ID: 1, Path: "/data/movies"}}},
+		{Key: "2", Title: "TV", Type: "show", Locations: []Location{{ID: 2, Path: "/data/tv"}, {ID: 3, Path: "/more/tv"}}},
+	}}
+	srv := newFakePlex(t, f)
+
+	got, err := NewClient(srv.URL+"/", testToken).Sections(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, f.sections) {
+		t.Fatalf("got %+v, want %+v", got, f.sections)
+	}
+
+	_, err = NewClient(srv.URL, "wrong").Sections(context.Background())
+	if se, ok := err.(*StatusError); !ok || se.Code != http.StatusUnauthorized || se.Temporary() {
+		t.Fatalf("got %v, want a 401", err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	f := &fakePlex{}
+	srv := newFakePlex(t, f)
+	c := NewClient(srv.URL, testToken)
+
+	if err := c.Refresh(context.Background(), "1", "/data/movies/New Movie (2020)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Refresh(context.Background(), "2", ""); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"/library/sections/1/refresh?path=%2Fdata%2Fmovies%2FNew+Movie+%282020%29",
+		"/library/sections/2/refresh",
+	}
+	if !reflect.DeepEqual(f.requests, want) {
+		t.Fatalf("got %q, want %q", f.requests, want)
+	}
+
+	f.fail = []int{http.StatusServiceUnavailable}
+	err := c.Refresh(context.Background(), "1", "")
+	if se, ok := err.(*StatusError); !ok || !se.Temporary() || se.Body != "busy" {
+		t.Fatalf("got %v, want a temporary 503", err)
+	}
+}
+
+func TestWatched(t *testing.T) {
+	f := &fakePlex{items: map[string][]item{
+		"1": {
+			{ViewCount: 1, Files: []string{"/data/movies/a.mkv"}},
+			{ViewCount: 0, Files: []string{"/data/movies/b.mkv"}},
+			{ViewCount: 3, Files: []string{"/data/movies/c.cd1.mkv", "/data/movies/c.cd2.mkv"}},
+		},
+	}}
+	srv := newFakePlex(t, f)
+	c := NewClient(srv.URL, testToken)
+
+	got, err := c.Watched(context.Background(), "1", "movie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/data/movies/a.mkv", "/data/movies/c.cd1.mkv", "/data/movies/c.cd2.mkv"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if f.requests[0] != "/library/sections/1/all?type=1" {
+		t.Fatalf("asked for %q", f.requests[0])
+	}
+
+	if _, err := c.Watched(context.Background(), "3", "photo"); err == nil {
+		t.Fatal("photos have nothing to watch")
+	}
+}
@@ -0,0 +1,90 @@
+package plex
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/jaredwarren/plexupdate/config"
+)
+
+// Discover adds a location for every folder of every plex library to conf,
+// and remembers its section so scans don't have to match folders. Locations
+// already in conf win, so the config file can rename or hide a folder.
+// Returns the names that were added.
+func Discover(ctx context.Context, conf *config.Configuration) ([]string, error) {
+	client := NewClient(conf.Plex.URL, conf.Plex.Token)
+	sections, err := client.Sections(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.Plex.Locations == nil {
+		conf.Plex.Locations = map[string]string{}
+	}
+	if conf.Plex.Sections == nil {
+		conf.Plex.Sections = map[string]string{}
+	}
+
+	// folders that already have a location, don't add them twice
+	known := map[string]string{}
+	for name, dir := range conf.Plex.Locations {
+		if abs, err := filepath.Abs(dir); err == nil {
+			known[abs] = name
+		}
+	}
+
+	added := []string{}
+	for _, section := range sections {
+		base := slug(section.Title)
+		if base == "" {
+			base = "section-" + section.Key
+		}
+		for i, l := range section.Locations {
+			dir := conf.Plex.ToLocal(l.Path)
+			abs, err := filepath.Abs(dir)
+			if err != nil {
+				continue
+			}
+			if name, ok := known[abs]; ok {
+				if _, ok := conf.Plex.Sections[name]; !ok {
+					conf.Plex.Sections[name] = section.Key
+				}
+				continue
+			}
+
+			// second folder of a library is movies-2, and so on
+			name, n := base, i+1
+			if n > 1 {
+				name = base + "-" + strconv.Itoa(n)
+			}
+			for conf.Plex.Locations[name] != "" {
+				n++
+				name = base + "-" + strconv.Itoa(n)
+			}
+			conf.Plex.Locations[name] = dir
+			conf.Plex.Sections[name] = section.Key
+			known[abs] = name
+			added = append(added, name)
+		}
+	}
+	return added, nil
+}
+
+// slug turns a library title into a location name, "TV Shows" is tv-shows
+func slug(title string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(strings.TrimSpace(title)) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimRight(b.String(), "-")
+}
@@ -0,0 +1,227 @@
+package plex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/jobs"
+)
+
+// JobType of scan jobs in the job list
+const JobType = "plex-scan"
+
+// Retries plex is often busy, or restarting after an update
+const retries = 4
+
+// retryDelay before the first retry, it doubles after each one
+var retryDelay = 2 * time.Second
+
+// Scanner tells plex about new files, so nobody has to click "Scan Library Files"
+type Scanner struct {
+	conf *config.Current
+	jobs *jobs.Manager
+}
+
+// NewScanner config is read on every scan, so changes are picked up on reload
+func NewScanner(conf *config.Current, jobs *jobs.Manager) *Scanner {
+	return &Scanner{
+		conf: conf,
+		jobs: jobs,
+	}
+}
+
+// Enabled false when no plex server is configured
+func (s *Scanner) Enabled() bool {
+	return s.conf.Get().Plex.URL != ""
+}
+
+// Scan starts a job that scans dir, a folder in location. Returns nil if plex
+// isn't configured, or for the default folder which isn't a library.
+func (s *Scanner) Scan(location, dir string) *jobs.Job {
+	if !s.Enabled() || location == "" {
+		return nil
+	}
+	return s.jobs.Start(JobType, "", location, func(ctx context.Context, j *jobs.Job) (string, error) {
+		return s.scan(ctx, location, dir)
+	})
+}
+
+// ScanAndWait scans dir and returns the result for the user, empty if plex
+// isn't configured.
+func (s *Scanner) ScanAndWait(location, dir string) string {
+	j := s.Scan(location, dir)
+	if j == nil {
+		return ""
+	}
+	j.Wait()
+	return Summary(j)
+}
+
+// Summary one line result of a scan job
+func Summary(j *jobs.Job) string {
+	snap := j.Snapshot()
+	switch snap.Status {
+	case jobs.Done:
+		return "plex: " + snap.Result
+	case jobs.Failed:
+		return "plex: scan failed: " + snap.Error
+	}
+	return "plex: scan " + string(snap.Status)
+}
+
+// Locate finds the location dir is in, for commands that were run in a library folder
+func (s *Scanner) Locate(dir string) (string, bool) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	for name, root := range s.conf.Get().Plex.Locations {
+		rootAbs, err := filepath.Abs(root)
+		if err == nil && within(rootAbs, abs) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (s *Scanner) scan(ctx context.Context, location, dir string) (string, error) {
+	client := NewClient(s.conf.Get().Plex.URL, s.conf.Get().Plex.Token)
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	var section *Section
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		if section == nil {
+			section, err = s.section(ctx, client, location)
+		}
+		// the section is looked up once, the refresh is tried every time
+		if section != nil {
+			err = client.Refresh(ctx, section.Key, s.conf.Get().Plex.ToPlex(abs))
+			if err == nil {
+				return fmt.Sprintf("scanning %s in %s", abs, section.Title), nil
+			}
+		}
+		if attempt == retries || !temporary(err) {
+			return "", err
+		}
+		fmt.Printf("  [E]: plex scan attempt %d: %s\n", attempt, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// Watched returns the local paths of the files in location's library that
+// have been watched. Nothing is watched if plex isn't configured.
+func (s *Scanner) Watched(ctx context.Context, location string) (map[string]bool, error) {
+	watched := map[string]bool{}
+	if !s.Enabled() {
+		return watched, nil
+	}
+	client := NewClient(s.conf.Get().Plex.URL, s.conf.Get().Plex.Token)
+	section, err := s.section(ctx, client, location)
+	if err != nil {
+		return nil, err
+	}
+	if section.Type == "" {
+		// plex.sections only has the key
+		sections, err := client.Sections(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for i := range sections {
+			if sections[i].Key == section.Key {
+				section = &sections[i]
+				break
+			}
+		}
+	}
+	files, err := client.Watched(ctx, section.Key, section.Type)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if local, err := filepath.Abs(s.conf.Get().Plex.ToLocal(f)); err == nil {
+			watched[local] = true
+		}
+	}
+	return watched, nil
+}
+
+// section finds the library for location, from config or by matching folders
+func (s *Scanner) section(ctx context.Context, client *Client, location string) (*Section, error) {
+	if key, ok := s.conf.Get().Plex.Sections[location]; ok && key != "" {
+		return &Section{Key: key, Title: "section " + key}, nil
+	}
+
+	rootDir, err := s.conf.Get().Plex.RootDir(location)
+	if err != nil {
+		return nil, err
+	}
+	rootAbs, err := filepath.Abs(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	sections, err := client.Sections(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sections {
+		for _, l := range sections[i].Locations {
+			local, err := filepath.Abs(s.conf.Get().Plex.ToLocal(l.Path))
+			if err != nil {
+				continue
+			}
+			if within(local, rootAbs) || within(rootAbs, local) {
+				return &sections[i], nil
+			}
+		}
+	}
+	return nil, &noSectionError{location: location, dir: rootAbs}
+}
+
+// noSectionError won't go away by trying again
+type noSectionError struct {
+	location string
+	dir      string
+}
+
+func (e *noSectionError) Error() string {
+	return fmt.Sprintf("no plex library has a folder for location %q (%s), set plex.sections.%s", e.location, e.dir, e.location)
+}
+
+// temporary true for network errors and 5xx
+func temporary(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Temporary()
+	}
+	var ns *noSectionError
+	if errors.As(err, &ns) {
+		return false
+	}
+	return !errors.Is(err, context.Canceled)
+}
+
+// within true if p is root or inside it
+func within(root, p string) bool {
+	root = filepath.Clean(root)
+	p = filepath.Clean(p)
+	if p == root {
+		return true
+	}
+	return strings.HasPrefix(p, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator))
+}
@@ -0,0 +1,156 @@
+package plex
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/config"
+)
+
+// newScanner for a fake plex that sees root as /data, with a location for
+// every name in locations, a folder in root
+func newScanner(t *testing.T, serverURL, root string, locations ...string) *Scanner {
+	t.Helper()
+	old := retryDelay
+	retryDelay = time.Millisecond
+	t.Cleanup(func() { retryDelay = old })
+
+	conf := &config.Configuration{}
+	conf.Plex.URL = serverURL
+	conf.Plex.Token = testToken
+	conf.Plex.PathMap = []config.PathMapping{{Plex: "/data", Local: root}}
+	conf.Plex.Locations = map[string]string{}
+	for _, l := range locations {
+		conf.Plex.Locations[l] = filepath.Join(root, filepath.FromSlash(l))
+	}
+	return NewScanner(config.NewCurrent(conf), nil)
+}
+
+// sections a plex with movies, tv in a folder inside the location, and music
+var sections = []Section{
+	{Key: "1", Title: "Movies", Type: "movie", Locations: []Location{{Path: "/data/movies"}}},
+	{Key: "2", Title: "TV", Type: "show", Locations: []Location{{Path: "/elsewhere/tv"}, {Path: "/data/tv/shows"}}},
+	{Key: "3", Title: "Music", Type: "artist", Locations: []Location{{Path: "/data/music"}}},
+}
+
+func TestScanSection(t *testing.T) {
+	root := t.TempDir()
+	tests := []struct {
+		location string
+		dir      string
+		want     string
+		refresh  string
+	}{
+		{location: "movies", dir: "movies/New (2020)", want: "Movies", refresh: "/data/movies/New (2020)"},
+		// a location inside the library's folder, and a library's folder inside the location
+		{location: "movies/kids", dir: "movies/kids", want: "Movies", refresh: "/data/movies/kids"},
+		{location: "tv", dir: "tv/shows/Show", want: "TV", refresh: "/data/tv/shows/Show"},
+		{location: "music", dir: "music", want: "Music", refresh: "/data/music"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.location, func(t *testing.T) {
+			f := &fakePlex{sections: sections}
+			srv := newFakePlex(t, f)
+			s := newScanner(t, srv.URL, root, "movies", "movies/kids", "tv", "music", "photos")
+
+			dir := filepath.Join(root, filepath.FromSlash(tt.dir))
+			got, err := s.scan(context.Background(), tt.location, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "scanning " + dir + " in " + tt.want; got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+			last := f.requests[len(f.requests)-1]
+			u, _ := url.Parse(last)
+			if u.Query().Get("path") != tt.refresh {
+				t.Fatalf("refreshed %q, want %q", last, tt.refresh)
+			}
+		})
+	}
+}
+
+func TestScanRetry(t *testing.T) {
+	root := t.TempDir()
+	tests := []struct {
+		name     string
+		fail     []int
+		wantErr  bool
+		requests int
+	}{
+		{name: "works", requests: 2},
+		{name: "busy", fail: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, requests: 4},
+		// the sections work, the refresh doesn't
+		{name: "refresh busy", fail: []int{0, http.StatusBadGateway}, requests: 3},
+		{name: "gives up", fail: []int{500, 500, 500, 500, 500}, wantErr: true, requests: retries},
+		{name: "not found", fail: []int{http.StatusNotFound}, wantErr: true, requests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakePlex{sections: sections, fail: tt.fail}
+			srv := newFakePlex(t, f)
+			s := newScanner(t, srv.URL, root, "movies")
+
+			_, err := s.scan(context.Background(), "movies", filepath.Join(root, "movies"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, want an error: %v", err, tt.wantErr)
+			}
+			if len(f.requests) != tt.requests {
+				t.Fatalf("%d requests, want %d: %q", len(f.requests), tt.requests, f.requests)
+			}
+		})
+	}
+}
+
+func TestScanNoSection(t *testing.T) {
+	root := t.TempDir()
+	f := &fakePlex{sections: sections}
+	srv := newFakePlex(t, f)
+	s := newScanner(t, srv.URL, root, "photos")
+
+	_, err := s.scan(context.Background(), "photos", filepath.Join(root, "photos"))
+	var ns *noSectionError
+	if !errors.As(err, &ns) {
+		t.Fatalf("got %v, want no section", err)
+	}
+	if n := f.count("/library/sections"); n != 1 {
+		t.Fatalf("asked plex %d times, it won't get a library by trying again", n)
+	}
+}
+
+func TestScannerWatched(t *testing.T) {
+	root := t.TempDir()
+	f := &fakePlex{sections: sections, items: map[string][]item{
+		"1": {
+			{ViewCount: 1, Files: []string{"/data/movies/a.mkv"}},
+			{ViewCount: 0, Files: []string{"/data/movies/b.mkv"}},
+		},
+	}}
+	srv := newFakePlex(t, f)
+	s := newScanner(t, srv.URL, root, "movies")
+
+	got, err := s.Watched(context.Background(), "movies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{filepath.Join(root, "movies", "a.mkv"): true}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// a section from config has only the key, the type comes from plex
+	s.conf.Get().Plex.Sections = map[string]string{"movies": "1"}
+	got, err = s.Watched(context.Background(), "movies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("from plex.sections got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,243 @@
+package probe
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/config"
+)
+
+// DefaultCommand used when probe.command isn't set
+const DefaultCommand = "ffprobe"
+
+// timeout for one file, ffprobe only reads the headers
+const timeout = 30 * time.Second
+
+// ErrUnavailable the probe command isn't installed
+var ErrUnavailable = errors.New("ffprobe isn't installed")
+
+// Runner runs a command and returns what it printed, swap Run to probe
+// without ffprobe
+type Runner func(ctx context.Context, name string, args ...string) ([]byte, error)
+
+// Run the command used for every probe
+var Run Runner = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).Output()
+}
+
+// extTypes the media type of a file by its extension, for when it can't be
+// probed
+var extTypes = map[string]string{
+	".mkv": api.MediaVideo, ".mp4": api.MediaVideo, ".m4v": api.MediaVideo, ".avi": api.MediaVideo,
+	".mov": api.MediaVideo, ".wmv": api.MediaVideo, ".ts": api.MediaVideo, ".webm": api.MediaVideo,
+	".mpg": api.MediaVideo, ".mpeg": api.MediaVideo, ".flv": api.MediaVideo,
+	".mp3": api.MediaAudio, ".m4a": api.MediaAudio, ".flac": api.MediaAudio, ".ogg": api.MediaAudio,
+	".opus": api.MediaAudio, ".wav": api.MediaAudio, ".aac": api.MediaAudio,
+	".srt": api.MediaSubtitle, ".ass": api.MediaSubtitle, ".ssa": api.MediaSubtitle,
+	".sub": api.MediaSubtitle, ".idx": api.MediaSubtitle, ".vtt": api.MediaSubtitle,
+	".jpg": api.MediaImage, ".jpeg": api.MediaImage, ".png": api.MediaImage, ".tbn": api.MediaImage,
+}
+
+// extType the media type name's extension says it is, "" if it isn't media
+func extType(name string) string {
+	return extTypes[strings.ToLower(filepath.Ext(name))]
+}
+
+// output the parts of ffprobe -print_format json we use
+type output struct {
+	Format struct {
+		Name     string `json:"format_name"`
+		Duration string `json:"duration"`
+	} `json:"format"`
+	Streams []struct {
+		Index     int    `json:"index"`
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+		Channels  int    `json:"channels"`
+		Tags      struct {
+			Language string `json:"language"`
+			Title    string `json:"title"`
+		} `json:"tags"`
+		Disposition struct {
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+	} `json:"streams"`
+	Chapters []struct {
+		Start string `json:"start_time"`
+		End   string `json:"end_time"`
+		Tags  struct {
+			Title string `json:"title"`
+		} `json:"tags"`
+	} `json:"chapters"`
+}
+
+// File probes a file. It returns ErrUnavailable if there's no ffprobe, and
+// ErrInvalid if ffprobe doesn't know what it is.
+func File(conf config.ProbeConfiguration, file string) (*api.MediaProbe, error) {
+	command := conf.Command
+	if command == "" {
+		command = DefaultCommand
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, err := Run(ctx, command, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", "-show_chapters", file)
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		return nil, ErrUnavailable
+	}
+	if err != nil {
+		msg := err.Error()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(bytes.TrimSpace(exitErr.Stderr)) > 0 {
+			// the first line says why, the file name is ours
+			msg = strings.SplitN(strings.TrimSpace(string(exitErr.Stderr)), "\n", 2)[0]
+			msg = strings.TrimPrefix(msg, file+": ")
+		}
+		return nil, fmt.Errorf("%w: %s", ErrInvalid, msg)
+	}
+	return parse(out)
+}
+
+// parse ffprobe's json
+func parse(out []byte) (*api.MediaProbe, error) {
+	o := &output{}
+	if err := json.Unmarshal(out, o); err != nil {
+		return nil, fmt.Errorf("ffprobe: %w", err)
+	}
+	info := &api.MediaProbe{Container: o.Format.Name}
+	info.Duration, _ = strconv.ParseFloat(o.Format.Duration, 64)
+	images := 0
+	for _, s := range o.Streams {
+		stream := api.MediaStream{
+			Index:    s.Index,
+			Codec:    s.CodecName,
+			Width:    s.Width,
+			Height:   s.Height,
+			Channels: s.Channels,
+			Language: s.Tags.Language,
+			Title:    s.Tags.Title,
+		}
+		switch s.CodecType {
+		case "video":
+			// cover art and posters are still images
+			if s.Disposition.AttachedPic != 0 || isImage(o.Format.Name) {
+				images++
+				continue
+			}
+			info.Video = append(info.Video, stream)
+		case "audio":
+			info.Audio = append(info.Audio, stream)
+		case "subtitle":
+			info.Subtitles = append(info.Subtitles, stream)
+		}
+	}
+	for _, c := range o.Chapters {
+		chapter := api.MediaChapter{Title: c.Tags.Title}
+		chapter.Start, _ = strconv.ParseFloat(c.Start, 64)
+		chapter.End, _ = strconv.ParseFloat(c.End, 64)
+		info.Chapters = append(info.Chapters, chapter)
+	}
+	switch {
+	case len(info.Video) > 0:
+		info.Type = api.MediaVideo
+	case len(info.Audio) > 0:
+		info.Type = api.MediaAudio
+	case len(info.Subtitles) > 0:
+		info.Type = api.MediaSubtitle
+	case images > 0:
+		info.Type = api.MediaImage
+	}
+	return info, nil
+}
+
+// isImage ffprobe reads pictures with its image2 and *_pipe demuxers
+func isImage(format string) bool {
+	return format == "image2" || strings.HasSuffix(format, "_pipe")
+}
+
+// maxCached listing probes kept, the least recently used go first
+const maxCached = 4096
+
+// cached a probe of file as it was then, a file that changed is probed
+// again
+type cached struct {
+	file     string
+	size     int64
+	modified time.Time
+	info     *api.MediaProbe
+}
+
+// cache listing probes by path, the most recently used at the front
+var cache = struct {
+	sync.Mutex
+	order *list.List
+	m     map[string]*list.Element
+}{order: list.New(), m: map[string]*list.Element{}}
+
+// cacheGet the probe of file if it hasn't changed since
+func cacheGet(file string, fi os.FileInfo) (*api.MediaProbe, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+	el, ok := cache.m[file]
+	if !ok {
+		return nil, false
+	}
+	c := el.Value.(*cached)
+	if c.size != fi.Size() || !c.modified.Equal(fi.ModTime()) {
+		return nil, false
+	}
+	cache.order.MoveToFront(el)
+	return c.info, true
+}
+
+// cachePut keeps the probe of file, and drops the least recently used one
+// if there are too many
+func cachePut(file string, fi os.FileInfo, info *api.MediaProbe) {
+	cache.Lock()
+	defer cache.Unlock()
+	c := &cached{file: file, size: fi.Size(), modified: fi.ModTime(), info: info}
+	if el, ok := cache.m[file]; ok {
+		el.Value = c
+		cache.order.MoveToFront(el)
+		return
+	}
+	cache.m[file] = cache.order.PushFront(c)
+	if cache.order.Len() > maxCached {
+		last := cache.order.Back()
+		cache.order.Remove(last)
+		delete(cache.m, last.Value.(*cached).file)
+	}
+}
+
+// Cached probes an audio or video file for a listing, nil if it isn't one,
+// can't be probed or ffprobe isn't installed
+func Cached(conf config.ProbeConfiguration, file string, fi os.FileInfo) *api.MediaProbe {
+	// only audio and video are worth it in a listing
+	if t := extType(file); t != api.MediaVideo && t != api.MediaAudio {
+		return nil
+	}
+	if info, ok := cacheGet(file, fi); ok {
+		return info
+	}
+
+	info, err := File(conf, file)
+	if errors.Is(err, ErrUnavailable) {
+		// it might be installed later
+		return nil
+	}
+	cachePut(file, fi, info)
+	return info
+}
@@ -0,0 +1,124 @@
+package probe
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/config"
+)
+
+// resetCache empties the listing cache until the test ends
+func resetCache(t *testing.T) {
+	t.Helper()
+	empty := func() {
+		cache.Lock()
+		cache.order.Init()
+		for k := range cache.m {
+			delete(cache.m, k)
+		}
+		cache.Unlock()
+	}
+	empty()
+	t.Cleanup(empty)
+}
+
+func TestCached(t *testing.T) {
+	resetCache(t)
+	runs := 0
+	old := Run
+	Run = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		runs++
+		return []byte(videoJSON), nil
+	}
+	t.Cleanup(func() { Run = old })
+
+	dir := t.TempDir()
+	file := newFile(t, dir, "a.mkv", "x")
+	stat := func() os.FileInfo {
+		fi, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi
+	}
+	conf := config.ProbeConfiguration{}
+	for i := 0; i < 2; i++ {
+		if info := Cached(conf, file, stat()); info == nil || info.Type != "video" {
+			t.Fatalf("got %+v", info)
+		}
+	}
+	if runs != 1 {
+		t.Fatalf("probed %d times, want once", runs)
+	}
+
+	// a changed file is probed again, and only kept once
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+	Cached(conf, file, stat())
+	if runs != 2 || len(cache.m) != 1 {
+		t.Fatalf("probed %d times, %d cached", runs, len(cache.m))
+	}
+
+	if info := Cached(conf, newFile(t, dir, "notes.txt", "x"), stat()); info != nil || runs != 2 {
+		t.Fatalf("got %+v after %d probes, only audio and video are probed", info, runs)
+	}
+}
+
+func TestCacheBound(t *testing.T) {
+	resetCache(t)
+	fi, err := os.Stat(newFile(t, t.TempDir(), "a.mkv", "x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := func(i int) string {
+		return filepath.Join("/media", fmt.Sprintf("%d.mkv", i))
+	}
+	for i := 0; i < maxCached; i++ {
+		cachePut(name(i), fi, nil)
+	}
+	// the first is used again, so the second is the oldest
+	if _, ok := cacheGet(name(0), fi); !ok {
+		t.Fatal("first probe wasn't cached")
+	}
+	cachePut(name(maxCached), fi, nil)
+
+	if n := cache.order.Len(); n != maxCached || len(cache.m) != maxCached {
+		t.Fatalf("%d cached, %d in the map, want %d", n, len(cache.m), maxCached)
+	}
+	if _, ok := cacheGet(name(1), fi); ok {
+		t.Fatal("the least recently used probe is still cached")
+	}
+	for _, i := range []int{0, 2, maxCached} {
+		if _, ok := cacheGet(name(i), fi); !ok {
+			t.Fatalf("%s was dropped", name(i))
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	fakeRun(t, "", os.ErrNotExist)
+	conf := config.ProbeConfiguration{Types: map[string][]string{"music": {"audio"}}}
+	dir := t.TempDir()
+	tests := []struct {
+		location string
+		file     string
+		allowed  bool
+	}{
+		{location: "music", file: "a.mp3", allowed: true},
+		{location: "music", file: "a.mkv"},
+		{location: "music", file: "notes.nfo", allowed: true},
+		{location: "movies", file: "a.mkv", allowed: true},
+	}
+	for _, tt := range tests {
+		err := Allowed(conf, tt.location, newFile(t, dir, tt.file, "x"))
+		if (err == nil) != tt.allowed {
+			t.Errorf("%s in %s: got %v", tt.file, tt.location, err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package probe
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/trash"
+)
+
+var (
+	// ErrInvalid the file is empty, or not audio, video, subtitles or a picture
+	ErrInvalid = errors.New("not a valid media file")
+	// ErrNotAllowed the location doesn't take this type of media
+	ErrNotAllowed = errors.New("media type not allowed")
+)
+
+// Validate probes a new file for location, name is what it's going to be
+// called. Without ffprobe the extension of name has to do.
+func Validate(conf config.ProbeConfiguration, location, file, name string) (*api.MediaProbe, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		return nil, fmt.Errorf("%w: empty file", ErrInvalid)
+	}
+	if conf.Disabled {
+		return nil, nil
+	}
+
+	info, err := File(conf, file)
+	if errors.Is(err, ErrUnavailable) {
+		// what the name says it is, only files that look like media get in
+		t := extType(name)
+		if t == "" {
+			return nil, fmt.Errorf("%w: %s, and %q isn't a media file name", ErrInvalid, err, path.Base(name))
+		}
+		if err := allow(conf, location, t); err != nil {
+			return nil, err
+		}
+		fmt.Println("  [W]: not validated,", err)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case info.Type == "":
+		return nil, fmt.Errorf("%w: no audio, video or subtitle streams", ErrInvalid)
+	case (info.Type == api.MediaVideo || info.Type == api.MediaAudio) && info.Duration <= 0:
+		return nil, fmt.Errorf("%w: %s has no duration", ErrInvalid, info.Type)
+	}
+	if err := allow(conf, location, info.Type); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// allow returns ErrNotAllowed if location doesn't take media of type t
+func allow(conf config.ProbeConfiguration, location, t string) error {
+	allowed := conf.Allowed(location)
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, a := range allowed {
+		if strings.EqualFold(a, t) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s only takes %s, not %s", ErrNotAllowed, location, strings.Join(allowed, ", "), t)
+}
+
+// Allowed returns ErrNotAllowed if location doesn't take the type of media
+// file is, e.g. before it's moved there. Files that aren't media pass, and
+// without ffprobe the extension has to do.
+func Allowed(conf config.ProbeConfiguration, location, file string) error {
+	if conf.Disabled || len(conf.Allowed(location)) == 0 {
+		return nil
+	}
+	t := extType(file)
+	if info, err := File(conf, file); err == nil && info.Type != "" {
+		t = info.Type
+	}
+	if t == "" {
+		return nil
+	}
+	return allow(conf, location, t)
+}
+
+// Admit validates file, a new file in the location that's going to be
+// relPath. Files that fail are deleted, or moved to the trash if
+// probe.quarantine is on.
+func Admit(conf *config.Configuration, sandbox *filesystem.Sandbox, location, file, relPath, user string) (*api.MediaProbe, error) {
+	info, err := Validate(conf.Probe, location, file, relPath)
+	if err == nil {
+		return info, nil
+	}
+	if !errors.Is(err, ErrInvalid) && !errors.Is(err, ErrNotAllowed) {
+		return nil, err
+	}
+	if conf.Probe.Quarantine && !conf.Trash.Disabled {
+		item, qerr := trash.New(sandbox, location).Put(file, relPath, user, api.TrashQuarantined)
+		if qerr == nil {
+			fmt.Println("  [W]: quarantined", relPath, err)
+			return nil, fmt.Errorf("%w, moved to the trash as %s", err, item.ID)
+		}
+		fmt.Println("  [E]: quarantine:", qerr)
+	}
+	os.Remove(file)
+	return nil, err
+}
+
+// Status 415 for ErrNotAllowed, 422 for ErrInvalid and 500 for anything else
+func Status(err error) int {
+	switch {
+	case errors.Is(err, ErrNotAllowed):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrInvalid):
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
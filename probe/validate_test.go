@@ -0,0 +1,141 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/trash"
+)
+
+const (
+	videoJSON = `{"format": {"format_name": "matroska,webm", "duration": "60.0"},
+		"streams": [{"index": 0, "codec_type": "video", "codec_name": "h264"}, {"index": 1, "codec_type": "audio", "codec_name": "aac"}]}`
+	audioJSON = `{"format": {"format_name": "mp3", "duration": "180.0"},
+		"streams": [{"index": 0, "codec_type": "audio", "codec_name": "mp3"}]}`
+	emptyJSON = `{"format": {"format_name": "tty"}, "streams": []}`
+)
+
+// fakeRun swaps Run for one that prints out, or fails with err, until the
+// test ends
+func fakeRun(t *testing.T, out string, err error) {
+	t.Helper()
+	old := Run
+	Run = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		return []byte(out), err
+	}
+	t.Cleanup(func() { Run = old })
+}
+
+// newFile writes content to name in dir
+func newFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestValidate(t *testing.T) {
+	conf := config.ProbeConfiguration{
+		Types: map[string][]string{"music": {"audio"}},
+	}
+	tests := []struct {
+		name     string
+		location string
+		content  string
+		file     string
+		out      string
+		runErr   error
+		want     error
+		wantType string
+	}{
+		{name: "video", location: "movies", content: "x", file: "a.mkv", out: videoJSON, wantType: "video"},
+		{name: "audio allowed", location: "music", content: "x", file: "a.mp3", out: audioJSON, wantType: "audio"},
+		{name: "empty", location: "movies", content: "", file: "a.mkv", out: videoJSON, want: ErrInvalid},
+		{name: "not media", location: "movies", content: "x", file: "a.mkv", out: emptyJSON, want: ErrInvalid},
+		{name: "ffprobe refuses", location: "movies", content: "x", file: "a.mkv", runErr: &exec.ExitError{}, want: ErrInvalid},
+		{name: "type not allowed", location: "music", content: "x", file: "a.mkv", out: videoJSON, want: ErrNotAllowed},
+		{name: "no ffprobe, media name", location: "movies", content: "x", file: "a.mkv", runErr: exec.ErrNotFound},
+		{name: "no ffprobe, not a media name", location: "movies", content: "x", file: "a.exe", runErr: exec.ErrNotFound, want: ErrInvalid},
+		{name: "no ffprobe, type not allowed", location: "music", content: "x", file: "a.mkv", runErr: exec.ErrNotFound, want: ErrNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeRun(t, tt.out, tt.runErr)
+			file := newFile(t, t.TempDir(), ".upload.part", tt.content)
+			info, err := Validate(conf, tt.location, file, "Folder/"+tt.file)
+			if tt.want != nil {
+				if !errors.Is(err, tt.want) {
+					t.Fatalf("got %v, want %v", err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantType == "" {
+				if info != nil {
+					t.Fatalf("got %+v without ffprobe", info)
+				}
+				return
+			}
+			if info == nil || info.Type != tt.wantType {
+				t.Fatalf("got %+v, want %s", info, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	tests := []struct {
+		name       string
+		quarantine bool
+		out        string
+		runErr     error
+		relPath    string
+		wantErr    bool
+		wantTrash  bool
+	}{
+		{name: "admitted", out: videoJSON, relPath: "a.mkv"},
+		{name: "deleted", out: emptyJSON, relPath: "a.mkv", wantErr: true},
+		{name: "quarantined", quarantine: true, out: emptyJSON, relPath: "a.mkv", wantErr: true, wantTrash: true},
+		{name: "no ffprobe, quarantined", quarantine: true, runErr: exec.ErrNotFound, relPath: "a.exe", wantErr: true, wantTrash: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeRun(t, tt.out, tt.runErr)
+			root := t.TempDir()
+			conf := &config.Configuration{}
+			conf.Probe.Quarantine = tt.quarantine
+			sandbox, err := filesystem.NewSandbox(root, filesystem.SymlinksInside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file := newFile(t, root, "."+tt.relPath+".part", "x")
+
+			_, err = Admit(conf, sandbox, "movies", file, tt.relPath, "tester")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, want an error: %v", err, tt.wantErr)
+			}
+			_, statErr := os.Stat(file)
+			if tt.wantErr != os.IsNotExist(statErr) {
+				t.Fatalf("part file left: %v", statErr)
+			}
+			items, err := trash.New(sandbox, "movies").List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(items) > 0; got != tt.wantTrash {
+				t.Fatalf("trash has %d items, want some: %v", len(items), tt.wantTrash)
+			}
+		})
+	}
+}
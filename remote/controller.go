@@ -0,0 +1,287 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/app"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/form"
+	"github.com/jaredwarren/plexupdate/jobs"
+	"github.com/jaredwarren/plexupdate/space"
+	"github.com/jaredwarren/plexupdate/transcode"
+)
+
+// browseTimeout for listing a folder, imports run as long as they need
+const browseTimeout = time.Minute
+
+// recentJobs imports shown under the browser
+const recentJobs = 10
+
+// Controller browses remote file servers and imports from them.
+type Controller struct {
+	mux  *mux.Router
+	api  *mux.Router
+	conf *config.Current
+	jobs *jobs.Manager
+}
+
+// Register sets up the importer and the routes
+func Register(service *app.Service) {
+	workers := service.Config.Get().Remote.Workers
+	if workers <= 0 {
+		workers = config.DefaultRemoteWorkers
+	}
+	importer = &Importer{
+		conf:  service.Config,
+		jobs:  service.Jobs.NewQueue(workers),
+		plex:  service.Plex,
+		index: service.Index,
+	}
+	c := &Controller{
+		mux:  service.Mux,
+		api:  service.API,
+		conf: service.Config,
+		jobs: service.Jobs,
+	}
+	c.MountController()
+}
+
+// MountController ...
+func (c *Controller) MountController() {
+	c.mux.HandleFunc("/remote", c.List).Methods("GET")
+	c.mux.HandleFunc("/remote/{name}", c.Browse).Methods("GET")
+	c.mux.HandleFunc("/remote/{name}/import", c.ImportHandler).Methods("POST")
+
+	c.api.HandleFunc("/remotes", c.APIList).Methods("GET")
+	c.api.HandleFunc("/remotes/{name}/files", c.APIFiles).Methods("GET")
+	c.api.HandleFunc("/remotes/{name}/import", c.ImportHandler).Methods("POST")
+}
+
+// writeError picks the status from err
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusInternalServerError
+	var se *StatusError
+	switch {
+	case errors.Is(err, ErrUnknown), errors.Is(err, os.ErrNotExist):
+		code = http.StatusNotFound
+	case errors.As(err, &se):
+		code = http.StatusBadGateway
+		if se.Code == http.StatusNotFound {
+			code = http.StatusNotFound
+		}
+	case errors.Is(err, ErrBusy):
+		code = http.StatusConflict
+	case errors.Is(err, ErrTooMany), errors.Is(err, transcode.ErrUnknownProfile), errors.Is(err, filesystem.ErrInvalid):
+		code = http.StatusBadRequest
+	case errors.Is(err, filesystem.ErrEscape), errors.Is(err, filesystem.ErrSymlink):
+		code = http.StatusForbidden
+	case errors.Is(err, space.ErrNoSpace), errors.Is(err, space.ErrQuota):
+		code = http.StatusInsufficientStorage
+	}
+	api.WriteError(w, r, code, err)
+}
+
+// canDownload sends 403 if the user can't download anywhere
+func canDownload(w http.ResponseWriter, r *http.Request) bool {
+	if !auth.Permissions(r)[auth.PermDownload] {
+		auth.Check(w, r, auth.PermDownload, "")
+		return false
+	}
+	return true
+}
+
+// files lists dir on the remote server with name
+func (c *Controller) files(r *http.Request, name, dir string) ([]api.RemoteFile, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), browseTimeout)
+	defer cancel()
+	src, err := Open(ctx, c.conf.Get(), name)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	return src.List(ctx, dir)
+}
+
+// crumb a link in the path above the listing
+type crumb struct {
+	Name string
+	Path string
+}
+
+// crumbs from the server's folder down to dir
+func crumbs(dir string) []crumb {
+	list := []crumb{}
+	for p := dir; p != "/"; p = path.Dir(p) {
+		list = append([]crumb{{Name: path.Base(p), Path: p}}, list...)
+	}
+	return list
+}
+
+// page the server list, or a folder on one server
+type page struct {
+	Title     string
+	Remotes   []api.Remote
+	Name      string
+	URL       string
+	Dir       string
+	Parent    string
+	Crumbs    []crumb
+	Files     []api.RemoteFile
+	Locations map[string]string
+	Profiles  []string
+	Jobs      []*api.Job
+}
+
+// render the page
+func render(w http.ResponseWriter, r *http.Request, p *page) {
+	// parse every time to make updates easier, and save memory
+	tpl := template.Must(template.New("base").Funcs(template.FuncMap{
+		"CsrfToken": form.TokenFunc(r),
+		"Size":      formatSize,
+		"Percent": func(p float64) string {
+			return fmt.Sprintf("%.0f%%", p*100)
+		},
+	}).ParseFiles("templates/remote.html", "templates/base.html"))
+	tpl.ExecuteTemplate(w, "base", p)
+}
+
+// List shows the remote servers
+func (c *Controller) List(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Remote", r.URL.String())
+	if !canDownload(w, r) {
+		return
+	}
+	render(w, r, &page{
+		Title:   "Remote Import",
+		Remotes: Remotes(c.conf.Get()),
+	})
+}
+
+// Browse shows a folder on a remote server, with a form to import each
+// file or folder in it
+func (c *Controller) Browse(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Browse", r.URL.String())
+	if !canDownload(w, r) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	s, ok := c.conf.Get().Remote.Server(name)
+	if !ok {
+		writeError(w, r, fmt.Errorf("%w: %q", ErrUnknown, name))
+		return
+	}
+	dir := clean(r.URL.Query().Get("path"))
+	files, err := c.files(r, name, dir)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	recent := []*api.Job{}
+	for _, j := range c.jobs.List() {
+		if j.Type == JobType && len(recent) < recentJobs {
+			recent = append(recent, api.NewJob(j))
+		}
+	}
+
+	render(w, r, &page{
+		Title:     "Remote Import",
+		Name:      name,
+		URL:       redact(s.URL),
+		Dir:       dir,
+		Parent:    path.Dir(dir),
+		Crumbs:    crumbs(dir),
+		Files:     files,
+		Locations: auth.Locations(r, auth.PermDownload, c.conf.Get().Plex.Locations),
+		Profiles:  c.conf.Get().Transcode.Names(),
+		Jobs:      recent,
+	})
+}
+
+// ImportHandler queues an import of a file or folder. Json clients get the
+// job back, the html form goes back to the folder.
+func (c *Controller) ImportHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("ImportHandler", r.URL.String())
+
+	name := mux.Vars(r)["name"]
+	req := &api.ImportRequest{}
+	if api.IsJSON(r) {
+		if err := api.ReadJSON(r, req); err != nil {
+			api.WriteError(w, r, http.StatusBadRequest, err)
+			return
+		}
+	} else {
+		r.ParseForm()
+		req.Path = r.PostForm.Get("path")
+		req.Location = r.PostForm.Get("location")
+		req.Folder = r.PostForm.Get("folder")
+		req.Transcode = r.PostForm.Get("transcode")
+		req.Extract = r.PostForm.Get("extract") == "on"
+		req.Flatten = r.PostForm.Get("flatten") == "on"
+	}
+	if req.Path == "" {
+		api.WriteError(w, r, http.StatusBadRequest, errors.New("missing path"))
+		return
+	}
+	if _, ok := c.conf.Get().Plex.Locations[req.Location]; !ok {
+		api.WriteError(w, r, http.StatusBadRequest, fmt.Errorf("unknown location: %q", req.Location))
+		return
+	}
+	if !auth.Check(w, r, auth.PermDownload, req.Location) {
+		return
+	}
+
+	job, err := Import(name, req, auth.Username(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if api.WantsJSON(r) {
+		w.Header().Set("Location", api.Prefix+"/jobs/"+job.ID)
+		api.WriteJSON(w, http.StatusAccepted, api.NewJob(job))
+		return
+	}
+	http.Redirect(w, r, "/remote/"+name+"?path="+url.QueryEscape(path.Dir(clean(req.Path))), http.StatusSeeOther)
+}
+
+// APIList the remote servers, without their logins
+func (c *Controller) APIList(w http.ResponseWriter, r *http.Request) {
+	if !canDownload(w, r) {
+		return
+	}
+	api.WriteJSON(w, http.StatusOK, Remotes(c.conf.Get()))
+}
+
+// APIFiles lists a folder on a remote server
+func (c *Controller) APIFiles(w http.ResponseWriter, r *http.Request) {
+	if !canDownload(w, r) {
+		return
+	}
+	files, err := c.files(r, mux.Vars(r)["name"], r.URL.Query().Get("path"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	api.WriteJSON(w, http.StatusOK, files)
+}
+
+// formatSize for the listing, blank if the server doesn't say
+func formatSize(size int64) string {
+	if size < 0 {
+		return ""
+	}
+	return api.FormatBytes(size)
+}
@@ -0,0 +1,333 @@
+package remote
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/config"
+)
+
+// maxListing bigger directory listings are refused
+const maxListing = 10 << 20
+
+// StatusError the server answered, but not with 2xx
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return "remote: " + e.Status
+}
+
+// Temporary true if trying again might work
+func (e *StatusError) Temporary() bool {
+	return e.Code >= 500 || e.Code == http.StatusRequestTimeout || e.Code == http.StatusTooManyRequests
+}
+
+// httpSource a folder on a web server
+type httpSource struct {
+	client   *http.Client
+	base     *url.URL
+	user     string
+	password string
+}
+
+// newHTTP the base url always ends in /
+func newHTTP(s config.RemoteServer) (*httpSource, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%q isn't an http url", redact(s.URL))
+	}
+	h := &httpSource{
+		// no timeout, files are big, a stalled read is canceled with the job
+		client:   &http.Client{},
+		base:     u,
+		user:     s.User,
+		password: s.Password,
+	}
+	if u.User != nil {
+		if h.user == "" {
+			h.user = u.User.Username()
+		}
+		if p, ok := u.User.Password(); ok && h.password == "" {
+			h.password = p
+		}
+		u.User = nil
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return h, nil
+}
+
+// url of p, folders end in /
+func (h *httpSource) url(p string, dir bool) string {
+	p = strings.TrimPrefix(clean(p), "/")
+	if dir && p != "" {
+		p += "/"
+	}
+	return h.base.ResolveReference(&url.URL{Path: p}).String()
+}
+
+// path in the server's folder of an absolute url path
+func (h *httpSource) path(urlPath string) (string, bool) {
+	if !strings.HasPrefix(urlPath, h.base.Path) {
+		return "", false
+	}
+	return clean(strings.TrimPrefix(urlPath, h.base.Path)), true
+}
+
+// do sends a request, anything but 2xx is an error
+func (h *httpSource) do(ctx context.Context, method, rawURL string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if h.user != "" || h.password != "" {
+		req.SetBasicAuth(h.user, h.password)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	return resp, nil
+}
+
+// Open reads from offset, a server that doesn't do ranges is read past it
+func (h *httpSource) Open(ctx context.Context, p string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := h.do(ctx, http.MethodGet, h.url(p, false), header, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	return resp.Body, nil
+}
+
+// Close ...
+func (h *httpSource) Close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+// listing a web server's directory listing, e.g. nginx autoindex or
+// apache's mod_autoindex
+type listing struct {
+	*httpSource
+}
+
+// hrefRe links in a directory listing
+var hrefRe = regexp.MustCompile(`(?i)<a\s[^>]*href\s*=\s*["']([^"'#?]+)["']`)
+
+func openHTTP(ctx context.Context, s config.RemoteServer) (Source, error) {
+	h, err := newHTTP(s)
+	if err != nil {
+		return nil, err
+	}
+	return &listing{h}, nil
+}
+
+// List the links to files and folders right in dir
+func (l *listing) List(ctx context.Context, dir string) ([]api.RemoteFile, error) {
+	dir = clean(dir)
+	dirURL, err := url.Parse(l.url(dir, true))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := l.do(ctx, http.MethodGet, dirURL.String(), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxListing))
+	if err != nil {
+		return nil, err
+	}
+
+	files := []api.RemoteFile{}
+	seen := map[string]bool{}
+	for _, m := range hrefRe.FindAllSubmatch(data, -1) {
+		ref, err := url.Parse(string(m[1]))
+		if err != nil {
+			continue
+		}
+		u := dirURL.ResolveReference(ref)
+		if u.Host != dirURL.Host {
+			continue
+		}
+		p, ok := l.path(u.Path)
+		// only what's right in dir, not the parent or sort links
+		if !ok || path.Dir(p) != dir || p == dir || seen[p] {
+			continue
+		}
+		seen[p] = true
+		files = append(files, api.RemoteFile{
+			Name: path.Base(p),
+			Path: p,
+			Dir:  strings.HasSuffix(u.Path, "/"),
+			Size: -1,
+		})
+	}
+	sortFiles(files)
+	return files, nil
+}
+
+// Stat a folder is a url that ends up with a / after redirects
+func (l *listing) Stat(ctx context.Context, p string) (api.RemoteFile, error) {
+	p = clean(p)
+	resp, err := l.do(ctx, http.MethodHead, l.url(p, false), nil, nil)
+	if err != nil {
+		return api.RemoteFile{}, err
+	}
+	resp.Body.Close()
+	f := api.RemoteFile{Name: path.Base(p), Path: p, Size: resp.ContentLength}
+	if p == "/" || strings.HasSuffix(resp.Request.URL.Path, "/") {
+		f.Dir, f.Size = true, 0
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		f.Modified = &t
+	}
+	return f, nil
+}
+
+// webdav a folder on a webdav server
+type webdav struct {
+	*httpSource
+}
+
+func openWebDAV(ctx context.Context, s config.RemoteServer) (Source, error) {
+	h, err := newHTTP(s)
+	if err != nil {
+		return nil, err
+	}
+	return &webdav{h}, nil
+}
+
+// propfind the properties we ask for
+const propfind = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/><getlastmodified/></prop></propfind>`
+
+// multistatus a PROPFIND answer
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				Length       string `xml:"DAV: getcontentlength"`
+				LastModified string `xml:"DAV: getlastmodified"`
+			} `xml:"DAV: prop"`
+			Status string `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// propfind p and what's in it with depth 1
+func (d *webdav) propfind(ctx context.Context, p string, depth string) ([]api.RemoteFile, error) {
+	header := http.Header{}
+	header.Set("Depth", depth)
+	header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := d.do(ctx, "PROPFIND", d.url(p, depth != "0"), header, strings.NewReader(propfind))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	ms := &multistatus{}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxListing)).Decode(ms); err != nil {
+		return nil, fmt.Errorf("remote: bad PROPFIND answer: %w", err)
+	}
+
+	files := []api.RemoteFile{}
+	for _, r := range ms.Responses {
+		u, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		fp, ok := d.path(u.Path)
+		if !ok {
+			continue
+		}
+		f := api.RemoteFile{Name: path.Base(fp), Path: fp, Size: -1}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200") {
+				continue
+			}
+			f.Dir = ps.Prop.ResourceType.Collection != nil
+			if n, err := strconv.ParseInt(ps.Prop.Length, 10, 64); err == nil {
+				f.Size = n
+			}
+			if t, err := http.ParseTime(ps.Prop.LastModified); err == nil {
+				f.Modified = &t
+			}
+		}
+		if f.Dir {
+			f.Size = 0
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// List ...
+func (d *webdav) List(ctx context.Context, dir string) ([]api.RemoteFile, error) {
+	dir = clean(dir)
+	all, err := d.propfind(ctx, dir, "1")
+	if err != nil {
+		return nil, err
+	}
+	// the answer has dir itself too
+	files := []api.RemoteFile{}
+	for _, f := range all {
+		if f.Path != dir {
+			files = append(files, f)
+		}
+	}
+	sortFiles(files)
+	return files, nil
+}
+
+// Stat ...
+func (d *webdav) Stat(ctx context.Context, p string) (api.RemoteFile, error) {
+	p = clean(p)
+	files, err := d.propfind(ctx, p, "0")
+	if err != nil {
+		return api.RemoteFile{}, err
+	}
+	if len(files) == 0 {
+		return api.RemoteFile{}, &StatusError{Code: http.StatusNotFound, Status: "404 Not Found"}
+	}
+	f := files[0]
+	f.Path, f.Name = p, path.Base(p)
+	return f, nil
+}
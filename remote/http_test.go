@@ -0,0 +1,249 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/config"
+)
+
+// modified the time every test file has
+var modified = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// basicAuth lets only user and password through to h
+func basicAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "pass" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// newFolder a temp folder with a movie, a file with a space and a folder
+func newFolder(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"movie.mkv":            "0123456789",
+		"a b.mkv":              "ab",
+		"Show/Season 1/e1.mkv": "e1",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// names of files, folders end in /
+func names(files []api.RemoteFile) []string {
+	got := []string{}
+	for _, f := range files {
+		name := f.Path
+		if f.Dir {
+			name += "/"
+		}
+		got = append(got, name)
+	}
+	return got
+}
+
+func TestListing(t *testing.T) {
+	dir := newFolder(t)
+	mux := http.NewServeMux()
+	mux.Handle("/pub/", basicAuth(http.StripPrefix("/pub/", http.FileServer(http.Dir(dir)))))
+	// what apache sends, with links that aren't files in the folder
+	mux.HandleFunc("/links/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html><body>
+<a href="?C=N;O=D">Name</a> <a href="?C=M;O=A">Last modified</a>
+<a href="/">Parent Directory</a> <a href="../">Up</a>
+<a href="Movies/">Movies/</a>
+<A HREF='x.mkv'>x.mkv</A> <a class="f" href="/links/y.mkv">y.mkv</a>
+<a href="x.mkv">again</a> <a href="deeper/z.mkv">z.mkv</a>
+<a href="http://elsewhere.example.com/links/w.mkv">w.mkv</a>
+</body></html>`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	ctx := context.Background()
+
+	src, err := openHTTP(ctx, config.RemoteServer{URL: strings.Replace(srv.URL, "http://", "http://user:pass@", 1) + "/pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	files, err := src.List(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(files), []string{"/Show/", "/a b.mkv", "/movie.mkv"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	all, err := walk(ctx, src, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(all), []string{"/a b.mkv", "/movie.mkv", "/Show/Season 1/e1.mkv"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("walked %q, want %q", got, want)
+	}
+
+	f, err := src.Stat(ctx, "/movie.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Dir || f.Size != 10 || f.Modified == nil || !f.Modified.Equal(modified) {
+		t.Fatalf("got %+v", f)
+	}
+	if f, err := src.Stat(ctx, "/Show"); err != nil || !f.Dir {
+		t.Fatalf("got %+v, %v, want a folder", f, err)
+	}
+	if _, err := src.Stat(ctx, "/gone.mkv"); err == nil || retryable(err) {
+		t.Fatalf("got %v, a missing file isn't tried again", err)
+	}
+
+	// the password is needed
+	noAuth, _ := openHTTP(ctx, config.RemoteServer{URL: srv.URL + "/pub/"})
+	_, err = noAuth.List(ctx, "/")
+	if se, ok := err.(*StatusError); !ok || se.Code != http.StatusUnauthorized || se.Temporary() {
+		t.Fatalf("got %v, want a 401", err)
+	}
+
+	links, _ := openHTTP(ctx, config.RemoteServer{URL: srv.URL + "/links"})
+	files, err = links.List(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(files), []string{"/Movies/", "/x.mkv", "/y.mkv"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestHTTPOpen(t *testing.T) {
+	content := []byte("0123456789")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ranges/movie.mkv", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "movie.mkv", modified, bytes.NewReader(content))
+	})
+	mux.HandleFunc("/whole/movie.mkv", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	for _, folder := range []string{"ranges", "whole"} {
+		t.Run(folder, func(t *testing.T) {
+			src, _ := openHTTP(context.Background(), config.RemoteServer{URL: srv.URL + "/" + folder})
+			in, err := src.Open(context.Background(), "/movie.mkv", 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(in)
+			in.Close()
+			if err != nil || string(got) != "456789" {
+				t.Fatalf("got %q, %v", got, err)
+			}
+		})
+	}
+}
+
+// fakeDAV answers PROPFIND for /dav/ like a webdav server, with the
+// properties it doesn't have in a 404 propstat
+func fakeDAV(t *testing.T) http.Handler {
+	entry := func(href string, dir bool, size int) string {
+		props := `<D:resourcetype/><D:getcontentlength>` + fmt.Sprint(size) + `</D:getcontentlength>`
+		if dir {
+			props = `<D:resourcetype><D:collection/></D:resourcetype>`
+		}
+		return `<D:response><D:href>` + href + `</D:href>
+<D:propstat><D:prop>` + props + `<D:getlastmodified>` + modified.Format(http.TimeFormat) + `</D:getlastmodified></D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>
+<D:propstat><D:prop><D:getcontentlength/></D:prop><D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>
+</D:response>`
+	}
+	return basicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PROPFIND" {
+			http.Error(w, "not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var body string
+		switch depth := r.Header.Get("Depth"); {
+		case r.URL.Path == "/dav/" && depth == "1":
+			body = entry("/dav/", true, 0) + entry("/dav/Show/", true, 0) +
+				entry("/dav/a%20b.mkv", false, 2) + entry("http://"+r.Host+"/dav/movie.mkv", false, 10) +
+				entry("/other/x.mkv", false, 1)
+		case r.URL.Path == "/dav/a b.mkv" && depth == "0":
+			body = entry("/dav/a%20b.mkv", false, 2)
+		case r.URL.Path == "/dav/empty" && depth == "0":
+		default:
+			t.Errorf("PROPFIND %s with depth %q", r.URL.Path, depth)
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:">`+body+`</D:multistatus>`)
+	}))
+}
+
+func TestWebDAV(t *testing.T) {
+	srv := httptest.NewServer(fakeDAV(t))
+	defer srv.Close()
+	ctx := context.Background()
+	src, err := openWebDAV(ctx, config.RemoteServer{URL: srv.URL + "/dav", User: "user", Password: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	files, err := src.List(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(files), []string{"/Show/", "/a b.mkv", "/movie.mkv"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if f := files[2]; f.Size != 10 || f.Modified == nil || !f.Modified.Equal(modified) {
+		t.Fatalf("got %+v", f)
+	}
+	if files[0].Size != 0 {
+		t.Fatalf("a folder has size %d", files[0].Size)
+	}
+
+	f, err := src.Stat(ctx, "/a b.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name != "a b.mkv" || f.Size != 2 || f.Dir {
+		t.Fatalf("got %+v", f)
+	}
+	_, err = src.Stat(ctx, "/empty")
+	if se, ok := err.(*StatusError); !ok || se.Code != http.StatusNotFound {
+		t.Fatalf("got %v, want a 404", err)
+	}
+
+	noAuth, _ := openWebDAV(ctx, config.RemoteServer{URL: srv.URL + "/dav"})
+	if _, err := noAuth.List(ctx, "/"); retryable(err) {
+		t.Fatalf("got %v, a login that isn't allowed isn't tried again", err)
+	}
+}
@@ -0,0 +1,428 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/archive"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/duplicates"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/jobs"
+	"github.com/jaredwarren/plexupdate/place"
+	"github.com/jaredwarren/plexupdate/plex"
+	"github.com/jaredwarren/plexupdate/probe"
+	"github.com/jaredwarren/plexupdate/space"
+	"github.com/jaredwarren/plexupdate/transcode"
+	"github.com/jaredwarren/plexupdate/trash"
+)
+
+// JobType of remote imports
+const JobType = "import"
+
+// partExt files are written to a hidden .part file until they're done, a
+// later import of the same file picks up where it stopped
+const partExt = ".part"
+
+// ErrBusy another import is writing the same file
+var ErrBusy = errors.New("already importing that file")
+
+// importer set up by Register
+var importer *Importer
+
+// Importer copies files from remote servers into locations, remote.workers
+// at once
+type Importer struct {
+	conf  *config.Current
+	jobs  *jobs.Queue
+	plex  *plex.Scanner
+	index *duplicates.Index
+}
+
+// Import queues req from the remote server with name for user
+func Import(name string, req *api.ImportRequest, user string) (*jobs.Job, error) {
+	if importer == nil {
+		return nil, errors.New("remote imports aren't set up")
+	}
+	return importer.Start(name, req, user)
+}
+
+// plan a checked request
+type plan struct {
+	server   string
+	path     string
+	location string
+	sandbox  *filesystem.Sandbox
+	folder   string
+	profile  string
+	extract  bool
+	flatten  bool
+}
+
+// Start checks req and queues it
+func (im *Importer) Start(name string, req *api.ImportRequest, user string) (*jobs.Job, error) {
+	if _, ok := im.conf.Get().Remote.Server(name); !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknown, name)
+	}
+	p := &plan{
+		server:   name,
+		path:     clean(req.Path),
+		location: req.Location,
+		extract:  req.Extract,
+		flatten:  req.Flatten,
+	}
+	var err error
+	if p.sandbox, err = im.conf.Get().Plex.Sandbox(req.Location); err != nil {
+		return nil, err
+	}
+	if p.folder, err = filesystem.Clean(req.Folder); err != nil {
+		return nil, err
+	}
+	if trash.Contains(p.folder) {
+		return nil, fmt.Errorf("%s: %w", p.folder, filesystem.ErrEscape)
+	}
+	if _, err := p.sandbox.Resolve(p.folder); err != nil {
+		return nil, err
+	}
+	p.profile = transcode.ProfileFor(im.conf.Get(), req.Location, req.Transcode)
+	if _, ok := im.conf.Get().Transcode.Profile(p.profile); p.profile != "" && !ok {
+		return nil, fmt.Errorf("%w: %q", transcode.ErrUnknownProfile, p.profile)
+	}
+	if err := space.Check(im.conf.Get(), req.Location, 0); err != nil {
+		return nil, err
+	}
+
+	j := im.jobs.Start(JobType, user, req.Location, func(ctx context.Context, j *jobs.Job) (string, error) {
+		return im.run(ctx, j, p, user)
+	})
+	fmt.Println("  import", name, p.path, "to", p.location, p.folder, "job", j.ID)
+	return j, nil
+}
+
+// item a remote file and where it goes in the location
+type item struct {
+	api.RemoteFile
+	relPath string
+}
+
+// run copies the file, or every file in the folder, keeping the folder's
+// layout under p.folder
+func (im *Importer) run(ctx context.Context, j *jobs.Job, p *plan, user string) (string, error) {
+	src, err := Open(ctx, im.conf.Get(), p.server)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	// sftp reads don't take a context, closing the connection stops them
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			src.Close()
+		case <-finished:
+		}
+	}()
+
+	top, err := src.Stat(ctx, p.path)
+	if err != nil {
+		return "", err
+	}
+	files := []api.RemoteFile{top}
+	if top.Dir {
+		if files, err = walk(ctx, src, p.path); err != nil {
+			return "", err
+		}
+	}
+	items, total, err := im.items(ctx, src, p, files)
+	if err != nil {
+		return "", err
+	}
+	if len(items) == 0 {
+		return "nothing to import, " + p.path + " is empty", nil
+	}
+
+	prog := &progress{j: j, total: total}
+	skipped, imported, size := 0, []string{}, int64(0)
+	notes := []string{}
+	for _, it := range items {
+		file, err := p.sandbox.Resolve(it.relPath)
+		if err != nil {
+			return "", err
+		}
+		// already there, from an earlier import
+		if fi, err := os.Stat(file); err == nil && same(fi, it.RemoteFile) {
+			prog.add(it.Size)
+			skipped++
+			continue
+		}
+		files, note, err := im.fetch(ctx, src, p, it, file, prog, user)
+		if errors.Is(err, probe.ErrInvalid) || errors.Is(err, probe.ErrNotAllowed) || archive.Refused(err) {
+			notes = append(notes, it.relPath+": "+err.Error())
+			continue
+		}
+		if err != nil {
+			if len(imported) > 0 {
+				err = fmt.Errorf("%s: %w (%d of %d files were imported)", it.Path, err, len(imported), len(items))
+			}
+			return "", err
+		}
+		if note != "" {
+			notes = append(notes, it.relPath+": "+note)
+		}
+		imported = append(imported, files...)
+		size += it.Size
+	}
+	j.SetProgress(1)
+
+	result := fmt.Sprintf("imported %d files (%s) to %s %s", len(imported), api.FormatBytes(size), p.location, path.Join("/", p.folder))
+	if len(imported) == 1 && !top.Dir {
+		result = imported[0]
+	}
+	if skipped > 0 {
+		result += fmt.Sprintf("\n%d already there", skipped)
+	}
+	for _, relPath := range imported {
+		_, _, jobNotes := place.Jobs(p.location, relPath, p.profile, user)
+		notes = append(notes, jobNotes...)
+	}
+	if len(notes) > 0 {
+		result += "\n" + strings.Join(notes, "\n")
+	}
+	if len(imported) > 0 {
+		scan := path.Dir(items[0].relPath)
+		if top.Dir {
+			scan = p.folder
+			if name, err := filesystem.NormalizeFilename(top.Name); err == nil && p.path != "/" {
+				scan = path.Join(p.folder, name)
+			}
+		}
+		dir, _ := p.sandbox.Resolve(scan)
+		if msg := im.plex.ScanAndWait(p.location, dir); msg != "" {
+			result += "\n" + msg
+		}
+	}
+	return result, nil
+}
+
+// same true if fi is f from an earlier import, imports keep the server's
+// modified time. Without one it can't be told.
+func same(fi os.FileInfo, f api.RemoteFile) bool {
+	return fi.Size() == f.Size && f.Modified != nil &&
+		fi.ModTime().Truncate(time.Second).Equal(f.Modified.Truncate(time.Second))
+}
+
+// items where each file goes, a folder keeps its own name. Servers that
+// don't list sizes or times are asked for each file, so the space check,
+// the progress and spotting files imported before cover everything.
+func (im *Importer) items(ctx context.Context, src Source, p *plan, files []api.RemoteFile) ([]item, int64, error) {
+	base := path.Dir(p.path)
+	items := []item{}
+	total := int64(0)
+	for _, f := range files {
+		if f.Size < 0 || f.Modified == nil {
+			fi, err := src.Stat(ctx, f.Path)
+			if err != nil {
+				return nil, 0, err
+			}
+			f.Size, f.Modified = fi.Size, fi.Modified
+		}
+		parts := []string{p.folder}
+		for _, part := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(f.Path, base), "/"), "/") {
+			name, err := filesystem.NormalizeFilename(part)
+			if err != nil {
+				return nil, 0, fmt.Errorf("%s: %w", f.Path, err)
+			}
+			parts = append(parts, name)
+		}
+		relPath := path.Join(parts...)
+		if trash.Contains(relPath) {
+			continue
+		}
+		items = append(items, item{RemoteFile: f, relPath: relPath})
+		if f.Size > 0 {
+			total += f.Size
+		}
+	}
+	if err := space.Check(im.conf.Get(), p.location, total); err != nil {
+		return nil, 0, err
+	}
+	return items, total, nil
+}
+
+// fetch copies it to file, retrying dropped connections, and puts it in
+// place. It returns the file's path in the location, or the files
+// extracted from it, and a note on how it went.
+func (im *Importer) fetch(ctx context.Context, src Source, p *plan, it item, file string, prog *progress, user string) ([]string, string, error) {
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return nil, "", err
+	}
+	part := filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+partExt)
+	if !place.Claim(part) {
+		return nil, "", fmt.Errorf("%s: %w", it.relPath, ErrBusy)
+	}
+	defer place.Release(part)
+
+	retries := im.conf.Get().Remote.Retries
+	if retries <= 0 {
+		retries = config.DefaultRemoteRetries
+	}
+	note := ""
+	before := prog.done
+	for attempt := 0; ; attempt++ {
+		offset, err := im.copy(ctx, src, p.location, it.RemoteFile, part, prog, before)
+		if err == nil {
+			if offset > 0 && attempt == 0 {
+				note = "resumed at " + api.FormatBytes(offset)
+			}
+			break
+		}
+		if ctx.Err() != nil {
+			// the next import of this file picks up where it stopped
+			return nil, "", ctx.Err()
+		}
+		if !retryable(err) {
+			os.Remove(part)
+			return nil, "", err
+		}
+		if attempt >= retries {
+			return nil, "", err
+		}
+		wait := time.Duration(1<<uint(attempt)) * time.Second
+		if wait > 30*time.Second {
+			wait = 30 * time.Second
+		}
+		fmt.Println("  [W]: import:", it.Path, err, "retrying in", wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+		// a new connection, the old one may be what broke
+		s, err := Open(ctx, im.conf.Get(), p.server)
+		if err != nil {
+			fmt.Println("  [W]: import:", err)
+			continue
+		}
+		defer s.Close()
+		src = s
+	}
+
+	if p.extract && archive.Is(it.relPath) {
+		// the archive is deleted once it's unpacked, kept for the next
+		// import if it can be tried again
+		res, err := archive.Extract(ctx, p.location, part, path.Base(it.relPath), path.Dir(it.relPath), p.flatten, user)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(res.Ignored) > 0 {
+			note = strings.TrimPrefix(note+"\nleft out of the archive: "+strings.Join(res.Ignored, ", "), "\n")
+		}
+		return res.Files, note, nil
+	}
+	if it.Modified != nil {
+		// so the next import can tell it's the same file
+		os.Chtimes(part, time.Now(), *it.Modified)
+	}
+	_, err := place.File(im.conf.Get(), im.index, place.Part{
+		Location: p.location,
+		Sandbox:  p.sandbox,
+		File:     part,
+		RelPath:  it.relPath,
+		User:     user,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return []string{it.relPath}, note, nil
+}
+
+// copy what's left of f after what part already has. It returns where it
+// started.
+func (im *Importer) copy(ctx context.Context, src Source, location string, f api.RemoteFile, part string, prog *progress, before int64) (int64, error) {
+	offset := int64(0)
+	// a size the server doesn't say can't be picked up
+	if fi, err := os.Stat(part); err == nil && fi.Size() <= f.Size {
+		offset = fi.Size()
+	}
+	out, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	if err := out.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	prog.done = before
+	prog.add(offset)
+
+	in, err := src.Open(ctx, f.Path, offset)
+	if err != nil {
+		return offset, err
+	}
+	defer in.Close()
+	expect := int64(0)
+	if f.Size > offset {
+		expect = f.Size - offset
+	}
+	w, err := space.Writer(im.conf.Get(), location, expect, out)
+	if err != nil {
+		return offset, err
+	}
+	defer w.Release()
+	defer space.Forget(location)
+	n, err := io.Copy(io.MultiWriter(jobs.NewWriter(ctx, w, nil, 0), prog), in)
+	if err != nil {
+		return offset, err
+	}
+	if err := out.Close(); err != nil {
+		return offset, err
+	}
+	if f.Size >= 0 && offset+n != f.Size {
+		return offset, fmt.Errorf("%s: got %d of %d bytes: %w", f.Path, offset+n, f.Size, io.ErrUnexpectedEOF)
+	}
+	return offset, nil
+}
+
+// retryable errors are dropped connections and server trouble, not a
+// missing file, a login that isn't allowed or a full disk
+func retryable(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Temporary()
+	}
+	return !errors.Is(err, os.ErrNotExist) && !errors.Is(err, os.ErrPermission) &&
+		!errors.Is(err, space.ErrNoSpace) && !errors.Is(err, space.ErrQuota)
+}
+
+// progress of an import over all its files
+type progress struct {
+	j     *jobs.Job
+	done  int64
+	total int64
+}
+
+// add n bytes to what's done
+func (p *progress) add(n int64) {
+	p.done += n
+	if p.j != nil && p.total > 0 {
+		p.j.SetProgress(float64(p.done) / float64(p.total))
+	}
+}
+
+// Write counts p
+func (p *progress) Write(b []byte) (int, error) {
+	p.add(int64(len(b)))
+	return len(b), nil
+}
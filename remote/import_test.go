@@ -0,0 +1,140 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/space"
+)
+
+// memSource files kept in memory, it notes every offset a file is opened at
+type memSource struct {
+	files map[string][]byte
+	// short cuts every file off after this many bytes, if it's more than 0
+	short   int
+	offsets []int64
+}
+
+func (m *memSource) List(ctx context.Context, dir string) ([]api.RemoteFile, error) {
+	return nil, errors.New("not a folder")
+}
+
+func (m *memSource) Stat(ctx context.Context, p string) (api.RemoteFile, error) {
+	b, ok := m.files[p]
+	if !ok {
+		return api.RemoteFile{}, os.ErrNotExist
+	}
+	return api.RemoteFile{Name: filepath.Base(p), Path: p, Size: int64(len(b))}, nil
+}
+
+func (m *memSource) Open(ctx context.Context, p string, offset int64) (io.ReadCloser, error) {
+	m.offsets = append(m.offsets, offset)
+	b, ok := m.files[p]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if m.short > 0 && m.short < len(b) {
+		b = b[:m.short]
+	}
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	return ioutil.NopCloser(bytes.NewReader(b[offset:])), nil
+}
+
+func (m *memSource) Close() error {
+	return nil
+}
+
+func TestCopy(t *testing.T) {
+	content := []byte("0123456789")
+	tests := []struct {
+		name string
+		// part what's already there, nil for nothing
+		part    []byte
+		size    int64
+		short   int
+		offset  int64
+		wantErr error
+	}{
+		{name: "new", size: 10},
+		{name: "resumed", part: content[:4], size: 10, offset: 4},
+		{name: "part was done", part: content, size: 10, offset: 10},
+		{name: "part bigger than the file", part: []byte("0123456789ab"), size: 10},
+		{name: "size unknown", size: -1},
+		{name: "cut off", size: 10, short: 6, wantErr: io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			conf := &config.Configuration{}
+			conf.Plex.Locations = map[string]string{"movies": root}
+			im := &Importer{conf: config.NewCurrent(conf)}
+			src := &memSource{files: map[string][]byte{"/movie.mkv": content}, short: tt.short}
+			part := filepath.Join(root, ".movie.mkv"+partExt)
+			if tt.part != nil {
+				if err := ioutil.WriteFile(part, tt.part, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			f := api.RemoteFile{Name: "movie.mkv", Path: "/movie.mkv", Size: tt.size}
+			prog := &progress{}
+			offset, err := im.copy(context.Background(), src, "movies", f, part, prog, 100)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) || !retryable(err) {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset != tt.offset || len(src.offsets) != 1 || src.offsets[0] != tt.offset {
+				t.Fatalf("started at %d, opened at %v, want %d", offset, src.offsets, tt.offset)
+			}
+			got, err := ioutil.ReadFile(part)
+			if err != nil || !bytes.Equal(got, content) {
+				t.Fatalf("got %q, %v", got, err)
+			}
+			// what was there counts as done too
+			if prog.done != 110 {
+				t.Fatalf("progress %d, want 110", prog.done)
+			}
+		})
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: io.ErrUnexpectedEOF, want: true},
+		{err: errors.New("connection reset by peer"), want: true},
+		{err: &StatusError{Code: http.StatusBadGateway}, want: true},
+		{err: &StatusError{Code: http.StatusTooManyRequests}, want: true},
+		{err: &StatusError{Code: http.StatusRequestTimeout}, want: true},
+		{err: &StatusError{Code: http.StatusNotFound}},
+		{err: &StatusError{Code: http.StatusUnauthorized}},
+		{err: fmt.Errorf("open: %w", os.ErrNotExist)},
+		{err: &os.PathError{Op: "open", Path: "/x", Err: os.ErrPermission}},
+		{err: space.ErrNoSpace},
+		{err: fmt.Errorf("movies: %w", space.ErrQuota)},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.err); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
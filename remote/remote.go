@@ -0,0 +1,129 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/config"
+)
+
+var (
+	// ErrUnknown no remote server with that name
+	ErrUnknown = errors.New("unknown remote server")
+	// ErrTooMany a folder has more files than an import takes
+	ErrTooMany = errors.New("too many files")
+	// ErrHostKey an sftp server without hostkey or knownhosts, its key
+	// can't be checked
+	ErrHostKey = errors.New("sftp server key can't be checked, set hostkey or knownhosts")
+)
+
+// maxFiles in one import, a whole seedbox is more than anyone meant
+const maxFiles = 5000
+
+// Source a file server. Paths are from the server's folder, with a
+// leading /.
+type Source interface {
+	// List the files and folders in dir
+	List(ctx context.Context, dir string) ([]api.RemoteFile, error)
+	// Stat a file or folder
+	Stat(ctx context.Context, p string) (api.RemoteFile, error)
+	// Open a file to read from offset
+	Open(ctx context.Context, p string, offset int64) (io.ReadCloser, error)
+	// Close the connection
+	Close() error
+}
+
+// Opener connects to a type of server
+type Opener func(ctx context.Context, s config.RemoteServer) (Source, error)
+
+// backends for each type of server
+var backends = map[string]Opener{
+	config.RemoteSFTP:   openSFTP,
+	config.RemoteWebDAV: openWebDAV,
+	config.RemoteHTTP:   openHTTP,
+}
+
+// Open connects to the remote server with name
+func Open(ctx context.Context, conf *config.Configuration, name string) (Source, error) {
+	s, ok := conf.Remote.Server(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknown, name)
+	}
+	open, ok := backends[s.Type]
+	if !ok {
+		return nil, fmt.Errorf("remote %s: unknown type %q", name, s.Type)
+	}
+	src, err := open(ctx, s)
+	if err != nil {
+		return nil, fmt.Errorf("remote %s: %w", name, err)
+	}
+	return src, nil
+}
+
+// Remotes the configured servers, without their logins
+func Remotes(conf *config.Configuration) []api.Remote {
+	list := []api.Remote{}
+	for _, name := range conf.Remote.Names() {
+		s, _ := conf.Remote.Server(name)
+		list = append(list, api.Remote{Name: name, Type: s.Type, URL: redact(s.URL)})
+	}
+	return list
+}
+
+// redact the password in a url
+func redact(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+// clean a path from a user, it can't go above the server's folder
+func clean(p string) string {
+	return path.Clean("/" + strings.Replace(p, "\\", "/", -1))
+}
+
+// sortFiles folders first, then by name
+func sortFiles(files []api.RemoteFile) {
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Dir != files[j].Dir {
+			return files[i].Dir
+		}
+		return strings.ToLower(files[i].Name) < strings.ToLower(files[j].Name)
+	})
+}
+
+// walk lists every file under dir
+func walk(ctx context.Context, src Source, dir string) ([]api.RemoteFile, error) {
+	files := []api.RemoteFile{}
+	dirs := []string{dir}
+	for len(dirs) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		list, err := src.List(ctx, dirs[0])
+		if err != nil {
+			return nil, err
+		}
+		dirs = dirs[1:]
+		for _, f := range list {
+			if f.Dir {
+				dirs = append(dirs, f.Path)
+				continue
+			}
+			files = append(files, f)
+			if len(files) > maxFiles {
+				return nil, fmt.Errorf("%w: %s has over %d", ErrTooMany, dir, maxFiles)
+			}
+		}
+	}
+	return files, nil
+}
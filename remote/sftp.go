@@ -0,0 +1,183 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpSource a folder on an ssh server
+type sftpSource struct {
+	ssh  *ssh.Client
+	sftp *sftp.Client
+	root string
+}
+
+// hostKeyCallback checks the server's key against the fingerprint, or the
+// known_hosts file. A key that can't be checked isn't trusted.
+func hostKeyCallback(s config.RemoteServer) (ssh.HostKeyCallback, error) {
+	switch {
+	case s.HostKey != "":
+		return func(host string, remote net.Addr, key ssh.PublicKey) error {
+			if got := ssh.FingerprintSHA256(key); got != s.HostKey {
+				return fmt.Errorf("host key %s isn't %s", got, s.HostKey)
+			}
+			return nil
+		}, nil
+	case s.KnownHosts != "":
+		return knownhosts.New(s.KnownHosts)
+	}
+	return nil, ErrHostKey
+}
+
+// openSFTP logs in with the password, the key file or both
+func openSFTP(ctx context.Context, s config.RemoteServer) (Source, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	user := s.User
+	if user == "" && u.User != nil {
+		user = u.User.Username()
+	}
+	password := s.Password
+	if p, ok := u.User.Password(); ok && password == "" {
+		password = p
+	}
+
+	auth := []ssh.AuthMethod{}
+	if s.KeyFile != "" {
+		data, err := ioutil.ReadFile(s.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) && password != "" {
+			// the password unlocks the key
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(password))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.KeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+	hostKey, err := hostKeyCallback(s)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	d := &net.Dialer{Timeout: 30 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKey,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	// no path is the login's home folder
+	root := u.Path
+	if root == "" {
+		if root, err = sc.Getwd(); err != nil {
+			sc.Close()
+			client.Close()
+			return nil, err
+		}
+	}
+	return &sftpSource{ssh: client, sftp: sc, root: root}, nil
+}
+
+// file describes fi, found at p
+func (s *sftpSource) file(p string, fi os.FileInfo) api.RemoteFile {
+	mod := fi.ModTime()
+	f := api.RemoteFile{Name: path.Base(p), Path: p, Dir: fi.IsDir(), Size: fi.Size(), Modified: &mod}
+	if f.Dir {
+		f.Size = 0
+	}
+	return f
+}
+
+// List ...
+func (s *sftpSource) List(ctx context.Context, dir string) ([]api.RemoteFile, error) {
+	dir = clean(dir)
+	infos, err := s.sftp.ReadDir(path.Join(s.root, dir))
+	if err != nil {
+		return nil, err
+	}
+	files := []api.RemoteFile{}
+	for _, fi := range infos {
+		p := path.Join(dir, fi.Name())
+		if fi.Mode()&os.ModeSymlink != 0 {
+			// what it points to, broken links are left out
+			if fi, err = s.sftp.Stat(path.Join(s.root, p)); err != nil {
+				continue
+			}
+		}
+		files = append(files, s.file(p, fi))
+	}
+	sortFiles(files)
+	return files, nil
+}
+
+// Stat ...
+func (s *sftpSource) Stat(ctx context.Context, p string) (api.RemoteFile, error) {
+	p = clean(p)
+	fi, err := s.sftp.Stat(path.Join(s.root, p))
+	if err != nil {
+		return api.RemoteFile{}, err
+	}
+	return s.file(p, fi), nil
+}
+
+// Open ...
+func (s *sftpSource) Open(ctx context.Context, p string, offset int64) (io.ReadCloser, error) {
+	f, err := s.sftp.Open(path.Join(s.root, clean(p)))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Close ...
+func (s *sftpSource) Close() error {
+	s.sftp.Close()
+	return s.ssh.Close()
+}
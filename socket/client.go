@@ -3,6 +3,7 @@ package socket
 import (
 	"bytes"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -32,7 +33,7 @@ type Broadcaster interface {
 	Broadcast(msg []byte)
 }
 
-// NewClient ...
+// NewClient call Start to run it, so the client can be registered with a hub first
 func NewClient(ID string, c *websocket.Conn, h Broadcaster) *Client {
 	client := &Client{
 		ID:   ID,
@@ -40,7 +41,6 @@ func NewClient(ID string, c *websocket.Conn, h Broadcaster) *Client {
 		conn: c,
 		Hub:  h,
 	}
-	client.Start()
 	return client
 }
 
@@ -54,19 +54,36 @@ type Client struct {
 
 	// Buffered channel of outbound messages.
 	send chan []byte
+
+	// mu guards closed, hubs send from their own goroutines
+	mu     sync.Mutex
+	closed bool
 }
 
 // Close ...
 func (c *Client) Close() {
-	close(c.send)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
 }
 
-// Send ...
+// Send drops the message if the client is closed or too slow to keep up
 func (c *Client) Send(msg []byte) {
-	c.send <- msg
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.send <- msg:
+	default:
+	}
 }
 
-// Start ...
+// Start blocks until the connection is closed
 func (c *Client) Start() {
 	go c.writePump()
 	c.readPump()
@@ -0,0 +1,267 @@
+package space
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/filesystem"
+)
+
+// usedTTL how long a location's folder size is trusted before it's walked
+// again, writes through Writer keep it up to date in between
+const usedTTL = 5 * time.Minute
+
+var (
+	// ErrNoSpace the disk doesn't have room, with the margin left free
+	ErrNoSpace = errors.New("not enough disk space")
+	// ErrQuota the location would go over its quota
+	ErrQuota = errors.New("location quota exceeded")
+)
+
+type used struct {
+	bytes int64
+	at    time.Time
+}
+
+// chunk how much more a Reservation sets aside when it's written all it had
+const chunk = 64 << 20
+
+var (
+	mu    sync.Mutex
+	cache = map[string]*used{}
+	// reserved bytes set aside in each location for transfers in progress,
+	// that aren't written yet
+	reserved = map[string]int64{}
+	// reserveMu makes looking at what's free and setting some aside one step
+	reserveMu sync.Mutex
+)
+
+// Usage free space of the disk a location is on, and how much of its quota
+// it uses. What transfers in progress have set aside isn't available.
+func Usage(conf *config.Configuration, location string) (*api.Space, error) {
+	s, _, err := usage(conf, location)
+	return s, err
+}
+
+// usage is Usage, and the bytes set aside in location
+func usage(conf *config.Configuration, location string) (*api.Space, int64, error) {
+	rootDir, err := conf.Plex.RootDir(location)
+	if err != nil {
+		return nil, 0, err
+	}
+	margin, quota, err := conf.Space.Limits(location)
+	if err != nil {
+		return nil, 0, err
+	}
+	s := &api.Space{Location: location}
+	if s.DiskFree, s.DiskTotal, err = filesystem.DiskSpace(rootDir); err != nil {
+		return nil, 0, err
+	}
+	mu.Lock()
+	held := reserved[location]
+	mu.Unlock()
+	s.Available = s.DiskFree - margin - held
+	if quota > 0 {
+		s.Quota = quota
+		s.Used = usedBytes(location, rootDir)
+		if left := quota - s.Used - held; left < s.Available {
+			s.Available = left
+		}
+	}
+	if s.Available < 0 {
+		s.Available = 0
+	}
+	return s, held, nil
+}
+
+// Report usage of every location, sorted by name. Locations that fail are
+// left out.
+func Report(conf *config.Configuration, locations map[string]string) []*api.Space {
+	list := []*api.Space{}
+	for location := range locations {
+		s, err := Usage(conf, location)
+		if err != nil {
+			fmt.Println("space:", location, err)
+			continue
+		}
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Location < list[j].Location
+	})
+	return list
+}
+
+// ForUser usage of every location the user can do anything in
+func ForUser(r *http.Request, conf *config.Configuration) []*api.Space {
+	locations := map[string]string{}
+	for _, perm := range auth.AllPermissions {
+		for name, dir := range auth.Locations(r, perm, conf.Plex.Locations) {
+			locations[name] = dir
+		}
+	}
+	return Report(conf, locations)
+}
+
+// Check returns ErrNoSpace or ErrQuota if size bytes won't fit in location
+func Check(conf *config.Configuration, location string, size int64) error {
+	s, held, err := usage(conf, location)
+	if err != nil {
+		return err
+	}
+	return check(s, held, size)
+}
+
+// check size against s, with held set aside already. The error says which
+// limit it hit.
+func check(s *api.Space, held, size int64) error {
+	if size <= s.Available && s.Available > 0 {
+		return nil
+	}
+	if s.Quota > 0 && s.Quota-s.Used-held <= s.Available {
+		return fmt.Errorf("%w: needs %s, %s has %s of its %s quota left", ErrQuota,
+			api.FormatBytes(size), s.Location, api.FormatBytes(s.Available), api.FormatBytes(s.Quota))
+	}
+	return fmt.Errorf("%w: needs %s, %s has %s free of %s", ErrNoSpace,
+		api.FormatBytes(size), s.Location, api.FormatBytes(s.DiskFree), api.FormatBytes(s.DiskTotal))
+}
+
+// Status 507 for ErrNoSpace and ErrQuota, 500 for anything else
+func Status(err error) int {
+	if errors.Is(err, ErrNoSpace) || errors.Is(err, ErrQuota) {
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+// Writer counts what's written to w against location, and fails with
+// ErrNoSpace or ErrQuota as soon as there's no room for more. size, the bytes
+// expected or 0 if that isn't known, is set aside up front so transfers
+// running side by side can't each count on the same free space. Release it
+// when done.
+func Writer(conf *config.Configuration, location string, size int64, w io.Writer) (*Reservation, error) {
+	if size < 0 {
+		size = 0
+	}
+	got, err := reserve(conf, location, size, size)
+	if err != nil {
+		return nil, err
+	}
+	return &Reservation{w: w, conf: conf, location: location, left: got}, nil
+}
+
+// Reserve sets size bytes aside in location for a transfer that doesn't
+// write through a Writer. Release it when done.
+func Reserve(conf *config.Configuration, location string, size int64) (*Reservation, error) {
+	return Writer(conf, location, size, nil)
+}
+
+// Reservation space set aside in a location for what's written through it
+type Reservation struct {
+	w        io.Writer
+	conf     *config.Configuration
+	location string
+	// left set aside but not written yet
+	left int64
+}
+
+// Write sets more aside if what's left isn't enough for p
+func (res *Reservation) Write(p []byte) (int, error) {
+	if need := int64(len(p)) - res.left; need > 0 {
+		want := need
+		if want < chunk {
+			want = chunk
+		}
+		got, err := reserve(res.conf, res.location, need, want)
+		if err != nil {
+			return 0, err
+		}
+		res.left += got
+	}
+	n, err := res.w.Write(p)
+	res.left -= int64(n)
+	mu.Lock()
+	reserved[res.location] -= int64(n)
+	if u, ok := cache[res.location]; ok {
+		u.bytes += int64(n)
+	}
+	mu.Unlock()
+	return n, err
+}
+
+// Release what's set aside and wasn't written, the writer can't be used
+// after
+func (res *Reservation) Release() {
+	mu.Lock()
+	reserved[res.location] -= res.left
+	if reserved[res.location] <= 0 {
+		delete(reserved, res.location)
+	}
+	mu.Unlock()
+	res.left = 0
+}
+
+// reserve sets aside at least need and up to want bytes in location, as much
+// as there's room for
+func reserve(conf *config.Configuration, location string, need, want int64) (int64, error) {
+	reserveMu.Lock()
+	defer reserveMu.Unlock()
+	s, held, err := usage(conf, location)
+	if err != nil {
+		return 0, err
+	}
+	if err := check(s, held, need); err != nil {
+		return 0, err
+	}
+	if want > s.Available {
+		want = s.Available
+	}
+	if want < need {
+		want = need
+	}
+	mu.Lock()
+	reserved[location] += want
+	mu.Unlock()
+	return want, nil
+}
+
+// usedBytes everything in rootDir, trash included since it's on the same
+// disk
+func usedBytes(location, rootDir string) int64 {
+	mu.Lock()
+	u, ok := cache[location]
+	mu.Unlock()
+	if ok && time.Since(u.at) < usedTTL {
+		return u.bytes
+	}
+
+	var total int64
+	filepath.Walk(rootDir, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			total += fi.Size()
+		}
+		return nil
+	})
+	mu.Lock()
+	cache[location] = &used{bytes: total, at: time.Now()}
+	mu.Unlock()
+	return total
+}
+
+// Forget location's folder size so it's walked again, after files were
+// removed
+func Forget(location string) {
+	mu.Lock()
+	delete(cache, location)
+	mu.Unlock()
+}
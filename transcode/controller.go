@@ -0,0 +1,131 @@
+package transcode
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/gorilla/mux"
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/app"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/filesystem"
+)
+
+// Controller queues library files to be transcoded.
+type Controller struct {
+	mux  *mux.Router
+	api  *mux.Router
+	conf *config.Current
+}
+
+// Register sets up the queue uploads and downloads use, and the routes
+func Register(service *app.Service) {
+	queue = &Queue{
+		conf:  service.Config,
+		jobs:  service.Jobs.NewQueue(service.Config.Get().Transcode.Workers),
+		hub:   service.Hub,
+		plex:  service.Plex,
+		index: service.Index,
+	}
+	c := &Controller{
+		mux:  service.Mux,
+		api:  service.API,
+		conf: service.Config,
+	}
+	c.MountController()
+}
+
+// MountController ...
+func (c *Controller) MountController() {
+	c.mux.HandleFunc("/library/{location}/transcode", c.TranscodeHandler).Methods("POST")
+
+	c.api.HandleFunc("/transcode/profiles", c.APIProfiles).Methods("GET")
+	c.api.HandleFunc("/transcode", c.APITranscode).Methods("POST")
+}
+
+// writeError picks the status from err
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrUnknownProfile), errors.Is(err, filesystem.ErrInvalid):
+		code = http.StatusBadRequest
+	case errors.Is(err, filesystem.ErrEscape), errors.Is(err, filesystem.ErrSymlink):
+		code = http.StatusForbidden
+	case os.IsNotExist(err):
+		code = http.StatusNotFound
+	}
+	api.WriteError(w, r, code, err)
+}
+
+// check the location exists and the user can manage it
+func (c *Controller) check(w http.ResponseWriter, r *http.Request, location string) bool {
+	if _, ok := c.conf.Get().Plex.Locations[location]; !ok {
+		api.WriteError(w, r, http.StatusNotFound, fmt.Errorf("unknown location: %q", location))
+		return false
+	}
+	return auth.Check(w, r, auth.PermManage, location)
+}
+
+// TranscodeHandler queues a file from the library browser
+func (c *Controller) TranscodeHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("TranscodeHandler", r.URL.String())
+
+	location := mux.Vars(r)["location"]
+	if !c.check(w, r, location) {
+		return
+	}
+	r.ParseForm()
+	relPath := r.PostForm.Get("path")
+	if _, err := Enqueue(location, relPath, r.PostForm.Get("profile"), auth.Username(r)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/library/"+url.PathEscape(location)+"?path="+url.QueryEscape(path.Dir(relPath)), http.StatusSeeOther)
+}
+
+// APIProfiles lists the transcode profiles
+func (c *Controller) APIProfiles(w http.ResponseWriter, r *http.Request) {
+	profiles := []api.TranscodeProfile{}
+	for _, name := range c.conf.Get().Transcode.Names() {
+		p := c.conf.Get().Transcode.Profiles[name]
+		profiles = append(profiles, api.TranscodeProfile{
+			Name:          name,
+			VideoCodec:    p.VideoCodec,
+			VideoBitrate:  p.VideoBitrate,
+			CRF:           p.CRF,
+			MaxHeight:     p.MaxHeight,
+			AudioCodec:    p.AudioCodec,
+			AudioBitrate:  p.AudioBitrate,
+			AudioChannels: p.AudioChannels,
+			Container:     container(p),
+			Replace:       p.Replace,
+		})
+	}
+	api.WriteJSON(w, http.StatusOK, profiles)
+}
+
+// APITranscode queues a library file
+func (c *Controller) APITranscode(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("APITranscode", r.URL.String())
+
+	req := &api.TranscodeRequest{}
+	if err := api.ReadJSON(r, req); err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if !c.check(w, r, req.Location) {
+		return
+	}
+	j, err := Enqueue(req.Location, req.Path, req.Profile, auth.Username(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", api.Prefix+"/jobs/"+j.ID)
+	api.WriteJSON(w, http.StatusAccepted, api.NewJob(j))
+}
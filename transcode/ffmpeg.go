@@ -0,0 +1,131 @@
+package transcode
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/jaredwarren/plexupdate/config"
+)
+
+// DefaultCommand used when transcode.command isn't set
+const DefaultCommand = "ffmpeg"
+
+// formats ffmpeg muxer for each container, the output is a temp file so
+// ffmpeg can't tell from the name
+var formats = map[string]string{
+	"mp4":  "mp4",
+	"m4v":  "mp4",
+	"mkv":  "matroska",
+	"mov":  "mov",
+	"webm": "webm",
+}
+
+// container of a profile, mp4 if it isn't set
+func container(p config.TranscodeProfile) string {
+	if p.Container == "" {
+		return "mp4"
+	}
+	return strings.ToLower(strings.TrimPrefix(p.Container, "."))
+}
+
+// args for ffmpeg to convert in to out with profile p, progress goes to
+// stdout
+func args(p config.TranscodeProfile, in, out string) ([]string, error) {
+	c := container(p)
+	format, ok := formats[c]
+	if !ok {
+		return nil, fmt.Errorf("unknown container: %q", p.Container)
+	}
+	a := []string{"-hide_banner", "-nostdin", "-nostats", "-y", "-progress", "pipe:1", "-i", in,
+		"-map", "0:v:0", "-map", "0:a?"}
+	// text subtitles only survive in matroska
+	if format == "matroska" {
+		a = append(a, "-map", "0:s?", "-c:s", "copy")
+	}
+
+	vcodec := p.VideoCodec
+	if vcodec == "" {
+		vcodec = "libx264"
+	}
+	a = append(a, "-c:v", vcodec)
+	if vcodec != "copy" {
+		if p.VideoBitrate != "" {
+			a = append(a, "-b:v", p.VideoBitrate, "-maxrate", p.VideoBitrate)
+		}
+		if p.CRF > 0 {
+			a = append(a, "-crf", strconv.Itoa(p.CRF))
+		}
+		if p.Preset != "" {
+			a = append(a, "-preset", p.Preset)
+		}
+		if p.MaxHeight > 0 {
+			a = append(a, "-vf", fmt.Sprintf("scale=-2:'min(ih,%d)'", p.MaxHeight))
+		}
+	}
+
+	acodec := p.AudioCodec
+	if acodec == "" {
+		acodec = "aac"
+	}
+	a = append(a, "-c:a", acodec)
+	if acodec != "copy" {
+		if p.AudioBitrate != "" {
+			a = append(a, "-b:a", p.AudioBitrate)
+		}
+		if p.AudioChannels > 0 {
+			a = append(a, "-ac", strconv.Itoa(p.AudioChannels))
+		}
+	}
+
+	if format == "mp4" || format == "mov" {
+		a = append(a, "-movflags", "+faststart")
+	}
+	return append(a, "-f", format, out), nil
+}
+
+// run ffmpeg, progress is called with the seconds done so far
+func run(ctx context.Context, command string, args []string, progress func(seconds float64)) error {
+	if command == "" {
+		command = DefaultCommand
+	}
+	cmd := exec.CommandContext(ctx, command, args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// key=value lines, a block of them every half second or so
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		// out_time_ms is microseconds too
+		if kv[0] == "out_time_us" || kv[0] == "out_time_ms" {
+			if us, err := strconv.ParseInt(kv[1], 10, 64); err == nil && us > 0 {
+				progress(float64(us) / 1e6)
+			}
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// the last line says what went wrong
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		return fmt.Errorf("ffmpeg: %s", lines[len(lines)-1])
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/duplicates"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/hub"
+	"github.com/jaredwarren/plexupdate/jobs"
+	"github.com/jaredwarren/plexupdate/plex"
+	"github.com/jaredwarren/plexupdate/probe"
+	"github.com/jaredwarren/plexupdate/space"
+	"github.com/jaredwarren/plexupdate/trash"
+)
+
+// JobType of transcode jobs
+const JobType = "transcode"
+
+// MessageType hub messages about transcode jobs, the action is the job status
+const MessageType = "transcode"
+
+// partExt the output is written to a hidden .part file until ffmpeg is done
+const partExt = ".part"
+
+// ErrUnknownProfile no transcode profile with that name
+var ErrUnknownProfile = errors.New("unknown transcode profile")
+
+// queue set up by Register, uploads and downloads add to it with Enqueue
+var queue *Queue
+
+// Queue of files waiting for ffmpeg, transcode.workers run at once
+type Queue struct {
+	conf  *config.Current
+	jobs  *jobs.Queue
+	hub   *hub.Hub
+	plex  *plex.Scanner
+	index *duplicates.Index
+}
+
+// Enqueue queues relPath in location to be transcoded with profile
+func Enqueue(location, relPath, profile, user string) (*jobs.Job, error) {
+	if queue == nil {
+		return nil, errors.New("transcoding isn't set up")
+	}
+	return queue.Enqueue(location, relPath, profile, user)
+}
+
+// ProfileFor the profile a new file in location gets, the one asked for or
+// the location's transcode.auto profile
+func ProfileFor(conf *config.Configuration, location, requested string) string {
+	if requested != "" {
+		return requested
+	}
+	return conf.Transcode.AutoProfile(location)
+}
+
+// Enqueue queues relPath in location to be transcoded with profile
+func (q *Queue) Enqueue(location, relPath, profile, user string) (*jobs.Job, error) {
+	p, ok := q.conf.Get().Transcode.Profile(profile)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownProfile, profile)
+	}
+	if _, err := args(p, "in", "out"); err != nil {
+		return nil, err
+	}
+	sandbox, err := q.conf.Get().Plex.Sandbox(location)
+	if err != nil {
+		return nil, err
+	}
+	relPath, err = filesystem.Clean(relPath)
+	if err != nil {
+		return nil, err
+	}
+	if trash.Contains(relPath) {
+		return nil, fmt.Errorf("%s: %w", relPath, filesystem.ErrEscape)
+	}
+	src, err := sandbox.Resolve(relPath)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("%s is a folder", relPath)
+	}
+
+	j := q.jobs.Start(JobType, user, location, func(ctx context.Context, j *jobs.Job) (string, error) {
+		return q.transcode(ctx, j, location, relPath, profile, p, user)
+	})
+	fmt.Println("  transcode", location, relPath, "with", profile, "job", j.ID)
+	q.publish(j, relPath)
+	go func() {
+		j.Wait()
+		q.publish(j, relPath)
+	}()
+	return j, nil
+}
+
+// publish the job to every open browser
+func (q *Queue) publish(j *jobs.Job, relPath string) {
+	q.hub.Broadcast(&hub.Message{
+		Type:   MessageType,
+		Action: string(j.Snapshot().Status),
+		Text:   relPath,
+		Data:   api.NewJob(j),
+	})
+}
+
+// output path of relPath transcoded with profile p, named profile
+func output(relPath, name string, p config.TranscodeProfile) string {
+	base := strings.TrimSuffix(relPath, path.Ext(relPath))
+	ext := "." + container(p)
+	if p.Replace {
+		return base + ext
+	}
+	suffix := p.Suffix
+	if suffix == "" {
+		suffix = name
+	}
+	return base + " - " + suffix + ext
+}
+
+// transcode runs ffmpeg and puts the result in place
+func (q *Queue) transcode(ctx context.Context, j *jobs.Job, location, relPath, name string, p config.TranscodeProfile, user string) (string, error) {
+	sandbox, err := q.conf.Get().Plex.Sandbox(location)
+	if err != nil {
+		return "", err
+	}
+	// it may have moved while it was queued
+	src, err := sandbox.Resolve(relPath)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	// the new file shouldn't be bigger than the old one
+	if err := space.Check(q.conf.Get(), location, fi.Size()); err != nil {
+		return "", err
+	}
+	outRel := output(relPath, name, p)
+	out, err := sandbox.Resolve(outRel)
+	if err != nil {
+		return "", err
+	}
+	part := filepath.Join(filepath.Dir(out), "."+filepath.Base(out)+partExt)
+
+	var duration float64
+	if info, err := probe.File(q.conf.Get().Probe, src); err == nil {
+		duration = info.Duration
+	}
+	a, err := args(p, src, part)
+	if err != nil {
+		return "", err
+	}
+	var published time.Time
+	err = run(ctx, q.conf.Get().Transcode.Command, a, func(seconds float64) {
+		if duration <= 0 {
+			return
+		}
+		// done isn't done until the file is in place
+		progress := seconds / duration
+		if progress > 0.99 {
+			progress = 0.99
+		}
+		j.SetProgress(progress)
+		if time.Since(published) >= time.Second {
+			published = time.Now()
+			q.publish(j, relPath)
+		}
+	})
+	if err != nil {
+		os.Remove(part)
+		return "", err
+	}
+	space.Forget(location)
+
+	// an older version is replaced
+	if err := trash.Replace(q.conf.Get().Trash, sandbox, location, outRel, user); err != nil {
+		os.Remove(part)
+		return "", err
+	}
+	if err := os.Rename(part, out); err != nil {
+		os.Remove(part)
+		return "", err
+	}
+	if err := q.index.Add(location, outRel); err != nil {
+		fmt.Println("  [E]: library index:", err)
+	}
+
+	// and so is the original, by a file with another extension maybe. It
+	// only goes once the new one is in place.
+	if p.Replace && outRel != relPath {
+		err := trash.Replace(q.conf.Get().Trash, sandbox, location, relPath, user)
+		if err == nil && q.conf.Get().Trash.Disabled {
+			err = os.Remove(src)
+		}
+		if err != nil {
+			fmt.Println("  [E]: replacing", relPath+":", err)
+		} else if err := q.index.Remove(location, relPath); err != nil {
+			fmt.Println("  [E]: library index:", err)
+		}
+	}
+	q.plex.Scan(location, filepath.Dir(out))
+	return outRel, nil
+}
@@ -0,0 +1,277 @@
+package trash
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/app"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/form"
+	"github.com/jaredwarren/plexupdate/plex"
+	"github.com/jaredwarren/plexupdate/space"
+)
+
+// purgeInterval how often old items are purged
+const purgeInterval = time.Hour
+
+// Controller lists, restores and purges the trash of every location.
+type Controller struct {
+	mux  *mux.Router
+	api  *mux.Router
+	conf *config.Current
+	plex *plex.Scanner
+}
+
+// Register ...
+func Register(service *app.Service) {
+	c := &Controller{
+		mux:  service.Mux,
+		api:  service.API,
+		conf: service.Config,
+		plex: service.Plex,
+	}
+	c.MountController()
+	StartPurger(service.Config, purgeInterval, nil)
+}
+
+// MountController ...
+func (c *Controller) MountController() {
+	c.mux.HandleFunc("/trash", c.List).Methods("GET")
+	c.mux.HandleFunc("/trash/{location}/{id}/restore", c.RestoreHandler).Methods("POST")
+	c.mux.HandleFunc("/trash/{location}/{id}/purge", c.PurgeHandler).Methods("POST")
+	c.mux.HandleFunc("/trash/{id}/restore", c.RestoreHandler).Methods("POST")
+	c.mux.HandleFunc("/trash/{id}/purge", c.PurgeHandler).Methods("POST")
+
+	c.api.HandleFunc("/trash", c.APIList).Methods("GET")
+	c.api.HandleFunc("/trash/{location}/{id}/restore", c.APIRestore).Methods("POST")
+	c.api.HandleFunc("/trash/{location}/{id}", c.APIPurge).Methods("DELETE")
+	c.api.HandleFunc("/trash/{id}/restore", c.APIRestore).Methods("POST")
+	c.api.HandleFunc("/trash/{id}", c.APIPurge).Methods("DELETE")
+}
+
+// StartPurger purges every location's trash now and then every interval
+// until stop is closed. The limits are read from conf each time so config
+// reloads apply.
+func StartPurger(conf *config.Current, interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			purgeAll(conf.Get())
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// purgeAll applies the trash limits to every location
+func purgeAll(conf *config.Configuration) {
+	maxAge, maxSize, err := conf.Trash.Limits()
+	if err != nil {
+		fmt.Println("trash:", err)
+		return
+	}
+	for location := range conf.Plex.AllLocations() {
+		sandbox, err := conf.Plex.Sandbox(location)
+		if err != nil {
+			continue
+		}
+		n, err := New(sandbox, location).Purge(maxAge, maxSize)
+		if err != nil {
+			fmt.Println("trash:", location, err)
+		}
+		if n > 0 {
+			space.Forget(location)
+			fmt.Printf("trash: purged %d from %s\n", n, location)
+		}
+	}
+}
+
+// writeError picks the status from err
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, filesystem.ErrExists):
+		code = http.StatusConflict
+	case errors.Is(err, filesystem.ErrEscape), errors.Is(err, filesystem.ErrSymlink):
+		code = http.StatusForbidden
+	}
+	api.WriteError(w, r, code, err)
+}
+
+// trash returns the trash of a location and checks the user can manage it,
+// the routes without one are for the default folder
+func (c *Controller) trash(w http.ResponseWriter, r *http.Request, location string) (*Trash, bool) {
+	if _, ok := c.conf.Get().Plex.AllLocations()[location]; !ok {
+		api.WriteError(w, r, http.StatusNotFound, fmt.Errorf("unknown location: %q", location))
+		return nil, false
+	}
+	if !auth.Check(w, r, auth.PermManage, location) {
+		return nil, false
+	}
+	sandbox, err := c.conf.Get().Plex.Sandbox(location)
+	if err != nil {
+		api.WriteError(w, r, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return New(sandbox, location), true
+}
+
+// items in every location the user can manage, newest first
+func (c *Controller) items(r *http.Request) []*api.TrashItem {
+	items := []*api.TrashItem{}
+	for location := range auth.Locations(r, auth.PermManage, c.conf.Get().Plex.AllLocations()) {
+		sandbox, err := c.conf.Get().Plex.Sandbox(location)
+		if err != nil {
+			continue
+		}
+		list, err := New(sandbox, location).List()
+		if err != nil {
+			fmt.Println("  ", location, err)
+			continue
+		}
+		items = append(items, list...)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Time.After(items[j].Time)
+	})
+	return items
+}
+
+// restore puts an item back and tells plex
+func (c *Controller) restore(t *Trash, id string) (*api.TrashItem, error) {
+	item, err := t.Restore(id)
+	if err != nil {
+		return nil, err
+	}
+	if p, err := t.sandbox.Resolve(item.Path); err == nil {
+		c.plex.Scan(t.Location, filepath.Dir(p))
+	}
+	return item, nil
+}
+
+// List shows the trash
+func (c *Controller) List(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("List", r.URL.String())
+
+	if !auth.Permissions(r)[auth.PermManage] {
+		auth.Check(w, r, auth.PermManage, "")
+		return
+	}
+	maxAge, maxSize, _ := c.conf.Get().Trash.Limits()
+
+	// parse every time to make updates easier, and save memory
+	tpl := template.Must(template.New("base").Funcs(template.FuncMap{
+		"CsrfToken": form.TokenFunc(r),
+		"Size":      api.FormatBytes,
+	}).ParseFiles("templates/trash.html", "templates/base.html"))
+	tpl.ExecuteTemplate(w, "base", &struct {
+		Title    string
+		Items    []*api.TrashItem
+		Disabled bool
+		MaxAge   string
+		MaxSize  int64
+	}{
+		Title:    "Trash",
+		Items:    c.items(r),
+		Disabled: c.conf.Get().Trash.Disabled,
+		MaxAge:   formatAge(maxAge),
+		MaxSize:  maxSize,
+	})
+}
+
+// formatAge 30 days, or 36h0m0s when it isn't whole days
+func formatAge(d time.Duration) string {
+	day := 24 * time.Hour
+	if d%day != 0 {
+		return d.String()
+	}
+	if d == day {
+		return "1 day"
+	}
+	return fmt.Sprintf("%d days", d/day)
+}
+
+// RestoreHandler puts an item back where it was
+func (c *Controller) RestoreHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("RestoreHandler", r.URL.String())
+
+	vars := mux.Vars(r)
+	t, ok := c.trash(w, r, vars["location"])
+	if !ok {
+		return
+	}
+	if _, err := c.restore(t, vars["id"]); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
+
+// PurgeHandler deletes an item for good
+func (c *Controller) PurgeHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("PurgeHandler", r.URL.String())
+
+	vars := mux.Vars(r)
+	t, ok := c.trash(w, r, vars["location"])
+	if !ok {
+		return
+	}
+	if err := t.Remove(vars["id"]); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
+
+// APIList lists the trash of every location the user can manage
+func (c *Controller) APIList(w http.ResponseWriter, r *http.Request) {
+	api.WriteJSON(w, http.StatusOK, c.items(r))
+}
+
+// APIRestore puts an item back where it was
+func (c *Controller) APIRestore(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("APIRestore", r.URL.String())
+
+	vars := mux.Vars(r)
+	t, ok := c.trash(w, r, vars["location"])
+	if !ok {
+		return
+	}
+	item, err := c.restore(t, vars["id"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	api.WriteJSON(w, http.StatusOK, item)
+}
+
+// APIPurge deletes an item for good
+func (c *Controller) APIPurge(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("APIPurge", r.URL.String())
+
+	vars := mux.Vars(r)
+	t, ok := c.trash(w, r, vars["location"])
+	if !ok {
+		return
+	}
+	if err := t.Remove(vars["id"]); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,281 @@
+package trash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/filesystem"
+)
+
+// Dir the trash folder at the top of every location. Plex skips hidden
+// folders so it's never scanned.
+const Dir = ".trash"
+
+// infoFile metadata next to the trashed file
+const infoFile = "item.json"
+
+// ErrNotFound no trash item with that id
+var ErrNotFound = errors.New("not in the trash")
+
+var idRe = regexp.MustCompile(`^[0-9a-z]+-[0-9a-z]+$`)
+
+// counter keeps ids unique within the same nanosecond
+var counter uint64
+
+// Trash of one location. Every item is a folder named by its id holding the
+// file, or folder, with its original name and item.json.
+type Trash struct {
+	Location string
+	sandbox  *filesystem.Sandbox
+}
+
+// New trash for the location sandbox confines
+func New(sandbox *filesystem.Sandbox, location string) *Trash {
+	return &Trash{
+		Location: location,
+		sandbox:  sandbox,
+	}
+}
+
+// Contains true if relPath, a clean path in a location, is in the trash
+func Contains(relPath string) bool {
+	first := strings.SplitN(strings.TrimPrefix(relPath, "/"), "/", 2)[0]
+	return first == Dir
+}
+
+// dir of the trash, or an item in it
+func (t *Trash) dir(id string) string {
+	return filepath.Join(t.sandbox.Root, Dir, id)
+}
+
+// Move puts relPath in the trash
+func (t *Trash) Move(relPath, user, reason string) (*api.TrashItem, error) {
+	relPath, err := filesystem.Clean(relPath)
+	if err != nil {
+		return nil, err
+	}
+	if relPath == "/" || Contains(relPath) {
+		return nil, fmt.Errorf("can't trash %s", relPath)
+	}
+	from, err := t.sandbox.Resolve(relPath)
+	if err != nil {
+		return nil, err
+	}
+	return t.Put(from, relPath, user, reason)
+}
+
+// Put moves from, a file in the location, to the trash as if it was at
+// relPath. New files that aren't kept go in this way before they have a
+// place of their own.
+func (t *Trash) Put(from, relPath, user, reason string) (*api.TrashItem, error) {
+	if !filesystem.Within(t.sandbox.Root, from) {
+		return nil, fmt.Errorf("%s: %w", from, filesystem.ErrEscape)
+	}
+	fi, err := os.Lstat(from)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	item := &api.TrashItem{
+		ID:       strconv.FormatInt(now.UnixNano(), 36) + "-" + strconv.FormatUint(atomic.AddUint64(&counter, 1), 36),
+		Location: t.Location,
+		Path:     relPath,
+		Name:     path.Base(relPath),
+		Dir:      fi.IsDir(),
+		Size:     size(from, fi),
+		User:     user,
+		Reason:   reason,
+		Time:     now,
+	}
+	dir := t.dir(item.ID)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := writeInfo(dir, item); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if err := filesystem.Move(from, filepath.Join(dir, item.Name)); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return item, nil
+}
+
+// Get an item by id
+func (t *Trash) Get(id string) (*api.TrashItem, error) {
+	if !idRe.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	b, err := ioutil.ReadFile(filepath.Join(t.dir(id), infoFile))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	item := &api.TrashItem{}
+	if err := json.Unmarshal(b, item); err != nil {
+		return nil, err
+	}
+	// the item is where it is, not where item.json says
+	item.ID = id
+	item.Location = t.Location
+	return item, nil
+}
+
+// List the items, newest first
+func (t *Trash) List() ([]*api.TrashItem, error) {
+	infos, err := ioutil.ReadDir(t.dir(""))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	items := []*api.TrashItem{}
+	for _, fi := range infos {
+		if !fi.IsDir() {
+			continue
+		}
+		item, err := t.Get(fi.Name())
+		if err != nil {
+			// not ours, or half written
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Time.After(items[j].Time)
+	})
+	return items, nil
+}
+
+// Restore moves an item back where it was, it never overwrites
+func (t *Trash) Restore(id string) (*api.TrashItem, error) {
+	item, err := t.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	to, err := t.sandbox.Resolve(item.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := filesystem.Move(filepath.Join(t.dir(id), item.Name), to); err != nil {
+		if errors.Is(err, filesystem.ErrExists) {
+			return nil, fmt.Errorf("%s %w", item.Path, filesystem.ErrExists)
+		}
+		return nil, err
+	}
+	return item, os.RemoveAll(t.dir(id))
+}
+
+// Remove deletes an item for good
+func (t *Trash) Remove(id string) error {
+	if _, err := t.Get(id); err != nil {
+		return err
+	}
+	return os.RemoveAll(t.dir(id))
+}
+
+// Purge removes items older than maxAge, then the oldest ones until the
+// trash fits in maxSize bytes, 0 is no limit. It returns how many went.
+func (t *Trash) Purge(maxAge time.Duration, maxSize int64) (int, error) {
+	items, err := t.List()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, item := range items {
+		total += item.Size
+	}
+
+	purged := 0
+	// oldest first
+	for i := len(items) - 1; i >= 0; i-- {
+		item := items[i]
+		tooOld := maxAge > 0 && time.Since(item.Time) > maxAge
+		tooBig := maxSize > 0 && total > maxSize
+		if !tooOld && !tooBig {
+			break
+		}
+		if err := os.RemoveAll(t.dir(item.ID)); err != nil {
+			return purged, err
+		}
+		total -= item.Size
+		purged++
+	}
+	return purged, nil
+}
+
+// writeInfo saves item.json in dir
+func writeInfo(dir string, item *api.TrashItem) error {
+	b, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, infoFile), b, 0644)
+}
+
+// size of a file, or everything in a folder
+func size(p string, fi os.FileInfo) int64 {
+	if !fi.IsDir() {
+		return fi.Size()
+	}
+	var total int64
+	filepath.Walk(p, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			total += fi.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// Delete moves relPath to the trash, or removes it right away when the
+// trash is disabled
+func Delete(conf config.TrashConfiguration, sandbox *filesystem.Sandbox, location, relPath, user string) error {
+	if !conf.Disabled {
+		_, err := New(sandbox, location).Move(relPath, user, api.TrashDeleted)
+		return err
+	}
+	p, err := sandbox.Resolve(relPath)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(p); err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+// Replace moves relPath to the trash before something overwrites it. It
+// does nothing if there's no file yet or the trash is disabled.
+func Replace(conf config.TrashConfiguration, sandbox *filesystem.Sandbox, location, relPath, user string) error {
+	if conf.Disabled {
+		return nil
+	}
+	p, err := sandbox.Resolve(relPath)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(p); os.IsNotExist(err) {
+		return nil
+	}
+	_, err = New(sandbox, location).Move(relPath, user, api.TrashOverwritten)
+	return err
+}
@@ -0,0 +1,113 @@
+package upload
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/archive"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/space"
+)
+
+// formBool a checkbox, or true/1 from a script
+func formBool(v string) bool {
+	if v == "on" {
+		return true
+	}
+	b, _ := strconv.ParseBool(v)
+	return b
+}
+
+// extract writes an uploaded archive next to where it would have gone, and
+// unpacks its media files there
+func (c *Controller) extract(w http.ResponseWriter, r *http.Request, file multipart.File, size int64, location string, sandbox *filesystem.Sandbox, name, relPath string) {
+	dir := path.Dir(relPath)
+	dirPath, err := sandbox.Resolve(dir)
+	if err != nil {
+		api.WriteError(w, r, targetStatus(err), err)
+		return
+	}
+	if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
+		api.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := space.Check(c.conf.Get(), location, size); err != nil {
+		api.WriteError(w, r, space.Status(err), err)
+		return
+	}
+
+	partPath := filepath.Join(dirPath, "."+name+partExt)
+	f, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		api.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	out, err := space.Writer(c.conf.Get(), location, size, f)
+	if err == nil {
+		_, err = io.Copy(out, file)
+		out.Release()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(partPath)
+		api.WriteError(w, r, space.Status(err), err)
+		return
+	}
+
+	// the archive is deleted once it's unpacked, an upload can't be tried
+	// again so it goes if it fails too
+	res, err := archive.Extract(r.Context(), location, partPath, name, dir, formBool(r.PostForm.Get("flatten")), auth.Username(r))
+	if err != nil {
+		os.Remove(partPath)
+		api.WriteError(w, r, archive.Status(err), err)
+		return
+	}
+
+	fmt.Println("  DONE!")
+	loudnessJobs, transcodeJobs := 0, 0
+	for _, relPath := range res.Files {
+		loudnessJob, transcodeJob := c.queue(r, location, relPath)
+		if loudnessJob != "" {
+			loudnessJobs++
+		}
+		if transcodeJob != "" {
+			transcodeJobs++
+		}
+	}
+	if api.WantsJSON(r) {
+		upload := &api.Upload{
+			Location:  location,
+			Path:      dir,
+			Size:      size,
+			Extracted: res.Files,
+			Ignored:   res.Ignored,
+		}
+		if j := c.plex.Scan(location, dirPath); j != nil {
+			upload.ScanJob = j.ID
+		}
+		api.WriteJSON(w, http.StatusCreated, upload)
+		return
+	}
+	w.Write([]byte("DONE " + name + ", extracted:\n" + strings.Join(res.Files, "\n")))
+	if len(res.Ignored) > 0 {
+		w.Write([]byte("\nleft out:\n" + strings.Join(res.Ignored, "\n")))
+	}
+	if loudnessJobs > 0 {
+		w.Write([]byte(fmt.Sprintf("\nevening out loudness of %d files", loudnessJobs)))
+	}
+	if transcodeJobs > 0 {
+		w.Write([]byte(fmt.Sprintf("\ntranscoding %d files", transcodeJobs)))
+	}
+	if msg := c.plex.ScanAndWait(location, dirPath); msg != "" {
+		w.Write([]byte("\n" + msg))
+	}
+}
@@ -0,0 +1,355 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/archive"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/place"
+	"github.com/jaredwarren/plexupdate/space"
+	"github.com/jaredwarren/plexupdate/trash"
+)
+
+// maxFileSize of one file in a batch, the same as a single upload
+const maxFileSize = 3200 << 20
+
+// maxFieldSize of a form field in a batch
+const maxFieldSize = 1 << 20
+
+var (
+	// ErrTooLarge a file in a batch was bigger than maxFileSize, or the
+	// batch over upload.batchmaxsize
+	ErrTooLarge = errors.New("too large")
+	// ErrTooMany a batch has more than upload.batchmaxfiles files
+	ErrTooMany = errors.New("too many files")
+)
+
+// rawFileName the file name as the client sent it. Part.FileName drops the
+// folders, which browsers send when a whole folder was picked. ok is false
+// for a form field.
+func rawFileName(part *multipart.Part) (name string, ok bool) {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return "", false
+	}
+	name, ok = params["filename"]
+	return
+}
+
+// Batch takes many files in one multipart request and writes each one as it
+// arrives, nothing is buffered. The fields have to come before the files:
+// location, folder, on_duplicate, transcode, extract and flatten. A path
+// field before a file is where it goes inside the folder, otherwise it's the
+// name the file was sent with, folders and all. The file that goes over
+// upload.batchmaxsize or upload.batchmaxfiles fails, and the rest aren't
+// read.
+func (c *Controller) Batch(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Batch", r.URL.String())
+
+	maxSize, maxFiles, err := c.conf.Get().Upload.BatchLimits()
+	if err != nil {
+		api.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// refuse before reading the body if the client says where it's going,
+	// and is allowed to
+	if location := r.URL.Query().Get("location"); location != "" && r.ContentLength > 0 {
+		if !auth.Check(w, r, auth.PermUpload, location) {
+			return
+		}
+		if err := space.Check(c.conf.Get(), location, r.ContentLength); err != nil {
+			api.WriteError(w, r, space.Status(err), err)
+			return
+		}
+	}
+	if maxSize > 0 && r.ContentLength > maxSize {
+		err := fmt.Errorf("batch %w, at most %s", ErrTooLarge, api.FormatBytes(maxSize))
+		api.WriteError(w, r, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// the helpers shared with a single upload read the fields from PostForm
+	form := url.Values{}
+	r.PostForm = form
+	batch := &api.UploadBatch{Files: []*api.Upload{}}
+	var sandbox *filesystem.Sandbox
+	next := ""
+	var total int64
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if sandbox == nil {
+				api.WriteError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			// the client went away, report the files that made it
+			fmt.Println("  [E]: batch:", err)
+			break
+		}
+
+		name, isFile := rawFileName(part)
+		if !isFile {
+			v, err := ioutil.ReadAll(io.LimitReader(part, maxFieldSize))
+			part.Close()
+			if err != nil {
+				api.WriteError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			if part.FormName() == "path" {
+				next = string(v)
+			} else {
+				form.Add(part.FormName(), string(v))
+			}
+			continue
+		}
+		userPath := next
+		next = ""
+		if userPath == "" {
+			userPath = name
+		}
+		if userPath == "" {
+			// a file input nothing was picked in
+			part.Close()
+			continue
+		}
+
+		// the first file, the fields it needs have been sent
+		if sandbox == nil {
+			batch.Location = form.Get("location")
+			sandbox, err = c.conf.Get().Plex.Sandbox(batch.Location)
+			if err != nil {
+				api.WriteError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			if !auth.Check(w, r, auth.PermUpload, batch.Location) {
+				return
+			}
+			batch.Folder, err = filesystem.Clean(form.Get("folder"))
+			if err == nil && trash.Contains(batch.Folder) {
+				err = fmt.Errorf("%s: %w", batch.Folder, filesystem.ErrEscape)
+			}
+			if err != nil {
+				api.WriteError(w, r, targetStatus(err), err)
+				return
+			}
+		}
+
+		// what this file may take, the batch's limit if that's less
+		limit := int64(maxFileSize)
+		over := fmt.Errorf("file %w, more than %d MB", ErrTooLarge, maxFileSize>>20)
+		if maxSize > 0 && maxSize-total < limit {
+			limit = maxSize - total
+			over = fmt.Errorf("batch %w, at most %s, the rest weren't read", ErrTooLarge, api.FormatBytes(maxSize))
+		}
+		var upload *api.Upload
+		if len(batch.Files) >= maxFiles {
+			upload = &api.Upload{
+				Location: batch.Location,
+				Path:     userPath,
+				Error:    fmt.Sprintf("%s, a batch takes at most %d, the rest weren't read", ErrTooMany, maxFiles),
+			}
+		} else {
+			upload = c.receive(r, sandbox, batch, part, userPath, limit, over)
+		}
+		part.Close()
+		total += upload.Size
+		if upload.Error != "" {
+			fmt.Println("  [E]:", upload.Path, upload.Error)
+			batch.Failed++
+		}
+		batch.Files = append(batch.Files, upload)
+		if len(batch.Files) > maxFiles || upload.Error == over.Error() && limit < maxFileSize {
+			break
+		}
+	}
+	if sandbox == nil {
+		api.WriteError(w, r, http.StatusBadRequest, errors.New("no files"))
+		return
+	}
+
+	fmt.Println("  DONE!", len(batch.Files)-batch.Failed, "of", len(batch.Files))
+	dir, err := sandbox.Resolve(batch.Folder)
+	if err != nil {
+		dir = sandbox.Root
+	}
+	code := http.StatusCreated
+	if batch.Failed > 0 {
+		code = http.StatusMultiStatus
+	}
+	if api.WantsJSON(r) {
+		if j := c.plex.Scan(batch.Location, dir); j != nil {
+			batch.ScanJob = j.ID
+		}
+		api.WriteJSON(w, code, batch)
+		return
+	}
+	w.WriteHeader(code)
+	for _, u := range batch.Files {
+		switch {
+		case u.Error != "":
+			w.Write([]byte("FAILED " + u.Path + ": " + u.Error + "\n"))
+		case u.Skipped:
+			w.Write([]byte("SKIPPED " + u.Path + ", already in the library: " + describe(u.Duplicates) + "\n"))
+		case u.Extracted != nil:
+			w.Write([]byte(fmt.Sprintf("DONE %s, extracted %d files\n", u.Path, len(u.Extracted))))
+		default:
+			w.Write([]byte("DONE " + u.Path + "\n"))
+		}
+	}
+	if msg := c.plex.ScanAndWait(batch.Location, dir); msg != "" {
+		w.Write([]byte(msg))
+	}
+}
+
+// receive writes one file of a batch into the folder, failing with over if
+// it's more than limit bytes. The result has Error set if it didn't make it.
+func (c *Controller) receive(r *http.Request, sandbox *filesystem.Sandbox, batch *api.UploadBatch, part io.Reader, userPath string, limit int64, over error) *api.Upload {
+	upload := &api.Upload{
+		Location: batch.Location,
+		Path:     userPath,
+	}
+	fail := func(err error) *api.Upload {
+		upload.Error = err.Error()
+		return upload
+	}
+
+	relPath, err := clientPath(userPath)
+	if err != nil {
+		return fail(err)
+	}
+	relPath = path.Join(batch.Folder, relPath)
+	upload.Path = relPath
+	filePath, err := sandbox.Resolve(relPath)
+	if err != nil {
+		return fail(err)
+	}
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fail(err)
+	}
+
+	// archives are written out of sight, they're deleted once unpacked
+	name := path.Base(relPath)
+	unpack := formBool(r.PostForm.Get("extract")) && archive.Is(name)
+	partPath := filePath + partExt
+	if unpack {
+		partPath = filepath.Join(dir, "."+name+partExt)
+	}
+	size, err := c.write(batch.Location, partPath, part, limit, over)
+	if err != nil {
+		return fail(err)
+	}
+	upload.Size = size
+
+	if unpack {
+		res, err := archive.Extract(r.Context(), batch.Location, partPath, name, path.Dir(relPath), formBool(r.PostForm.Get("flatten")), auth.Username(r))
+		if err != nil {
+			os.Remove(partPath)
+			return fail(err)
+		}
+		upload.Path = path.Dir(relPath)
+		upload.Extracted = res.Files
+		upload.Ignored = res.Ignored
+		for _, p := range res.Files {
+			c.queue(r, batch.Location, p)
+		}
+		return upload
+	}
+
+	// is it in the library already? it's been written, so look at the copy
+	f, err := os.Open(partPath)
+	if err != nil {
+		os.Remove(partPath)
+		return fail(err)
+	}
+	matches, err := c.index.Match(f, size)
+	f.Close()
+	if err != nil {
+		os.Remove(partPath)
+		return fail(err)
+	}
+	upload.Duplicates = api.NewLibraryFiles(matches)
+	replace := false
+	if len(upload.Duplicates) > 0 {
+		switch r.PostForm.Get("on_duplicate") {
+		case api.DuplicateSkip:
+			os.Remove(partPath)
+			upload.Skipped = true
+			return upload
+		case api.DuplicateReplace:
+			replace = true
+		default:
+			relPath, _, err = freePath(sandbox, relPath)
+			if err != nil {
+				os.Remove(partPath)
+				return fail(err)
+			}
+			upload.Path = relPath
+		}
+	}
+
+	upload.Media, err = place.File(c.conf.Get(), c.index, place.Part{
+		Location: batch.Location,
+		Sandbox:  sandbox,
+		File:     partPath,
+		RelPath:  relPath,
+		User:     auth.Username(r),
+		Before: func() (err error) {
+			if replace {
+				_, err = c.replaceDuplicates(r, upload.Duplicates)
+			}
+			return
+		},
+	})
+	if err != nil {
+		return fail(err)
+	}
+	upload.LoudnessJob, upload.TranscodeJob = c.queue(r, batch.Location, relPath)
+	return upload
+}
+
+// write copies a file of a batch to partPath, failing with over if it's
+// more than limit bytes. Nothing is left behind if it doesn't all make it.
+func (c *Controller) write(location, partPath string, in io.Reader, limit int64, over error) (int64, error) {
+	f, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	out, err := space.Writer(c.conf.Get(), location, 0, f)
+	if err == nil {
+		size, err = io.Copy(out, io.LimitReader(in, limit+1))
+		out.Release()
+	}
+	if err == nil && size > limit {
+		err = over
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(partPath)
+		return 0, err
+	}
+	return size, nil
+}
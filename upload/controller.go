@@ -0,0 +1,499 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/app"
+	"github.com/jaredwarren/plexupdate/archive"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/duplicates"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/form"
+	"github.com/jaredwarren/plexupdate/jobs"
+	"github.com/jaredwarren/plexupdate/place"
+	"github.com/jaredwarren/plexupdate/plex"
+	"github.com/jaredwarren/plexupdate/probe"
+	"github.com/jaredwarren/plexupdate/space"
+	"github.com/jaredwarren/plexupdate/transcode"
+	"github.com/jaredwarren/plexupdate/trash"
+)
+
+// partExt is added to a file until every byte has been received
+const partExt = ".part"
+
+// Controller handles file uploads.
+type Controller struct {
+	mux   *mux.Router
+	api   *mux.Router
+	conf  *config.Current
+	jobs  *jobs.Manager
+	plex  *plex.Scanner
+	index *duplicates.Index
+}
+
+// Register ...
+func Register(service *app.Service) {
+	c := &Controller{
+		mux:   service.Mux,
+		api:   service.API,
+		conf:  service.Config,
+		jobs:  service.Jobs,
+		plex:  service.Plex,
+		index: service.Index,
+	}
+	c.MountController()
+}
+
+// MountController ...
+func (c *Controller) MountController() {
+	c.mux.HandleFunc("/upload", c.Upload).Methods("GET")
+	c.mux.HandleFunc("/upload", c.UploadHandler).Methods("POST")
+	c.mux.HandleFunc("/upload/batch", c.Batch).Methods("POST")
+
+	c.api.HandleFunc("/uploads", c.UploadHandler).Methods("POST")
+	c.api.HandleFunc("/uploads/batch", c.Batch).Methods("POST")
+	c.api.HandleFunc("/uploads/{location}/{path:.+}", c.Status).Methods("GET")
+	c.api.HandleFunc("/uploads/{location}/{path:.+}", c.Resume).Methods("PUT")
+	c.api.HandleFunc("/naming/parse", c.ParseName).Methods("GET")
+	c.api.HandleFunc("/naming/preview", c.PreviewName).Methods("GET")
+}
+
+// Upload ...
+func (c *Controller) Upload(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Update", r.URL.String())
+
+	if !auth.Permissions(r)[auth.PermUpload] {
+		auth.Check(w, r, auth.PermUpload, "")
+		return
+	}
+
+	// parse every time to make updates easier, and save memory
+	tpl := template.Must(template.New("base").Funcs(template.FuncMap{"CsrfToken": form.TokenFunc(r)}).ParseFiles("templates/upload.html", "templates/base.html"))
+	tpl.ExecuteTemplate(w, "base", &struct {
+		Title     string
+		Locations map[string]string
+		Profiles  []string
+	}{
+		Title:     "User List",
+		Locations: auth.Locations(r, auth.PermUpload, c.conf.Get().Plex.Locations),
+		Profiles:  c.conf.Get().Transcode.Names(),
+	})
+}
+
+// UploadHandler ...
+func (c *Controller) UploadHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	fmt.Println("UploadHandler", r.URL.String())
+
+	// refuse before reading the body if the client says where it's going,
+	// and is allowed to
+	if location := r.URL.Query().Get("location"); location != "" && r.ContentLength > 0 {
+		if !auth.Check(w, r, auth.PermUpload, location) {
+			return
+		}
+		if err := space.Check(c.conf.Get(), location, r.ContentLength); err != nil {
+			api.WriteError(w, r, space.Status(err), err)
+			return
+		}
+	}
+
+	// 3200 MB files max.
+	r.Body = http.MaxBytesReader(w, r.Body, 3200<<20)
+	// a url is all a plain form has to send
+	if err := r.ParseMultipartForm(3200 << 20); err != nil && err != http.ErrNotMultipart {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// setup root dir
+	location := r.PostForm.Get("location")
+	sandbox, err := c.conf.Get().Plex.Sandbox(location)
+	if err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	rootDir := sandbox.Root
+	if !auth.Check(w, r, auth.PermUpload, location) {
+		return
+	}
+	err = os.MkdirAll(rootDir, os.ModePerm)
+	if err != nil {
+		api.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// the server fetches it instead
+	if rawURL := strings.TrimSpace(r.PostForm.Get("url")); rawURL != "" {
+		c.fromURL(w, r, location, sandbox, rawURL)
+		return
+	}
+
+	// get form file
+	file, handler, err := r.FormFile("video_file")
+	if err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	defer file.Close()
+
+	// never trust the client's file name
+	name, err := filesystem.NormalizeFilename(handler.Filename)
+	if err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	relPath, err := uploadPath(r.PostForm, name)
+	if err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	filePath, err := sandbox.Resolve(relPath)
+	if err != nil {
+		api.WriteError(w, r, targetStatus(err), err)
+		return
+	}
+
+	// a season pack, its files are checked one by one
+	if formBool(r.PostForm.Get("extract")) && archive.Is(name) {
+		c.extract(w, r, file, handler.Size, location, sandbox, name, relPath)
+		return
+	}
+
+	// is it in the library already?
+	matches, err := c.index.Match(file, handler.Size)
+	if err != nil {
+		api.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	dups := api.NewLibraryFiles(matches)
+	replace := false
+	if len(dups) > 0 {
+		switch r.PostForm.Get("on_duplicate") {
+		case api.DuplicateSkip:
+			fmt.Println("  SKIPPED, duplicate of", describe(dups))
+			if api.WantsJSON(r) {
+				api.WriteJSON(w, http.StatusOK, &api.Upload{
+					Location:   location,
+					Path:       relPath,
+					Duplicates: dups,
+					Skipped:    true,
+				})
+				return
+			}
+			w.Write([]byte("SKIPPED, already in the library: " + describe(dups)))
+			return
+		case api.DuplicateReplace:
+			// once the new one has passed the checks
+			replace = true
+		default:
+			// keep both, don't let the new one overwrite the old one
+			relPath, filePath, err = freePath(sandbox, relPath)
+			if err != nil {
+				api.WriteError(w, r, targetStatus(err), err)
+				return
+			}
+		}
+	}
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		api.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := space.Check(c.conf.Get(), location, handler.Size); err != nil {
+		api.WriteError(w, r, space.Status(err), err)
+		return
+	}
+
+	// write next to it, what's there stays until the new one is checked
+	partPath := filePath + partExt
+	f, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		api.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+	var size int64
+	out, err := space.Writer(c.conf.Get(), location, handler.Size, f)
+	if err == nil {
+		size, err = io.Copy(out, file)
+		out.Release()
+	}
+	if err != nil {
+		// don't leave half a file behind
+		f.Close()
+		os.Remove(partPath)
+		api.WriteError(w, r, space.Status(err), err)
+		return
+	}
+	f.Close()
+
+	// what's there is kept in the trash
+	code := 0
+	media, err := place.File(c.conf.Get(), c.index, place.Part{
+		Location: location,
+		Sandbox:  sandbox,
+		File:     partPath,
+		RelPath:  relPath,
+		User:     auth.Username(r),
+		Before: func() (err error) {
+			if replace {
+				code, err = c.replaceDuplicates(r, dups)
+			}
+			return
+		},
+	})
+	if err != nil {
+		if code == 0 {
+			code = probe.Status(err)
+		}
+		api.WriteError(w, r, code, err)
+		return
+	}
+
+	fmt.Println("  DONE!")
+	loudnessJob, transcodeJob := c.queue(r, location, relPath)
+	if api.WantsJSON(r) {
+		upload := &api.Upload{
+			Location:     location,
+			Path:         relPath,
+			Size:         size,
+			Duplicates:   dups,
+			Media:        media,
+			TranscodeJob: transcodeJob,
+			LoudnessJob:  loudnessJob,
+		}
+		if j := c.plex.Scan(location, dir); j != nil {
+			upload.ScanJob = j.ID
+		}
+		api.WriteJSON(w, http.StatusCreated, upload)
+		return
+	}
+	w.Write([]byte("DONE " + relPath))
+	if len(dups) > 0 {
+		w.Write([]byte("\nalready in the library: " + describe(dups)))
+	}
+	if loudnessJob != "" {
+		w.Write([]byte("\nevening out loudness, job " + loudnessJob))
+	}
+	if transcodeJob != "" {
+		w.Write([]byte("\ntranscoding, job " + transcodeJob))
+	}
+	if msg := c.plex.ScanAndWait(location, dir); msg != "" {
+		w.Write([]byte("\n" + msg))
+	}
+}
+
+// queue starts what a new file gets once it's in place, a transcode with
+// the profile asked for or the location's auto profile. It returns the
+// loudness and transcode job ids, a file that can't be processed is still
+// uploaded.
+func (c *Controller) queue(r *http.Request, location, relPath string) (string, string) {
+	profile := transcode.ProfileFor(c.conf.Get(), location, r.PostForm.Get("transcode"))
+	loudnessJob, transcodeJob, _ := place.Jobs(location, relPath, profile, auth.Username(r))
+	return loudnessJob, transcodeJob
+}
+
+// target returns the final file path for a resumable upload
+func (c *Controller) target(r *http.Request) (location, relPath, filePath string, err error) {
+	vars := mux.Vars(r)
+	location = vars["location"]
+	if _, ok := c.conf.Get().Plex.Locations[location]; !ok {
+		return "", "", "", fmt.Errorf("unknown location: %q", location)
+	}
+	sandbox, err := c.conf.Get().Plex.Sandbox(location)
+	if err != nil {
+		return "", "", "", err
+	}
+	relPath, err = clientPath(vars["path"])
+	if err != nil {
+		return "", "", "", err
+	}
+	filePath, err = sandbox.Resolve(relPath)
+	return
+}
+
+// clientPath cleans a path the client picked inside a location, folders are
+// kept and the file name is normalized like a normal upload
+func clientPath(userPath string) (string, error) {
+	relPath, err := filesystem.Clean(userPath)
+	if err != nil {
+		return "", err
+	}
+	if relPath == "/" {
+		return "", errors.New("missing path")
+	}
+	if trash.Contains(relPath) {
+		return "", fmt.Errorf("%s: %w", relPath, filesystem.ErrEscape)
+	}
+	name, err := filesystem.NormalizeFilename(path.Base(relPath))
+	if err != nil {
+		return "", err
+	}
+	return path.Join(path.Dir(relPath), name), nil
+}
+
+// targetStatus paths outside the location are forbidden, bad paths are bad
+// requests, anything else wasn't found
+func targetStatus(err error) int {
+	if errors.Is(err, filesystem.ErrEscape) || errors.Is(err, filesystem.ErrSymlink) {
+		return http.StatusForbidden
+	}
+	if errors.Is(err, filesystem.ErrInvalid) || errors.Is(err, filesystem.ErrEmptyName) {
+		return http.StatusBadRequest
+	}
+	return http.StatusNotFound
+}
+
+// Status tells a client how much of a resumable upload the server already has
+func (c *Controller) Status(w http.ResponseWriter, r *http.Request) {
+	location, relPath, filePath, err := c.target(r)
+	if err != nil {
+		api.WriteError(w, r, targetStatus(err), err)
+		return
+	}
+	if !auth.Check(w, r, auth.PermUpload, location) {
+		return
+	}
+
+	status := &api.UploadStatus{
+		Location: location,
+		Path:     relPath,
+	}
+	if fi, err := os.Stat(filePath); err == nil {
+		status.Offset = fi.Size()
+		status.Complete = true
+	} else if fi, err := os.Stat(filePath + partExt); err == nil {
+		status.Offset = fi.Size()
+	}
+
+	w.Header().Set(api.UploadOffsetHeader, strconv.FormatInt(status.Offset, 10))
+	api.WriteJSON(w, http.StatusOK, status)
+}
+
+// Resume appends the request body to a partial upload. Upload-Offset must
+// match what the server has, Upload-Length is the size of the whole file.
+func (c *Controller) Resume(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Resume", r.URL.String())
+
+	location, relPath, filePath, err := c.target(r)
+	if err != nil {
+		api.WriteError(w, r, targetStatus(err), err)
+		return
+	}
+	if !auth.Check(w, r, auth.PermUpload, location) {
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(api.UploadOffsetHeader), 10, 64)
+	if err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, fmt.Errorf("invalid %s: %s", api.UploadOffsetHeader, err))
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get(api.UploadLengthHeader), 10, 64)
+	if err != nil || length < offset {
+		api.WriteError(w, r, http.StatusBadRequest, fmt.Errorf("invalid %s", api.UploadLengthHeader))
+		return
+	}
+
+	if err := space.Check(c.conf.Get(), location, length-offset); err != nil {
+		api.WriteError(w, r, space.Status(err), err)
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+	if err != nil {
+		api.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	partPath := filePath + partExt
+	f, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		api.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		api.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if fi.Size() != offset {
+		w.Header().Set(api.UploadOffsetHeader, strconv.FormatInt(fi.Size(), 10))
+		api.WriteError(w, r, http.StatusConflict, fmt.Errorf("offset mismatch, server has %d bytes", fi.Size()))
+		return
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		api.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	out, err := space.Writer(c.conf.Get(), location, length-offset, f)
+	if err != nil {
+		api.WriteError(w, r, space.Status(err), err)
+		return
+	}
+	defer out.Release()
+	n, err := io.Copy(out, io.LimitReader(r.Body, length-offset))
+	offset += n
+	w.Header().Set(api.UploadOffsetHeader, strconv.FormatInt(offset, 10))
+	if err != nil {
+		// what was written is kept, the client can resume once there's room
+		api.WriteError(w, r, space.Status(err), err)
+		return
+	}
+
+	if offset < length {
+		api.WriteJSON(w, http.StatusOK, &api.UploadStatus{
+			Location: location,
+			Path:     relPath,
+			Offset:   offset,
+		})
+		return
+	}
+
+	f.Close()
+	sandbox, err := c.conf.Get().Plex.Sandbox(location)
+	if err != nil {
+		api.WriteError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	media, err := place.File(c.conf.Get(), c.index, place.Part{
+		Location: location,
+		Sandbox:  sandbox,
+		File:     partPath,
+		RelPath:  relPath,
+		User:     auth.Username(r),
+	})
+	if err != nil {
+		api.WriteError(w, r, probe.Status(err), err)
+		return
+	}
+
+	fmt.Println("  DONE!")
+	upload := &api.Upload{
+		Location: location,
+		Path:     relPath,
+		Size:     length,
+		Media:    media,
+	}
+	upload.Duplicates = c.others(location, relPath, filePath, length)
+	upload.LoudnessJob, upload.TranscodeJob = c.queue(r, location, relPath)
+	if j := c.plex.Scan(location, filepath.Dir(filePath)); j != nil {
+		upload.ScanJob = j.ID
+	}
+	api.WriteJSON(w, http.StatusCreated, upload)
+}
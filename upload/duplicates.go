@@ -0,0 +1,66 @@
+package upload
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/trash"
+)
+
+// replaceDuplicates moves files an upload replaces to the trash, the user
+// has to be able to manage every one of them
+func (c *Controller) replaceDuplicates(r *http.Request, dups []api.LibraryFile) (int, error) {
+	for _, d := range dups {
+		if !auth.Can(r, auth.PermManage, d.Location) {
+			return http.StatusForbidden, fmt.Errorf("can't replace %s in %s", d.Path, d.Location)
+		}
+	}
+	for _, d := range dups {
+		sandbox, err := c.conf.Get().Plex.Sandbox(d.Location)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if err := trash.Delete(c.conf.Get().Trash, sandbox, d.Location, d.Path, auth.Username(r)); err != nil && !os.IsNotExist(err) {
+			return http.StatusInternalServerError, err
+		}
+		if p, err := sandbox.Resolve(d.Path); err == nil {
+			c.plex.Scan(d.Location, filepath.Dir(p))
+		}
+	}
+	return 0, nil
+}
+
+// freePath finds a name next to relPath that isn't taken, "name (2).ext"
+func freePath(sandbox *filesystem.Sandbox, relPath string) (string, string, error) {
+	ext := path.Ext(relPath)
+	base := strings.TrimSuffix(relPath, ext)
+	for n := 1; ; n++ {
+		p := relPath
+		if n > 1 {
+			p = fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}
+		filePath, err := sandbox.Resolve(p)
+		if err != nil {
+			return "", "", err
+		}
+		if _, err := os.Lstat(filePath); os.IsNotExist(err) {
+			return p, filePath, nil
+		}
+	}
+}
+
+// describe duplicates for the plain text response
+func describe(dups []api.LibraryFile) string {
+	list := make([]string, len(dups))
+	for i, d := range dups {
+		list[i] = d.Location + ":" + d.Path
+	}
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,84 @@
+package upload
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/naming"
+)
+
+// mediaInfo reads the naming fields of the upload form
+func mediaInfo(form url.Values) api.MediaInfo {
+	number := func(key string) int {
+		n, _ := strconv.Atoi(strings.TrimSpace(form.Get(key)))
+		return n
+	}
+	return api.MediaInfo{
+		Type:         form.Get("media_type"),
+		Title:        form.Get("title"),
+		Year:         number("year"),
+		Season:       number("season"),
+		Episode:      number("episode"),
+		EpisodeTitle: form.Get("episode_title"),
+		Date:         strings.TrimSpace(form.Get("date")),
+		Artist:       form.Get("artist"),
+		Album:        form.Get("album"),
+		Track:        number("track"),
+	}
+}
+
+// uploadPath where an uploaded file named name goes inside its location,
+// the plex layout when the form has a media type
+func uploadPath(form url.Values, name string) (string, error) {
+	if form.Get("media_type") == "" {
+		return "/" + name, nil
+	}
+	return naming.Path(mediaInfo(form), filepath.Ext(name))
+}
+
+// ParseName guesses the naming fields from a file name, ?name=
+func (c *Controller) ParseName(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("ParseName", r.URL.String())
+
+	if !auth.Permissions(r)[auth.PermUpload] {
+		auth.Check(w, r, auth.PermUpload, "")
+		return
+	}
+	name := r.URL.Query().Get("name")
+	info := naming.Parse(name)
+	preview := &api.NamingPreview{Info: info}
+	if p, err := naming.Path(info, filepath.Ext(name)); err == nil {
+		preview.Path = p
+	} else {
+		preview.Error = err.Error()
+	}
+	api.WriteJSON(w, http.StatusOK, preview)
+}
+
+// PreviewName shows where an upload will go, it takes the upload form's
+// fields as query parameters, name is the file's name
+func (c *Controller) PreviewName(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("PreviewName", r.URL.String())
+
+	if !auth.Permissions(r)[auth.PermUpload] {
+		auth.Check(w, r, auth.PermUpload, "")
+		return
+	}
+	q := r.URL.Query()
+	preview := &api.NamingPreview{Info: mediaInfo(q)}
+	name, err := filesystem.NormalizeFilename(q.Get("name"))
+	if err == nil {
+		preview.Path, err = uploadPath(q, name)
+	}
+	if err != nil {
+		preview.Error = err.Error()
+	}
+	api.WriteJSON(w, http.StatusOK, preview)
+}
@@ -0,0 +1,247 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/archive"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/download"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/jobs"
+	"github.com/jaredwarren/plexupdate/place"
+	"github.com/jaredwarren/plexupdate/probe"
+)
+
+// JobType of uploads the server fetches from a url
+const JobType = "upload"
+
+// urlRequest the download an upload from rawURL is, the file goes where the
+// naming fields put it like any other upload
+func urlRequest(form url.Values, location, rawURL string) (*api.DownloadRequest, error) {
+	req := &api.DownloadRequest{
+		URL:       rawURL,
+		Location:  location,
+		Path:      "/",
+		Checksum:  form.Get("checksum"),
+		Transcode: form.Get("transcode"),
+		Extract:   formBool(form.Get("extract")),
+		Flatten:   formBool(form.Get("flatten")),
+	}
+	name := form.Get("name")
+	if name == "" && form.Get("media_type") != "" {
+		// plex names need the extension, the url has to do
+		if u, err := url.Parse(rawURL); err == nil {
+			name = path.Base(u.Path)
+		}
+	}
+	if name == "" {
+		// the name the server gives it
+		return req, nil
+	}
+	name, err := filesystem.NormalizeFilename(name)
+	if err != nil {
+		return nil, err
+	}
+	relPath, err := uploadPath(form, name)
+	if err != nil {
+		return nil, err
+	}
+	req.Path, req.Name = path.Dir(relPath), path.Base(relPath)
+	return req, nil
+}
+
+// fromURL has the server fetch rawURL into the location instead of the client
+// sending the file. The fetch is a job so its progress can be watched, the
+// answer is the same as a normal upload's once the file is there, and so is
+// what's done with duplicates.
+func (c *Controller) fromURL(w http.ResponseWriter, r *http.Request, location string, sandbox *filesystem.Sandbox, rawURL string) {
+	req, err := urlRequest(r.PostForm, location, rawURL)
+	if err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// the errors are kept to pick the status, the job only has their text
+	user := auth.Username(r)
+	var relPath string
+	var res *archive.Result
+	var fetchErr error
+	dup := &fetched{}
+	job := c.jobs.Start(JobType, user, location, func(ctx context.Context, j *jobs.Job) (string, error) {
+		relPath, res, fetchErr = download.FetchJob(ctx, j, req, user, func(pt *place.Part) (bool, error) {
+			return c.checkFetched(r, sandbox, pt, dup)
+		})
+		if fetchErr != nil {
+			return "", fetchErr
+		}
+		if res != nil {
+			return strings.Join(res.Files, "\n"), nil
+		}
+		if dup.skipped {
+			return "skipped, already in the library: " + describe(dup.files), nil
+		}
+		return relPath, nil
+	})
+	fmt.Println("  fetching to", location, req.Path, "job", job.ID)
+	// like a normal upload the answer waits for the file, it carries on if
+	// the client goes away
+	job.Wait()
+	if fetchErr == nil && job.Snapshot().Status != jobs.Done {
+		fetchErr = errors.New("upload " + string(job.Snapshot().Status))
+	}
+	if fetchErr != nil {
+		code := dup.code
+		if code == 0 {
+			code = download.Status(fetchErr)
+		}
+		api.WriteError(w, r, code, fetchErr)
+		return
+	}
+
+	if dup.skipped {
+		fmt.Println("  SKIPPED, duplicate of", describe(dup.files))
+		if api.WantsJSON(r) {
+			api.WriteJSON(w, http.StatusOK, &api.Upload{
+				Location:   location,
+				Path:       dup.relPath,
+				Duplicates: dup.files,
+				Skipped:    true,
+				FetchJob:   job.ID,
+			})
+			return
+		}
+		w.Write([]byte("SKIPPED, already in the library: " + describe(dup.files)))
+		return
+	}
+
+	fmt.Println("  DONE!")
+	upload := &api.Upload{
+		Location:   location,
+		Path:       relPath,
+		Duplicates: dup.files,
+		FetchJob:   job.ID,
+	}
+	if res != nil {
+		upload.Extracted = res.Files
+		upload.Ignored = res.Ignored
+		for _, p := range res.Files {
+			c.queue(r, location, p)
+		}
+	} else {
+		if filePath, err := sandbox.Resolve(relPath); err == nil {
+			if fi, err := os.Stat(filePath); err == nil {
+				upload.Size = fi.Size()
+				upload.Media = probe.Cached(c.conf.Get().Probe, filePath, fi)
+			}
+		}
+		upload.LoudnessJob, upload.TranscodeJob = c.queue(r, location, relPath)
+	}
+	dir, _ := sandbox.Resolve(req.Path)
+	if api.WantsJSON(r) {
+		if j := c.plex.Scan(location, dir); j != nil {
+			upload.ScanJob = j.ID
+		}
+		api.WriteJSON(w, http.StatusCreated, upload)
+		return
+	}
+	if res != nil {
+		w.Write([]byte("DONE " + relPath + ", extracted:\n" + strings.Join(res.Files, "\n")))
+		if len(res.Ignored) > 0 {
+			w.Write([]byte("\nleft out:\n" + strings.Join(res.Ignored, "\n")))
+		}
+	} else {
+		w.Write([]byte("DONE " + relPath))
+	}
+	if len(upload.Duplicates) > 0 {
+		w.Write([]byte("\nalready in the library: " + describe(upload.Duplicates)))
+	}
+	if upload.LoudnessJob != "" {
+		w.Write([]byte("\nevening out loudness, job " + upload.LoudnessJob))
+	}
+	if upload.TranscodeJob != "" {
+		w.Write([]byte("\ntranscoding, job " + upload.TranscodeJob))
+	}
+	if msg := c.plex.ScanAndWait(location, dir); msg != "" {
+		w.Write([]byte("\n" + msg))
+	}
+}
+
+// fetched what checkFetched found out about a file from a url
+type fetched struct {
+	// relPath it would have had, files it's the same as
+	relPath string
+	files   []api.LibraryFile
+	skipped bool
+	// code the status for an error replacing the duplicates
+	code int
+}
+
+// checkFetched does with a fetched file what on_duplicate says, like a
+// normal upload: skip it, replace the ones it's the same as once it's
+// admitted, or keep both under a free name
+func (c *Controller) checkFetched(r *http.Request, sandbox *filesystem.Sandbox, pt *place.Part, dup *fetched) (bool, error) {
+	f, err := os.Open(pt.File)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	matches, err := c.index.Match(f, fi.Size())
+	if err != nil {
+		return false, err
+	}
+	dup.relPath = pt.RelPath
+	dup.files = api.NewLibraryFiles(matches)
+	if len(dup.files) == 0 {
+		return true, nil
+	}
+	switch r.PostForm.Get("on_duplicate") {
+	case api.DuplicateSkip:
+		dup.skipped = true
+		return false, nil
+	case api.DuplicateReplace:
+		pt.Before = func() (err error) {
+			dup.code, err = c.replaceDuplicates(r, dup.files)
+			return
+		}
+	default:
+		pt.RelPath, _, err = freePath(sandbox, pt.RelPath)
+		if err != nil {
+			dup.code = targetStatus(err)
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// others files in the library with the same content as the one that just
+// landed at relPath from a resumed upload. All that's left is to warn.
+func (c *Controller) others(location, relPath, filePath string, size int64) []api.LibraryFile {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	matches, err := c.index.Match(f, size)
+	if err != nil {
+		return nil
+	}
+	dups := []api.LibraryFile{}
+	for _, d := range api.NewLibraryFiles(matches) {
+		if d.Location != location || d.Path != relPath {
+			dups = append(dups, d)
+		}
+	}
+	return dups
+}
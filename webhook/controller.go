@@ -0,0 +1,196 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/app"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/command"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/hub"
+	"github.com/jaredwarren/plexupdate/socket"
+)
+
+// Path plex posts to, it can't log in so it's public and checks the secret instead
+const Path = "/webhooks/plex"
+
+// MessageType of hub messages for webhook events
+const MessageType = "plex"
+
+// Controller receives plex webhooks and shows recent events.
+type Controller struct {
+	mux    *mux.Router
+	api    *mux.Router
+	conf   *config.Current
+	hub    *hub.Hub
+	events *Events
+	notify *http.Client
+}
+
+// Register ...
+func Register(service *app.Service) {
+	c := &Controller{
+		mux:    service.Mux,
+		api:    service.API,
+		conf:   service.Config,
+		hub:    service.Hub,
+		events: &Events{},
+		notify: &http.Client{Timeout: 10 * time.Second},
+	}
+	c.MountController()
+}
+
+// MountController ...
+func (c *Controller) MountController() {
+	c.mux.HandleFunc(Path, c.Receive).Methods("POST")
+	c.mux.HandleFunc("/webhooks", auth.Require(auth.PermLibrary, c.EventList)).Methods("GET")
+	c.mux.HandleFunc("/webhooks/ws", auth.Require(auth.PermLibrary, c.EventWS)).Methods("GET")
+
+	c.api.HandleFunc("/webhooks/events", auth.Require(auth.PermLibrary, c.APIEventList)).Methods("GET")
+}
+
+// Receive handles a webhook from plex, a multipart form with a json payload part
+func (c *Controller) Receive(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Webhook", r.URL.Path)
+
+	secret := c.conf.Get().Webhooks.Secret
+	if secret == "" {
+		api.WriteError(w, r, http.StatusNotFound, errors.New("webhooks are turned off"))
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("secret")), []byte(secret)) != 1 {
+		api.WriteError(w, r, http.StatusForbidden, errors.New("invalid secret"))
+		return
+	}
+
+	// plex adds a thumbnail to some events, it's not used
+	r.Body = http.MaxBytesReader(w, r.Body, 10<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	p := &Payload{}
+	if err := json.Unmarshal([]byte(r.FormValue("payload")), p); err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, fmt.Errorf("invalid payload: %s", err))
+		return
+	}
+	if p.Event == "" {
+		api.WriteError(w, r, http.StatusBadRequest, errors.New("missing event"))
+		return
+	}
+
+	ev := c.events.Add(p)
+	fmt.Println("  ", ev.Summary)
+	// plex doesn't wait long, and doesn't care how the actions went
+	go c.run(ev)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// run does every action that matches the event
+func (c *Controller) run(ev *api.WebhookEvent) {
+	for _, a := range c.conf.Get().Webhooks.Actions {
+		if ok, _ := path.Match(a.Event, ev.Event); !ok {
+			continue
+		}
+		if a.Broadcast {
+			c.hub.Broadcast(&hub.Message{
+				Type:   MessageType,
+				Action: ev.Event,
+				Text:   ev.Summary,
+				Data:   ev,
+			})
+		}
+		if a.Command != "" {
+			preset, ok := c.conf.Get().Commands[a.Command]
+			if !ok {
+				fmt.Printf("  [E]: webhook %s: unknown command preset %q\n", ev.Event, a.Command)
+			} else {
+				cmd := command.Run(preset)
+				fmt.Println("  webhook", ev.Event, "started cmd", cmd.ID)
+			}
+		}
+		if a.Notify != "" {
+			if err := c.post(a.Notify, ev); err != nil {
+				fmt.Printf("  [E]: webhook %s: notify: %s\n", ev.Event, err)
+			}
+		}
+	}
+}
+
+// post sends the event as json, text is there for chat webhooks, e.g. slack
+func (c *Controller) post(url string, ev *api.WebhookEvent) error {
+	data, err := json.Marshal(&struct {
+		Text string `json:"text"`
+		*api.WebhookEvent
+	}{
+		Text:         ev.Summary,
+		WebhookEvent: ev,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := c.notify.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// EventList shows recent events, new ones are added live
+func (c *Controller) EventList(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("EventList", r.URL.String())
+
+	// parse every time to make updates easier, and save memory
+	tpl := template.Must(template.New("base").ParseFiles("templates/webhooks.html", "templates/base.html"))
+	tpl.ExecuteTemplate(w, "base", &struct {
+		Title   string
+		Enabled bool
+		Events  []api.WebhookEvent
+	}{
+		Title:   "Plex Events",
+		Enabled: c.conf.Get().Webhooks.Secret != "",
+		Events:  c.events.List(),
+	})
+}
+
+// APIEventList returns recent events, newest first
+func (c *Controller) APIEventList(w http.ResponseWriter, r *http.Request) {
+	api.WriteJSON(w, http.StatusOK, c.events.List())
+}
+
+// listener browsers only listen, anything they send is dropped
+type listener struct{}
+
+func (listener) Broadcast(msg []byte) {}
+
+// EventWS streams hub messages to the browser
+func (c *Controller) EventWS(w http.ResponseWriter, r *http.Request) {
+	var upgrader = websocket.Upgrader{}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("upgrade:", err)
+		return
+	}
+
+	client := socket.NewClient(auth.CurrentUser(r).Username, ws, listener{})
+	c.hub.Register(client)
+	client.Start()
+	c.hub.Unregister(client)
+}
@@ -0,0 +1,117 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+)
+
+// maxEvents kept for the recent events page
+const maxEvents = 200
+
+// Payload the json part of a plex webhook, only the fields we use
+type Payload struct {
+	Event   string `json:"event"`
+	User    bool   `json:"user"`
+	Owner   bool   `json:"owner"`
+	Account struct {
+		Title string `json:"title"`
+	} `json:"Account"`
+	Server struct {
+		Title string `json:"title"`
+		UUID  string `json:"uuid"`
+	} `json:"Server"`
+	Player struct {
+		Title         string `json:"title"`
+		Local         bool   `json:"local"`
+		PublicAddress string `json:"publicAddress"`
+		UUID          string `json:"uuid"`
+	} `json:"Player"`
+	Metadata struct {
+		LibrarySectionTitle string `json:"librarySectionTitle"`
+		Type                string `json:"type"`
+		Title               string `json:"title"`
+		ParentTitle         string `json:"parentTitle"`
+		GrandparentTitle    string `json:"grandparentTitle"`
+	} `json:"Metadata"`
+}
+
+// title "Show - Episode", or just the title for movies
+func (p *Payload) title() string {
+	if p.Metadata.GrandparentTitle != "" {
+		return p.Metadata.GrandparentTitle + " - " + p.Metadata.Title
+	}
+	return p.Metadata.Title
+}
+
+// summary one line for people
+func (p *Payload) summary() string {
+	who := p.Account.Title
+	if who == "" {
+		who = "someone"
+	}
+	switch p.Event {
+	case "library.new":
+		return fmt.Sprintf("new in %s: %s", p.Metadata.LibrarySectionTitle, p.title())
+	case "library.on.deck":
+		return fmt.Sprintf("on deck for %s: %s", who, p.title())
+	case "media.play":
+		return fmt.Sprintf("%s started %s on %s", who, p.title(), p.Player.Title)
+	case "media.pause":
+		return fmt.Sprintf("%s paused %s on %s", who, p.title(), p.Player.Title)
+	case "media.resume":
+		return fmt.Sprintf("%s resumed %s on %s", who, p.title(), p.Player.Title)
+	case "media.stop":
+		return fmt.Sprintf("%s stopped %s on %s", who, p.title(), p.Player.Title)
+	case "media.scrobble":
+		return fmt.Sprintf("%s watched %s", who, p.title())
+	case "media.rate":
+		return fmt.Sprintf("%s rated %s", who, p.title())
+	}
+	return strings.TrimSpace(p.Event + " " + p.title())
+}
+
+// Events recent webhooks, newest first
+type Events struct {
+	mu     sync.RWMutex
+	seq    int64
+	events []*api.WebhookEvent
+}
+
+// Add stores the event and returns it
+func (e *Events) Add(p *Payload) *api.WebhookEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.seq++
+	ev := &api.WebhookEvent{
+		ID:       e.seq,
+		Event:    p.Event,
+		Received: time.Now(),
+		Account:  p.Account.Title,
+		Server:   p.Server.Title,
+		Player:   p.Player.Title,
+		Library:  p.Metadata.LibrarySectionTitle,
+		Type:     p.Metadata.Type,
+		Title:    p.title(),
+		Summary:  p.summary(),
+	}
+	e.events = append([]*api.WebhookEvent{ev}, e.events...)
+	if len(e.events) > maxEvents {
+		e.events = e.events[:maxEvents]
+	}
+	return ev
+}
+
+// List returns a copy, newest first
+func (e *Events) List() []api.WebhookEvent {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	list := make([]api.WebhookEvent, len(e.events))
+	for i, ev := range e.events {
+		list[i] = *ev
+	}
+	return list
+}
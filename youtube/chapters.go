@@ -0,0 +1,95 @@
+package youtube
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jaredwarren/plexupdate/api"
+)
+
+// minChapters fewer than this isn't worth splitting
+const minChapters = 2
+
+var (
+	// "0:00 Intro", "[1:02:03] - Title", "• 12:34 | Title"
+	leadingTimeRe = regexp.MustCompile(`^[\s\-*•▶►]*[(\[]?((?:\d{1,2}:)?\d{1,2}:\d{2})[)\]]?\s*(?:[-–—:|.]\s*)?(.*)$`)
+	// "Intro 0:00", "01. Title - (12:34)"
+	trailingTimeRe = regexp.MustCompile(`^(.*?)\s*(?:[-–—:|]\s*)?[(\[]?((?:\d{1,2}:)?\d{1,2}:\d{2})[)\]]?\s*$`)
+	// the track number some descriptions put before the title
+	numberRe = regexp.MustCompile(`^\d{1,3}[.)]\s+`)
+)
+
+// chapterList the chapters the file has, or failing that the ones in the
+// description, nil if there aren't enough of either. duration is the
+// file's, in seconds, 0 if it isn't known.
+func chapterList(info *api.MediaProbe, description string, duration float64) []api.MediaChapter {
+	if info != nil && len(info.Chapters) >= minChapters {
+		return info.Chapters
+	}
+	return parseChapters(description, duration)
+}
+
+// parseChapters finds a chapter list in a video description, one timestamp
+// and title per line. Like YouTube it wants the first at 0:00 and every
+// other after the one before, anything else is just a time someone
+// mentioned.
+func parseChapters(description string, duration float64) []api.MediaChapter {
+	var chapters []api.MediaChapter
+	for _, line := range strings.Split(description, "\n") {
+		// "1. 0:00 One", the number goes before the time too
+		line = numberRe.ReplaceAllString(strings.TrimSpace(line), "")
+		var stamp, title string
+		if m := leadingTimeRe.FindStringSubmatch(line); m != nil {
+			stamp, title = m[1], m[2]
+		} else if m := trailingTimeRe.FindStringSubmatch(line); m != nil {
+			stamp, title = m[2], m[1]
+		} else {
+			continue
+		}
+		start, err := parseTimestamp(stamp)
+		if err != nil {
+			continue
+		}
+		if len(chapters) == 0 && start != 0 {
+			continue
+		}
+		if n := len(chapters); n > 0 {
+			if start <= chapters[n-1].Start {
+				return nil
+			}
+			chapters[n-1].End = start
+		}
+		title = strings.TrimSpace(numberRe.ReplaceAllString(strings.TrimSpace(title), ""))
+		chapters = append(chapters, api.MediaChapter{Title: title, Start: start})
+	}
+	if len(chapters) < minChapters {
+		return nil
+	}
+	if duration > 0 {
+		if chapters[len(chapters)-1].Start >= duration {
+			return nil
+		}
+		chapters[len(chapters)-1].End = duration
+	}
+	return chapters
+}
+
+// parseTimestamp "1:02:03" or "2:03" in seconds
+func parseTimestamp(s string) (float64, error) {
+	var seconds int
+	parts := strings.Split(s, ":")
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, err
+		}
+		// minutes and seconds are 0-59, hours can be anything
+		if i > 0 && n > 59 {
+			return 0, fmt.Errorf("invalid timestamp: %q", s)
+		}
+		seconds = seconds*60 + n
+	}
+	return float64(seconds), nil
+}
@@ -0,0 +1,105 @@
+package youtube
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jaredwarren/plexupdate/api"
+)
+
+func TestParseChapters(t *testing.T) {
+	tests := []struct {
+		name        string
+		description string
+		duration    float64
+		want        []api.MediaChapter
+	}{
+		{
+			name:        "leading",
+			description: "Tracklist:\n0:00 Intro\n1:30 - Second\n[1:02:03] Third",
+			want:        []api.MediaChapter{{Title: "Intro", End: 90}, {Title: "Second", Start: 90, End: 3723}, {Title: "Third", Start: 3723}},
+		},
+		{
+			name:        "trailing",
+			description: "Intro 0:00\nSecond - (2:00)",
+			duration:    300,
+			want:        []api.MediaChapter{{Title: "Intro", End: 120}, {Title: "Second", Start: 120, End: 300}},
+		},
+		{
+			name:        "numbered",
+			description: "1. 0:00 One\n2. 3:00 Two\n03) Three 4:00",
+			want:        []api.MediaChapter{{Title: "One", End: 180}, {Title: "Two", Start: 180, End: 240}, {Title: "Three", Start: 240}},
+		},
+		{
+			name:        "number in the title",
+			description: "0:00 01. One\n1:00 | 02) Two",
+			want:        []api.MediaChapter{{Title: "One", End: 60}, {Title: "Two", Start: 60}},
+		},
+		{
+			name:        "bullets",
+			description: "• 0:00 | One\n▶ 0:45 Two",
+			want:        []api.MediaChapter{{Title: "One", End: 45}, {Title: "Two", Start: 45}},
+		},
+		{
+			name:        "times before the list",
+			description: "at 5:00 it gets good\n0:00 One\n1:00 Two",
+			want:        []api.MediaChapter{{Title: "One", End: 60}, {Title: "Two", Start: 60}},
+		},
+		{name: "not from the start", description: "0:10 One\n1:00 Two"},
+		{name: "out of order", description: "0:00 One\n2:00 Two\n1:00 Three"},
+		{name: "one isn't enough", description: "0:00 One"},
+		{name: "past the end", description: "0:00 One\n9:00 Two", duration: 300},
+		{name: "not a time", description: "0:00 One\n1:75 Two"},
+		{name: "none", description: "just a video"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseChapters(tt.description, tt.duration); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChapterList(t *testing.T) {
+	embedded := []api.MediaChapter{{Title: "A", End: 10}, {Title: "B", Start: 10, End: 20}}
+	description := "0:00 One\n0:05 Two"
+	fromDescription := []api.MediaChapter{{Title: "One", End: 5}, {Title: "Two", Start: 5, End: 20}}
+	tests := []struct {
+		name string
+		info *api.MediaProbe
+		want []api.MediaChapter
+	}{
+		{name: "the file's", info: &api.MediaProbe{Chapters: embedded}, want: embedded},
+		{name: "one in the file", info: &api.MediaProbe{Chapters: embedded[:1]}, want: fromDescription},
+		{name: "not probed", want: fromDescription},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chapterList(tt.info, description, 20); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{in: "0:00", ok: true},
+		{in: "2:03", want: 123, ok: true},
+		{in: "1:02:03", want: 3723, ok: true},
+		{in: "100:00:00", want: 360000, ok: true},
+		{in: "1:60"},
+		{in: "1:x"},
+	}
+	for _, tt := range tests {
+		got, err := parseTimestamp(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("%q: got %v, %v", tt.in, got, err)
+		}
+	}
+}
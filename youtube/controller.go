@@ -1,82 +1,190 @@
 package youtube
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/jaredwarren/plexupdate/api"
 	"github.com/jaredwarren/plexupdate/app"
+	"github.com/jaredwarren/plexupdate/auth"
 	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/duplicates"
+	"github.com/jaredwarren/plexupdate/form"
+	"github.com/jaredwarren/plexupdate/jobs"
+	"github.com/jaredwarren/plexupdate/place"
+	"github.com/jaredwarren/plexupdate/plex"
+	"github.com/jaredwarren/plexupdate/space"
+	"github.com/jaredwarren/plexupdate/transcode"
 )
 
 // Controller implements the home resource.
 type Controller struct {
-	mux  *mux.Router
-	conf config.Configuration
+	mux   *mux.Router
+	api   *mux.Router
+	conf  *config.Current
+	jobs  *jobs.Manager
+	plex  *plex.Scanner
+	index *duplicates.Index
+	subs  *Subscriptions
 }
 
 // Register ...
 func Register(service *app.Service) {
 	uc := &Controller{
-		mux:  service.Mux,
-		conf: service.Config,
+		mux:   service.Mux,
+		api:   service.API,
+		conf:  service.Config,
+		jobs:  service.Jobs,
+		plex:  service.Plex,
+		index: service.Index,
+	}
+	uc.subs = &Subscriptions{
+		conf:    service.Config,
+		store:   &store{conf: service.Config},
+		jobs:    service.Jobs.NewQueue(1),
+		plex:    service.Plex,
+		index:   service.Index,
+		client:  &http.Client{},
+		running: map[string]*jobs.Job{},
 	}
 	uc.MountController()
+	uc.subs.Start(nil)
 }
 
 // MountController ...
 func (c *Controller) MountController() {
 	c.mux.HandleFunc("/youtube", c.Ytdl).Methods("GET")
 	c.mux.HandleFunc("/ytdl", c.YtdlHandler).Methods("POST")
+
+	c.mux.HandleFunc("/youtube/subscriptions", c.Subscriptions).Methods("GET")
+	c.mux.HandleFunc("/youtube/subscriptions", c.SubscribeHandler).Methods("POST")
+	c.mux.HandleFunc("/youtube/subscriptions/{id}/refresh", c.SubscriptionRefreshHandler).Methods("POST")
+	c.mux.HandleFunc("/youtube/subscriptions/{id}/delete", c.UnsubscribeHandler).Methods("POST")
+
+	c.api.HandleFunc("/ytdl", c.YtdlHandler).Methods("POST")
+	c.api.HandleFunc("/subscriptions", c.APISubscriptionList).Methods("GET")
+	c.api.HandleFunc("/subscriptions", c.SubscribeHandler).Methods("POST")
+	c.api.HandleFunc("/subscriptions/{id}", c.APISubscription).Methods("GET")
+	c.api.HandleFunc("/subscriptions/{id}", c.UnsubscribeHandler).Methods("DELETE")
+	c.api.HandleFunc("/subscriptions/{id}/refresh", c.SubscriptionRefreshHandler).Methods("POST")
 }
 
 // Ytdl ...
 func (c *Controller) Ytdl(w http.ResponseWriter, r *http.Request) {
+	if !auth.Permissions(r)[auth.PermDownload] {
+		auth.Check(w, r, auth.PermDownload, "")
+		return
+	}
+
 	// parse every time to make updates easier, and save memory
-	templates := template.Must(template.ParseFiles("templates/ytdl.html", "templates/base.html"))
+	templates := template.Must(template.New("base").Funcs(template.FuncMap{"CsrfToken": form.TokenFunc(r)}).ParseFiles("templates/ytdl.html", "templates/base.html"))
 	templates.ExecuteTemplate(w, "base", &struct {
 		Title     string
 		Locations map[string]string
+		Profiles  []string
 	}{
 		Title:     "YTDL",
-		Locations: c.conf.Plex.Locations,
+		Locations: auth.Locations(r, auth.PermDownload, c.conf.Get().Plex.Locations),
+		Profiles:  c.conf.Get().Transcode.Names(),
 	})
 }
 
-// YtdlHandler ...
+// YtdlHandler starts a download job. Json clients get the job back right away,
+// the html form waits for the download to finish.
 func (c *Controller) YtdlHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("YtdlHandler:", r.URL.String())
 
-	r.ParseForm()
-	id := r.FormValue("id")
-	if id == "" {
-		fmt.Println("  Empty username")
-		w.Write([]byte(" Empty username"))
+	req := &api.YtdlRequest{}
+	if api.IsJSON(r) {
+		if err := api.ReadJSON(r, req); err != nil {
+			api.WriteError(w, r, http.StatusBadRequest, err)
+			return
+		}
+	} else {
+		r.ParseForm()
+		req.ID = r.FormValue("id")
+		req.Audio = r.FormValue("audio") == "on"
+		req.Location = r.PostForm.Get("location")
+		req.Transcode = r.PostForm.Get("transcode")
+		req.Split = r.PostForm.Get("split") == "on"
+	}
+	if req.ID == "" {
+		api.WriteError(w, r, http.StatusBadRequest, errors.New("missing id"))
 		return
 	}
 
-	audioOnly := r.FormValue("audio") == "on"
-
 	// setup root dir
-	location := r.PostForm.Get("location")
-	rootDir := c.conf.Plex.Locations[location]
-	if rootDir == "" {
-		rootDir = "./uploads"
+	rootDir, err := c.conf.Get().Plex.RootDir(req.Location)
+	if err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
 	}
-	err := os.MkdirAll(rootDir, os.ModePerm)
+	if !auth.Check(w, r, auth.PermDownload, req.Location) {
+		return
+	}
+	if err := space.Check(c.conf.Get(), req.Location, 0); err != nil {
+		api.WriteError(w, r, space.Status(err), err)
+		return
+	}
+	err = os.MkdirAll(rootDir, os.ModePerm)
 	if err != nil {
-		w.Write([]byte(" [E]:" + err.Error()))
+		api.WriteError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
+	profile := transcode.ProfileFor(c.conf.Get(), req.Location, req.Transcode)
+	if _, ok := c.conf.Get().Transcode.Profile(profile); profile != "" && !ok {
+		api.WriteError(w, r, http.StatusBadRequest, fmt.Errorf("%w: %q", transcode.ErrUnknownProfile, profile))
+		return
+	}
+	user := auth.Username(r)
 	// TODO: get dir...
-	fileName, err := downloadVideo(id, rootDir, audioOnly)
-	if err != nil {
-		w.Write([]byte(" [E]:" + err.Error()))
+	job := c.jobs.Start("ytdl", user, req.Location, func(ctx context.Context, j *jobs.Job) (string, error) {
+		vid, relPath, err := downloadVideo(ctx, j, c.conf.Get(), c.index, req.ID, req.Location, req.Audio, user)
+		if err != nil {
+			return "", err
+		}
+		fileName := relPath
+		relPaths := []string{relPath}
+		if req.Split {
+			// the whole file stays if splitting fails part way
+			if chapters, err := c.split(ctx, req.Location, relPath, vid, req.Audio, user); err != nil {
+				fileName += "\nsplit: " + err.Error()
+			} else if len(chapters) == 0 {
+				fileName += "\nno chapters, kept as one file"
+			} else {
+				relPaths = chapters
+				fileName += fmt.Sprintf("\nsplit into %d chapters in %s", len(chapters), splitFolder(chapters))
+			}
+		}
+		for _, relPath := range relPaths {
+			if _, _, notes := place.Jobs(req.Location, relPath, profile, user); len(notes) > 0 {
+				fileName += "\n" + strings.Join(notes, "\n")
+			}
+		}
+		if msg := c.plex.ScanAndWait(req.Location, rootDir); msg != "" {
+			fileName += "\n" + msg
+		}
+		return fileName, nil
+	})
+
+	if api.WantsJSON(r) {
+		w.Header().Set("Location", api.Prefix+"/jobs/"+job.ID)
+		api.WriteJSON(w, http.StatusAccepted, api.NewJob(job))
 		return
 	}
 
-	w.Write([]byte("Success:" + fileName))
+	job.Wait()
+	s := job.Snapshot()
+	if s.Status != jobs.Done {
+		api.WriteError(w, r, http.StatusInternalServerError, fmt.Errorf("%s %s", s.Status, s.Error))
+		return
+	}
+	w.Write([]byte("Success:" + s.Result))
 }
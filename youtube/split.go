@@ -0,0 +1,217 @@
+package youtube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/naming"
+	"github.com/jaredwarren/plexupdate/place"
+	"github.com/jaredwarren/plexupdate/probe"
+	"github.com/jaredwarren/plexupdate/space"
+	"github.com/jaredwarren/plexupdate/transcode"
+	"github.com/jaredwarren/plexupdate/trash"
+	"github.com/rylio/ytdl"
+)
+
+// partExt chapters are written to a hidden .part file until ffmpeg is done
+const partExt = ".part"
+
+// splitFormats ffmpeg muxer for each extension a download can have, the
+// output is a temp file so ffmpeg can't tell from the name
+var splitFormats = map[string]string{
+	".mp4":  "mp4",
+	".m4v":  "mp4",
+	".m4a":  "ipod",
+	".mp3":  "mp3",
+	".webm": "webm",
+	".mkv":  "matroska",
+	".flv":  "flv",
+	".3gp":  "3gp",
+	".ogg":  "ogg",
+	".opus": "opus",
+}
+
+// split cuts a download into a file per chapter, named like plex wants
+// them: an album for audio, a season of the video's title for video. The
+// whole file goes to the trash once every chapter is written, if one fails
+// the ones already written are removed. It returns the chapters' paths in
+// the location, none if the download has no chapters.
+func (c *Controller) split(ctx context.Context, location, relPath string, vid *ytdl.VideoInfo, audio bool, user string) ([]string, error) {
+	sandbox, err := c.conf.Get().Plex.Sandbox(location)
+	if err != nil {
+		return nil, err
+	}
+	file, err := sandbox.Resolve(relPath)
+	if err != nil {
+		return nil, err
+	}
+	ext := strings.ToLower(filepath.Ext(file))
+	format, ok := splitFormats[ext]
+	if !ok {
+		return nil, fmt.Errorf("can't split %s files", ext)
+	}
+
+	info, err := probe.File(c.conf.Get().Probe, file)
+	if err != nil && !errors.Is(err, probe.ErrUnavailable) {
+		return nil, err
+	}
+	var duration float64
+	if info != nil {
+		duration = info.Duration
+		audio = info.Type == api.MediaAudio
+	}
+	chapters := chapterList(info, vid.Description, duration)
+	if len(chapters) == 0 {
+		return nil, nil
+	}
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	// every chapter together is as big as the whole file
+	if err := space.Check(c.conf.Get(), location, fi.Size()); err != nil {
+		return nil, err
+	}
+
+	artist := vid.Artist
+	if artist == "" {
+		artist = vid.Uploader
+	}
+	if artist == "" {
+		artist = "Unknown Artist"
+	}
+	command := c.conf.Get().Transcode.Command
+	if command == "" {
+		command = transcode.DefaultCommand
+	}
+	paths := []string{}
+	for i, chapter := range chapters {
+		title := chapter.Title
+		if title == "" {
+			title = fmt.Sprintf("Chapter %d", i+1)
+		}
+		var mi api.MediaInfo
+		tags := []string{"title=" + title, fmt.Sprintf("track=%d/%d", i+1, len(chapters))}
+		if audio {
+			mi = api.MediaInfo{Type: api.MediaMusic, Artist: artist, Album: vid.Title, Title: title, Track: i + 1}
+			tags = append(tags, "artist="+artist, "album="+vid.Title)
+		} else {
+			mi = api.MediaInfo{Type: api.MediaEpisode, Title: vid.Title, Season: 1, Episode: i + 1, EpisodeTitle: title}
+			tags = append(tags, "show="+vid.Title, "season_number=1", "episode_sort="+strconv.Itoa(i+1))
+		}
+		chapterPath, err := c.chapter(ctx, command, sandbox, location, file, format, ext, mi, chapter, tags, user)
+		if err != nil {
+			c.unsplit(sandbox, location, paths)
+			return nil, fmt.Errorf("chapter %d: %w", i+1, err)
+		}
+		paths = append(paths, chapterPath)
+	}
+	space.Forget(location)
+
+	if c.conf.Get().Trash.Disabled {
+		err = os.Remove(file)
+	} else {
+		_, err = trash.New(sandbox, location).Move(relPath, user, api.TrashSplit)
+	}
+	if err == nil {
+		if err := c.index.Remove(location, relPath); err != nil {
+			fmt.Println("  [E]: library index:", err)
+		}
+	}
+	return paths, err
+}
+
+// chapter cuts one chapter of file to where mi says it goes, and puts it
+// in place. It returns the chapter's path in the location.
+func (c *Controller) chapter(ctx context.Context, command string, sandbox *filesystem.Sandbox, location, file, format, ext string, mi api.MediaInfo, chapter api.MediaChapter, tags []string, user string) (string, error) {
+	chapterPath, err := naming.Path(mi, ext)
+	if err != nil {
+		return "", err
+	}
+	out, err := sandbox.Resolve(chapterPath)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(out), os.ModePerm); err != nil {
+		return "", err
+	}
+	part := filepath.Join(filepath.Dir(out), "."+filepath.Base(out)+partExt)
+	if err := cut(ctx, command, splitArgs(file, part, format, chapter, tags)); err != nil {
+		os.Remove(part)
+		return "", err
+	}
+	_, err = place.File(c.conf.Get(), c.index, place.Part{
+		Location: location,
+		Sandbox:  sandbox,
+		File:     part,
+		RelPath:  chapterPath,
+		User:     user,
+	})
+	return chapterPath, err
+}
+
+// unsplit removes the chapters a split that failed part way wrote, the
+// whole file is still there
+func (c *Controller) unsplit(sandbox *filesystem.Sandbox, location string, paths []string) {
+	for _, relPath := range paths {
+		p, err := sandbox.Resolve(relPath)
+		if err == nil {
+			err = os.Remove(p)
+		}
+		if err != nil {
+			fmt.Println("  [E]: split:", err)
+			continue
+		}
+		if err := c.index.Remove(location, relPath); err != nil {
+			fmt.Println("  [E]: library index:", err)
+		}
+	}
+}
+
+// splitArgs for ffmpeg to copy chapter of in to out with tags. Streams are
+// copied, so a video chapter starts at the keyframe before its start.
+func splitArgs(in, out, format string, chapter api.MediaChapter, tags []string) []string {
+	a := []string{"-hide_banner", "-nostdin", "-nostats", "-y",
+		"-ss", strconv.FormatFloat(chapter.Start, 'f', 3, 64), "-i", in}
+	if chapter.End > chapter.Start {
+		a = append(a, "-t", strconv.FormatFloat(chapter.End-chapter.Start, 'f', 3, 64))
+	}
+	a = append(a, "-map", "0", "-c", "copy", "-map_metadata", "0", "-map_chapters", "-1")
+	for _, tag := range tags {
+		a = append(a, "-metadata", tag)
+	}
+	return append(a, "-f", format, out)
+}
+
+// cut runs ffmpeg, its last line is the error if it fails
+func cut(ctx context.Context, command string, args []string) error {
+	out, err := exec.CommandContext(ctx, command, args...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if lines := strings.Split(strings.TrimSpace(string(out)), "\n"); lines[len(lines)-1] != "" {
+		return fmt.Errorf("ffmpeg: %s", lines[len(lines)-1])
+	}
+	return err
+}
+
+// splitFolder the album or season folder chapters went in
+func splitFolder(paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+	return path.Dir(paths[0])
+}
@@ -0,0 +1,156 @@
+package youtube
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/config"
+)
+
+var (
+	// ErrNotFound no subscription with that id
+	ErrNotFound = errors.New("subscription not found")
+	// ErrExists already subscribed to the channel in that location
+	ErrExists = errors.New("already subscribed")
+)
+
+// store subscriptions and the videos seen for each, saved in
+// youtube.subscriptionsfile
+type store struct {
+	conf *config.Current
+
+	mu     sync.Mutex
+	subs   []*api.Subscription
+	loaded bool
+}
+
+// file the store is saved to
+func (s *store) file() string {
+	if s.conf.Get().Youtube.SubscriptionsFile != "" {
+		return s.conf.Get().Youtube.SubscriptionsFile
+	}
+	return config.DefaultSubscriptionsFile
+}
+
+// load reads the file once, caller must hold the lock
+func (s *store) load() {
+	if s.loaded {
+		return
+	}
+	s.loaded = true
+	data, err := ioutil.ReadFile(s.file())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("  [E]: subscriptions:", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &s.subs); err != nil {
+		fmt.Println("  [E]: subscriptions:", err)
+	}
+}
+
+// save writes the file, caller must hold the lock
+func (s *store) save() error {
+	data, err := json.MarshalIndent(s.subs, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write then rename so a crash doesn't leave half a file
+	tmp := s.file() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file())
+}
+
+// find the subscription with id, caller must hold the lock
+func (s *store) find(id string) (*api.Subscription, int) {
+	for i, sub := range s.subs {
+		if sub.ID == id {
+			return sub, i
+		}
+	}
+	return nil, -1
+}
+
+// clone sub so it can be read without the lock
+func clone(sub *api.Subscription) api.Subscription {
+	c := *sub
+	c.Videos = append([]api.SubscriptionVideo{}, sub.Videos...)
+	return c
+}
+
+// List every subscription
+func (s *store) List() []api.Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load()
+	list := make([]api.Subscription, 0, len(s.subs))
+	for _, sub := range s.subs {
+		list = append(list, clone(sub))
+	}
+	return list
+}
+
+// Get the subscription with id
+func (s *store) Get(id string) (api.Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load()
+	sub, _ := s.find(id)
+	if sub == nil {
+		return api.Subscription{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return clone(sub), nil
+}
+
+// Add a subscription, it gets an id and the time it was added
+func (s *store) Add(sub api.Subscription) (api.Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load()
+	for _, other := range s.subs {
+		if other.Feed == sub.Feed && other.Location == sub.Location {
+			return api.Subscription{}, fmt.Errorf("%w: %s in %s", ErrExists, sub.Feed, sub.Location)
+		}
+	}
+	sub.ID = strconv.FormatInt(time.Now().UnixNano(), 36)
+	sub.Added = time.Now()
+	sub.Videos = []api.SubscriptionVideo{}
+	s.subs = append(s.subs, &sub)
+	return clone(&sub), s.save()
+}
+
+// Remove the subscription with id, the videos stay
+func (s *store) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load()
+	_, i := s.find(id)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	s.subs = append(s.subs[:i], s.subs[i+1:]...)
+	return s.save()
+}
+
+// Update the subscription with id with fn and save it
+func (s *store) Update(id string, fn func(sub *api.Subscription)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load()
+	sub, _ := s.find(id)
+	if sub == nil {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	fn(sub)
+	return s.save()
+}
@@ -0,0 +1,250 @@
+package youtube
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/auth"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/form"
+	"github.com/jaredwarren/plexupdate/transcode"
+)
+
+// writeError picks the status from err
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, ErrExists):
+		code = http.StatusConflict
+	case errors.Is(err, ErrChannel), errors.Is(err, transcode.ErrUnknownProfile):
+		code = http.StatusBadRequest
+	}
+	api.WriteError(w, r, code, err)
+}
+
+// subscription returns the subscription with id and checks the user can
+// download to its location
+func (c *Controller) subscription(w http.ResponseWriter, r *http.Request, id string) (api.Subscription, bool) {
+	sub, err := c.subs.store.Get(id)
+	if err != nil {
+		writeError(w, r, err)
+		return sub, false
+	}
+	if !auth.Check(w, r, auth.PermDownload, sub.Location) {
+		return sub, false
+	}
+	return sub, true
+}
+
+// subscriptions in every location the user can download to, by title
+func (c *Controller) subscriptions(r *http.Request) []api.Subscription {
+	locations := auth.Locations(r, auth.PermDownload, c.conf.Get().Plex.Locations)
+	list := []api.Subscription{}
+	for _, sub := range c.subs.store.List() {
+		if _, ok := locations[sub.Location]; ok {
+			list = append(list, sub)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Title < list[j].Title
+	})
+	return list
+}
+
+// Subscriptions shows the subscriptions and the subscribe form
+func (c *Controller) Subscriptions(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Subscriptions", r.URL.String())
+
+	if !auth.Permissions(r)[auth.PermDownload] {
+		auth.Check(w, r, auth.PermDownload, "")
+		return
+	}
+	interval := c.conf.Get().Youtube.Interval
+	if interval <= 0 {
+		interval = config.DefaultYoutubeInterval
+	}
+
+	// parse every time to make updates easier, and save memory
+	tpl := template.Must(template.New("base").Funcs(template.FuncMap{"CsrfToken": form.TokenFunc(r)}).ParseFiles("templates/subscriptions.html", "templates/base.html"))
+	tpl.ExecuteTemplate(w, "base", &struct {
+		Title         string
+		Subscriptions []api.Subscription
+		Locations     map[string]string
+		Profiles      []string
+		Interval      string
+	}{
+		Title:         "Subscriptions",
+		Subscriptions: c.subscriptions(r),
+		Locations:     auth.Locations(r, auth.PermDownload, c.conf.Get().Plex.Locations),
+		Profiles:      c.conf.Get().Transcode.Names(),
+		Interval:      interval.String(),
+	})
+}
+
+// SubscribeHandler adds a channel or playlist, after checking its feed, and
+// fetches its newest videos
+func (c *Controller) SubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("SubscribeHandler", r.URL.String())
+
+	req := &api.SubscriptionRequest{}
+	if api.IsJSON(r) {
+		if err := api.ReadJSON(r, req); err != nil {
+			api.WriteError(w, r, http.StatusBadRequest, err)
+			return
+		}
+	} else {
+		r.ParseForm()
+		req.URL = r.PostForm.Get("url")
+		req.Location = r.PostForm.Get("location")
+		req.Audio = r.PostForm.Get("audio") == "on"
+		req.Transcode = r.PostForm.Get("transcode")
+		req.Match = r.PostForm.Get("match")
+		req.MinDuration = r.PostForm.Get("min_duration")
+		req.MaxDuration = r.PostForm.Get("max_duration")
+		req.NoShorts = r.PostForm.Get("no_shorts") == "on"
+		req.NoLive = r.PostForm.Get("no_live") == "on"
+		req.DeleteWatched = r.PostForm.Get("delete_watched") == "on"
+		for name, n := range map[string]*int{"keep": &req.Keep, "keep_days": &req.KeepDays} {
+			if v := r.PostForm.Get(name); v != "" {
+				i, err := strconv.Atoi(v)
+				if err != nil {
+					api.WriteError(w, r, http.StatusBadRequest, fmt.Errorf("%s: %w", name, err))
+					return
+				}
+				*n = i
+			}
+		}
+	}
+	if req.URL == "" {
+		api.WriteError(w, r, http.StatusBadRequest, errors.New("missing url"))
+		return
+	}
+	if _, ok := c.conf.Get().Plex.Locations[req.Location]; !ok {
+		api.WriteError(w, r, http.StatusBadRequest, fmt.Errorf("unknown location: %q", req.Location))
+		return
+	}
+	if !auth.Check(w, r, auth.PermDownload, req.Location) {
+		return
+	}
+
+	sub := api.Subscription{
+		Location:      req.Location,
+		Audio:         req.Audio,
+		Transcode:     req.Transcode,
+		Match:         req.Match,
+		MinDuration:   req.MinDuration,
+		MaxDuration:   req.MaxDuration,
+		NoShorts:      req.NoShorts,
+		NoLive:        req.NoLive,
+		Keep:          req.Keep,
+		KeepDays:      req.KeepDays,
+		DeleteWatched: req.DeleteWatched,
+		User:          auth.Username(r),
+	}
+	if sub.Keep < 0 || sub.KeepDays < 0 {
+		api.WriteError(w, r, http.StatusBadRequest, errors.New("keep and keepDays can't be negative"))
+		return
+	}
+	if _, err := newFilter(&sub); err != nil {
+		api.WriteError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if _, ok := c.conf.Get().Transcode.Profile(sub.Transcode); sub.Transcode != "" && !ok {
+		writeError(w, r, fmt.Errorf("%w: %q", transcode.ErrUnknownProfile, sub.Transcode))
+		return
+	}
+	feed, err := feedURL(req.URL)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ch, err := c.subs.get(r.Context(), feed)
+	if err != nil {
+		if !errors.Is(err, ErrChannel) {
+			err = fmt.Errorf("%w: %v", ErrChannel, err)
+		}
+		writeError(w, r, err)
+		return
+	}
+	sub.Feed, sub.Title = feed, ch.Title
+	if sub, err = c.subs.store.Add(sub); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if _, err := c.subs.Refresh(sub.ID); err != nil {
+		fmt.Println("  [E]: subscriptions:", err)
+	}
+
+	if api.WantsJSON(r) {
+		w.Header().Set("Location", api.Prefix+"/subscriptions/"+sub.ID)
+		api.WriteJSON(w, http.StatusCreated, sub)
+		return
+	}
+	http.Redirect(w, r, "/youtube/subscriptions", http.StatusSeeOther)
+}
+
+// SubscriptionRefreshHandler checks a subscription for new videos now
+func (c *Controller) SubscriptionRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("SubscriptionRefreshHandler", r.URL.String())
+
+	sub, ok := c.subscription(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	job, err := c.subs.Refresh(sub.ID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if api.WantsJSON(r) {
+		w.Header().Set("Location", api.Prefix+"/jobs/"+job.ID)
+		api.WriteJSON(w, http.StatusAccepted, api.NewJob(job))
+		return
+	}
+	http.Redirect(w, r, "/youtube/subscriptions", http.StatusSeeOther)
+}
+
+// UnsubscribeHandler removes a subscription, videos already downloaded are
+// kept
+func (c *Controller) UnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("UnsubscribeHandler", r.URL.String())
+
+	sub, ok := c.subscription(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	if err := c.subs.store.Remove(sub.ID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if api.WantsJSON(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, "/youtube/subscriptions", http.StatusSeeOther)
+}
+
+// APISubscriptionList lists the subscriptions in every location the user
+// can download to
+func (c *Controller) APISubscriptionList(w http.ResponseWriter, r *http.Request) {
+	api.WriteJSON(w, http.StatusOK, c.subscriptions(r))
+}
+
+// APISubscription a subscription and its videos
+func (c *Controller) APISubscription(w http.ResponseWriter, r *http.Request) {
+	sub, ok := c.subscription(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	api.WriteJSON(w, http.StatusOK, sub)
+}
@@ -0,0 +1,541 @@
+package youtube
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jaredwarren/plexupdate/api"
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/duplicates"
+	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/jobs"
+	"github.com/jaredwarren/plexupdate/naming"
+	"github.com/jaredwarren/plexupdate/place"
+	"github.com/jaredwarren/plexupdate/plex"
+	"github.com/jaredwarren/plexupdate/transcode"
+	"github.com/jaredwarren/plexupdate/trash"
+	"github.com/rylio/ytdl"
+)
+
+// SubscriptionJobType of subscription checks
+const SubscriptionJobType = "subscription"
+
+// feedBase youtube's atom feed of a channel's or playlist's newest videos
+const feedBase = "https://www.youtube.com/feeds/videos.xml"
+
+// maxFeedSize youtube's feeds only have the newest 15 videos
+const maxFeedSize = 5 << 20
+
+// ErrChannel the url isn't a channel, playlist or feed
+var ErrChannel = errors.New("not a youtube channel or playlist")
+
+var (
+	channelIDRe  = regexp.MustCompile(`^UC[\w-]{22}$`)
+	playlistIDRe = regexp.MustCompile(`^(PL|UU|LL|FL|OL)[\w-]{10,}$`)
+)
+
+// feedURL the feed of a channel or playlist link or id. Other feeds are
+// used as they are.
+func feedURL(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case channelIDRe.MatchString(s):
+		return feedBase + "?channel_id=" + s, nil
+	case playlistIDRe.MatchString(s):
+		return feedBase + "?playlist_id=" + s, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%w: %q", ErrChannel, s)
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if host != "youtube.com" && host != "m.youtube.com" && host != "music.youtube.com" {
+		return u.String(), nil
+	}
+	if u.Path == "/feeds/videos.xml" {
+		return u.String(), nil
+	}
+	if list := u.Query().Get("list"); list != "" {
+		return feedBase + "?playlist_id=" + url.QueryEscape(list), nil
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) >= 2 && parts[0] == "channel" && channelIDRe.MatchString(parts[1]) {
+		return feedBase + "?channel_id=" + parts[1], nil
+	}
+	// handles and custom urls need the page scraped for the id
+	return "", fmt.Errorf("%w: %q, use the channel's /channel/UC... link", ErrChannel, s)
+}
+
+// entry a video in a channel's feed
+type entry struct {
+	ID        string
+	Title     string
+	Published time.Time
+	Short     bool
+}
+
+// channelFeed the title and videos of a channel or playlist
+type channelFeed struct {
+	Title   string
+	Entries []entry
+}
+
+// parseFeed youtube's atom feed, newest first
+func parseFeed(data []byte) (*channelFeed, error) {
+	f := &struct {
+		XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+		Title   string   `xml:"title"`
+		Author  struct {
+			Name string `xml:"name"`
+		} `xml:"author"`
+		Entries []struct {
+			VideoID   string `xml:"http://www.youtube.com/xml/schemas/2015 videoId"`
+			Title     string `xml:"title"`
+			Published string `xml:"published"`
+			Link      struct {
+				Href string `xml:"href,attr"`
+			} `xml:"link"`
+		} `xml:"entry"`
+	}{}
+	if err := xml.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrChannel, err)
+	}
+	c := &channelFeed{Title: strings.TrimSpace(f.Title)}
+	if c.Title == "" {
+		c.Title = strings.TrimSpace(f.Author.Name)
+	}
+	for _, e := range f.Entries {
+		if e.VideoID == "" {
+			continue
+		}
+		published, err := time.Parse(time.RFC3339, strings.TrimSpace(e.Published))
+		if err != nil {
+			published = time.Now()
+		}
+		c.Entries = append(c.Entries, entry{
+			ID:        e.VideoID,
+			Title:     strings.TrimSpace(e.Title),
+			Published: published,
+			Short:     strings.Contains(e.Link.Href, "/shorts/"),
+		})
+	}
+	sort.SliceStable(c.Entries, func(i, j int) bool {
+		return c.Entries[i].Published.After(c.Entries[j].Published)
+	})
+	return c, nil
+}
+
+// filter the checked rules of a subscription
+type filter struct {
+	match    *regexp.Regexp
+	min, max time.Duration
+	noShorts bool
+	noLive   bool
+}
+
+// newFilter checks sub's rules
+func newFilter(sub *api.Subscription) (*filter, error) {
+	f := &filter{noShorts: sub.NoShorts, noLive: sub.NoLive}
+	var err error
+	if sub.Match != "" {
+		if f.match, err = regexp.Compile(sub.Match); err != nil {
+			return nil, fmt.Errorf("match: %w", err)
+		}
+	}
+	if sub.MinDuration != "" {
+		if f.min, err = time.ParseDuration(sub.MinDuration); err != nil {
+			return nil, fmt.Errorf("minDuration: %w", err)
+		}
+	}
+	if sub.MaxDuration != "" {
+		if f.max, err = time.ParseDuration(sub.MaxDuration); err != nil {
+			return nil, fmt.Errorf("maxDuration: %w", err)
+		}
+	}
+	if f.max > 0 && f.max < f.min {
+		return nil, errors.New("maxDuration is shorter than minDuration")
+	}
+	return f, nil
+}
+
+// skipEntry why e is left out before asking youtube about it, empty if
+// it isn't
+func (f *filter) skipEntry(e entry) string {
+	if f.match != nil && !f.match.MatchString(e.Title) {
+		return "title doesn't match"
+	}
+	if f.noShorts && (e.Short || strings.Contains(strings.ToLower(e.Title), "#shorts")) {
+		return "short"
+	}
+	return ""
+}
+
+// skipVideo why vid is left out, empty if it isn't
+func (f *filter) skipVideo(vid *ytdl.VideoInfo) string {
+	// a stream that's live, or hasn't started, doesn't have a length yet
+	if f.noLive && vid.Duration == 0 {
+		return "live"
+	}
+	if f.noShorts && strings.Contains(strings.ToLower(vid.Description), "#shorts") {
+		return "short"
+	}
+	if f.min > 0 && vid.Duration < f.min {
+		return "shorter than " + f.min.String()
+	}
+	if f.max > 0 && vid.Duration > f.max {
+		return "longer than " + f.max.String()
+	}
+	return ""
+}
+
+// Subscriptions checks channels and playlists for new videos, one at a time
+type Subscriptions struct {
+	conf   *config.Current
+	store  *store
+	jobs   *jobs.Queue
+	plex   *plex.Scanner
+	index  *duplicates.Index
+	client *http.Client
+
+	mu      sync.Mutex
+	running map[string]*jobs.Job
+}
+
+// Start checks every subscription now and then every youtube.interval
+// until stop is closed
+func (s *Subscriptions) Start(stop <-chan struct{}) {
+	go func() {
+		for {
+			s.RefreshAll()
+			interval := s.conf.Get().Youtube.Interval
+			if interval <= 0 {
+				interval = config.DefaultYoutubeInterval
+			}
+			select {
+			case <-time.After(interval):
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// RefreshAll queues a check of every subscription
+func (s *Subscriptions) RefreshAll() {
+	for _, sub := range s.store.List() {
+		if _, err := s.Refresh(sub.ID); err != nil {
+			fmt.Println("  [E]: subscriptions:", err)
+		}
+	}
+}
+
+// Refresh queues a check of the subscription with id, or returns the one
+// that's already queued
+func (s *Subscriptions) Refresh(id string) (*jobs.Job, error) {
+	sub, err := s.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, ok := s.running[id]; ok {
+		select {
+		case <-j.Done():
+		default:
+			return j, nil
+		}
+	}
+	j := s.jobs.Start(SubscriptionJobType, sub.User, sub.Location, func(ctx context.Context, j *jobs.Job) (string, error) {
+		return s.refresh(ctx, j, id)
+	})
+	s.running[id] = j
+	return j, nil
+}
+
+// get the feed at rawURL
+func (s *Subscriptions) get(ctx context.Context, rawURL string) (*channelFeed, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// youtube answers 404 for channels and playlists that don't exist
+		return nil, fmt.Errorf("%s: %s", rawURL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxFeedSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseFeed(data)
+}
+
+// refresh downloads a subscription's new videos and deletes the ones its
+// rules don't keep
+func (s *Subscriptions) refresh(ctx context.Context, j *jobs.Job, id string) (string, error) {
+	sub, err := s.store.Get(id)
+	if err != nil {
+		return "", err
+	}
+	c, err := s.get(ctx, sub.Feed)
+	if err != nil {
+		s.store.Update(id, func(sub *api.Subscription) {
+			now := time.Now()
+			sub.Checked, sub.Error = &now, err.Error()
+		})
+		return "", err
+	}
+	f, err := newFilter(&sub)
+	if err != nil {
+		return "", err
+	}
+	title := c.Title
+	if title == "" {
+		title = sub.Title
+	}
+
+	// the newest videos that would be kept, oldest first so they're
+	// downloaded in order
+	seen := map[string]bool{}
+	for _, v := range sub.Videos {
+		seen[v.ID] = true
+	}
+	entries := c.Entries
+	if sub.Keep > 0 && len(entries) > sub.Keep {
+		entries = entries[:sub.Keep]
+	}
+	todo := []entry{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if !seen[entries[i].ID] {
+			todo = append(todo, entries[i])
+		}
+	}
+
+	fetched, skipped, failed := 0, 0, 0
+	var lastErr error
+	dirs := map[string]bool{}
+	for i, e := range todo {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		v := api.SubscriptionVideo{ID: e.ID, Title: e.Title, Published: e.Published}
+		if sub.KeepDays > 0 && e.Published.Before(time.Now().AddDate(0, 0, -sub.KeepDays)) {
+			v.Skipped = fmt.Sprintf("older than %d days", sub.KeepDays)
+		}
+		if v.Skipped == "" {
+			v.Skipped = f.skipEntry(e)
+		}
+		if v.Skipped == "" {
+			relPath, skip, err := s.video(ctx, &sub, title, f, e)
+			if err != nil {
+				if ctx.Err() != nil {
+					return "", ctx.Err()
+				}
+				// it's tried again next time
+				failed++
+				lastErr = fmt.Errorf("%s: %w", e.Title, err)
+				fmt.Println("  [E]: subscriptions:", sub.Feed, lastErr)
+				continue
+			}
+			v.Path, v.Skipped = relPath, skip
+		}
+		v.Fetched = time.Now()
+		if v.Path != "" {
+			fetched++
+			dirs[path.Dir(v.Path)] = true
+		} else {
+			skipped++
+		}
+		s.store.Update(id, func(sub *api.Subscription) {
+			sub.Videos = append(sub.Videos, v)
+		})
+		j.SetProgress(float64(i+1) / float64(len(todo)))
+	}
+
+	var watched map[string]bool
+	if sub.DeleteWatched {
+		if watched, err = s.plex.Watched(ctx, sub.Location); err != nil {
+			fmt.Println("  [E]: subscriptions: plex:", err)
+		}
+	}
+	// the files are removed with the store unlocked, it only hears which
+	// ones went
+	current, err := s.store.Get(id)
+	if err != nil {
+		return "", err
+	}
+	deleted := s.retain(current, watched)
+	err = s.store.Update(id, func(sub *api.Subscription) {
+		now := time.Now()
+		sub.Checked, sub.Error = &now, ""
+		if lastErr != nil {
+			sub.Error = lastErr.Error()
+		}
+		sub.Title = title
+		forget(sub, c, deleted)
+	})
+	if err != nil {
+		return "", err
+	}
+	if sandbox, err := s.conf.Get().Plex.Sandbox(sub.Location); err == nil {
+		for dir := range dirs {
+			if d, err := sandbox.Resolve(dir); err == nil {
+				s.plex.Scan(sub.Location, d)
+			}
+		}
+	}
+
+	result := fmt.Sprintf("%s: %d new, %d skipped, %d failed, %d removed", title, fetched, skipped, failed, len(deleted))
+	if fetched == 0 && failed > 0 {
+		return result, lastErr
+	}
+	return result, nil
+}
+
+// video downloads e if it gets past the filters. It returns the file's path
+// in the location, or why it was skipped.
+func (s *Subscriptions) video(ctx context.Context, sub *api.Subscription, channel string, f *filter, e entry) (string, string, error) {
+	vid, err := ytdl.GetVideoInfo(e.ID)
+	if err != nil {
+		return "", "", err
+	}
+	if skip := f.skipVideo(vid); skip != "" {
+		return "", skip, nil
+	}
+
+	// the extension is added when the format is picked
+	var relPath string
+	if sub.Audio {
+		relPath, err = naming.Path(api.MediaInfo{
+			Type:   api.MediaMusic,
+			Artist: channel,
+			Album:  channel,
+			Title:  e.Published.Format("2006-01-02") + " - " + e.Title,
+		}, "")
+	} else {
+		relPath, err = naming.Dated(channel, e.Published, e.Title, "")
+	}
+	if err != nil {
+		return "", "", err
+	}
+	relPath, err = saveVideo(ctx, nil, s.conf.Get(), s.index, vid, sub.Location, path.Dir(relPath), path.Base(relPath), sub.Audio, sub.User)
+	if err != nil {
+		return "", "", err
+	}
+
+	place.Jobs(sub.Location, relPath, transcode.ProfileFor(s.conf.Get(), sub.Location, sub.Transcode), sub.User)
+	return relPath, "", nil
+}
+
+// retain deletes sub's videos that its keep rules don't keep, or that have
+// been watched. sub is a copy, nothing is locked while the files go. It
+// returns the paths it deleted.
+func (s *Subscriptions) retain(sub api.Subscription, watched map[string]bool) map[string]bool {
+	deleted := map[string]bool{}
+	sandbox, err := s.conf.Get().Plex.Sandbox(sub.Location)
+	if err != nil {
+		return deleted
+	}
+	sort.SliceStable(sub.Videos, func(i, j int) bool {
+		return sub.Videos[i].Published.After(sub.Videos[j].Published)
+	})
+	cutoff := time.Now().AddDate(0, 0, -sub.KeepDays)
+
+	kept := 0
+	for _, v := range sub.Videos {
+		if v.Path == "" {
+			continue
+		}
+		reason := ""
+		switch {
+		case sub.Keep > 0 && kept >= sub.Keep:
+			reason = api.TrashExpired
+		case sub.KeepDays > 0 && v.Published.Before(cutoff):
+			reason = api.TrashExpired
+		case watched[s.abs(sandbox, v.Path)]:
+			reason = api.TrashWatched
+		}
+		if reason == "" {
+			kept++
+		} else if err := s.remove(sandbox, &sub, v.Path, reason); err != nil {
+			fmt.Println("  [E]: subscriptions:", v.Path, err)
+			kept++
+		} else {
+			deleted[v.Path] = true
+		}
+	}
+	return deleted
+}
+
+// forget the paths of sub's deleted videos, and the videos that are gone
+// from c too. Newest first.
+func forget(sub *api.Subscription, c *channelFeed, deleted map[string]bool) {
+	sort.SliceStable(sub.Videos, func(i, j int) bool {
+		return sub.Videos[i].Published.After(sub.Videos[j].Published)
+	})
+	inFeed := map[string]bool{}
+	for _, e := range c.Entries {
+		inFeed[e.ID] = true
+	}
+	videos := sub.Videos[:0]
+	for _, v := range sub.Videos {
+		if deleted[v.Path] {
+			v.Path = ""
+		}
+		// it's remembered so it isn't fetched again, until the feed drops it
+		if v.Path == "" && !inFeed[v.ID] {
+			continue
+		}
+		videos = append(videos, v)
+	}
+	sub.Videos = videos
+}
+
+// abs the path of relPath on disk, as plex's paths are compared
+func (s *Subscriptions) abs(sandbox *filesystem.Sandbox, relPath string) string {
+	p, err := sandbox.Resolve(relPath)
+	if err != nil {
+		return ""
+	}
+	p, err = filepath.Abs(p)
+	if err != nil {
+		return ""
+	}
+	return p
+}
+
+// remove moves a video to the trash with reason, or deletes it when the
+// trash is disabled
+func (s *Subscriptions) remove(sandbox *filesystem.Sandbox, sub *api.Subscription, relPath, reason string) error {
+	var err error
+	if s.conf.Get().Trash.Disabled {
+		err = trash.Delete(s.conf.Get().Trash, sandbox, sub.Location, relPath, sub.User)
+	} else {
+		_, err = trash.New(sandbox, sub.Location).Move(relPath, sub.User, reason)
+	}
+	if os.IsNotExist(err) {
+		// deleted by hand already
+		return nil
+	}
+	return err
+}
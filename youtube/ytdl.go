@@ -1,62 +1,129 @@
 package youtube
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
-	"strings"
 
+	"github.com/jaredwarren/plexupdate/config"
+	"github.com/jaredwarren/plexupdate/duplicates"
 	"github.com/jaredwarren/plexupdate/filesystem"
+	"github.com/jaredwarren/plexupdate/jobs"
+	"github.com/jaredwarren/plexupdate/place"
+	"github.com/jaredwarren/plexupdate/space"
 	"github.com/rylio/ytdl"
 )
 
-func downloadVideo(id, rootDir string, audioOnly bool) (string, error) {
-	os.MkdirAll(rootDir, os.ModePerm)
+// ErrBusy another download is writing the same file
+var ErrBusy = errors.New("already downloading that video")
 
+// downloadVideo saves id in the root of location, and returns what youtube
+// says about it and the file's path in the location
+func downloadVideo(ctx context.Context, j *jobs.Job, conf *config.Configuration, index *duplicates.Index, id, location string, audioOnly bool, user string) (*ytdl.VideoInfo, string, error) {
 	vid, err := ytdl.GetVideoInfo(id)
 	if err != nil {
 		fmt.Println("  ", err)
-		return "", err
+		return nil, "", err
 	}
-	var format ytdl.Format
+	relPath, err := saveVideo(ctx, j, conf, index, vid, location, "/", vid.Title, audioOnly, user)
+	return vid, relPath, err
+}
+
+// saveVideo downloads vid to the folder dir in location as name, with the
+// extension of its format. It's written to a hidden .part file and put in
+// place like any other download. It returns the file's path in the
+// location.
+func saveVideo(ctx context.Context, j *jobs.Job, conf *config.Configuration, index *duplicates.Index, vid *ytdl.VideoInfo, location, dir, name string, audioOnly bool, user string) (string, error) {
+	var formats ytdl.FormatList
 	if audioOnly {
-		format = vid.Formats.Best("audbr")[0]
+		formats = vid.Formats.Best("audbr")
 	} else {
-		format = vid.Formats.Best("videnc")[0]
+		formats = vid.Formats.Best("videnc")
+	}
+	if len(formats) == 0 {
+		return "", fmt.Errorf("no formats found for %q", vid.ID)
 	}
-	fileName := filepath.Join(rootDir, filesystem.SanitizeFilename(vid.Title, false)+"."+format.Extension)
-	file, err := os.Create(fileName)
-	defer file.Close()
+	format := formats[0]
+	ext := format.Extension
+	if audioOnly {
+		ext = "mp3"
+	}
+	name, err := filesystem.NormalizeFilename(name + "." + ext)
 	if err != nil {
-		fmt.Println("  ", err)
-		return fileName, err
+		name = vid.ID + "." + ext
+	}
+
+	sandbox, err := conf.Plex.Sandbox(location)
+	if err != nil {
+		return "", err
+	}
+	relPath := path.Join(dir, name)
+	file, err := sandbox.Resolve(relPath)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return "", err
+	}
+	part := filepath.Join(filepath.Dir(file), "."+name+partExt)
+	if !place.Claim(part) {
+		return "", fmt.Errorf("%s: %w", relPath, ErrBusy)
+	}
+	defer place.Release(part)
+
+	f, err := os.Create(part)
+	if err != nil {
+		return "", err
+	}
+	out, err := space.Writer(conf, location, 0, f)
+	if err == nil {
+		err = vid.Download(format, jobs.NewWriter(ctx, out, j, 0))
+		out.Release()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
-	err = vid.Download(vid.Formats[0], file)
 	if err != nil {
+		// don't leave half a file behind
+		os.Remove(part)
 		fmt.Println("  ", err)
-		return fileName, err
+		return "", err
 	}
 
-	// Convert to mp3
 	if audioOnly {
-		videoFile := fileName
-		fileName, err = convertVideoToMP3(fileName)
+		audio := filepath.Join(filepath.Dir(file), "."+name+".audio"+partExt)
+		err := convertVideoToMP3(ctx, part, audio)
+		os.Remove(part)
 		if err != nil {
+			os.Remove(audio)
 			fmt.Println("  ", err)
-			return fileName, err
+			return "", err
 		}
-		// cleanup video file
-		os.Remove(videoFile)
+		part = audio
+	}
+
+	// what's there goes to the trash, the index learns the new file
+	_, err = place.File(conf, index, place.Part{
+		Location: location,
+		Sandbox:  sandbox,
+		File:     part,
+		RelPath:  relPath,
+		User:     user,
+	})
+	if err != nil {
+		return "", err
 	}
-	return fileName, nil
+	return relPath, nil
 }
 
-func convertVideoToMP3(videoPath string) (string, error) {
-	// ffmpeg -i video.mp4 -q:a 0 -map a audio.mp3
-	destName := strings.TrimSuffix(videoPath, filepath.Ext(videoPath))
-	audioPath := destName + ".mp3"
-	cmd := exec.Command("ffmpeg", "-i", videoPath, "-q:a", "0", "-map", "a", audioPath)
-	err := cmd.Run()
-	return audioPath, err
+// convertVideoToMP3 writes the audio of videoPath to audioPath as mp3,
+// whatever the extensions are
+func convertVideoToMP3(ctx context.Context, videoPath, audioPath string) error {
+	// ffmpeg -i video.mp4 -q:a 0 -map a -f mp3 audio.mp3
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-y", "-i", videoPath, "-q:a", "0", "-map", "a", "-f", "mp3", audioPath)
+	return cmd.Run()
 }